@@ -3,23 +3,61 @@ package config
 import (
 	"crypto/tls"
 	"fmt"
+	"lilmail/keyring"
+	"net/mail"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type ServerConfig struct {
-	Port int `toml:"port"`
+	Port           int      `toml:"port"`
+	TrustedOrigins []string `toml:"trusted_origins"` // Extra origins allowed to post, such as a reverse proxy's public URL
+	ProxyHeader    string   `toml:"proxy_header"`    // Header with the client address behind a reverse proxy, e.g. X-Forwarded-For
+}
+
+type LoginConfig struct {
+	MaxAttemptsPerIP      int      `toml:"max_attempts_per_ip"`      // Failed logins from one address before it is locked out
+	MaxAttemptsPerAccount int      `toml:"max_attempts_per_account"` // Failed logins to one account before it is locked out
+	BaseDelay             int      `toml:"base_delay"`               // Seconds to wait after the first failure, doubled after each further one
+	LockoutSeconds        int      `toml:"lockout_seconds"`          // Length of a lockout, and upper bound of the backoff
+	Window                int      `toml:"window"`                   // Seconds after which failures are forgotten
+	AllowList             []string `toml:"allow_list"`               // Addresses or CIDR ranges that are never throttled
 }
 
 type IMAPConfig struct {
-	Server string `toml:"server"`
-	Port   int    `toml:"port"`
+	Server             string `toml:"server"` // May carry an ssl://, tls:// or starttls:// prefix
+	Port               int    `toml:"port"`
+	TLS                *bool  `toml:"tls"`                  // Legacy switch, used when no scheme or security is given
+	Security           string `toml:"security"`             // tls, starttls or none
+	Auth               string `toml:"auth"`                 // plain or login
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"` // Accept self-signed certificates
+	SubscribedOnly     bool   `toml:"subscribed_only"`      // Show only subscribed folders in the sidebar
+
+	Profile ConnectionProfile `toml:"-"` // Resolved by LoadConfig
 }
 
 type SMTPConfig struct {
-	Server      string `toml:"server"`
-	Port        int    `toml:"port"`
-	UseSTARTTLS bool   `toml:"use_starttls"` // true for port 587, false for port 465
+	Server             string `toml:"server"` // May carry an ssl://, tls:// or starttls:// prefix
+	Port               int    `toml:"port"`
+	UseSTARTTLS        bool   `toml:"use_starttls"`         // true for port 587, false for port 465
+	Security           string `toml:"security"`             // tls, starttls or none
+	Auth               string `toml:"auth"`                 // plain or login
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"` // Accept self-signed certificates
+	ServerSavesSent    bool   `toml:"server_saves_sent"`    // Skip our Sent copy when the server files sent mail itself
+
+	Profile ConnectionProfile `toml:"-"` // Resolved by LoadConfig
+}
+
+type SieveConfig struct {
+	Enabled            bool   `toml:"enabled"`              // Offer Sieve script management through ManageSieve
+	Server             string `toml:"server"`               // Defaults to the IMAP host; may carry a scheme prefix
+	Port               int    `toml:"port"`                 // Defaults to 4190
+	Security           string `toml:"security"`             // tls, starttls or none
+	Auth               string `toml:"auth"`                 // plain or login
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"` // Accept self-signed certificates
+
+	Profile ConnectionProfile `toml:"-"` // Resolved by LoadConfig
 }
 
 type JWTConfig struct {
@@ -30,8 +68,96 @@ type CacheConfig struct {
 	Folder string `toml:"folder"`
 }
 
+// Session storage backends
+const (
+	SessionFile   = "file"   // One file per session; instances may share the directory
+	SessionBolt   = "bolt"   // Embedded database file, for a single instance
+	SessionMemory = "memory" // Lost on restart, for tests
+)
+
+type SessionConfig struct {
+	Backend string `toml:"backend"` // file (default), bolt or memory
+	Path    string `toml:"path"`    // Session directory, or database file for bolt
+}
+
+type DataConfig struct {
+	Folder string `toml:"folder"` // Persistent per-user data (survives logout, unlike the cache)
+}
+
+type OutboxConfig struct {
+	PollInterval int `toml:"poll_interval"` // Seconds between queue scans
+	RetryBase    int `toml:"retry_base"`    // Seconds before the first retry, doubled on each attempt
+	RetryMax     int `toml:"retry_max"`     // Upper bound in seconds for a single backoff step
+	MaxAttempts  int `toml:"max_attempts"`  // Attempts before a temporary failure becomes a bounce
+	UndoSeconds  int `toml:"undo_seconds"`  // Delay during which a sent message can still be cancelled
+}
+
+type RulesConfig struct {
+	PollInterval int `toml:"poll_interval"` // Seconds between INBOX scans for new mail
+}
+
+type VacationConfig struct {
+	PollInterval int `toml:"poll_interval"` // Seconds between INBOX scans when replies are sent without Sieve
+}
+
+type IdentitiesConfig struct {
+	Domains []string            `toml:"domains"` // Users may send as any address in these domains
+	Aliases map[string][]string `toml:"aliases"` // Further addresses each login address may send as
+}
+
+type QuotaConfig struct {
+	WarnPercent     int `toml:"warn_percent"`     // Usage at which the sidebar shows a warning
+	CriticalPercent int `toml:"critical_percent"` // Usage at which the warning turns red
+}
+
+type TwoFactorConfig struct {
+	Issuer string `toml:"issuer"` // Name shown for the account in authenticator apps
+}
+
+type OAuthConfig struct {
+	Enabled      bool     `toml:"enabled"`      // Offer sign-in with an OAuth 2.0 provider next to the password form
+	Name         string   `toml:"name"`         // Provider name on the login button
+	AuthURL      string   `toml:"auth_url"`     // Authorization endpoint
+	TokenURL     string   `toml:"token_url"`    // Token endpoint
+	UserInfoURL  string   `toml:"userinfo_url"` // Endpoint returning the address; the ID token is used when empty
+	Issuer       string   `toml:"issuer"`       // Expected issuer of the ID token, required without userinfo_url
+	ClientID     string   `toml:"client_id"`
+	ClientSecret string   `toml:"client_secret"` // Empty for public clients, which rely on PKCE alone
+	Scopes       []string `toml:"scopes"`        // Must grant IMAP and SMTP access, e.g. https://mail.google.com/
+	RedirectURL  string   `toml:"redirect_url"`  // Public URL of /login/oauth/callback
+	Mechanism    string   `toml:"mechanism"`     // SASL mechanism for the mail servers: xoauth2 or oauthbearer
+}
+
+type OIDCConfig struct {
+	Enabled         bool              `toml:"enabled"` // Offer single sign-on with an OpenID Connect provider
+	Name            string            `toml:"name"`    // Provider name on the login button
+	Issuer          string            `toml:"issuer"`  // Issuer URL; endpoints and keys are discovered from it
+	ClientID        string            `toml:"client_id"`
+	ClientSecret    string            `toml:"client_secret"`  // Empty for public clients, which rely on PKCE alone
+	Scopes          []string          `toml:"scopes"`         // Must include openid
+	RedirectURL     string            `toml:"redirect_url"`   // Public URL of /login/oidc/callback
+	MailboxClaim    string            `toml:"mailbox_claim"`  // ID token claim naming the mailbox, e.g. email or preferred_username
+	MailboxDomain   string            `toml:"mailbox_domain"` // Domain of the mailboxes; appended to claim values without one
+	Mailboxes       map[string]string `toml:"mailboxes"`      // Claim values mapped to other mailboxes
+	MasterUser      string            `toml:"master_user"`    // Mail server user allowed to log in to any mailbox
+	MasterPassword  string            `toml:"master_password"`
+	MasterMode      string            `toml:"master_mode"`      // separator (user*master login name) or authzid (SASL PLAIN authorization identity)
+	MasterSeparator string            `toml:"master_separator"` // Dovecot's auth_master_user_separator
+}
+
 type EncryptionConfig struct {
-	Key string `toml:"key"` // 32-byte key for AES encryption
+	Key  string          `toml:"key"`  // Passphrase of the key "default"; a 16, 24 or 32 byte key also still decrypts data from before key IDs
+	KDF  string          `toml:"kdf"`  // hkdf (default) or argon2id, for key
+	Keys []EncryptionKey `toml:"keys"` // Replace key for rotation: the first encrypts, the others only decrypt
+
+	Keyring *keyring.Keyring `toml:"-"` // Resolved by LoadConfig
+}
+
+type EncryptionKey struct {
+	ID         string `toml:"id"` // Stored with every ciphertext
+	Passphrase string `toml:"passphrase"`
+	KDF        string `toml:"kdf"`  // hkdf (default) for random secrets, argon2id for passphrases
+	Salt       string `toml:"salt"` // Optional; derived from the ID when empty
 }
 
 type SSLConfig struct {
@@ -49,8 +175,20 @@ type Config struct {
 	Server     ServerConfig     `toml:"server"`
 	IMAP       IMAPConfig       `toml:"imap"`
 	SMTP       SMTPConfig       `toml:"smtp"`
+	Sieve      SieveConfig      `toml:"sieve"`
 	JWT        JWTConfig        `toml:"jwt"`
+	Login      LoginConfig      `toml:"login"`
+	TwoFactor  TwoFactorConfig  `toml:"two_factor"`
+	OAuth      OAuthConfig      `toml:"oauth"`
+	OIDC       OIDCConfig       `toml:"oidc"`
+	Session    SessionConfig    `toml:"session"`
 	Cache      CacheConfig      `toml:"cache"`
+	Data       DataConfig       `toml:"data"`
+	Identities IdentitiesConfig `toml:"identities"`
+	Outbox     OutboxConfig     `toml:"outbox"`
+	Quota      QuotaConfig      `toml:"quota"`
+	Rules      RulesConfig      `toml:"rules"`
+	Vacation   VacationConfig   `toml:"vacation"`
 	Encryption EncryptionConfig `toml:"encryption"`
 	SSL        SSLConfig        `toml:"ssl"`
 }
@@ -60,8 +198,49 @@ func LoadConfig(filepath string) (*Config, error) {
 
 	config.Server.Port = 3000
 	// Set default values
-	config.SMTP.Port = 587 // Default to STARTTLS port
-	config.SMTP.UseSTARTTLS = true
+	config.SMTP.UseSTARTTLS = true // Port 587 unless configured otherwise
+
+	config.Data.Folder = "./data"
+
+	config.Session.Backend = SessionFile
+
+	// Default outbox configuration
+	config.Outbox.PollInterval = 15
+	config.Outbox.RetryBase = 60
+	config.Outbox.RetryMax = 6 * 60 * 60
+	config.Outbox.MaxAttempts = 10
+	config.Outbox.UndoSeconds = 10
+
+	// Default login throttling
+	config.Login.MaxAttemptsPerIP = 20
+	config.Login.MaxAttemptsPerAccount = 5
+	config.Login.BaseDelay = 1
+	config.Login.LockoutSeconds = 15 * 60
+	config.Login.Window = 60 * 60
+
+	config.TwoFactor.Issuer = "LilMail"
+
+	// Default OAuth settings
+	config.OAuth.Name = "OAuth"
+	config.OAuth.Scopes = []string{"openid", "email"}
+	config.OAuth.Mechanism = AuthXOAuth2
+
+	// Default OpenID Connect settings
+	config.OIDC.Name = "single sign-on"
+	config.OIDC.Scopes = []string{"openid", "email", "profile"}
+	config.OIDC.MailboxClaim = "email"
+	config.OIDC.MasterMode = MasterSeparator
+	config.OIDC.MasterSeparator = "*"
+
+	// Default mail rules scan interval
+	config.Rules.PollInterval = 60
+
+	// Default vacation reply scan interval
+	config.Vacation.PollInterval = 60
+
+	// Default quota warning thresholds
+	config.Quota.WarnPercent = 80
+	config.Quota.CriticalPercent = 95
 
 	// Default SSL configuration
 	config.SSL.Port = 443
@@ -75,15 +254,61 @@ func LoadConfig(filepath string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := config.IMAP.ResolveIMAP(); err != nil {
+		return nil, fmt.Errorf("IMAP configuration error: %w", err)
+	}
+
 	// If SMTP server is not specified, derive it from IMAP server
 	if config.SMTP.Server == "" {
-		config.SMTP.Server = config.IMAP.Server
+		config.SMTP.Server = config.IMAP.Profile.Host
 		// Convert imap.server.com to smtp.server.com
-		if len(config.SMTP.Server) > 5 && config.SMTP.Server[:5] == "imap." {
+		if strings.HasPrefix(config.SMTP.Server, "imap.") {
 			config.SMTP.Server = "smtp" + config.SMTP.Server[4:]
 		}
 	}
 
+	if err := config.SMTP.ResolveSMTP(); err != nil {
+		return nil, fmt.Errorf("SMTP configuration error: %w", err)
+	}
+
+	if config.Sieve.Enabled {
+		if config.Sieve.Server == "" {
+			config.Sieve.Server = config.IMAP.Profile.Host
+			config.Sieve.InsecureSkipVerify = config.Sieve.InsecureSkipVerify || config.IMAP.Profile.SkipVerify
+		}
+		if err := config.Sieve.ResolveSieve(); err != nil {
+			return nil, fmt.Errorf("Sieve configuration error: %w", err)
+		}
+	}
+
+	if err := config.Session.ResolveSession(); err != nil {
+		return nil, fmt.Errorf("session configuration error: %w", err)
+	}
+
+	if err := config.Encryption.ResolveKeyring(); err != nil {
+		return nil, fmt.Errorf("encryption configuration error: %w", err)
+	}
+
+	if err := config.Identities.ResolveIdentities(); err != nil {
+		return nil, fmt.Errorf("identities configuration error: %w", err)
+	}
+
+	if config.Quota.WarnPercent < 1 || config.Quota.CriticalPercent > 100 || config.Quota.WarnPercent > config.Quota.CriticalPercent {
+		return nil, fmt.Errorf("quota configuration error: thresholds must satisfy 1 <= warn_percent <= critical_percent <= 100")
+	}
+
+	if config.OAuth.Enabled {
+		if err := config.ValidateOAuth(); err != nil {
+			return nil, fmt.Errorf("OAuth configuration error: %w", err)
+		}
+	}
+
+	if config.OIDC.Enabled {
+		if err := config.ValidateOIDC(); err != nil {
+			return nil, fmt.Errorf("OIDC configuration error: %w", err)
+		}
+	}
+
 	// Validate SSL configuration if enabled
 	if config.SSL.Enabled {
 		if err := config.ValidateSSL(); err != nil {
@@ -94,15 +319,30 @@ func LoadConfig(filepath string) (*Config, error) {
 	return &config, nil
 }
 
-// Helper method to get the appropriate SMTP port based on encryption
-func (c *SMTPConfig) GetPort() int {
-	if c.Port != 0 {
-		return c.Port
+// ResolveIdentities checks the sender addresses and lowercases them, so
+// they can be compared directly
+func (c *IdentitiesConfig) ResolveIdentities() error {
+	for i, domain := range c.Domains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain == "" || strings.ContainsAny(domain, "@ ") {
+			return fmt.Errorf("invalid domain %q", c.Domains[i])
+		}
+		c.Domains[i] = domain
 	}
-	if c.UseSTARTTLS {
-		return 587 // STARTTLS port
+
+	aliases := make(map[string][]string, len(c.Aliases))
+	for login, addresses := range c.Aliases {
+		for _, address := range addresses {
+			parsed, err := mail.ParseAddress(address)
+			if err != nil || parsed.Name != "" {
+				return fmt.Errorf("invalid alias %q of %s", address, login)
+			}
+			key := strings.ToLower(strings.TrimSpace(login))
+			aliases[key] = append(aliases[key], strings.ToLower(parsed.Address))
+		}
 	}
-	return 465 // SSL/TLS port
+	c.Aliases = aliases
+	return nil
 }
 
 // ValidateSSL checks if the SSL configuration is valid
@@ -128,6 +368,121 @@ func (c *Config) ValidateSSL() error {
 	return nil
 }
 
+// ResolveSession checks the backend and fills in its default path
+func (c *SessionConfig) ResolveSession() error {
+	c.Backend = strings.ToLower(c.Backend)
+	switch c.Backend {
+	case SessionFile:
+		if c.Path == "" {
+			c.Path = "./sessions"
+		}
+	case SessionBolt:
+		if c.Path == "" {
+			c.Path = "./sessions.db"
+		}
+	case SessionMemory:
+	default:
+		return fmt.Errorf("backend %q must be one of file, bolt, memory", c.Backend)
+	}
+	return nil
+}
+
+// ResolveKeyring derives the encryption keys. Without a keys list, key is
+// the passphrase of a single key with the ID "default".
+func (c *EncryptionConfig) ResolveKeyring() error {
+	var specs []keyring.Spec
+	for _, key := range c.Keys {
+		specs = append(specs, keyring.Spec{
+			ID:         key.ID,
+			Passphrase: key.Passphrase,
+			KDF:        key.KDF,
+			Salt:       key.Salt,
+		})
+	}
+	if len(specs) == 0 && c.Key != "" {
+		specs = append(specs, keyring.Spec{
+			ID:         "default",
+			Passphrase: c.Key,
+			KDF:        c.KDF,
+		})
+	}
+
+	ring, err := keyring.New(specs, c.Key)
+	if err != nil {
+		return err
+	}
+	c.Keyring = ring
+	return nil
+}
+
+// ValidateOAuth checks the provider settings and normalises the mechanism
+func (c *Config) ValidateOAuth() error {
+	required := []struct{ name, value string }{
+		{"auth_url", c.OAuth.AuthURL},
+		{"token_url", c.OAuth.TokenURL},
+		{"client_id", c.OAuth.ClientID},
+		{"redirect_url", c.OAuth.RedirectURL},
+	}
+	for _, setting := range required {
+		if setting.value == "" {
+			return fmt.Errorf("%s is required", setting.name)
+		}
+	}
+	if c.OAuth.UserInfoURL == "" && c.OAuth.Issuer == "" {
+		return fmt.Errorf("issuer is required when userinfo_url is empty")
+	}
+
+	switch mech := strings.ToLower(strings.TrimSpace(c.OAuth.Mechanism)); mech {
+	case AuthXOAuth2, AuthOAuthBearer:
+		c.OAuth.Mechanism = mech
+	default:
+		return fmt.Errorf("mechanism %q must be one of xoauth2, oauthbearer", c.OAuth.Mechanism)
+	}
+
+	return nil
+}
+
+// ValidateOIDC checks the provider settings and gives the mail server
+// profiles the master user
+func (c *Config) ValidateOIDC() error {
+	required := []struct{ name, value string }{
+		{"issuer", c.OIDC.Issuer},
+		{"client_id", c.OIDC.ClientID},
+		{"redirect_url", c.OIDC.RedirectURL},
+		{"mailbox_claim", c.OIDC.MailboxClaim},
+		{"mailbox_domain", c.OIDC.MailboxDomain},
+		{"master_user", c.OIDC.MasterUser},
+		{"master_password", c.OIDC.MasterPassword},
+	}
+	for _, setting := range required {
+		if setting.value == "" {
+			return fmt.Errorf("%s is required", setting.name)
+		}
+	}
+
+	master := &MasterLogin{
+		User:      c.OIDC.MasterUser,
+		Password:  c.OIDC.MasterPassword,
+		Separator: c.OIDC.MasterSeparator,
+	}
+	switch mode := strings.ToLower(strings.TrimSpace(c.OIDC.MasterMode)); mode {
+	case MasterSeparator:
+		if master.Separator == "" {
+			return fmt.Errorf("master_separator is required in separator mode")
+		}
+		master.Mode = mode
+	case MasterAuthzid:
+		master.Mode = mode
+	default:
+		return fmt.Errorf("master_mode %q must be one of separator, authzid", c.OIDC.MasterMode)
+	}
+
+	c.IMAP.Profile.Master = master
+	c.SMTP.Profile.Master = master
+	c.Sieve.Profile.Master = master
+	return nil
+}
+
 // GetSecurityHeaders returns a map of security headers based on the configuration
 func (c *Config) GetSecurityHeaders() map[string]string {
 	headers := make(map[string]string)
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Connection security modes
+const (
+	SecurityTLS      = "tls"      // Implicit TLS from the first byte (IMAPS/SMTPS)
+	SecurityStartTLS = "starttls" // Plain connection upgraded with STARTTLS
+	SecurityNone     = "none"     // Unencrypted connection
+)
+
+// Authentication mechanisms
+const (
+	AuthPlain = "plain"
+	AuthLogin = "login"
+
+	// Bearer token mechanisms, used for OAuth logins only
+	AuthXOAuth2     = "xoauth2"
+	AuthOAuthBearer = "oauthbearer"
+
+	// Login with the master user on behalf of the mailbox, used for OpenID
+	// Connect logins only
+	AuthMaster = "master"
+)
+
+// Ways for the master user to name the mailbox it logs in to
+const (
+	MasterSeparator = "separator" // Dovecot style login name mailbox*master
+	MasterAuthzid   = "authzid"   // SASL PLAIN authorization identity
+)
+
+// MasterLogin is a user allowed to log in to any mailbox, such as a Dovecot
+// master user
+type MasterLogin struct {
+	User      string
+	Password  string
+	Mode      string // MasterSeparator or MasterAuthzid
+	Separator string // Between mailbox and master user in separator mode
+}
+
+// ConnectionProfile is the resolved way to reach a mail server. It is filled
+// in by LoadConfig so the rest of the code never has to re-derive it.
+type ConnectionProfile struct {
+	Host          string
+	Port          int
+	Security      string
+	AuthMechanism string
+	SkipVerify    bool
+	Master        *MasterLogin // Set when OpenID Connect login is enabled
+}
+
+// Address returns the host:port pair to dial
+func (p ConnectionProfile) Address() string {
+	return net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+}
+
+// TLSConfig returns the TLS configuration used for TLS and STARTTLS connections
+func (p ConnectionProfile) TLSConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         p.Host,
+		InsecureSkipVerify: p.SkipVerify,
+	}
+}
+
+// String describes the profile for logging
+func (p ConnectionProfile) String() string {
+	return fmt.Sprintf("%s (%s, auth %s)", p.Address(), p.Security, p.AuthMechanism)
+}
+
+// splitServer separates an optional scheme prefix (ssl://, tls://,
+// starttls://, plain://) from the host. The returned security is empty when no
+// prefix was given.
+func splitServer(server string) (host, security string, err error) {
+	server = strings.TrimSpace(server)
+
+	idx := strings.Index(server, "://")
+	if idx < 0 {
+		return server, "", nil
+	}
+
+	scheme := strings.ToLower(server[:idx])
+	host = server[idx+3:]
+
+	switch scheme {
+	case "ssl", "tls", "imaps", "smtps":
+		security = SecurityTLS
+	case "starttls":
+		security = SecurityStartTLS
+	case "plain", "tcp", "imap", "smtp":
+		security = SecurityNone
+	default:
+		return "", "", fmt.Errorf("unknown scheme %q in server %q", scheme+"://", server)
+	}
+
+	return strings.TrimSuffix(host, "/"), security, nil
+}
+
+// normalizeSecurity validates an explicit security setting
+func normalizeSecurity(security string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(security)) {
+	case "":
+		return "", nil
+	case "tls", "ssl":
+		return SecurityTLS, nil
+	case "starttls":
+		return SecurityStartTLS, nil
+	case "none", "plain":
+		return SecurityNone, nil
+	}
+	return "", fmt.Errorf("security %q must be one of tls, starttls, none", security)
+}
+
+// normalizeAuth validates an authentication mechanism, defaulting to PLAIN
+func normalizeAuth(mech string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mech)) {
+	case "", AuthPlain:
+		return AuthPlain, nil
+	case AuthLogin:
+		return AuthLogin, nil
+	}
+	return "", fmt.Errorf("auth mechanism %q must be one of plain, login", mech)
+}
+
+// resolveProfile builds a profile from the raw settings of one section.
+// fallbackSecurity is used when neither a scheme prefix nor an explicit
+// security key is present, and defaultPort picks the port for a security mode
+// when none is configured.
+func resolveProfile(server string, port int, security, auth string, skipVerify bool,
+	fallbackSecurity string, defaultPort func(string) int) (ConnectionProfile, error) {
+
+	host, schemeSecurity, err := splitServer(server)
+	if err != nil {
+		return ConnectionProfile{}, err
+	}
+
+	explicitSecurity, err := normalizeSecurity(security)
+	if err != nil {
+		return ConnectionProfile{}, err
+	}
+
+	if schemeSecurity != "" && explicitSecurity != "" && schemeSecurity != explicitSecurity {
+		return ConnectionProfile{}, fmt.Errorf("server scheme implies %s but security is set to %s",
+			schemeSecurity, explicitSecurity)
+	}
+
+	mech, err := normalizeAuth(auth)
+	if err != nil {
+		return ConnectionProfile{}, err
+	}
+
+	profile := ConnectionProfile{
+		Host:          host,
+		Port:          port,
+		AuthMechanism: mech,
+		SkipVerify:    skipVerify,
+	}
+
+	switch {
+	case schemeSecurity != "":
+		profile.Security = schemeSecurity
+	case explicitSecurity != "":
+		profile.Security = explicitSecurity
+	default:
+		profile.Security = fallbackSecurity
+	}
+
+	if profile.Port == 0 {
+		profile.Port = defaultPort(profile.Security)
+	}
+
+	if profile.Host == "" {
+		return ConnectionProfile{}, fmt.Errorf("server is required")
+	}
+	if strings.ContainsAny(profile.Host, "/ ") {
+		return ConnectionProfile{}, fmt.Errorf("invalid server host %q", profile.Host)
+	}
+	if profile.Port < 1 || profile.Port > 65535 {
+		return ConnectionProfile{}, fmt.Errorf("port %d out of range", profile.Port)
+	}
+
+	return profile, nil
+}
+
+// ResolveIMAP fills in c.Profile from the [imap] section
+func (c *IMAPConfig) ResolveIMAP() error {
+	fallback := SecurityTLS
+	if c.TLS != nil && !*c.TLS {
+		fallback = SecurityNone
+	}
+
+	profile, err := resolveProfile(c.Server, c.Port, c.Security, c.Auth, c.InsecureSkipVerify,
+		fallback, func(security string) int {
+			if security == SecurityTLS {
+				return 993
+			}
+			return 143
+		})
+	if err != nil {
+		return err
+	}
+
+	c.Profile = profile
+	return nil
+}
+
+// IsLocalhost reports whether host is the local machine, the only place
+// credentials are sent to over an unencrypted connection
+func IsLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// ResolveSMTP fills in c.Profile from the [smtp] section. Sending always
+// logs in, and the login mechanisms refuse unencrypted connections to other
+// hosts, so security none is only accepted for a server on localhost.
+func (c *SMTPConfig) ResolveSMTP() error {
+	fallback := SecurityTLS
+	if c.UseSTARTTLS {
+		fallback = SecurityStartTLS
+	}
+
+	profile, err := resolveProfile(c.Server, c.Port, c.Security, c.Auth, c.InsecureSkipVerify,
+		fallback, func(security string) int {
+			switch security {
+			case SecurityTLS:
+				return 465
+			case SecurityStartTLS:
+				return 587
+			}
+			return 25
+		})
+	if err != nil {
+		return err
+	}
+	if profile.Security == SecurityNone && !IsLocalhost(profile.Host) {
+		return fmt.Errorf("security none is only allowed for a server on localhost, as the login would send the password unencrypted to %s; use tls or starttls", profile.Host)
+	}
+
+	c.Profile = profile
+	return nil
+}
+
+// ResolveSieve fills in c.Profile from the [sieve] section. ManageSieve
+// servers listen on 4190 and expect STARTTLS unless told otherwise.
+func (c *SieveConfig) ResolveSieve() error {
+	profile, err := resolveProfile(c.Server, c.Port, c.Security, c.Auth, c.InsecureSkipVerify,
+		SecurityStartTLS, func(string) int {
+			return 4190
+		})
+	if err != nil {
+		return err
+	}
+
+	c.Profile = profile
+	return nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveSMTPUnencrypted(t *testing.T) {
+	for _, tt := range []struct {
+		server   string
+		security string
+		wantErr  bool
+	}{
+		{"mail.example.com", "none", true},
+		{"smtp://mail.example.com", "", true},
+		{"plain://192.0.2.1", "", true},
+		{"localhost", "none", false},
+		{"127.0.0.1", "none", false},
+		{"::1", "none", false},
+		{"mail.example.com", "starttls", false},
+		{"ssl://mail.example.com", "", false},
+	} {
+		c := &SMTPConfig{Server: tt.server, Security: tt.security}
+		err := c.ResolveSMTP()
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "only allowed for a server on localhost") {
+				t.Errorf("ResolveSMTP(%s, %q) = %v, want the unencrypted login refused", tt.server, tt.security, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolveSMTP(%s, %q) = %v", tt.server, tt.security, err)
+		}
+	}
+}
@@ -3,10 +3,142 @@ set -e
 
 echo "Generando config.toml con variables de entorno..."
 
+# Valores por defecto, los mismos que usa LilMail sin config. Un puerto 0
+# elige el del modo de seguridad y un texto vacío deja el valor de fábrica.
+
+# [server]
+: "${SERVER_PORT:=3000}"
+: "${SERVER_TRUSTED_ORIGINS:=[]}"             # Lista TOML, p. ej. ["https://mail.example.com"]
+: "${SERVER_PROXY_HEADER:=}"                  # p. ej. X-Forwarded-For
+
+# [imap] (IMAP_SERVER es obligatorio)
+: "${IMAP_PORT:=0}"                           # 993 con TLS, 143 sin
+: "${IMAP_TLS:=true}"                         # Solo si ni el esquema ni IMAP_SECURITY lo indican
+: "${IMAP_SECURITY:=}"                        # tls, starttls o none
+: "${IMAP_AUTH:=plain}"                       # plain o login
+: "${IMAP_INSECURE_SKIP_VERIFY:=false}"
+: "${IMAP_SUBSCRIBED_ONLY:=false}"
+
+# [cache], [jwt] y [encryption] (JWT_SECRET y ENCRYPTION_KEY son obligatorios)
+: "${CACHE_FOLDER:=./cache}"
+: "${ENCRYPTION_KDF:=hkdf}"                   # hkdf o argon2id
+
+# [smtp]
+: "${SMTP_SERVER:=}"                          # Vacío: se deriva del servidor IMAP
+: "${SMTP_PORT:=0}"                           # 465 con TLS, 587 con STARTTLS, 25 sin
+: "${SMTP_STARTTLS:=true}"                    # Solo si ni el esquema ni SMTP_SECURITY lo indican
+: "${SMTP_SECURITY:=}"                        # tls, starttls o none (none solo en localhost)
+: "${SMTP_AUTH:=plain}"                       # plain o login
+: "${SMTP_INSECURE_SKIP_VERIFY:=false}"
+: "${SMTP_SERVER_SAVES_SENT:=false}"
+
+# [sieve]
+: "${SIEVE_ENABLED:=false}"
+: "${SIEVE_SERVER:=}"                         # Vacío: el servidor IMAP
+: "${SIEVE_PORT:=4190}"
+: "${SIEVE_SECURITY:=}"                       # starttls si se deja vacío
+: "${SIEVE_AUTH:=plain}"                      # plain o login
+: "${SIEVE_INSECURE_SKIP_VERIFY:=false}"
+
+# [session] y [data]
+: "${SESSION_BACKEND:=file}"                  # file, bolt o memory
+: "${SESSION_PATH:=}"                         # Vacío: ./sessions (file) o ./sessions.db (bolt)
+: "${DATA_FOLDER:=./data}"
+
+# [login]
+: "${LOGIN_MAX_ATTEMPTS_PER_IP:=20}"
+: "${LOGIN_MAX_ATTEMPTS_PER_ACCOUNT:=5}"
+: "${LOGIN_BASE_DELAY:=1}"
+: "${LOGIN_LOCKOUT_SECONDS:=900}"
+: "${LOGIN_WINDOW:=3600}"
+: "${LOGIN_ALLOW_LIST:=[]}"                   # Lista TOML, p. ej. ["10.0.0.0/8"]
+
+# [two_factor]
+: "${TWO_FACTOR_ISSUER:=LilMail}"
+
+# [outbox]
+: "${OUTBOX_POLL_INTERVAL:=15}"
+: "${OUTBOX_RETRY_BASE:=60}"
+: "${OUTBOX_RETRY_MAX:=21600}"
+: "${OUTBOX_MAX_ATTEMPTS:=10}"
+: "${OUTBOX_UNDO_SECONDS:=10}"
+
+# [identities]
+: "${IDENTITIES_DOMAINS:=[]}"                 # Lista TOML, p. ej. ["example.com"]
+: "${IDENTITIES_ALIASES:={\}}"                # Tabla TOML, p. ej. { "user@example.com" = ["sales@example.com"] }
+
+# [quota], [rules] y [vacation]
+: "${QUOTA_WARN_PERCENT:=80}"
+: "${QUOTA_CRITICAL_PERCENT:=95}"
+: "${RULES_POLL_INTERVAL:=60}"
+: "${VACATION_POLL_INTERVAL:=60}"
+
+# [oauth]
+: "${OAUTH_ENABLED:=false}"
+: "${OAUTH_NAME:=OAuth}"
+: "${OAUTH_AUTH_URL:=}"
+: "${OAUTH_TOKEN_URL:=}"
+: "${OAUTH_USERINFO_URL:=}"
+: "${OAUTH_ISSUER:=}"                         # Obligatorio sin OAUTH_USERINFO_URL
+: "${OAUTH_CLIENT_ID:=}"
+: "${OAUTH_CLIENT_SECRET:=}"
+: "${OAUTH_SCOPES:=[\"openid\", \"email\"]}"  # Lista TOML
+: "${OAUTH_REDIRECT_URL:=}"
+: "${OAUTH_MECHANISM:=xoauth2}"               # xoauth2 u oauthbearer
+
+# [oidc]
+: "${OIDC_ENABLED:=false}"
+: "${OIDC_NAME:=single sign-on}"
+: "${OIDC_ISSUER:=}"
+: "${OIDC_CLIENT_ID:=}"
+: "${OIDC_CLIENT_SECRET:=}"
+: "${OIDC_SCOPES:=[\"openid\", \"email\", \"profile\"]}"  # Lista TOML
+: "${OIDC_REDIRECT_URL:=}"
+: "${OIDC_MAILBOX_CLAIM:=email}"
+: "${OIDC_MAILBOX_DOMAIN:=}"                  # Obligatorio con OIDC
+: "${OIDC_MAILBOXES:={\}}"                    # Tabla TOML, p. ej. { "jdoe@corp.example" = "john@mail.example" }
+: "${OIDC_MASTER_USER:=}"
+: "${OIDC_MASTER_PASSWORD:=}"
+: "${OIDC_MASTER_MODE:=separator}"            # separator o authzid
+: "${OIDC_MASTER_SEPARATOR:=*}"
+
+# [ssl]
+: "${SSL_ENABLED:=false}"
+: "${SSL_CERT_FILE:=}"
+: "${SSL_KEY_FILE:=}"
+: "${SSL_PORT:=443}"
+: "${SSL_HTTP_PORT:=80}"
+: "${SSL_AUTO_REDIRECT:=true}"
+: "${SSL_DOMAIN:=}"
+: "${SSL_HSTS_MAX_AGE:=31536000}"
+
 # exporta las variables que envsubst necesita
-export IMAP_SERVER IMAP_PORT IMAP_TLS \
-       CACHE_FOLDER JWT_SECRET ENCRYPTION_KEY \
-       SMTP_SERVER SMTP_PORT SMTP_STARTTLS
+export SERVER_PORT SERVER_TRUSTED_ORIGINS SERVER_PROXY_HEADER \
+       IMAP_SERVER IMAP_PORT IMAP_TLS IMAP_SECURITY IMAP_AUTH \
+       IMAP_INSECURE_SKIP_VERIFY IMAP_SUBSCRIBED_ONLY \
+       CACHE_FOLDER JWT_SECRET ENCRYPTION_KEY ENCRYPTION_KDF \
+       SMTP_SERVER SMTP_PORT SMTP_STARTTLS SMTP_SECURITY SMTP_AUTH \
+       SMTP_INSECURE_SKIP_VERIFY SMTP_SERVER_SAVES_SENT \
+       SIEVE_ENABLED SIEVE_SERVER SIEVE_PORT SIEVE_SECURITY SIEVE_AUTH \
+       SIEVE_INSECURE_SKIP_VERIFY \
+       SESSION_BACKEND SESSION_PATH DATA_FOLDER \
+       LOGIN_MAX_ATTEMPTS_PER_IP LOGIN_MAX_ATTEMPTS_PER_ACCOUNT LOGIN_BASE_DELAY \
+       LOGIN_LOCKOUT_SECONDS LOGIN_WINDOW LOGIN_ALLOW_LIST \
+       TWO_FACTOR_ISSUER \
+       OUTBOX_POLL_INTERVAL OUTBOX_RETRY_BASE OUTBOX_RETRY_MAX \
+       OUTBOX_MAX_ATTEMPTS OUTBOX_UNDO_SECONDS \
+       IDENTITIES_DOMAINS IDENTITIES_ALIASES \
+       QUOTA_WARN_PERCENT QUOTA_CRITICAL_PERCENT \
+       RULES_POLL_INTERVAL VACATION_POLL_INTERVAL \
+       OAUTH_ENABLED OAUTH_NAME OAUTH_AUTH_URL OAUTH_TOKEN_URL OAUTH_USERINFO_URL \
+       OAUTH_ISSUER OAUTH_CLIENT_ID OAUTH_CLIENT_SECRET OAUTH_SCOPES \
+       OAUTH_REDIRECT_URL OAUTH_MECHANISM \
+       OIDC_ENABLED OIDC_NAME OIDC_ISSUER OIDC_CLIENT_ID OIDC_CLIENT_SECRET \
+       OIDC_SCOPES OIDC_REDIRECT_URL OIDC_MAILBOX_CLAIM OIDC_MAILBOX_DOMAIN \
+       OIDC_MAILBOXES OIDC_MASTER_USER OIDC_MASTER_PASSWORD OIDC_MASTER_MODE \
+       OIDC_MASTER_SEPARATOR \
+       SSL_ENABLED SSL_CERT_FILE SSL_KEY_FILE SSL_PORT SSL_HTTP_PORT \
+       SSL_AUTO_REDIRECT SSL_DOMAIN SSL_HSTS_MAX_AGE
 
 # reemplaza las variables en el template
 envsubst < /app/config.template.toml > /app/config.toml
@@ -14,4 +146,4 @@ envsubst < /app/config.template.toml > /app/config.toml
 echo "Config generado:"
 cat /app/config.toml
 
-exec ./lilmail
\ No newline at end of file
+exec ./lilmail
@@ -2,13 +2,15 @@
 package api
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
+	"lilmail/config"
+	"lilmail/keyring"
+	"lilmail/storage"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -22,25 +24,66 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
+// Credentials are what the mail servers are logged in with. For OAuth
+// logins Password holds the access token and Mechanism the SASL mechanism
+// that presents it; OpenID Connect logins have no password and go through
+// the master user.
 type Credentials struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email        string    `json:"email"`
+	Password     string    `json:"password"`
+	Mechanism    string    `json:"mechanism,omitempty"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// TokenRefresher renews the access token of OAuth credentials. It is set
+// when an OAuth provider is configured.
+var TokenRefresher func(creds *Credentials) error
+
+// CredentialsRenewed is called after DecryptCredentials renewed an access
+// token, with the refresh token it used and the renewed credentials sealed
+// again, so the stored copies can be replaced. Providers may rotate refresh
+// tokens, which leaves the old copies unusable.
+var CredentialsRenewed func(email, refreshToken, credentials string)
+
+// tokenMargin renews access tokens this long before they expire, so they
+// do not run out during a session with the server
+const tokenMargin = time.Minute
+
+// Profile returns the connection profile with the mechanism these
+// credentials need
+func (c *Credentials) Profile(profile config.ConnectionProfile) config.ConnectionProfile {
+	if c.Mechanism != "" {
+		profile.AuthMechanism = c.Mechanism
+	}
+	return profile
 }
 
-// GenerateToken creates a new JWT token for the user
-func GenerateToken(username, email, secret string) (string, error) {
-	claims := Claims{
+// GenerateToken creates a new JWT token for the user. Its claims are
+// returned too, since the token ID is what revokes it.
+func GenerateToken(username, email, secret string) (string, *Claims, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token ID: %v", err)
+	}
+
+	claims := &Claims{
 		Username: username,
 		Email:    email,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Subject:   email,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
 }
 
 // ValidateToken verifies the JWT token and returns the claims
@@ -65,69 +108,65 @@ func ValidateToken(tokenString, secret string) (*Claims, error) {
 }
 
 // EncryptCredentials encrypts the email and password
-func EncryptCredentials(email, password, key string) (string, error) {
-	creds := Credentials{
+func EncryptCredentials(email, password string, keys *keyring.Keyring) (string, error) {
+	return SealCredentials(&Credentials{
 		Email:    email,
 		Password: password,
-	}
+	}, keys)
+}
 
+// SealCredentials encrypts a full set of credentials
+func SealCredentials(creds *Credentials, keys *keyring.Keyring) (string, error) {
 	plaintext, err := json.Marshal(creds)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal credentials: %v", err)
 	}
 
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %v", err)
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %v", err)
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("failed to create nonce: %v", err)
-	}
-
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return keys.Encrypt(plaintext)
 }
 
-// DecryptCredentials decrypts the stored credentials
-func DecryptCredentials(encryptedStr, key string) (*Credentials, error) {
-	ciphertext, err := base64.StdEncoding.DecodeString(encryptedStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode credentials: %v", err)
-	}
-
-	block, err := aes.NewCipher([]byte(key))
+// DecryptCredentials decrypts the stored credentials, renewing an access
+// token about to expire
+func DecryptCredentials(encryptedStr string, keys *keyring.Keyring) (*Credentials, error) {
+	creds, err := UnsealCredentials(encryptedStr, keys)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %v", err)
+		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	// Stored access tokens expire; every user of the credentials gets a
+	// fresh one
+	if creds.RefreshToken != "" && time.Until(creds.Expiry) < tokenMargin {
+		if TokenRefresher == nil {
+			return nil, fmt.Errorf("%w: access token expired", ErrLoginFailed)
+		}
+		refreshToken := creds.RefreshToken
+		if err := TokenRefresher(creds); err != nil {
+			return nil, fmt.Errorf("%w: token refresh failed: %v", ErrLoginFailed, err)
+		}
+		if CredentialsRenewed != nil {
+			sealed, err := SealCredentials(creds, keys)
+			if err != nil {
+				log.Printf("Error sealing renewed credentials of %s: %v", creds.Email, err)
+			} else {
+				CredentialsRenewed(creds.Email, refreshToken, sealed)
+			}
+		}
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
+	return creds, nil
+}
 
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+// UnsealCredentials decrypts stored credentials as they are
+func UnsealCredentials(encryptedStr string, keys *keyring.Keyring) (*Credentials, error) {
+	plaintext, err := keys.Decrypt(encryptedStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %v", err)
+		return nil, err
 	}
 
 	var creds Credentials
 	if err := json.Unmarshal(plaintext, &creds); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal credentials: %v", err)
 	}
-
 	return &creds, nil
 }
 
@@ -152,7 +191,7 @@ func GetSessionToken(c *fiber.Ctx, store *session.Store) (string, error) {
 }
 
 // GetCredentials safely retrieves and decrypts credentials from session
-func GetCredentials(c *fiber.Ctx, store *session.Store, encryptionKey string) (*Credentials, error) {
+func GetCredentials(c *fiber.Ctx, store *session.Store, keys *keyring.Keyring) (*Credentials, error) {
 	sess, err := store.Get(c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get session: %v", err)
@@ -168,7 +207,7 @@ func GetCredentials(c *fiber.Ctx, store *session.Store, encryptionKey string) (*
 		return nil, fmt.Errorf("invalid credentials format")
 	}
 
-	return DecryptCredentials(encryptedStr, encryptionKey)
+	return DecryptCredentials(encryptedStr, keys)
 }
 
 // ValidateSession checks if the current session is valid
@@ -196,7 +235,7 @@ func RefreshSession(sess *session.Session) error {
 }
 
 // SessionMiddleware checks if the user is authenticated
-func SessionMiddleware(store *session.Store) fiber.Handler {
+func SessionMiddleware(store *session.Store, sessions *storage.Store) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		sess, err := store.Get(c)
 		if err != nil {
@@ -217,10 +256,64 @@ func SessionMiddleware(store *session.Store) fiber.Handler {
 			c.Locals("email", email)
 		}
 
+		// Record the device for the sessions page
+		owner, _ := email.(string)
+		tokenID, _ := sess.Get("token_id").(string)
+		tokenExpiry, _ := sess.Get("token_expiry").(int64)
+		if err := sessions.Touch(sess.ID(), storage.SessionMeta{
+			Owner:       owner,
+			LastSeen:    time.Now(),
+			IP:          c.IP(),
+			UserAgent:   c.Get("User-Agent"),
+			TokenID:     tokenID,
+			TokenExpiry: time.Unix(tokenExpiry, 0),
+		}); err != nil {
+			log.Printf("Error recording session use: %v", err)
+		}
+
+		return c.Next()
+	}
+}
+
+// TokenMiddleware requires a valid bearer token issued to the session user.
+// It runs after SessionMiddleware, so a token copied from another account
+// cannot be used with this session. Tokens on the denylist are refused.
+func TokenMiddleware(secret string, denylist *Denylist) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		header := c.Get("Authorization")
+		if len(header) < 8 || !strings.EqualFold(header[:7], "Bearer ") {
+			return tokenError(c, "Missing bearer token")
+		}
+
+		claims, err := ValidateToken(strings.TrimSpace(header[7:]), secret)
+		if err != nil {
+			return tokenError(c, "Invalid or expired token")
+		}
+		if denylist.Revoked(claims.ID) {
+			return tokenError(c, "Token has been revoked")
+		}
+
+		email := GetSessionEmail(c)
+		if email == "" || !strings.EqualFold(claims.Subject, email) {
+			return tokenError(c, "Token does not belong to this session")
+		}
+
+		c.Locals("claims", claims)
 		return c.Next()
 	}
 }
 
+// tokenError rejects a request with 401. htmx is asked to go to the login
+// page, since the page's token can only be renewed by signing in again.
+func tokenError(c *fiber.Ctx, message string) error {
+	if c.Get("HX-Request") != "" {
+		c.Set("HX-Redirect", "/login")
+	}
+	return c.Status(401).JSON(fiber.Map{
+		"error": message,
+	})
+}
+
 // GetSessionUser safely retrieves username from context
 func GetSessionUser(c *fiber.Ctx) string {
 	if username := c.Locals("username"); username != nil {
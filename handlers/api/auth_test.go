@@ -0,0 +1,205 @@
+// handlers/api/auth_test.go
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lilmail/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret"
+
+// protectedRoutes are routes of the /api and /htmx groups, covering every
+// method they use
+var protectedRoutes = []struct{ method, path string }{
+	{"GET", "/api/email/1"},
+	{"DELETE", "/api/email/1"},
+	{"POST", "/api/email/1/mark-unread"},
+	{"GET", "/api/folder/INBOX/emails"},
+	{"POST", "/api/folders"},
+	{"PUT", "/api/folder/Archive"},
+	{"POST", "/api/compose"},
+	{"GET", "/api/sessions"},
+	{"DELETE", "/api/sessions/abc"},
+	{"PUT", "/api/vacation"},
+	{"GET", "/htmx/email/1"},
+	{"GET", "/htmx/folder/INBOX/emails"},
+}
+
+type authApp struct {
+	app      *fiber.App
+	denylist *Denylist
+	cookie   string // Session cookie of user@example.com
+}
+
+// newAuthApp guards the protected routes as main does, with a handler
+// answering 200 behind the middleware
+func newAuthApp(t *testing.T) *authApp {
+	t.Helper()
+	sessions := storage.NewMemoryStore()
+	t.Cleanup(func() { sessions.Close() })
+	store := session.New(session.Config{Storage: sessions})
+
+	denylist, err := NewDenylist(filepath.Join(t.TempDir(), "revoked-tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/test-login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("authenticated", true)
+		sess.Set("email", "user@example.com")
+		return sess.Save()
+	})
+
+	reached := func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	}
+	protected := app.Group("", SessionMiddleware(store, sessions))
+	apiRoutes := protected.Group("/api", TokenMiddleware(testSecret, denylist))
+	htmx := protected.Group("/htmx", TokenMiddleware(testSecret, denylist))
+	for _, route := range protectedRoutes {
+		if path, ok := strings.CutPrefix(route.path, "/api"); ok {
+			apiRoutes.Add(route.method, path, reached)
+		} else {
+			htmx.Add(route.method, strings.TrimPrefix(route.path, "/htmx"), reached)
+		}
+	}
+
+	res, err := app.Test(httptest.NewRequest("POST", "/test-login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := res.Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("no session cookie")
+	}
+
+	return &authApp{
+		app:      app,
+		denylist: denylist,
+		cookie:   cookies[0].Name + "=" + cookies[0].Value,
+	}
+}
+
+func (a *authApp) status(t *testing.T, method, path, authorization string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Cookie", a.cookie)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err := a.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestTokenRequiredOnEveryRoute(t *testing.T) {
+	a := newAuthApp(t)
+	token, _, err := GenerateToken("user", "user@example.com", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range protectedRoutes {
+		if got := a.status(t, route.method, route.path, ""); got != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token = %d, want 401", route.method, route.path, got)
+		}
+		if got := a.status(t, route.method, route.path, "Bearer "+token); got != http.StatusOK {
+			t.Errorf("%s %s with a token = %d, want 200", route.method, route.path, got)
+		}
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	a := newAuthApp(t)
+	otherUser, _, _ := GenerateToken("other", "other@example.com", testSecret)
+	otherSecret, _, _ := GenerateToken("user", "user@example.com", "another-secret")
+
+	expired := &Claims{
+		Email: "user@example.com",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "user@example.com",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	}
+	expiredToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, expired).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, authorization := range map[string]string{
+		"malformed":           "Bearer not-a-token",
+		"not bearer":          "Basic dXNlcjpwYXNz",
+		"other user":          "Bearer " + otherUser,
+		"other secret":        "Bearer " + otherSecret,
+		"expired":             "Bearer " + expiredToken,
+		"empty bearer":        "Bearer ",
+		"unsigned (alg=none)": "Bearer eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJzdWIiOiJ1c2VyQGV4YW1wbGUuY29tIn0.",
+	} {
+		if got := a.status(t, "GET", "/api/sessions", authorization); got != http.StatusUnauthorized {
+			t.Errorf("%s token = %d, want 401", name, got)
+		}
+	}
+}
+
+func TestRevokedTokenRejected(t *testing.T) {
+	a := newAuthApp(t)
+	token, claims, err := GenerateToken("user", "user@example.com", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _, _ := GenerateToken("user", "user@example.com", testSecret)
+
+	if got := a.status(t, "GET", "/api/sessions", "Bearer "+token); got != http.StatusOK {
+		t.Fatalf("token before revoking = %d, want 200", got)
+	}
+
+	// Revoked through another instance, as the sign-out command does
+	other, err := NewDenylist(a.denylist.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Revoke(map[string]time.Time{claims.ID: claims.ExpiresAt.Time}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range protectedRoutes {
+		if got := a.status(t, route.method, route.path, "Bearer "+token); got != http.StatusUnauthorized {
+			t.Errorf("%s %s with a revoked token = %d, want 401", route.method, route.path, got)
+		}
+	}
+	if got := a.status(t, "GET", "/api/sessions", "Bearer "+kept); got != http.StatusOK {
+		t.Errorf("token that was not revoked = %d, want 200", got)
+	}
+}
+
+func TestSessionRequired(t *testing.T) {
+	a := newAuthApp(t)
+	token, _, _ := GenerateToken("user", "user@example.com", testSecret)
+
+	req := httptest.NewRequest("GET", "/api/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := a.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/login" {
+		t.Errorf("token without a session = %d to %q, want a redirect to /login", res.StatusCode, res.Header.Get("Location"))
+	}
+}
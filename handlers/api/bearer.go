@@ -0,0 +1,75 @@
+// handlers/api/bearer.go
+package api
+
+import (
+	"errors"
+	"lilmail/config"
+	"net/smtp"
+
+	"github.com/emersion/go-sasl"
+)
+
+// bearerClient returns the SASL client presenting an OAuth access token
+// with the profile's mechanism, or nil for password mechanisms
+func bearerClient(profile config.ConnectionProfile, email, token string) sasl.Client {
+	switch profile.AuthMechanism {
+	case config.AuthXOAuth2:
+		return &xoauth2Client{username: email, token: token}
+	case config.AuthOAuthBearer:
+		return &oauthBearerClient{sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: email,
+			Token:    token,
+			Host:     profile.Host,
+			Port:     profile.Port,
+		})}
+	}
+	return nil
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism of Google and Microsoft,
+// which go-sasl does not provide
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	ir := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(ir), nil
+}
+
+// Next answers the JSON error a server sends for a rejected token with an
+// empty response, after which the server fails the exchange
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// oauthBearerClient is go-sasl's OAUTHBEARER client (RFC 7628) answering
+// an error challenge with the dummy response the RFC asks for. go-sasl
+// returns an error instead, which leaves the IMAP exchange waiting.
+type oauthBearerClient struct {
+	sasl.Client
+}
+
+func (a *oauthBearerClient) Next(challenge []byte) ([]byte, error) {
+	return []byte{0x01}, nil
+}
+
+// saslAuth adapts a SASL client to net/smtp
+type saslAuth struct {
+	client sasl.Client
+}
+
+func (a *saslAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !config.IsLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return a.client.Start()
+}
+
+func (a *saslAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return a.client.Next(fromServer)
+}
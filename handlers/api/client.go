@@ -2,66 +2,78 @@
 package api
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"strings"
+	"lilmail/config"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
 )
 
+// ErrLoginFailed is returned by NewClient when the server rejects the
+// credentials
+var ErrLoginFailed = errors.New("login error")
+
 // Client represents an IMAP client wrapper
 type Client struct {
-	client   *client.Client
-	username string // Add username field
+	client *client.Client
 }
 
-// NewClient creates a new IMAP client
-func NewClient(server string, port int, email, password string) (*Client, error) {
-	c, err := client.DialTLS(fmt.Sprintf("%s:%d", server, port), nil)
+// NewClient creates a new IMAP client using the resolved connection profile
+func NewClient(profile config.ConnectionProfile, email, password string) (*Client, error) {
+	c, err := dialIMAP(profile)
 	if err != nil {
 		return nil, fmt.Errorf("connection error: %v", err)
 	}
 
-	err = c.Login(email, password)
+	// OAuth tokens and master logins go through their own mechanism.
+	// Passwords use AUTHENTICATE PLAIN when asked for and offered, the LOGIN
+	// command otherwise.
+	if bearer := bearerClient(profile, email, password); bearer != nil {
+		err = c.Authenticate(bearer)
+	} else if master := masterClient(profile, email); master != nil {
+		err = c.Authenticate(master)
+	} else if ok, _ := c.SupportAuth(sasl.Plain); ok && profile.AuthMechanism == config.AuthPlain {
+		err = c.Authenticate(sasl.NewPlainClient("", email, password))
+	} else {
+		err = c.Login(email, password)
+	}
 	if err != nil {
 		c.Logout()
-		return nil, fmt.Errorf("login error: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrLoginFailed, err)
 	}
 
 	return &Client{client: c}, nil
 }
 
+// dialIMAP opens a connection secured according to the profile
+func dialIMAP(profile config.ConnectionProfile) (*client.Client, error) {
+	switch profile.Security {
+	case config.SecurityTLS:
+		return client.DialTLS(profile.Address(), profile.TLSConfig())
+	case config.SecurityStartTLS:
+		c, err := client.Dial(profile.Address())
+		if err != nil {
+			return nil, err
+		}
+		if err := c.StartTLS(profile.TLSConfig()); err != nil {
+			c.Logout()
+			return nil, fmt.Errorf("starttls failed: %v", err)
+		}
+		return c, nil
+	default:
+		return client.Dial(profile.Address())
+	}
+}
+
 // Close closes the IMAP connection
 func (c *Client) Close() error {
 	return c.client.Logout()
 }
 
-// FetchFolders retrieves all mailbox folders
-func (c *Client) FetchFolders() ([]*MailboxInfo, error) {
-	mailboxChan := make(chan *imap.MailboxInfo, 10)
-	done := make(chan error, 1)
-
-	go func() {
-		done <- c.client.List("", "*", mailboxChan)
-	}()
-
-	var mailboxes []*MailboxInfo
-	for mb := range mailboxChan {
-		mailboxes = append(mailboxes, &MailboxInfo{
-			Name:       mb.Name,
-			Delimiter:  mb.Delimiter,
-			Attributes: mb.Attributes,
-		})
-	}
-
-	if err := <-done; err != nil {
-		return nil, fmt.Errorf("error fetching folders: %v", err)
-	}
-
-	return mailboxes, nil
-}
-
 // SelectFolder selects a mailbox/folder
 func (c *Client) SelectFolder(folderName string, readOnly bool) (*imap.MailboxStatus, error) {
 	return c.client.Select(folderName, readOnly)
@@ -71,7 +83,11 @@ type MailboxInfo struct {
 	Attributes  []string `json:"attributes"`
 	Delimiter   string   `json:"delimiter"`
 	Name        string   `json:"name"`
+	Role        string   `json:"role,omitempty"` // See AssignRoles
+	Subscribed  bool     `json:"subscribed"`
+	TotalCount  int      `json:"totalCount,omitempty"`
 	UnreadCount int      `json:"unreadCount,omitempty"`
+	RecentCount int      `json:"recentCount,omitempty"`
 }
 
 // parseUID converts a string UID to uint32
@@ -84,33 +100,47 @@ func parseUID(uid string) (uint32, error) {
 	return uidNum, nil
 }
 
-// Add this method to your existing Client struct
-func (c *Client) SaveToSent(to, subject, body string) error {
-	// Try different common names for Sent folder
-	sentFolders := []string{"Sent", "Sent Items", "Sent Mail"}
+// SaveToSent appends the exact bytes of a sent message to the Sent folder,
+// flagged as \Seen
+func (c *Client) SaveToSent(raw []byte) error {
+	folder, err := c.folderByRole(RoleSent)
+	if err != nil {
+		return err
+	}
+
+	return c.AppendMessage(folder, []string{imap.SeenFlag}, raw)
+}
 
-	var selectedFolder string
-	for _, folder := range sentFolders {
-		if _, err := c.client.Select(folder, false); err == nil {
-			selectedFolder = folder
-			break
-		}
+// AppendMessage stores a raw RFC 5322 message in the given folder
+func (c *Client) AppendMessage(folderName string, flags []string, raw []byte) error {
+	if err := c.client.Append(folderName, flags, time.Now(), bytes.NewReader(raw)); err != nil {
+		return fmt.Errorf("error appending to %s: %v", folderName, err)
 	}
+	return nil
+}
+
+// uidExpunge is the UIDPLUS UID EXPUNGE command (RFC 4315)
+type uidExpunge struct {
+	seqSet *imap.SeqSet
+}
 
-	if selectedFolder == "" {
-		return fmt.Errorf("could not find Sent folder")
+func (cmd *uidExpunge) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "UID EXPUNGE",
+		Arguments: []interface{}{cmd.seqSet},
 	}
+}
 
-	// Format the message
-	message := fmt.Sprintf("From: %s\r\n"+
-		"To: %s\r\n"+
-		"Subject: %s\r\n"+
-		"Date: %s\r\n"+
-		"Content-Type: text/plain; charset=UTF-8\r\n"+
-		"\r\n"+
-		"%s", c.username, to, subject,
-		time.Now().Format(time.RFC1123Z), body)
-
-	// Append the message to the Sent folder
-	return c.client.Append(selectedFolder, nil, time.Now(), strings.NewReader(message))
+// expungeUIDs permanently removes the given messages, which must already be
+// flagged \Deleted, from the selected folder. Without UIDPLUS this falls
+// back to a plain EXPUNGE.
+func (c *Client) expungeUIDs(seqSet *imap.SeqSet) error {
+	if ok, _ := c.client.Support("UIDPLUS"); ok {
+		status, err := c.client.Execute(&uidExpunge{seqSet: seqSet}, nil)
+		if err != nil {
+			return err
+		}
+		return status.Err()
+	}
+	return c.client.Expunge(nil)
 }
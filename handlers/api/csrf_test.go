@@ -0,0 +1,139 @@
+// handlers/api/csrf_test.go
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"lilmail/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+type csrfApp struct {
+	app    *fiber.App
+	cookie string
+	token  string
+}
+
+// newCSRFApp serves http://mail.example.com behind CSRFMiddleware and loads
+// a page, which hands out the session cookie and the token
+func newCSRFApp(t *testing.T) *csrfApp {
+	t.Helper()
+	sessions := storage.NewMemoryStore()
+	t.Cleanup(func() { sessions.Close() })
+	store := session.New(session.Config{Storage: sessions})
+
+	app := fiber.New()
+	app.Use(CSRFMiddleware(store, []string{"https://webmail.example.org/"}))
+	app.Get("/page", func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("CSRFToken").(string))
+	})
+	app.Post("/action", func(c *fiber.Ctx) error {
+		return c.SendString("done")
+	})
+
+	res, err := app.Test(httptest.NewRequest("GET", "http://mail.example.com/page", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || len(token) == 0 || len(res.Cookies()) == 0 {
+		t.Fatalf("page = %d with token %q and %d cookies", res.StatusCode, token, len(res.Cookies()))
+	}
+
+	return &csrfApp{
+		app:    app,
+		cookie: res.Cookies()[0].Name + "=" + res.Cookies()[0].Value,
+		token:  string(token),
+	}
+}
+
+// post sends a form post with the session cookie and the given headers
+func (a *csrfApp) post(t *testing.T, body string, headers map[string]string) int {
+	t.Helper()
+	req := httptest.NewRequest("POST", "http://mail.example.com/action", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", a.cookie)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	res, err := a.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestCSRFSameOrigin(t *testing.T) {
+	a := newCSRFApp(t)
+	form := url.Values{CSRFField: {a.token}}.Encode()
+
+	for name, tc := range map[string]struct {
+		body    string
+		headers map[string]string
+	}{
+		"header token": {"", map[string]string{CSRFHeader: a.token, "Origin": "http://mail.example.com"}},
+		"form token":   {form, map[string]string{"Origin": "http://mail.example.com"}},
+		"referer":      {form, map[string]string{"Referer": "http://mail.example.com/inbox"}},
+		"trusted":      {form, map[string]string{"Origin": "https://webmail.example.org"}},
+	} {
+		if got := a.post(t, tc.body, tc.headers); got != http.StatusOK {
+			t.Errorf("%s: same-origin post with the token = %d, want 200", name, got)
+		}
+	}
+}
+
+func TestCSRFCrossSiteRefused(t *testing.T) {
+	a := newCSRFApp(t)
+	form := url.Values{CSRFField: {a.token}}.Encode()
+
+	// A forged post is refused even when it carries a valid token
+	for name, headers := range map[string]map[string]string{
+		"origin":          {"Origin": "https://evil.example"},
+		"referer":         {"Referer": "https://evil.example/form"},
+		"opaque origin":   {"Origin": "null"},
+		"lookalike host":  {"Origin": "http://mail.example.com.evil.example"},
+		"untrusted https": {"Origin": "https://mail.example.org"},
+	} {
+		if got := a.post(t, form, headers); got != http.StatusForbidden {
+			t.Errorf("%s: cross-site post = %d, want 403", name, got)
+		}
+	}
+}
+
+func TestCSRFTokenRequired(t *testing.T) {
+	a := newCSRFApp(t)
+	origin := map[string]string{"Origin": "http://mail.example.com"}
+
+	if got := a.post(t, "", origin); got != http.StatusForbidden {
+		t.Errorf("same-origin post without the token = %d, want 403", got)
+	}
+	if got := a.post(t, url.Values{CSRFField: {"wrong"}}.Encode(), origin); got != http.StatusForbidden {
+		t.Errorf("same-origin post with a wrong token = %d, want 403", got)
+	}
+
+	// Without Origin and Referer the token is all that protects the request
+	if got := a.post(t, "", nil); got != http.StatusForbidden {
+		t.Errorf("post naming no origin, without the token = %d, want 403", got)
+	}
+	if got := a.post(t, "", map[string]string{CSRFHeader: a.token}); got != http.StatusOK {
+		t.Errorf("post naming no origin, with the token = %d, want 200", got)
+	}
+}
+
+func TestCSRFTokenBoundToSession(t *testing.T) {
+	a := newCSRFApp(t)
+	b := newCSRFApp(t)
+
+	// The token of another session, such as the attacker's own
+	headers := map[string]string{CSRFHeader: b.token, "Origin": "http://mail.example.com"}
+	if got := a.post(t, "", headers); got != http.StatusForbidden {
+		t.Errorf("post with another session's token = %d, want 403", got)
+	}
+}
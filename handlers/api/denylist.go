@@ -0,0 +1,140 @@
+// handlers/api/denylist.go
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/storage"
+	"lilmail/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Denylist holds the IDs of revoked tokens until they would have expired
+// anyway. It is kept in a file that the sign-out command may change while
+// LilMail runs, so it is reloaded when the file changes, and changed only
+// under a lock both processes honour.
+type Denylist struct {
+	path   string
+	lock   *storage.FileLock
+	tokens map[string]time.Time
+	loaded os.FileInfo // The file as last read or written
+	mu     sync.Mutex
+}
+
+// NewDenylist loads the revoked tokens stored at path
+func NewDenylist(path string) (*Denylist, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	lock, err := storage.OpenFileLock(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Denylist{
+		path:   path,
+		lock:   lock,
+		tokens: make(map[string]time.Time),
+	}
+	if err := d.reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Revoked reports whether the token with this ID was revoked
+func (d *Denylist) Revoked(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.reload(); err != nil {
+		log.Printf("Token denylist: %v", err)
+	}
+	until, ok := d.tokens[id]
+	return ok && time.Now().Before(until)
+}
+
+// Revoke denies tokens by ID until the given expiry times
+func (d *Denylist) Revoke(tokens map[string]time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Another process may add tokens between reading and writing the file
+	return d.lock.Locked(func() error {
+		if err := d.reload(); err != nil {
+			return err
+		}
+		return d.save(tokens)
+	})
+}
+
+// save adds tokens to the denylist, drops expired ones and writes the
+// file; the caller holds both locks
+func (d *Denylist) save(tokens map[string]time.Time) error {
+	now := time.Now()
+	for id, until := range d.tokens {
+		if now.After(until) {
+			delete(d.tokens, id)
+		}
+	}
+	for id, until := range tokens {
+		if id != "" && now.Before(until) {
+			d.tokens[id] = until
+		}
+	}
+
+	data, err := json.Marshal(d.tokens)
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(d.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save revoked tokens: %v", err)
+	}
+	if info, err := os.Stat(d.path); err == nil {
+		d.loaded = info
+	}
+	return nil
+}
+
+// RevokeSessions denies the tokens of deleted sessions
+func (d *Denylist) RevokeSessions(sessions []storage.SessionMeta) error {
+	tokens := make(map[string]time.Time)
+	for _, meta := range sessions {
+		tokens[meta.TokenID] = meta.TokenExpiry
+	}
+	return d.Revoke(tokens)
+}
+
+// reload reads the file when it changed since it was last read; the
+// caller holds the lock. Every write replaces the file, so a different
+// file or size shows a change even within one modification time tick.
+func (d *Denylist) reload() error {
+	info, err := os.Stat(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read revoked tokens: %v", err)
+	}
+	if d.loaded != nil && os.SameFile(info, d.loaded) && info.Size() == d.loaded.Size() && info.ModTime().Equal(d.loaded.ModTime()) {
+		return nil
+	}
+
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to read revoked tokens: %v", err)
+	}
+	tokens := make(map[string]time.Time)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("failed to parse revoked tokens: %v", err)
+	}
+	d.tokens = tokens
+	d.loaded = info
+	return nil
+}
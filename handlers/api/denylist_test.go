@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDenylistInstancesKeepEachOthersRevocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked-tokens.json")
+
+	// The server and sign-out commands, each with its own instance
+	var instances []*Denylist
+	for i := 0; i < 4; i++ {
+		d, err := NewDenylist(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, d)
+	}
+
+	until := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	for i, d := range instances {
+		wg.Add(1)
+		go func(i int, d *Denylist) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if err := d.Revoke(map[string]time.Time{fmt.Sprintf("token-%d-%d", i, j): until}); err != nil {
+					t.Errorf("Revoke: %v", err)
+				}
+			}
+		}(i, d)
+	}
+	wg.Wait()
+
+	fresh, err := NewDenylist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range instances {
+		for j := 0; j < 25; j++ {
+			id := fmt.Sprintf("token-%d-%d", i, j)
+			if !fresh.Revoked(id) {
+				t.Errorf("%s lost", id)
+			}
+		}
+	}
+}
+
+func TestDenylistReloadsWithinOneTick(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked-tokens.json")
+	d, err := NewDenylist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour)
+	if err := d.Revoke(map[string]time.Time{"token-a": until}); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Revoked("token-a") {
+		t.Fatal("token-a not revoked")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaced by another process with a file of the same size and
+	// modification time
+	data, _ := json.Marshal(map[string]time.Time{"token-b": until})
+	if err := utils.WriteFileAtomic(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if replaced, _ := os.Stat(path); replaced.Size() != info.Size() {
+		t.Fatalf("replaced file has %d bytes, want %d", replaced.Size(), info.Size())
+	}
+
+	if !d.Revoked("token-b") {
+		t.Error("change within the same modification time was missed")
+	}
+}
@@ -0,0 +1,118 @@
+// handlers/api/drafts.go
+package api
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+)
+
+// DraftsFolder returns the name of the Drafts folder, creating one when
+// the server has none
+func (c *Client) DraftsFolder() (string, error) {
+	return c.folderByRole(RoleDrafts)
+}
+
+// SaveDraft appends a draft with the \Draft and \Seen flags to the Drafts
+// folder and removes the previous version identified by replaceUID (if not
+// empty). It returns the UID of the new version.
+//
+// Without UIDPLUS the previous version is only flagged \Deleted: a plain
+// EXPUNGE on every autosave would also remove whatever else is flagged
+// \Deleted in Drafts.
+func (c *Client) SaveDraft(msg *OutgoingMessage, replaceUID string) (string, error) {
+	folder, err := c.DraftsFolder()
+	if err != nil {
+		return "", err
+	}
+
+	// A fresh Message-ID per version lets us find the new UID afterwards
+	msg.MessageID = ""
+	raw := msg.Bytes()
+
+	if err := c.AppendMessage(folder, []string{imap.DraftFlag, imap.SeenFlag}, raw); err != nil {
+		return "", err
+	}
+
+	if _, err := c.client.Select(folder, false); err != nil {
+		return "", fmt.Errorf("error selecting folder %s: %v", folder, err)
+	}
+
+	if replaceUID != "" {
+		if err := c.retireUID(replaceUID); err != nil {
+			fmt.Printf("Error removing previous draft %s: %v\n", replaceUID, err)
+		}
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-ID", "<"+msg.MessageID+">")
+	uids, err := c.client.UidSearch(criteria)
+	if err != nil {
+		return "", fmt.Errorf("error locating saved draft: %v", err)
+	}
+	if len(uids) == 0 {
+		return "", fmt.Errorf("saved draft not found")
+	}
+
+	newest := uids[0]
+	for _, uid := range uids {
+		if uid > newest {
+			newest = uid
+		}
+	}
+	return strconv.FormatUint(uint64(newest), 10), nil
+}
+
+// DeleteDraft removes a draft by UID from the Drafts folder
+func (c *Client) DeleteDraft(uid string) error {
+	folder, err := c.DraftsFolder()
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.client.Select(folder, false); err != nil {
+		return fmt.Errorf("error selecting folder %s: %v", folder, err)
+	}
+
+	return c.removeUID(uid)
+}
+
+// removeUID flags a message in the selected folder as deleted and expunges it
+func (c *Client) removeUID(uid string) error {
+	seqSet, err := c.flagDeleted(uid)
+	if err != nil {
+		return err
+	}
+	return c.expungeUIDs(seqSet)
+}
+
+// retireUID flags a message in the selected folder as deleted, and expunges
+// it only when the server can expunge single messages
+func (c *Client) retireUID(uid string) error {
+	seqSet, err := c.flagDeleted(uid)
+	if err != nil {
+		return err
+	}
+	if ok, _ := c.client.Support("UIDPLUS"); !ok {
+		return nil
+	}
+	return c.expungeUIDs(seqSet)
+}
+
+// flagDeleted adds the \Deleted flag to a message in the selected folder
+func (c *Client) flagDeleted(uid string) (*imap.SeqSet, error) {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID: %v", err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uidNum)
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.client.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return nil, fmt.Errorf("error marking message as deleted: %v", err)
+	}
+	return seqSet, nil
+}
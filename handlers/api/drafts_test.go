@@ -0,0 +1,133 @@
+package api
+
+import (
+	"lilmail/config"
+	"net"
+	"net/mail"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// newIMAPStub starts an IMAP server holding the memory backend's only user,
+// "username" with password "password". Like many servers, it lacks UIDPLUS.
+func newIMAPStub(t *testing.T) config.ConnectionProfile {
+	t.Helper()
+	imapServer := server.New(memory.New())
+	imapServer.AllowInsecureAuth = true
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go imapServer.Serve(ln)
+	t.Cleanup(func() { imapServer.Close() })
+
+	return config.ConnectionProfile{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		Security: config.SecurityNone,
+	}
+}
+
+// folderFlags returns the flags of every message in folder by UID,
+// including messages flagged \Deleted
+func folderFlags(t *testing.T, c *Client, folder string) map[uint32][]string {
+	t.Helper()
+	if _, err := c.client.Select(folder, false); err != nil {
+		t.Fatal(err)
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchFlags, imap.FetchUid}, messages)
+	}()
+	flags := make(map[uint32][]string)
+	for msg := range messages {
+		flags[msg.Uid] = msg.Flags
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
+
+func TestSaveDraftWithoutUIDPlus(t *testing.T) {
+	c, err := NewClient(newIMAPStub(t), "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, _ := c.client.Support("UIDPLUS"); ok {
+		t.Fatal("the stub server announces UIDPLUS")
+	}
+
+	folder, err := c.DraftsFolder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client deleted a message in Drafts without expunging it yet
+	other := &OutgoingMessage{From: &mail.Address{Address: "username@example.com"}, Subject: "Other", Body: "x"}
+	if err := c.AppendMessage(folder, []string{imap.DeletedFlag}, other.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	flags := folderFlags(t, c, folder)
+	if len(flags) != 1 {
+		t.Fatalf("%d messages in Drafts, want 1", len(flags))
+	}
+	var otherUID uint32
+	for uid := range flags {
+		otherUID = uid
+	}
+
+	// Two autosaves of the same draft
+	draft := &OutgoingMessage{From: &mail.Address{Address: "username@example.com"}, Subject: "Draft", Body: "first"}
+	first, err := c.SaveDraft(draft, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	draft.Body = "second"
+	second, err := c.SaveDraft(draft, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatalf("SaveDraft returned the UID of the replaced version")
+	}
+
+	flags = folderFlags(t, c, folder)
+	if _, ok := flags[otherUID]; !ok {
+		t.Error("saving a draft expunged a message it did not replace")
+	}
+	firstUID, _ := parseUID(first)
+	if !hasFlag(flags[firstUID], imap.DeletedFlag) {
+		t.Errorf("replaced draft flags = %v, want \\Deleted", flags[firstUID])
+	}
+	secondUID, _ := parseUID(second)
+	if hasFlag(flags[secondUID], imap.DeletedFlag) {
+		t.Errorf("saved draft flags = %v", flags[secondUID])
+	}
+
+	// Messages flagged \Deleted are not listed
+	emails, err := c.FetchMessages(folder, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].ID != second {
+		t.Errorf("FetchMessages listed %d messages, want only the saved draft %s", len(emails), second)
+	}
+
+	// Deleting a draft on purpose still removes it
+	if err := c.DeleteDraft(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := folderFlags(t, c, folder)[secondUID]; ok {
+		t.Error("DeleteDraft kept the draft")
+	}
+}
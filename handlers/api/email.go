@@ -3,6 +3,7 @@ package api
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"log"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/mail"
 	"regexp"
 	"strconv"
@@ -40,7 +42,14 @@ func (c *Client) FetchMessages(folderName string, limit uint32) ([]models.Email,
 	seqSet := new(imap.SeqSet)
 	seqSet.AddRange(from, mbox.Messages)
 
-	messages := make(chan *imap.Message, limit)
+	return c.fetchEmails(seqSet, false, limit)
+}
+
+// fetchEmails fetches and processes the messages in seqSet, which holds
+// UIDs when byUID is set and sequence numbers otherwise. Messages flagged
+// \Deleted but not yet expunged, such as replaced drafts, are left out.
+func (c *Client) fetchEmails(seqSet *imap.SeqSet, byUID bool, size uint32) ([]models.Email, error) {
+	messages := make(chan *imap.Message, size)
 	items := []imap.FetchItem{
 		imap.FetchEnvelope,
 		imap.FetchFlags,
@@ -51,11 +60,18 @@ func (c *Client) FetchMessages(folderName string, limit uint32) ([]models.Email,
 
 	done := make(chan error, 1)
 	go func() {
-		done <- c.client.Fetch(seqSet, items, messages)
+		if byUID {
+			done <- c.client.UidFetch(seqSet, items, messages)
+		} else {
+			done <- c.client.Fetch(seqSet, items, messages)
+		}
 	}()
 
 	var emails []models.Email
 	for msg := range messages {
+		if hasFlag(msg.Flags, imap.DeletedFlag) {
+			continue
+		}
 		email, err := c.processMessage(msg)
 		if err != nil {
 			fmt.Printf("Error processing message %d: %v\n", msg.Uid, err)
@@ -148,7 +164,7 @@ func (c *Client) DeleteMessage(folderName, uid string) error {
 	}
 
 	// Expunge to permanently remove
-	err = c.client.Expunge(nil)
+	err = c.expungeUIDs(seqSet)
 	if err != nil {
 		return fmt.Errorf("error expunging mailbox: %v", err)
 	}
@@ -295,6 +311,18 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 			}
 			email.Cc = strings.Join(ccAddresses, ", ")
 		}
+
+		// Process Reply-To addresses
+		var replyTo []string
+		for _, addr := range msg.Envelope.ReplyTo {
+			if addr != nil {
+				replyTo = append(replyTo, addr.Address())
+			}
+		}
+		email.ReplyTo = strings.Join(replyTo, ", ")
+
+		email.MessageID = msg.Envelope.MessageId
+		email.InReplyTo = msg.Envelope.InReplyTo
 	}
 
 	// Process body
@@ -317,6 +345,11 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 			return email, fmt.Errorf("error parsing message: %v", err)
 		}
 
+		email.References = m.Header.Get("References")
+		for _, key := range []string{"Delivered-To", "X-Original-To"} {
+			email.DeliveredTo = append(email.DeliveredTo, m.Header[key]...)
+		}
+
 		// Debug content type
 		contentType := m.Header.Get("Content-Type")
 		log.Printf("Content-Type: %s", contentType)
@@ -360,7 +393,7 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 			}
 		} else {
 			// Handle non-multipart messages
-			bodyData, err := ioutil.ReadAll(m.Body)
+			bodyData, err := ioutil.ReadAll(decodeTransferEncoding(m.Body, m.Header.Get("Content-Transfer-Encoding")))
 			if err == nil {
 				email.Body = string(bodyData)
 				log.Printf("Non-multipart body: %d bytes", len(email.Body))
@@ -390,6 +423,18 @@ func (c *Client) processMessage(msg *imap.Message) (models.Email, error) {
 	return email, nil
 }
 
+// decodeTransferEncoding undoes a quoted-printable or base64
+// Content-Transfer-Encoding; other encodings are passed through
+func decodeTransferEncoding(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	return r
+}
+
 // Simple HTML tag stripping
 func stripHTML(html string) string {
 	var builder strings.Builder
@@ -513,3 +558,13 @@ func (c *Client) getMessageBody(msg *imap.Message, wantHTML bool) string {
 	body, _ := findSection(msg.BodyStructure, nil)
 	return body
 }
+
+// hasFlag reports whether flags holds flag; system flags ignore case
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
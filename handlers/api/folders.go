@@ -0,0 +1,196 @@
+// handlers/api/folders.go
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// ErrProtectedFolder is returned when renaming or deleting INBOX or a
+// folder with a role such as Sent or Trash
+var ErrProtectedFolder = errors.New("folder cannot be renamed or deleted")
+
+// FetchFolders retrieves all mailbox folders and marks the subscribed ones
+func (c *Client) FetchFolders() ([]*MailboxInfo, error) {
+	mailboxes, err := c.list(false)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching folders: %v", err)
+	}
+
+	subscribed, err := c.list(true)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching subscriptions: %v", err)
+	}
+	names := make(map[string]bool, len(subscribed))
+	for _, mb := range subscribed {
+		names[mb.Name] = true
+	}
+	for _, mb := range mailboxes {
+		mb.Subscribed = names[mb.Name] || strings.EqualFold(mb.Name, "INBOX")
+	}
+	AssignRoles(mailboxes)
+
+	return mailboxes, nil
+}
+
+// list runs LIST, or LSUB for subscribed folders only
+func (c *Client) list(subscribed bool) ([]*MailboxInfo, error) {
+	mailboxChan := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		if subscribed {
+			done <- c.client.Lsub("", "*", mailboxChan)
+		} else {
+			done <- c.client.List("", "*", mailboxChan)
+		}
+	}()
+
+	var mailboxes []*MailboxInfo
+	for mb := range mailboxChan {
+		mailboxes = append(mailboxes, &MailboxInfo{
+			Name:       mb.Name,
+			Delimiter:  mb.Delimiter,
+			Attributes: mb.Attributes,
+		})
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return mailboxes, nil
+}
+
+// SubscribedFolders keeps the subscribed folders only. INBOX is always kept.
+func SubscribedFolders(folders []*MailboxInfo) []*MailboxInfo {
+	var subscribed []*MailboxInfo
+	for _, mb := range folders {
+		if mb.Subscribed || strings.EqualFold(mb.Name, "INBOX") {
+			subscribed = append(subscribed, mb)
+		}
+	}
+	return subscribed
+}
+
+// IsProtectedFolder reports whether name is INBOX or a folder with a role
+// such as Drafts, Sent or Trash
+func IsProtectedFolder(folders []*MailboxInfo, name string) bool {
+	if strings.EqualFold(name, "INBOX") {
+		return true
+	}
+	for _, mb := range folders {
+		if mb.Name == name && mb.Role != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateFolder creates a folder, below parent when it is not empty, and
+// subscribes to it
+func (c *Client) CreateFolder(parent, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("folder name is required")
+	}
+
+	if parent != "" {
+		delimiter, err := c.delimiter(parent)
+		if err != nil {
+			return "", err
+		}
+		name = parent + delimiter + name
+	}
+
+	if err := c.client.Create(name); err != nil {
+		return "", fmt.Errorf("error creating folder %s: %v", name, err)
+	}
+	if err := c.client.Subscribe(name); err != nil {
+		return "", fmt.Errorf("error subscribing to %s: %v", name, err)
+	}
+	return name, nil
+}
+
+// RenameFolder renames a folder that is not protected, keeping its
+// subscription
+func (c *Client) RenameFolder(oldName, newName string) error {
+	newName = strings.TrimSpace(newName)
+	if newName == "" {
+		return fmt.Errorf("folder name is required")
+	}
+
+	folders, err := c.FetchFolders()
+	if err != nil {
+		return err
+	}
+	if IsProtectedFolder(folders, oldName) {
+		return ErrProtectedFolder
+	}
+
+	if err := c.client.Rename(oldName, newName); err != nil {
+		return fmt.Errorf("error renaming folder %s: %v", oldName, err)
+	}
+
+	for _, mb := range folders {
+		if mb.Name == oldName && mb.Subscribed {
+			// Not every server moves subscriptions along with the folder
+			c.client.Unsubscribe(oldName)
+			if err := c.client.Subscribe(newName); err != nil {
+				return fmt.Errorf("error subscribing to %s: %v", newName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteFolder deletes a folder that is not protected and drops its
+// subscription
+func (c *Client) DeleteFolder(name string) error {
+	folders, err := c.FetchFolders()
+	if err != nil {
+		return err
+	}
+	if IsProtectedFolder(folders, name) {
+		return ErrProtectedFolder
+	}
+
+	if err := c.client.Delete(name); err != nil {
+		return fmt.Errorf("error deleting folder %s: %v", name, err)
+	}
+	c.client.Unsubscribe(name)
+	return nil
+}
+
+// SetSubscribed subscribes to or unsubscribes from a folder
+func (c *Client) SetSubscribed(name string, subscribed bool) error {
+	var err error
+	if subscribed {
+		err = c.client.Subscribe(name)
+	} else {
+		err = c.client.Unsubscribe(name)
+	}
+	if err != nil {
+		return fmt.Errorf("error updating subscription of %s: %v", name, err)
+	}
+	return nil
+}
+
+// delimiter returns the hierarchy delimiter used below a folder
+func (c *Client) delimiter(name string) (string, error) {
+	folders, err := c.list(false)
+	if err != nil {
+		return "", fmt.Errorf("error fetching folders: %v", err)
+	}
+	for _, mb := range folders {
+		if mb.Name == name {
+			if mb.Delimiter == "" {
+				return "", fmt.Errorf("folder %s cannot have subfolders", name)
+			}
+			return mb.Delimiter, nil
+		}
+	}
+	return "", fmt.Errorf("folder %s not found", name)
+}
@@ -0,0 +1,95 @@
+// handlers/api/keywords.go
+package api
+
+import (
+	"errors"
+	"fmt"
+	"lilmail/models"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// ErrKeywordsUnsupported is returned when a folder does not accept custom
+// keywords, as announced by PERMANENTFLAGS
+var ErrKeywordsUnsupported = errors.New("folder does not allow custom keywords")
+
+// keywordAllowed reports whether keyword can be stored permanently in the
+// selected folder: PERMANENTFLAGS lists it or contains \*. Servers that send
+// no PERMANENTFLAGS at all are given the benefit of the doubt.
+func keywordAllowed(mbox *imap.MailboxStatus, keyword string) bool {
+	if len(mbox.PermanentFlags) == 0 {
+		return true
+	}
+	for _, flag := range mbox.PermanentFlags {
+		if flag == imap.TryCreateFlag || strings.EqualFold(flag, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetKeyword adds keyword to (or removes it from) the messages with the
+// given UIDs
+func (c *Client) SetKeyword(folderName string, uids []string, keyword string, add bool) error {
+	seqSet := new(imap.SeqSet)
+	for _, uid := range uids {
+		uidNum, err := parseUID(uid)
+		if err != nil {
+			return fmt.Errorf("invalid UID: %v", err)
+		}
+		seqSet.AddNum(uidNum)
+	}
+	if seqSet.Empty() {
+		return fmt.Errorf("no messages given")
+	}
+
+	mbox, err := c.client.Select(folderName, false)
+	if err != nil {
+		return fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+	// Removing is always attempted so stale keywords can be cleaned up
+	if add && !keywordAllowed(mbox, keyword) {
+		return ErrKeywordsUnsupported
+	}
+
+	var operation imap.FlagsOp
+	if add {
+		operation = imap.AddFlags
+	} else {
+		operation = imap.RemoveFlags
+	}
+	item := imap.FormatFlagsOp(operation, true)
+	if err := c.client.UidStore(seqSet, item, []interface{}{keyword}, nil); err != nil {
+		return fmt.Errorf("error setting keyword: %v", err)
+	}
+	return nil
+}
+
+// FetchMessagesWithKeyword retrieves the newest messages of a folder that
+// carry keyword
+func (c *Client) FetchMessagesWithKeyword(folderName, keyword string, limit uint32) ([]models.Email, error) {
+	if _, err := c.client.Select(folderName, false); err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{keyword}
+	uids, err := c.client.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("error searching folder %s: %v", folderName, err)
+	}
+	if len(uids) == 0 {
+		return []models.Email{}, nil
+	}
+
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if uint32(len(uids)) > limit {
+		uids = uids[uint32(len(uids))-limit:]
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	return c.fetchEmails(seqSet, true, limit)
+}
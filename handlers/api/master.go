@@ -0,0 +1,22 @@
+// handlers/api/master.go
+package api
+
+import (
+	"lilmail/config"
+
+	"github.com/emersion/go-sasl"
+)
+
+// masterClient returns the SASL client logging the profile's master user in
+// to email's mailbox, or nil unless the profile asks for a master login
+func masterClient(profile config.ConnectionProfile, email string) sasl.Client {
+	master := profile.Master
+	if profile.AuthMechanism != config.AuthMaster || master == nil {
+		return nil
+	}
+
+	if master.Mode == config.MasterAuthzid {
+		return sasl.NewPlainClient(email, master.User, master.Password)
+	}
+	return sasl.NewPlainClient("", email+master.Separator+master.User, master.Password)
+}
@@ -0,0 +1,171 @@
+// handlers/api/message.go
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OutgoingMessage holds the parts of a message written by the user. Bytes
+// turns it into an RFC 5322 message.
+type OutgoingMessage struct {
+	From       *mail.Address
+	To         []*mail.Address
+	Cc         []*mail.Address
+	ReplyTo    []*mail.Address
+	Subject    string
+	Body       string
+	HTMLBody   string // Optional; sent as multipart/alternative with Body
+	Date       time.Time
+	MessageID  string // Without angle brackets; generated when empty
+	InReplyTo  string
+	References string
+	Headers    map[string]string // Additional headers such as X-Mailer
+}
+
+// ParseAddressList parses a comma separated list of addresses. An empty
+// string yields an empty list.
+func ParseAddressList(list string) ([]*mail.Address, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address list %q: %v", list, err)
+	}
+	return addrs, nil
+}
+
+// FormatAddressList renders addresses for display or for a form field
+func FormatAddressList(addrs []*mail.Address) string {
+	parts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Name != "" {
+			parts = append(parts, addr.String())
+		} else {
+			parts = append(parts, addr.Address)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Bytes renders the message with CRLF line endings, quoted-printable UTF-8
+// text (and HTML) bodies and encoded headers. Missing Date and Message-ID headers
+// are filled in on the message itself so repeated calls return the same bytes.
+func (m *OutgoingMessage) Bytes() []byte {
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+	if m.MessageID == "" {
+		from := ""
+		if m.From != nil {
+			from = m.From.Address
+		}
+		m.MessageID = NewMessageID(from)
+	}
+
+	var buf bytes.Buffer
+	writeHeader := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, sanitizeHeader(value))
+	}
+
+	writeHeader("Date", m.Date.Format(time.RFC1123Z))
+	if m.From != nil {
+		writeHeader("From", m.From.String())
+	}
+	if len(m.To) > 0 {
+		writeHeader("To", joinAddresses(m.To))
+	}
+	if len(m.Cc) > 0 {
+		writeHeader("Cc", joinAddresses(m.Cc))
+	}
+	if len(m.ReplyTo) > 0 {
+		writeHeader("Reply-To", joinAddresses(m.ReplyTo))
+	}
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	writeHeader("Message-ID", "<"+m.MessageID+">")
+	if m.InReplyTo != "" {
+		writeHeader("In-Reply-To", m.InReplyTo)
+	}
+	if m.References != "" {
+		writeHeader("References", m.References)
+	}
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(name, m.Headers[name])
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	if m.HTMLBody == "" {
+		writeHeader("Content-Type", "text/plain; charset=\"utf-8\"")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writeQuotedPrintable(&buf, m.Body)
+		return buf.Bytes()
+	}
+
+	// Derived from the Message-ID so the rendering stays stable
+	sum := sha256.Sum256([]byte(m.MessageID))
+	boundary := "lilmail-" + hex.EncodeToString(sum[:12])
+	writeHeader("Content-Type", fmt.Sprintf("multipart/alternative; boundary=\"%s\"", boundary))
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ mediaType, content string }{
+		{"text/plain", m.Body},
+		{"text/html", m.HTMLBody},
+	} {
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=\"utf-8\"\r\n", part.mediaType)
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&buf, part.content)
+		buf.WriteString("\r\n")
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
+
+// writeQuotedPrintable encodes text with CRLF line endings
+func writeQuotedPrintable(buf *bytes.Buffer, text string) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+
+	qp := quotedprintable.NewWriter(buf)
+	qp.Write([]byte(text))
+	qp.Close()
+}
+
+// Recipients returns the envelope recipients of the message
+func (m *OutgoingMessage) Recipients() []string {
+	var rcpts []string
+	for _, list := range [][]*mail.Address{m.To, m.Cc} {
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return rcpts
+}
+
+func joinAddresses(addrs []*mail.Address) string {
+	parts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		parts = append(parts, addr.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// sanitizeHeader prevents header injection through user supplied values
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,251 @@
+// handlers/api/quota.go
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// ErrQuotaUnsupported is returned when the server lacks the QUOTA extension
+var ErrQuotaUnsupported = errors.New("server does not support quotas")
+
+// Quota is the STORAGE resource of the quota root of INBOX (RFC 9208).
+// Sizes are in bytes; the server reports them in units of 1024 octets.
+type Quota struct {
+	Root  string `json:"root"`
+	Used  int64  `json:"used"`
+	Limit int64  `json:"limit"`
+}
+
+// Percent returns the used share of the limit, from 0 to 100
+func (q *Quota) Percent() int {
+	if q.Limit <= 0 {
+		return 0
+	}
+	p := int(q.Used * 100 / q.Limit)
+	if p > 100 {
+		p = 100
+	}
+	return p
+}
+
+// getQuotaRoot is the GETQUOTAROOT command
+type getQuotaRoot struct {
+	Mailbox string
+}
+
+func (cmd *getQuotaRoot) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "GETQUOTAROOT",
+		Arguments: []interface{}{imap.FormatMailboxName(cmd.Mailbox)},
+	}
+}
+
+// Quota returns the storage quota of the mailbox. Servers may report
+// several quota roots; the first one with a STORAGE limit is used.
+func (c *Client) Quota() (*Quota, error) {
+	if ok, err := c.client.Support("QUOTA"); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrQuotaUnsupported
+	}
+
+	var quotas []*Quota
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok {
+			return responses.ErrUnhandled
+		}
+		switch name {
+		case "QUOTAROOT":
+			return nil
+		case "QUOTA":
+			quota, err := parseQuota(fields)
+			if err != nil {
+				return err
+			}
+			if quota != nil {
+				quotas = append(quotas, quota)
+			}
+			return nil
+		}
+		return responses.ErrUnhandled
+	})
+
+	status, err := c.client.Execute(&getQuotaRoot{Mailbox: "INBOX"}, handler)
+	if err != nil {
+		return nil, fmt.Errorf("error getting quota: %v", err)
+	}
+	if err := status.Err(); err != nil {
+		return nil, fmt.Errorf("error getting quota: %v", err)
+	}
+
+	if len(quotas) == 0 {
+		return nil, ErrQuotaUnsupported
+	}
+	return quotas[0], nil
+}
+
+// parseQuota reads `"root" (STORAGE used limit ...)`. It returns nil when
+// the root has no STORAGE resource.
+func parseQuota(fields []interface{}) (*Quota, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid QUOTA response")
+	}
+	root, err := imap.ParseString(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid quota root: %v", err)
+	}
+	resources, ok := fields[1].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid quota resource list")
+	}
+
+	for i := 0; i+2 < len(resources); i += 3 {
+		name, err := imap.ParseString(resources[i])
+		if err != nil || !strings.EqualFold(name, "STORAGE") {
+			continue
+		}
+		used, err := parseSize(resources[i+1])
+		if err != nil {
+			return nil, err
+		}
+		limit, err := parseSize(resources[i+2])
+		if err != nil {
+			return nil, err
+		}
+		return &Quota{Root: root, Used: used * 1024, Limit: limit * 1024}, nil
+	}
+	return nil, nil
+}
+
+// parseSize reads a number that may not fit in 32 bits
+func parseSize(f interface{}) (int64, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quota value: %v", err)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quota value %q: %v", s, err)
+	}
+	return n, nil
+}
+
+// LargeMessage is an entry of the largest messages view
+type LargeMessage struct {
+	Folder  string    `json:"folder"`
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	From    string    `json:"from"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+}
+
+// LargestMessages returns the limit largest messages of the given folders.
+// Sizes come from RFC822.SIZE, so only the winners' envelopes are fetched.
+func (c *Client) LargestMessages(folders []string, limit int) ([]LargeMessage, error) {
+	var largest []LargeMessage
+	for _, folder := range folders {
+		found, err := c.messageSizes(folder)
+		if err != nil {
+			return nil, err
+		}
+		largest = append(largest, found...)
+		sort.Slice(largest, func(i, j int) bool { return largest[i].Size > largest[j].Size })
+		if len(largest) > limit {
+			largest = largest[:limit]
+		}
+	}
+
+	byFolder := make(map[string][]int)
+	for i, msg := range largest {
+		byFolder[msg.Folder] = append(byFolder[msg.Folder], i)
+	}
+	for folder, indexes := range byFolder {
+		if err := c.fillEnvelopes(folder, largest, indexes); err != nil {
+			return nil, err
+		}
+	}
+	return largest, nil
+}
+
+// messageSizes lists the UID and size of every message in a folder
+func (c *Client) messageSizes(folder string) ([]LargeMessage, error) {
+	mbox, err := c.client.Select(folder, true)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folder, err)
+	}
+	if mbox.Messages == 0 {
+		return nil, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, mbox.Messages)
+
+	messages := make(chan *imap.Message, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.client.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}, messages)
+	}()
+
+	var sizes []LargeMessage
+	for msg := range messages {
+		sizes = append(sizes, LargeMessage{
+			Folder: folder,
+			ID:     strconv.FormatUint(uint64(msg.Uid), 10),
+			Size:   int64(msg.Size),
+		})
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("error fetching sizes in %s: %v", folder, err)
+	}
+	return sizes, nil
+}
+
+// fillEnvelopes sets From and Subject of the listed entries of one folder
+func (c *Client) fillEnvelopes(folder string, list []LargeMessage, indexes []int) error {
+	if _, err := c.client.Select(folder, true); err != nil {
+		return fmt.Errorf("error selecting folder %s: %v", folder, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	byUID := make(map[string]int)
+	for _, i := range indexes {
+		uid, err := parseUID(list[i].ID)
+		if err != nil {
+			return err
+		}
+		seqSet.AddNum(uid)
+		byUID[list[i].ID] = i
+	}
+
+	messages := make(chan *imap.Message, len(indexes))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+	}()
+
+	for msg := range messages {
+		i, ok := byUID[strconv.FormatUint(uint64(msg.Uid), 10)]
+		if !ok || msg.Envelope == nil {
+			continue
+		}
+		list[i].Subject = msg.Envelope.Subject
+		list[i].Date = msg.Envelope.Date
+		if len(msg.Envelope.From) > 0 && msg.Envelope.From[0] != nil {
+			list[i].From = msg.Envelope.From[0].Address()
+		}
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("error fetching envelopes in %s: %v", folder, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// handlers/api/reply.go
+package api
+
+import (
+	"fmt"
+	"lilmail/models"
+	"strings"
+)
+
+// Reply holds the compose fields prefilled when answering a message
+type Reply struct {
+	To         string
+	Cc         string
+	Subject    string
+	Body       string
+	InReplyTo  string
+	References string
+}
+
+// NewReply prepares an answer to email. isOwn reports whether an address
+// belongs to the user; those addresses are never added as recipients, and
+// answering one's own message goes to its original recipients. With all
+// set, the other recipients of email are copied.
+func NewReply(email models.Email, isOwn func(address string) bool, all bool) Reply {
+	to := splitAddresses(email.ReplyTo)
+	if len(to) == 0 {
+		to = splitAddresses(email.From)
+	}
+
+	others := append(splitAddresses(email.To), splitAddresses(email.Cc)...)
+	if isOwn(email.From) {
+		to = splitAddresses(email.To)
+		others = splitAddresses(email.Cc)
+	}
+
+	var cc []string
+	if all {
+		seen := make(map[string]bool)
+		for _, addr := range to {
+			seen[strings.ToLower(addr)] = true
+		}
+		for _, addr := range others {
+			key := strings.ToLower(addr)
+			if seen[key] || isOwn(addr) {
+				continue
+			}
+			seen[key] = true
+			cc = append(cc, addr)
+		}
+	}
+
+	references := strings.TrimSpace(email.References + " " + email.MessageID)
+
+	return Reply{
+		To:         strings.Join(to, ", "),
+		Cc:         strings.Join(cc, ", "),
+		Subject:    replySubject(email.Subject),
+		Body:       quoteBody(email),
+		InReplyTo:  email.MessageID,
+		References: references,
+	}
+}
+
+// NewForward prepares the subject and body for forwarding email inline.
+// The recipients are left empty.
+func NewForward(email models.Email) Reply {
+	subject := email.Subject
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(subject)), "fwd:") {
+		subject = "Fwd: " + subject
+	}
+
+	text := email.Body
+	if strings.TrimSpace(text) == "" && email.HTML != "" {
+		text = html2text(string(email.HTML))
+	}
+
+	var b strings.Builder
+	b.WriteString("\n\n---------- Forwarded message ----------\n")
+	fmt.Fprintf(&b, "From: %s\n", email.From)
+	fmt.Fprintf(&b, "Date: %s\n", email.Date.Format("Jan 02, 2006 15:04"))
+	fmt.Fprintf(&b, "Subject: %s\n", email.Subject)
+	fmt.Fprintf(&b, "To: %s\n", email.To)
+	if email.Cc != "" {
+		fmt.Fprintf(&b, "Cc: %s\n", email.Cc)
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.ReplaceAll(strings.TrimSpace(text), "\r\n", "\n"))
+	b.WriteString("\n")
+
+	return Reply{
+		Subject:    subject,
+		Body:       b.String(),
+		References: strings.TrimSpace(email.References + " " + email.MessageID),
+	}
+}
+
+func replySubject(subject string) string {
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(subject)), "re:") {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// quoteBody returns the text of email prefixed with an attribution line
+// and "> " quote markers
+func quoteBody(email models.Email) string {
+	text := email.Body
+	if strings.TrimSpace(text) == "" && email.HTML != "" {
+		text = html2text(string(email.HTML))
+	}
+	text = strings.ReplaceAll(strings.TrimSpace(text), "\r\n", "\n")
+
+	var b strings.Builder
+	b.WriteString("\n\n")
+	fmt.Fprintf(&b, "On %s, %s wrote:\n", email.Date.Format("Jan 02, 2006 15:04"), email.From)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, ">") {
+			b.WriteString(">" + line + "\n")
+		} else {
+			b.WriteString("> " + line + "\n")
+		}
+	}
+	return b.String()
+}
+
+func splitAddresses(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,144 @@
+// handlers/api/roles.go
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Folder roles, from RFC 6154 SPECIAL-USE attributes or guessed from names
+const (
+	RoleInbox   = "inbox"
+	RoleDrafts  = "drafts"
+	RoleSent    = "sent"
+	RoleArchive = "archive"
+	RoleAll     = "all"
+	RoleJunk    = "junk"
+	RoleTrash   = "trash"
+)
+
+// Roles lists the folder roles in sidebar order
+var Roles = []string{RoleInbox, RoleDrafts, RoleSent, RoleArchive, RoleAll, RoleJunk, RoleTrash}
+
+// roleAttrs maps SPECIAL-USE attributes, and the XLIST attributes of older
+// Gmail servers, to roles
+var roleAttrs = map[string]string{
+	imap.DraftsAttr:  RoleDrafts,
+	imap.SentAttr:    RoleSent,
+	imap.ArchiveAttr: RoleArchive,
+	imap.AllAttr:     RoleAll,
+	imap.JunkAttr:    RoleJunk,
+	imap.TrashAttr:   RoleTrash,
+	`\Inbox`:         RoleInbox,
+	`\AllMail`:       RoleAll,
+	`\Spam`:          RoleJunk,
+}
+
+// roleNames are well-known folder names, tried when no folder carries the
+// attribute of a role. The first name is created when a role is required
+// but missing.
+var roleNames = map[string][]string{
+	RoleDrafts:  {"Drafts", "Draft", "Brouillons", "Entwürfe"},
+	RoleSent:    {"Sent", "Sent Items", "Sent Mail", "Sent Messages", "Gesendet", "Envoyés"},
+	RoleArchive: {"Archive", "Archives", "Archiv"},
+	RoleAll:     {"All Mail"},
+	RoleJunk:    {"Junk", "Spam", "Junk Mail", "Junk E-mail", "Bulk Mail"},
+	RoleTrash:   {"Trash", "Deleted Items", "Deleted Messages", "Deleted", "Bin", "Papierkorb", "Corbeille"},
+}
+
+// AssignRoles sets the Role of each folder. Every role is given to at most
+// one folder: the one with the matching attribute, otherwise the first
+// folder whose name (or last path component) is a well-known name.
+func AssignRoles(folders []*MailboxInfo) {
+	taken := make(map[string]bool)
+	for _, mb := range folders {
+		mb.Role = ""
+		if strings.EqualFold(mb.Name, "INBOX") {
+			mb.Role = RoleInbox
+			taken[RoleInbox] = true
+		}
+	}
+
+	for _, mb := range folders {
+		if mb.Role != "" {
+			continue
+		}
+	attrs:
+		for _, attr := range mb.Attributes {
+			for special, role := range roleAttrs {
+				if strings.EqualFold(attr, special) && !taken[role] {
+					mb.Role = role
+					taken[role] = true
+					break attrs
+				}
+			}
+		}
+	}
+
+	for _, role := range Roles {
+		if taken[role] {
+			continue
+		}
+		for _, name := range roleNames[role] {
+			if mb := findByName(folders, name); mb != nil {
+				mb.Role = role
+				taken[role] = true
+				break
+			}
+		}
+	}
+}
+
+// findByName matches a top-level folder or a direct child of INBOX
+// (INBOX.Sent on Courier-style servers) without a role yet
+func findByName(folders []*MailboxInfo, name string) *MailboxInfo {
+	for _, mb := range folders {
+		if mb.Role != "" {
+			continue
+		}
+		leaf := mb.Name
+		if mb.Delimiter != "" && strings.HasPrefix(strings.ToUpper(leaf), "INBOX"+mb.Delimiter) {
+			leaf = leaf[len("INBOX"+mb.Delimiter):]
+		}
+		if strings.EqualFold(leaf, name) {
+			return mb
+		}
+	}
+	return nil
+}
+
+// FolderByRole returns the name of the folder with the given role, or an
+// empty string
+func FolderByRole(folders []*MailboxInfo, role string) string {
+	for _, mb := range folders {
+		if mb.Role == role {
+			return mb.Name
+		}
+	}
+	return ""
+}
+
+// folderByRole looks up a folder on the server. When the server has none,
+// a folder with the role's usual name is created.
+func (c *Client) folderByRole(role string) (string, error) {
+	folders, err := c.FetchFolders()
+	if err != nil {
+		return "", err
+	}
+
+	if name := FolderByRole(folders, role); name != "" {
+		return name, nil
+	}
+
+	names := roleNames[role]
+	if len(names) == 0 {
+		return "", fmt.Errorf("no %s folder found", role)
+	}
+	if err := c.client.Create(names[0]); err != nil {
+		return "", fmt.Errorf("error creating %s folder: %v", names[0], err)
+	}
+	c.client.Subscribe(names[0])
+	return names[0], nil
+}
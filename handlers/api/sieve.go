@@ -0,0 +1,567 @@
+// handlers/api/sieve.go
+package api
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// sieveTimeout bounds each ManageSieve command and each step of logging in
+var sieveTimeout = 30 * time.Second
+
+// checkScriptPrefix starts the name of the temporary script uploaded and
+// removed again to validate a script on servers predating CHECKSCRIPT
+const checkScriptPrefix = "lilmail-check-"
+
+// maxSieveLiteral bounds the literals read from the server, far above the
+// size of any script a server accepts
+const maxSieveLiteral = 1 << 20
+
+// SieveScript is a script stored on the server
+type SieveScript struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+// SieveError is a NO or BYE response. For PUTSCRIPT and CHECKSCRIPT the
+// message holds the errors found in the script.
+type SieveError struct {
+	Code    string // Response code such as QUOTA or NONEXISTENT, may be empty
+	Message string
+}
+
+func (e *SieveError) Error() string {
+	if e.Message == "" {
+		return "ManageSieve command failed"
+	}
+	return e.Message
+}
+
+// SieveClient speaks ManageSieve (RFC 5804) to upload and activate the
+// Sieve scripts that filter mail on the server
+type SieveClient struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	capabilities map[string]string
+}
+
+// Token kinds of a ManageSieve response line
+const (
+	sieveAtom = iota
+	sieveString
+	sieveCode // Parenthesised response code, stored without the parentheses
+)
+
+type sieveToken struct {
+	kind int
+	text string
+}
+
+// sieveStatus is the final OK of a command
+type sieveStatus struct {
+	code    string
+	message string
+}
+
+// NewSieveClient connects and logs in using the resolved connection profile
+func NewSieveClient(profile config.ConnectionProfile, email, password string) (*SieveClient, error) {
+	dialer := &net.Dialer{Timeout: sieveTimeout}
+	var conn net.Conn
+	var err error
+	if profile.Security == config.SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", profile.Address(), profile.TLSConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", profile.Address())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connection error: %v", err)
+	}
+
+	c := &SieveClient{}
+	c.attach(conn)
+
+	// The greeting is an unsolicited capability response
+	if err := c.withDeadline(c.readCapabilities); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connection error: %v", err)
+	}
+
+	if profile.Security == config.SecurityStartTLS {
+		if err := c.withDeadline(func() error { return c.startTLS(profile.TLSConfig()) }); err != nil {
+			c.conn.Close()
+			return nil, fmt.Errorf("starttls failed: %v", err)
+		}
+	}
+
+	client := bearerClient(profile, email, password)
+	if client == nil {
+		client = masterClient(profile, email)
+	}
+	switch {
+	case client != nil:
+	case profile.AuthMechanism == config.AuthLogin && c.supportsSASL(sasl.Login):
+		client = sasl.NewLoginClient(email, password)
+	default:
+		client = sasl.NewPlainClient("", email, password)
+	}
+	if err := c.withDeadline(func() error { return c.authenticate(client) }); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+
+	return c, nil
+}
+
+// Close logs out and closes the connection
+func (c *SieveClient) Close() error {
+	c.command("LOGOUT")
+	return c.conn.Close()
+}
+
+// Extensions returns the Sieve extensions supported by the server, such
+// as fileinto or vacation
+func (c *SieveClient) Extensions() []string {
+	return strings.Fields(c.capabilities["SIEVE"])
+}
+
+// HasExtension reports whether the server supports a Sieve extension
+func (c *SieveClient) HasExtension(name string) bool {
+	for _, ext := range c.Extensions() {
+		if strings.EqualFold(ext, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Implementation returns the server software name, when announced
+func (c *SieveClient) Implementation() string {
+	return c.capabilities["IMPLEMENTATION"]
+}
+
+// ListScripts returns the scripts of the user
+func (c *SieveClient) ListScripts() ([]SieveScript, error) {
+	data, _, err := c.command("LISTSCRIPTS")
+	if err != nil {
+		return nil, fmt.Errorf("error listing scripts: %v", err)
+	}
+
+	scripts := []SieveScript{}
+	for _, rec := range data {
+		if len(rec) == 0 || rec[0].kind != sieveString {
+			continue
+		}
+		script := SieveScript{Name: rec[0].text}
+		if len(rec) > 1 && rec[1].kind == sieveAtom && strings.EqualFold(rec[1].text, "ACTIVE") {
+			script.Active = true
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+// GetScript returns the content of a script with LF line endings
+func (c *SieveClient) GetScript(name string) (string, error) {
+	data, _, err := c.command("GETSCRIPT", sieveQuote(name))
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 || len(data[0]) == 0 || data[0][0].kind != sieveString {
+		return "", fmt.Errorf("empty GETSCRIPT response")
+	}
+	return strings.ReplaceAll(data[0][0].text, "\r\n", "\n"), nil
+}
+
+// CheckScript validates a script without storing it and returns the
+// server's warnings, if any. A script with errors yields a *SieveError.
+func (c *SieveClient) CheckScript(content string) (string, error) {
+	if _, ok := c.capabilities["VERSION"]; !ok {
+		name, err := c.unusedScriptName()
+		if err != nil {
+			return "", err
+		}
+		warnings, err := c.PutScript(name, content)
+		if err != nil {
+			return "", err
+		}
+		return warnings, c.DeleteScript(name)
+	}
+
+	_, status, err := c.command("CHECKSCRIPT", sieveQuote(toCRLF(content)))
+	if err != nil {
+		return "", err
+	}
+	return status.warnings(), nil
+}
+
+// PutScript stores a script, replacing one with the same name. The server
+// validates it first and returns its warnings, if any.
+func (c *SieveClient) PutScript(name, content string) (string, error) {
+	_, status, err := c.command("PUTSCRIPT", sieveQuote(name), sieveQuote(toCRLF(content)))
+	if err != nil {
+		return "", err
+	}
+	return status.warnings(), nil
+}
+
+// SetActive makes a script the active one. An empty name deactivates all
+// scripts.
+func (c *SieveClient) SetActive(name string) error {
+	_, _, err := c.command("SETACTIVE", sieveQuote(name))
+	return err
+}
+
+// DeleteScript removes a script. The server refuses to delete the active
+// script.
+func (c *SieveClient) DeleteScript(name string) error {
+	_, _, err := c.command("DELETESCRIPT", sieveQuote(name))
+	return err
+}
+
+// Helper methods
+
+// unusedScriptName picks a random name for the temporary script that no
+// script of the user has, so checking never replaces one of them
+func (c *SieveClient) unusedScriptName() (string, error) {
+	scripts, err := c.ListScripts()
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to generate script name: %v", err)
+		}
+		name := checkScriptPrefix + hex.EncodeToString(b)
+		taken := false
+		for _, script := range scripts {
+			taken = taken || script.Name == name
+		}
+		if !taken {
+			return name, nil
+		}
+	}
+	return "", errors.New("no free name for checking the script")
+}
+
+func (c *SieveClient) attach(conn net.Conn) {
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	c.w = bufio.NewWriter(conn)
+}
+
+func (c *SieveClient) startTLS(tlsConfig *tls.Config) error {
+	if _, ok := c.capabilities["STARTTLS"]; !ok {
+		return fmt.Errorf("server does not offer STARTTLS")
+	}
+	if _, _, err := c.command("STARTTLS"); err != nil {
+		return err
+	}
+
+	// command clears its deadline; the handshake needs one of its own
+	c.conn.SetDeadline(time.Now().Add(sieveTimeout))
+	conn := tls.Client(c.conn, tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.attach(conn)
+
+	// Capabilities are sent again, as they may differ over TLS
+	return c.readCapabilities()
+}
+
+func (c *SieveClient) readCapabilities() error {
+	data, _, err := c.readResponse()
+	if err != nil {
+		return err
+	}
+
+	c.capabilities = make(map[string]string)
+	for _, rec := range data {
+		if len(rec) == 0 {
+			continue
+		}
+		value := ""
+		if len(rec) > 1 {
+			value = rec[1].text
+		}
+		c.capabilities[strings.ToUpper(rec[0].text)] = value
+	}
+	return nil
+}
+
+func (c *SieveClient) supportsSASL(mech string) bool {
+	for _, m := range strings.Fields(c.capabilities["SASL"]) {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SieveClient) authenticate(client sasl.Client) error {
+	mech, ir, err := client.Start()
+	if err != nil {
+		return err
+	}
+
+	line := "AUTHENTICATE " + sieveQuote(mech)
+	if ir != nil {
+		line += " " + sieveQuote(base64.StdEncoding.EncodeToString(ir))
+	}
+	if err := c.writeLine(line); err != nil {
+		return err
+	}
+
+	for {
+		rec, err := c.readRecord()
+		if err != nil {
+			return err
+		}
+		if len(rec) == 0 || rec[0].kind != sieveString {
+			_, err := parseStatus(rec)
+			return err
+		}
+
+		// A server challenge, answered with a base64 string line
+		challenge, err := base64.StdEncoding.DecodeString(rec[0].text)
+		if err != nil {
+			return fmt.Errorf("invalid SASL challenge: %v", err)
+		}
+		response, err := client.Next(challenge)
+		if err != nil {
+			c.writeLine(`"*"`)
+			return err
+		}
+		if err := c.writeLine(sieveQuote(base64.StdEncoding.EncodeToString(response))); err != nil {
+			return err
+		}
+	}
+}
+
+// withDeadline runs one step of setting up the connection, so that a
+// server that stops answering cannot block it forever
+func (c *SieveClient) withDeadline(step func() error) error {
+	c.conn.SetDeadline(time.Now().Add(sieveTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	return step()
+}
+
+// command sends a command and reads its response lines up to the final
+// OK, NO or BYE
+func (c *SieveClient) command(name string, args ...string) ([][]sieveToken, *sieveStatus, error) {
+	c.conn.SetDeadline(time.Now().Add(sieveTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.writeLine(strings.Join(append([]string{name}, args...), " ")); err != nil {
+		return nil, nil, err
+	}
+	return c.readResponse()
+}
+
+func (c *SieveClient) writeLine(line string) error {
+	if _, err := c.w.WriteString(line + "\r\n"); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *SieveClient) readResponse() ([][]sieveToken, *sieveStatus, error) {
+	var data [][]sieveToken
+	for {
+		rec, err := c.readRecord()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rec) > 0 && rec[0].kind == sieveAtom {
+			switch strings.ToUpper(rec[0].text) {
+			case "OK", "NO", "BYE":
+				status, err := parseStatus(rec)
+				return data, status, err
+			}
+		}
+		data = append(data, rec)
+	}
+}
+
+// parseStatus turns an OK line into a status and NO or BYE into an error
+func parseStatus(rec []sieveToken) (*sieveStatus, error) {
+	if len(rec) == 0 || rec[0].kind != sieveAtom {
+		return nil, fmt.Errorf("unexpected ManageSieve response")
+	}
+
+	status := &sieveStatus{}
+	for _, token := range rec[1:] {
+		switch token.kind {
+		case sieveCode:
+			if fields := strings.Fields(token.text); len(fields) > 0 {
+				status.code = strings.ToUpper(fields[0])
+			}
+		case sieveString:
+			status.message = token.text
+		}
+	}
+
+	if strings.EqualFold(rec[0].text, "OK") {
+		return status, nil
+	}
+	return nil, &SieveError{Code: status.code, Message: status.message}
+}
+
+func (s *sieveStatus) warnings() string {
+	if s.code == "WARNINGS" {
+		return s.message
+	}
+	return ""
+}
+
+// readRecord reads one response line, including any literals it carries
+func (c *SieveClient) readRecord() ([]sieveToken, error) {
+	var rec []sieveToken
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch b {
+		case '\n':
+			return rec, nil
+		case '\r', ' ':
+		case '"':
+			text, err := c.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			rec = append(rec, sieveToken{kind: sieveString, text: text})
+		case '{':
+			text, err := c.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			rec = append(rec, sieveToken{kind: sieveString, text: text})
+		case '(':
+			text, err := c.readCode()
+			if err != nil {
+				return nil, err
+			}
+			rec = append(rec, sieveToken{kind: sieveCode, text: text})
+		default:
+			var atom strings.Builder
+			atom.WriteByte(b)
+			for {
+				next, err := c.r.Peek(1)
+				if err != nil {
+					return nil, err
+				}
+				if next[0] == ' ' || next[0] == '\r' || next[0] == '\n' || next[0] == '(' || next[0] == '"' {
+					break
+				}
+				b, _ := c.r.ReadByte()
+				atom.WriteByte(b)
+			}
+			rec = append(rec, sieveToken{kind: sieveAtom, text: atom.String()})
+		}
+	}
+}
+
+func (c *SieveClient) readQuoted() (string, error) {
+	var s strings.Builder
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '"':
+			return s.String(), nil
+		case '\\':
+			if b, err = c.r.ReadByte(); err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			return "", fmt.Errorf("line break in quoted string")
+		}
+		s.WriteByte(b)
+	}
+}
+
+// readLiteral reads "{n}" or "{n+}" (the opening brace already consumed),
+// the line break that follows and n bytes of content
+func (c *SieveClient) readLiteral() (string, error) {
+	spec, err := c.r.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(spec, "}"), "+"))
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("invalid literal length %q", spec)
+	}
+	if n > maxSieveLiteral {
+		return "", fmt.Errorf("literal of %d bytes exceeds the limit of %d", n, maxSieveLiteral)
+	}
+	if crlf, err := c.r.ReadString('\n'); err != nil || strings.TrimSpace(crlf) != "" {
+		return "", fmt.Errorf("malformed literal")
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readCode reads a response code up to its closing parenthesis, skipping
+// over quoted strings inside it
+func (c *SieveClient) readCode() (string, error) {
+	var s strings.Builder
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case ')':
+			return s.String(), nil
+		case '"':
+			text, err := c.readQuoted()
+			if err != nil {
+				return "", err
+			}
+			s.WriteString(strconv.Quote(text))
+			continue
+		case '\r', '\n':
+			return "", errors.New("unterminated response code")
+		}
+		s.WriteByte(b)
+	}
+}
+
+// sieveQuote encodes a string argument. Text with line breaks, and long
+// text, is sent as a non-synchronising literal, which RFC 5804 servers
+// must accept.
+func sieveQuote(s string) string {
+	if len(s) > 1024 || strings.ContainsAny(s, "\r\n\x00") {
+		return fmt.Sprintf("{%d+}\r\n%s", len(s), s)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func toCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
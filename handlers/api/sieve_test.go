@@ -0,0 +1,338 @@
+// handlers/api/sieve_test.go
+package api
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sieveStub is a ManageSieve server keeping the scripts of one user in
+// memory. Scripts containing "error" are refused as invalid.
+type sieveStub struct {
+	checkScript bool   // Announce VERSION, and with it CHECKSCRIPT
+	hugeLiteral bool   // Answer GETSCRIPT with an oversized literal
+	stall       string // Stop answering at "greeting", STARTTLS (once acknowledged) or AUTHENTICATE
+
+	mu      sync.Mutex
+	scripts map[string]string
+	active  string
+	puts    []string // Names passed to PUTSCRIPT
+}
+
+func newSieveStub(t *testing.T, stub *sieveStub) config.ConnectionProfile {
+	t.Helper()
+	if stub.scripts == nil {
+		stub.scripts = make(map[string]string)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return config.ConnectionProfile{
+		Host:          "127.0.0.1",
+		Port:          addr.Port,
+		Security:      config.SecurityNone,
+		AuthMechanism: config.AuthPlain,
+	}
+}
+
+func (s *sieveStub) serve(conn net.Conn) {
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	send := func(lines ...string) {
+		for _, line := range lines {
+			w.WriteString(line + "\r\n")
+		}
+		w.Flush()
+	}
+
+	// A server that stopped answering still reads what it is sent
+	hang := func() { io.Copy(io.Discard, conn) }
+	if s.stall == "greeting" {
+		hang()
+		return
+	}
+
+	greeting := []string{`"IMPLEMENTATION" "stub"`, `"SASL" "PLAIN"`, `"SIEVE" "fileinto vacation"`, `"STARTTLS"`}
+	if s.checkScript {
+		greeting = append(greeting, `"VERSION" "1.0"`)
+	}
+	send(append(greeting, "OK")...)
+
+	// The client's tokenizer reads commands as well as responses
+	reader := &SieveClient{r: bufio.NewReader(conn)}
+	for {
+		rec, err := reader.readRecord()
+		if err != nil {
+			return
+		}
+		if len(rec) == 0 {
+			continue
+		}
+		args := make([]string, len(rec)-1)
+		for i, token := range rec[1:] {
+			args[i] = token.text
+		}
+		switch command := strings.ToUpper(rec[0].text); {
+		case command == s.stall && command == "STARTTLS":
+			send("OK")
+			hang()
+			return
+		case command == s.stall:
+			hang()
+			return
+		}
+
+		s.mu.Lock()
+		lines := s.handle(strings.ToUpper(rec[0].text), args)
+		s.mu.Unlock()
+		send(lines...)
+		if rec[0].text == "LOGOUT" {
+			return
+		}
+	}
+}
+
+func (s *sieveStub) handle(command string, args []string) []string {
+	switch command {
+	case "AUTHENTICATE":
+		ir, _ := base64.StdEncoding.DecodeString(args[1])
+		if string(ir) != "\x00user@example.com\x00secret" {
+			return []string{`NO "Authentication failed"`}
+		}
+		return []string{"OK"}
+	case "LISTSCRIPTS":
+		var lines []string
+		for name := range s.scripts {
+			line := strconv.Quote(name)
+			if name == s.active {
+				line += " ACTIVE"
+			}
+			lines = append(lines, line)
+		}
+		return append(lines, "OK")
+	case "GETSCRIPT":
+		if s.hugeLiteral {
+			return []string{fmt.Sprintf("{%d}", maxSieveLiteral+1)}
+		}
+		content, ok := s.scripts[args[0]]
+		if !ok {
+			return []string{`NO (NONEXISTENT) "No such script"`}
+		}
+		return []string{fmt.Sprintf("{%d}\r\n%s", len(content), content), "OK"}
+	case "PUTSCRIPT":
+		s.puts = append(s.puts, args[0])
+		if strings.Contains(args[1], "error") {
+			return []string{`NO "line 1: syntax error"`}
+		}
+		s.scripts[args[0]] = args[1]
+		if strings.Contains(args[1], "keep") {
+			return []string{`OK (WARNINGS) "implicit keep"`}
+		}
+		return []string{"OK"}
+	case "CHECKSCRIPT":
+		if strings.Contains(args[0], "error") {
+			return []string{`NO "line 1: syntax error"`}
+		}
+		return []string{"OK"}
+	case "SETACTIVE":
+		if _, ok := s.scripts[args[0]]; !ok && args[0] != "" {
+			return []string{`NO (NONEXISTENT) "No such script"`}
+		}
+		s.active = args[0]
+		return []string{"OK"}
+	case "DELETESCRIPT":
+		if args[0] == s.active {
+			return []string{`NO (ACTIVE) "Script is active"`}
+		}
+		delete(s.scripts, args[0])
+		return []string{"OK"}
+	case "LOGOUT":
+		return []string{"OK"}
+	}
+	return []string{`NO "Unknown command"`}
+}
+
+func dialSieveStub(t *testing.T, stub *sieveStub) *SieveClient {
+	t.Helper()
+	c, err := NewSieveClient(newSieveStub(t, stub), "user@example.com", "secret")
+	if err != nil {
+		t.Fatalf("NewSieveClient: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSieveLoginFailure(t *testing.T) {
+	profile := newSieveStub(t, &sieveStub{})
+	_, err := NewSieveClient(profile, "user@example.com", "wrong")
+	if !errors.Is(err, ErrLoginFailed) {
+		t.Fatalf("NewSieveClient with a wrong password = %v, want ErrLoginFailed", err)
+	}
+}
+
+func TestSieveSetupTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { sieveTimeout = timeout }(sieveTimeout)
+	sieveTimeout = 200 * time.Millisecond
+
+	for _, stall := range []string{"greeting", "STARTTLS", "AUTHENTICATE"} {
+		profile := newSieveStub(t, &sieveStub{stall: stall})
+		if stall == "STARTTLS" {
+			profile.Security = config.SecurityStartTLS
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := NewSieveClient(profile, "user@example.com", "secret")
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "timeout") {
+				t.Errorf("stalled at %s: NewSieveClient = %v, want a timeout", stall, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stalled at %s: NewSieveClient did not give up", stall)
+		}
+	}
+}
+
+func TestSieveScripts(t *testing.T) {
+	stub := &sieveStub{checkScript: true}
+	c := dialSieveStub(t, stub)
+
+	if !c.HasExtension("vacation") || c.Implementation() != "stub" {
+		t.Errorf("capabilities = %v", c.capabilities)
+	}
+
+	content := "require \"fileinto\";\nfileinto \"Lists\";\n"
+	if _, err := c.PutScript("lilmail", content); err != nil {
+		t.Fatalf("PutScript: %v", err)
+	}
+	if got := stub.scripts["lilmail"]; got != toCRLF(content) {
+		t.Errorf("stored script = %q, want CRLF line endings", got)
+	}
+
+	warnings, err := c.PutScript("other", "keep;")
+	if err != nil || warnings != "implicit keep" {
+		t.Errorf("PutScript with warnings = %q, %v", warnings, err)
+	}
+
+	var sieveErr *SieveError
+	if _, err := c.PutScript("broken", "error;"); !errors.As(err, &sieveErr) || sieveErr.Message != "line 1: syntax error" {
+		t.Errorf("PutScript of an invalid script = %v, want the server's errors", err)
+	}
+
+	if err := c.SetActive("lilmail"); err != nil {
+		t.Fatalf("SetActive: %v", err)
+	}
+	scripts, err := c.ListScripts()
+	if err != nil {
+		t.Fatalf("ListScripts: %v", err)
+	}
+	if len(scripts) != 2 {
+		t.Fatalf("ListScripts = %v, want 2 scripts", scripts)
+	}
+	for _, script := range scripts {
+		if script.Active != (script.Name == "lilmail") {
+			t.Errorf("script %s active = %v", script.Name, script.Active)
+		}
+	}
+
+	got, err := c.GetScript("lilmail")
+	if err != nil || got != content {
+		t.Errorf("GetScript = %q, %v; want %q", got, err, content)
+	}
+	if _, err := c.GetScript("missing"); !errors.As(err, &sieveErr) || sieveErr.Code != "NONEXISTENT" {
+		t.Errorf("GetScript of a missing script = %v, want NONEXISTENT", err)
+	}
+
+	if err := c.DeleteScript("lilmail"); !errors.As(err, &sieveErr) || sieveErr.Code != "ACTIVE" {
+		t.Errorf("DeleteScript of the active script = %v, want ACTIVE", err)
+	}
+	if err := c.SetActive(""); err != nil {
+		t.Fatalf("SetActive(\"\"): %v", err)
+	}
+	if err := c.DeleteScript("lilmail"); err != nil {
+		t.Errorf("DeleteScript: %v", err)
+	}
+}
+
+func TestSieveCheckScript(t *testing.T) {
+	stub := &sieveStub{checkScript: true}
+	c := dialSieveStub(t, stub)
+
+	if _, err := c.CheckScript("keep;"); err != nil {
+		t.Errorf("CheckScript of a valid script: %v", err)
+	}
+	if _, err := c.CheckScript("error;"); err == nil {
+		t.Error("CheckScript of an invalid script succeeded")
+	}
+	if len(stub.puts) != 0 {
+		t.Errorf("CheckScript uploaded %v despite CHECKSCRIPT", stub.puts)
+	}
+}
+
+func TestSieveCheckScriptFallback(t *testing.T) {
+	// Scripts of the user, one named like the temporary script used to be
+	stub := &sieveStub{scripts: map[string]string{
+		"lilmail-check": "keep;",
+		"lilmail":       "keep;",
+	}}
+	c := dialSieveStub(t, stub)
+
+	if _, err := c.CheckScript("discard;"); err != nil {
+		t.Fatalf("CheckScript: %v", err)
+	}
+	if _, err := c.CheckScript("error;"); err == nil {
+		t.Error("CheckScript of an invalid script succeeded")
+	}
+
+	if len(stub.puts) != 2 {
+		t.Fatalf("PUTSCRIPT calls = %v, want 2", stub.puts)
+	}
+	for _, name := range stub.puts {
+		if name == "lilmail-check" || name == "lilmail" || !strings.HasPrefix(name, checkScriptPrefix) {
+			t.Errorf("temporary script named %q", name)
+		}
+	}
+	if stub.puts[0] == stub.puts[1] {
+		t.Errorf("temporary script name %q reused", stub.puts[0])
+	}
+	if len(stub.scripts) != 2 || stub.scripts["lilmail-check"] != "keep;" {
+		t.Errorf("scripts after checking = %v, want the user's scripts untouched", stub.scripts)
+	}
+}
+
+func TestSieveLiteralLimit(t *testing.T) {
+	c := dialSieveStub(t, &sieveStub{hugeLiteral: true})
+
+	_, err := c.GetScript("huge")
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("GetScript with an oversized literal = %v, want a limit error", err)
+	}
+}
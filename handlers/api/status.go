@@ -0,0 +1,156 @@
+// handlers/api/status.go
+package api
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// FolderCount holds the message counters of a folder
+type FolderCount struct {
+	Total  uint32 `json:"total"`
+	Unread uint32 `json:"unread"`
+	Recent uint32 `json:"recent"`
+}
+
+var statusItems = []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, imap.StatusRecent}
+
+func countFromStatus(status *imap.MailboxStatus) FolderCount {
+	return FolderCount{
+		Total:  status.Messages,
+		Unread: status.Unseen,
+		Recent: status.Recent,
+	}
+}
+
+// FolderCount returns the counters of a single folder
+func (c *Client) FolderCount(name string) (FolderCount, error) {
+	status, err := c.client.Status(name, statusItems)
+	if err != nil {
+		return FolderCount{}, fmt.Errorf("error getting status of %s: %v", name, err)
+	}
+	return countFromStatus(status), nil
+}
+
+// listStatus is the LIST-STATUS command (RFC 5819), which returns the
+// counters of every folder along with the folder list
+type listStatus struct{}
+
+func (cmd *listStatus) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "LIST",
+		Arguments: []interface{}{imap.RawString(`"" "*" RETURN (STATUS (MESSAGES UNSEEN RECENT))`)},
+	}
+}
+
+// listFolderCounts runs LIST-STATUS
+func (c *Client) listFolderCounts() (map[string]FolderCount, error) {
+	counts := make(map[string]FolderCount)
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		status := &responses.Status{}
+		if err := status.Handle(resp); err != nil {
+			return err
+		}
+		counts[status.Mailbox.Name] = countFromStatus(status.Mailbox)
+		return nil
+	})
+
+	status, err := c.client.Execute(&listStatus{}, handler)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// FetchFolderCounts returns the counters of every selectable folder. A
+// server with LIST-STATUS answers in a single command; otherwise STATUS
+// commands are spread over up to workers connections opened with dial,
+// since a connection only runs one command at a time. Folders whose STATUS
+// fails are left out.
+func FetchFolderCounts(folders []*MailboxInfo, dial func() (*Client, error), workers int) (map[string]FolderCount, error) {
+	first, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer first.Close()
+
+	if ok, _ := first.client.Support("LIST-STATUS"); ok {
+		return first.listFolderCounts()
+	}
+
+	var names []string
+	for _, mb := range folders {
+		if !hasAttr(mb.Attributes, imap.NoSelectAttr) {
+			names = append(names, mb.Name)
+		}
+	}
+
+	jobs := make(chan string)
+	counts := make(map[string]FolderCount)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	work := func(client *Client) {
+		defer wg.Done()
+		for name := range jobs {
+			count, err := client.FolderCount(name)
+			if err != nil {
+				log.Printf("Skipping folder count: %v", err)
+				continue
+			}
+			mu.Lock()
+			counts[name] = count
+			mu.Unlock()
+		}
+	}
+
+	wg.Add(1)
+	go work(first)
+	for i := 1; i < workers && i < len(names); i++ {
+		client, err := dial()
+		if err != nil {
+			log.Printf("Counting folders with fewer connections: %v", err)
+			break
+		}
+		defer client.Close()
+		wg.Add(1)
+		go work(client)
+	}
+
+	for _, name := range names {
+		jobs <- name
+	}
+	close(jobs)
+	wg.Wait()
+
+	return counts, nil
+}
+
+// ApplyFolderCounts copies counters onto the folder list
+func ApplyFolderCounts(folders []*MailboxInfo, counts map[string]FolderCount) {
+	for _, mb := range folders {
+		if count, ok := counts[mb.Name]; ok {
+			mb.TotalCount = int(count.Total)
+			mb.UnreadCount = int(count.Unread)
+			mb.RecentCount = int(count.Recent)
+		}
+	}
+}
+
+// TotalUnread sums the unread messages of all folders except Junk and Trash
+func TotalUnread(folders []*MailboxInfo) int {
+	total := 0
+	for _, mb := range folders {
+		if mb.Role != RoleJunk && mb.Role != RoleTrash {
+			total += mb.UnreadCount
+		}
+	}
+	return total
+}
@@ -2,7 +2,10 @@ package api
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"lilmail/config"
+	"log"
 	"math/rand"
 	"net/smtp"
 	"os"
@@ -11,106 +14,139 @@ import (
 
 // SMTPClient handles email sending
 type SMTPClient struct {
-	server   string
-	port     int
+	profile  config.ConnectionProfile
 	email    string
 	password string
 }
 
-// NewSMTPClient creates a new SMTP client
-func NewSMTPClient(server string, port int, email, password string) *SMTPClient {
+// NewSMTPClient creates a new SMTP client using the resolved connection profile
+func NewSMTPClient(profile config.ConnectionProfile, email, password string) *SMTPClient {
 	return &SMTPClient{
-		server:   server,
-		port:     port,
+		profile:  profile,
 		email:    email,
 		password: password,
 	}
 }
 
-// SendMail sends an email using SMTP
-func (c *SMTPClient) SendMail(to, subject, body string) error {
-	// Debug print
-	fmt.Printf("Connecting to %s:%d as %s\n", c.server, c.port, c.email)
+// dial opens an SMTP session secured according to the profile
+func (c *SMTPClient) dial() (*smtp.Client, error) {
+	addr := c.profile.Address()
+
+	if c.profile.Security == config.SecurityTLS {
+		conn, err := tls.Dial("tcp", addr, c.profile.TLSConfig())
+		if err != nil {
+			return nil, fmt.Errorf("dial failed: %w", err)
+		}
+		client, err := smtp.NewClient(conn, c.profile.Host)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("dial failed: %w", err)
+		}
+		return client, nil
+	}
 
-	// Connect to the server
-	addr := fmt.Sprintf("%s:%d", c.server, c.port)
 	client, err := smtp.Dial(addr)
 	if err != nil {
-		return fmt.Errorf("dial failed: %v", err)
+		return nil, fmt.Errorf("dial failed: %w", err)
+	}
+	return client, nil
+}
+
+// Send delivers a rendered message to the given envelope recipients. The
+// raw bytes are transmitted unchanged, so the caller can store exactly what
+// was sent.
+func (c *SMTPClient) Send(recipients []string, raw []byte) error {
+	return c.send(c.email, recipients, raw)
+}
+
+// SendAutomatic delivers an automatic message, such as a vacation reply,
+// with an empty envelope sender (MAIL FROM:<>), so that its bounces are
+// not returned and cannot start a loop (RFC 3834, section 3.3)
+func (c *SMTPClient) SendAutomatic(recipients []string, raw []byte) error {
+	return c.send("", recipients, raw)
+}
+
+func (c *SMTPClient) send(from string, recipients []string, raw []byte) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+
+	// Connect to the server
+	client, err := c.dial()
+	if err != nil {
+		return err
 	}
 	defer client.Close()
 
 	// Send EHLO with domain from email
 	domain := GetDomainFromEmail(c.email)
 	if err := client.Hello(domain); err != nil {
-		return fmt.Errorf("hello failed: %v", err)
+		return fmt.Errorf("hello failed: %w", err)
 	}
 
-	// Start TLS
-	tlsConfig := &tls.Config{
-		ServerName:         c.server,
-		InsecureSkipVerify: true,
-	}
-	if err = client.StartTLS(tlsConfig); err != nil {
-		return fmt.Errorf("starttls failed: %v", err)
+	// Upgrade the connection when the profile asks for STARTTLS
+	if c.profile.Security == config.SecurityStartTLS {
+		if err = client.StartTLS(c.profile.TLSConfig()); err != nil {
+			return fmt.Errorf("starttls failed: %w", err)
+		}
 	}
 
 	username := GetUsernameFromEmail(c.email)
 	// Authenticate after TLS
-	auth := smtp.PlainAuth("", username, c.password, c.server)
+	var auth smtp.Auth
+	if bearer := bearerClient(c.profile, c.email, c.password); bearer != nil {
+		auth = &saslAuth{client: bearer}
+	} else if master := masterClient(c.profile, c.email); master != nil {
+		auth = &saslAuth{client: master}
+	} else if c.profile.AuthMechanism == config.AuthLogin {
+		auth = &loginAuth{username: username, password: c.password}
+	} else {
+		auth = smtp.PlainAuth("", username, c.password, c.profile.Host)
+	}
 	if err = client.Auth(auth); err != nil {
-		return fmt.Errorf("auth failed: %v", err)
+		return fmt.Errorf("auth failed: %w", err)
 	}
 
 	// Set sender
-	if err = client.Mail(c.email); err != nil {
-		return fmt.Errorf("mail from failed: %v", err)
+	if err = client.Mail(from); err != nil {
+		return fmt.Errorf("mail from failed: %w", err)
 	}
 
-	// Set recipient
-	if err = client.Rcpt(to); err != nil {
-		return fmt.Errorf("rcpt to failed: %v", err)
+	// Set recipients
+	for _, rcpt := range recipients {
+		if err = client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("rcpt to %s failed: %w", rcpt, err)
+		}
 	}
 
 	// Send the email body
 	writer, err := client.Data()
 	if err != nil {
-		return fmt.Errorf("data failed: %v", err)
-	}
-
-	// Get current time in RFC822 format
-	now := time.Now().Format(time.RFC822Z)
-
-	// Construct proper email headers and body
-	msg := fmt.Sprintf("Date: %s\r\n"+
-		"From: %s <%s>\r\n"+
-		"To: %s\r\n"+
-		"Subject: %s\r\n"+
-		"MIME-Version: 1.0\r\n"+
-		"Content-Type: text/plain; charset=\"utf-8\"\r\n"+
-		"Message-ID: <%s@%s>\r\n"+
-		"\r\n"+
-		"%s",
-		now,
-		username,
-		c.email,
-		to,
-		subject,
-		generateMessageID(), // You'll need to implement this
-		domain,
-		body)
-
-	_, err = writer.Write([]byte(msg))
+		return fmt.Errorf("data failed: %w", err)
+	}
+
+	_, err = writer.Write(raw)
 	if err != nil {
-		return fmt.Errorf("write failed: %v", err)
+		return fmt.Errorf("write failed: %w", err)
 	}
 
 	err = writer.Close()
 	if err != nil {
-		return fmt.Errorf("close failed: %v", err)
+		return fmt.Errorf("close failed: %w", err)
+	}
+
+	// The server has accepted the message; reporting a failed QUIT would
+	// make the outbox deliver it again
+	if err := client.Quit(); err != nil {
+		log.Printf("SMTP QUIT after delivery failed: %v", err)
 	}
+	return nil
+}
 
-	return client.Quit()
+// NewMessageID returns a Message-ID (without angle brackets) in the domain
+// of the given address
+func NewMessageID(email string) string {
+	return fmt.Sprintf("%s@%s", generateMessageID(), GetDomainFromEmail(email))
 }
 
 // generateMessageID creates a unique Message-ID for the email
@@ -120,3 +156,29 @@ func generateMessageID() string {
 		os.Getpid(),
 		rand.Int63())
 }
+
+// loginAuth implements the non-standard but widespread AUTH LOGIN mechanism
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !config.IsLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
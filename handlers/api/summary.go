@@ -0,0 +1,276 @@
+// handlers/api/summary.go
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// MessageSummary holds the parts of a message that mail rules look at,
+// fetched without downloading the body
+type MessageSummary struct {
+	UID            string
+	From           string
+	To             []string
+	Cc             []string
+	Subject        string
+	Date           time.Time
+	Header         textproto.MIMEHeader
+	Size           int64
+	HasAttachments bool
+}
+
+// HeaderValue returns the decoded value of a header, all occurrences
+// joined with ", "
+func (m *MessageSummary) HeaderValue(name string) string {
+	dec := new(mime.WordDecoder)
+	var values []string
+	for _, value := range m.Header.Values(name) {
+		if decoded, err := dec.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, ", ")
+}
+
+// FolderState returns the UIDVALIDITY and UIDNEXT of a folder, which tell
+// a scanner whether its last seen UID is still meaningful
+func (c *Client) FolderState(folderName string) (uidValidity, uidNext uint32, err error) {
+	mbox, err := c.client.Select(folderName, true)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+	uidNext = mbox.UidNext
+	if uidNext != 0 || mbox.Messages == 0 {
+		return mbox.UidValidity, uidNext, nil
+	}
+
+	// UIDNEXT is optional in the SELECT response; without it the next UID
+	// follows the UID of the last message
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(mbox.Messages)
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.client.Fetch(seqSet, []imap.FetchItem{imap.FetchUid}, messages)
+	}()
+	for msg := range messages {
+		uidNext = msg.Uid + 1
+	}
+	if err := <-done; err != nil {
+		return 0, 0, fmt.Errorf("error fetching last UID of %s: %v", folderName, err)
+	}
+	return mbox.UidValidity, uidNext, nil
+}
+
+// SummariesSince returns the messages of a folder with a UID above lastUID,
+// oldest first
+func (c *Client) SummariesSince(folderName string, lastUID uint32) ([]MessageSummary, error) {
+	if _, err := c.client.Select(folderName, true); err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(lastUID+1, 0)
+
+	summaries, err := c.fetchSummaries(seqSet, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// "n:*" always includes the last message, even when its UID is below n
+	kept := summaries[:0]
+	for _, s := range summaries {
+		if uid, _ := parseUID(s.UID); uid > lastUID {
+			kept = append(kept, s)
+		}
+	}
+	return kept, nil
+}
+
+// LatestSummaries returns up to limit of the newest messages of a folder,
+// oldest first
+func (c *Client) LatestSummaries(folderName string, limit uint32) ([]MessageSummary, error) {
+	mbox, err := c.client.Select(folderName, true)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+	if mbox.Messages == 0 {
+		return nil, nil
+	}
+
+	from := uint32(1)
+	if mbox.Messages > limit {
+		from = mbox.Messages - limit + 1
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(from, mbox.Messages)
+
+	return c.fetchSummaries(seqSet, false)
+}
+
+func (c *Client) fetchSummaries(seqSet *imap.SeqSet, byUID bool) ([]MessageSummary, error) {
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+		Peek:         true,
+	}
+	items := []imap.FetchItem{
+		imap.FetchUid,
+		imap.FetchEnvelope,
+		imap.FetchRFC822Size,
+		imap.FetchBodyStructure,
+		section.FetchItem(),
+	}
+
+	messages := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		if byUID {
+			done <- c.client.UidFetch(seqSet, items, messages)
+		} else {
+			done <- c.client.Fetch(seqSet, items, messages)
+		}
+	}()
+
+	var summaries []MessageSummary
+	for msg := range messages {
+		summaries = append(summaries, summarize(msg, section))
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("error fetching messages: %v", err)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		a, _ := parseUID(summaries[i].UID)
+		b, _ := parseUID(summaries[j].UID)
+		return a < b
+	})
+	return summaries, nil
+}
+
+func summarize(msg *imap.Message, section *imap.BodySectionName) MessageSummary {
+	summary := MessageSummary{
+		UID:    strconv.FormatUint(uint64(msg.Uid), 10),
+		Size:   int64(msg.Size),
+		Header: textproto.MIMEHeader{},
+	}
+
+	if env := msg.Envelope; env != nil {
+		summary.Subject = env.Subject
+		summary.Date = env.Date
+		if len(env.From) > 0 && env.From[0] != nil {
+			summary.From = env.From[0].Address()
+		}
+		summary.To = envelopeAddresses(env.To)
+		summary.Cc = envelopeAddresses(env.Cc)
+	}
+
+	if r := msg.GetBody(section); r != nil {
+		header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+		if err == nil || len(header) > 0 {
+			summary.Header = header
+		}
+	}
+
+	if msg.BodyStructure != nil {
+		msg.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+			if part.Disposition == "attachment" {
+				summary.HasAttachments = true
+			} else if name, _ := part.Filename(); name != "" {
+				summary.HasAttachments = true
+			}
+			return !summary.HasAttachments
+		})
+	}
+
+	return summary
+}
+
+func envelopeAddresses(list []*imap.Address) []string {
+	var addrs []string
+	for _, addr := range list {
+		if addr != nil {
+			addrs = append(addrs, addr.Address())
+		}
+	}
+	return addrs
+}
+
+// MoveMessage moves a message to another folder, using MOVE when the
+// server supports it
+func (c *Client) MoveMessage(folderName, uid, target string) error {
+	uidNum, err := parseUID(uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID: %v", err)
+	}
+
+	if _, err := c.client.Select(folderName, false); err != nil {
+		return fmt.Errorf("error selecting folder %s: %v", folderName, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uidNum)
+	if err := c.client.UidMove(seqSet, target); err != nil {
+		return fmt.Errorf("error moving message to %s: %v", target, err)
+	}
+	return nil
+}
+
+// TrashMessage moves a message to the Trash folder. Messages already in
+// Trash, and messages on servers without one, are deleted for good.
+func (c *Client) TrashMessage(folderName, uid string) error {
+	folders, err := c.FetchFolders()
+	if err != nil {
+		return err
+	}
+	trash := FolderByRole(folders, RoleTrash)
+	if trash == "" || trash == folderName {
+		return c.DeleteMessage(folderName, uid)
+	}
+	return c.MoveMessage(folderName, uid, trash)
+}
+
+// SetFlagged flags or unflags a message
+func (c *Client) SetFlagged(folderName, uid string, flagged bool) error {
+	return c.setMessageFlag(folderName, uid, imap.FlaggedFlag, flagged)
+}
+
+// SentRecipients returns the lowercased To and Cc addresses of the newest
+// limit messages in the Sent folder, the people the user writes to
+func (c *Client) SentRecipients(limit uint32) ([]string, error) {
+	folders, err := c.FetchFolders()
+	if err != nil {
+		return nil, err
+	}
+	sent := FolderByRole(folders, RoleSent)
+	if sent == "" {
+		return nil, nil
+	}
+
+	summaries, err := c.LatestSummaries(sent, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var recipients []string
+	for _, s := range summaries {
+		for _, addr := range append(append([]string{}, s.To...), s.Cc...) {
+			addr = strings.ToLower(addr)
+			if addr != "" && !seen[addr] {
+				seen[addr] = true
+				recipients = append(recipients, addr)
+			}
+		}
+	}
+	return recipients, nil
+}
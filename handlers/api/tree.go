@@ -0,0 +1,118 @@
+// handlers/api/tree.go
+package api
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// FolderNode is a folder in the hierarchy built from the flat LIST result.
+// go-imap already decodes modified UTF-7, so names are plain UTF-8.
+type FolderNode struct {
+	Name        string        // Full mailbox name, used in routes and IMAP commands
+	Label       string        // Last path component, shown in the sidebar
+	Role        string        // Folder role, see AssignRoles
+	Depth       int           // Nesting level, 0 for top-level folders
+	Selectable  bool          // False for \Noselect folders and implied parents
+	HasChildren bool          // Set from child folders or the \HasChildren attribute
+	Current     bool          // The folder being viewed
+	Open        bool          // Expanded in the sidebar; set on ancestors of the current folder
+	Info        *MailboxInfo  // Nil for parents that were not listed
+	Children    []*FolderNode // Sorted by label
+}
+
+// FolderTree nests folders by their hierarchy delimiter. Parents missing
+// from the list, such as "INBOX.Projects" for "INBOX.Projects.2024", are
+// added as non-selectable nodes. Folders with a role come first, in the
+// order of Roles.
+func FolderTree(folders []*MailboxInfo) []*FolderNode {
+	root := &FolderNode{}
+	nodes := make(map[string]*FolderNode)
+
+	var node func(name, delimiter string) *FolderNode
+	node = func(name, delimiter string) *FolderNode {
+		if n, ok := nodes[name]; ok {
+			return n
+		}
+
+		parent, label := root, name
+		if delimiter != "" {
+			if i := strings.LastIndex(name, delimiter); i > 0 {
+				parent = node(name[:i], delimiter)
+				label = name[i+len(delimiter):]
+			}
+		}
+
+		n := &FolderNode{Name: name, Label: label}
+		if parent != root {
+			n.Depth = parent.Depth + 1
+			parent.HasChildren = true
+		}
+		parent.Children = append(parent.Children, n)
+		nodes[name] = n
+		return n
+	}
+
+	for _, mb := range folders {
+		n := node(mb.Name, mb.Delimiter)
+		n.Info = mb
+		n.Role = mb.Role
+		n.Selectable = !hasAttr(mb.Attributes, imap.NoSelectAttr)
+		if hasAttr(mb.Attributes, imap.HasChildrenAttr) {
+			n.HasChildren = true
+		}
+	}
+
+	sortNodes(root.Children)
+	return root.Children
+}
+
+// SetCurrentFolder marks the node named name as current and expands its
+// ancestors. It reports whether the folder was found.
+func SetCurrentFolder(nodes []*FolderNode, name string) bool {
+	for _, n := range nodes {
+		if n.Name == name {
+			n.Current = true
+			return true
+		}
+		if SetCurrentFolder(n.Children, name) {
+			n.Open = true
+			return true
+		}
+	}
+	return false
+}
+
+func sortNodes(nodes []*FolderNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if ra, rb := roleRank(a.Role), roleRank(b.Role); ra != rb {
+			return ra < rb
+		}
+		return strings.ToLower(a.Label) < strings.ToLower(b.Label)
+	})
+	for _, n := range nodes {
+		sortNodes(n.Children)
+	}
+}
+
+// roleRank orders folders by role; folders without a role come last
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return len(Roles)
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
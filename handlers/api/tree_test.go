@@ -0,0 +1,179 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// outline renders a folder tree one node per line, indented by depth and
+// followed by its state
+func outline(t *testing.T, nodes []*FolderNode) string {
+	t.Helper()
+	var b strings.Builder
+	var walk func(nodes []*FolderNode, depth int)
+	walk = func(nodes []*FolderNode, depth int) {
+		for _, n := range nodes {
+			if n.Depth != depth {
+				t.Errorf("%s has depth %d, want %d", n.Name, n.Depth, depth)
+			}
+			b.WriteString(strings.Repeat("  ", depth) + n.Label)
+			if n.Info == nil {
+				b.WriteString(" implied")
+			}
+			if !n.Selectable {
+				b.WriteString(" noselect")
+			}
+			if n.HasChildren {
+				b.WriteString(" children")
+			}
+			if n.Open {
+				b.WriteString(" open")
+			}
+			if n.Current {
+				b.WriteString(" current")
+			}
+			b.WriteString("\n")
+			walk(n.Children, depth+1)
+		}
+	}
+	walk(nodes, 0)
+	return b.String()
+}
+
+func mailbox(name, delimiter, role string, attrs ...string) *MailboxInfo {
+	return &MailboxInfo{Name: name, Delimiter: delimiter, Role: role, Attributes: attrs}
+}
+
+func TestFolderTree(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		folders []*MailboxInfo
+		want    string
+	}{
+		{
+			name: "nested by dot",
+			folders: []*MailboxInfo{
+				mailbox("INBOX", ".", RoleInbox),
+				mailbox("INBOX.Projects", ".", ""),
+				mailbox("INBOX.Projects.2024", ".", ""),
+				mailbox("INBOX.Sent", ".", RoleSent),
+			},
+			want: "INBOX children\n  Sent\n  Projects children\n    2024\n",
+		},
+		{
+			name: "missing parents",
+			folders: []*MailboxInfo{
+				mailbox("Archive/2023/Q1", "/", ""),
+				mailbox("Archive/2024", "/", ""),
+			},
+			want: "Archive implied noselect children\n  2023 implied noselect children\n    Q1\n  2024\n",
+		},
+		{
+			name: "parent listed after its child",
+			folders: []*MailboxInfo{
+				mailbox("Lists.Go", ".", ""),
+				mailbox("Lists", ".", ""),
+			},
+			want: "Lists children\n  Go\n",
+		},
+		{
+			name: "without a delimiter",
+			folders: []*MailboxInfo{
+				mailbox("a.b", "", ""),
+				mailbox(".hidden", ".", ""),
+			},
+			want: ".hidden\na.b\n",
+		},
+		{
+			name: "attributes",
+			folders: []*MailboxInfo{
+				mailbox("Shared", "/", "", imap.NoSelectAttr, imap.HasChildrenAttr),
+				mailbox("Old", "/", "", `\haschildren`),
+			},
+			want: "Old children\nShared noselect children\n",
+		},
+		{
+			name: "roles first, then by label ignoring case",
+			folders: []*MailboxInfo{
+				mailbox("zeta", "/", ""),
+				mailbox("Trash", "/", RoleTrash),
+				mailbox("alpha", "/", ""),
+				mailbox("Sent", "/", RoleSent),
+				mailbox("Beta", "/", ""),
+				mailbox("INBOX", "/", RoleInbox),
+			},
+			want: "INBOX\nSent\nTrash\nalpha\nBeta\nzeta\n",
+		},
+		{
+			name: "non-ASCII names",
+			folders: []*MailboxInfo{
+				mailbox("Entwürfe", "/", RoleDrafts),
+				mailbox("Projekte/Größe", "/", ""),
+				mailbox("日本語/メモ", "/", ""),
+				mailbox("Ordner→Unterordner", "→", ""),
+			},
+			want: "Entwürfe\nOrdner implied noselect children\n  Unterordner\nProjekte implied noselect children\n  Größe\n日本語 implied noselect children\n  メモ\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outline(t, FolderTree(tt.folders)); got != tt.want {
+				t.Errorf("FolderTree =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetCurrentFolder(t *testing.T) {
+	folders := func() []*MailboxInfo {
+		return []*MailboxInfo{
+			mailbox("INBOX", ".", RoleInbox),
+			mailbox("INBOX.Projects.2024", ".", ""),
+			mailbox("INBOX.Projekte.Größe", ".", ""),
+			mailbox("Archive", ".", ""),
+		}
+	}
+
+	for _, tt := range []struct {
+		current string
+		found   bool
+		want    string
+	}{
+		{
+			current: "INBOX",
+			found:   true,
+			want:    "INBOX children current\n  Projects implied noselect children\n    2024\n  Projekte implied noselect children\n    Größe\nArchive\n",
+		},
+		{
+			current: "INBOX.Projects.2024",
+			found:   true,
+			want:    "INBOX children open\n  Projects implied noselect children open\n    2024 current\n  Projekte implied noselect children\n    Größe\nArchive\n",
+		},
+		{
+			current: "INBOX.Projekte.Größe",
+			found:   true,
+			want:    "INBOX children open\n  Projects implied noselect children\n    2024\n  Projekte implied noselect children open\n    Größe current\nArchive\n",
+		},
+		{
+			current: "INBOX.Projects",
+			found:   true,
+			want:    "INBOX children open\n  Projects implied noselect children current\n    2024\n  Projekte implied noselect children\n    Größe\nArchive\n",
+		},
+		{
+			current: "INBOX.Missing",
+			found:   false,
+			want:    "INBOX children\n  Projects implied noselect children\n    2024\n  Projekte implied noselect children\n    Größe\nArchive\n",
+		},
+	} {
+		t.Run(tt.current, func(t *testing.T) {
+			tree := FolderTree(folders())
+			if found := SetCurrentFolder(tree, tt.current); found != tt.found {
+				t.Errorf("SetCurrentFolder = %v, want %v", found, tt.found)
+			}
+			if got := outline(t, tree); got != tt.want {
+				t.Errorf("tree =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,12 +2,21 @@
 package web
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"lilmail/config"
 	"lilmail/handlers/api"
+	"lilmail/oauth"
+	"lilmail/oidc"
+	"lilmail/throttle"
+	"lilmail/twofactor"
 	"lilmail/utils"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,20 +24,38 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/session"
 )
 
+// pendingLoginTimeout is how long the second login step may take
+const pendingLoginTimeout = 5 * time.Minute
+
 type AuthHandler struct {
-	store  *session.Store
-	config *config.Config
-	client *api.Client
+	store     *session.Store
+	config    *config.Config
+	client    *api.Client
+	limiter   *throttle.Limiter
+	twoFactor *twofactor.Store
+	oauth     *oauth.Provider // nil unless OAuth login is enabled
+	oidc      *oidc.Provider  // nil unless OpenID Connect login is enabled
+	logins    []func(email, credentials string)
 }
 
 // NewAuthHandler creates a new instance of AuthHandler
-func NewAuthHandler(store *session.Store, config *config.Config) *AuthHandler {
+func NewAuthHandler(store *session.Store, config *config.Config, limiter *throttle.Limiter, twoFactor *twofactor.Store, provider *oauth.Provider, sso *oidc.Provider) *AuthHandler {
 	return &AuthHandler{
-		store:  store,
-		config: config,
+		store:     store,
+		config:    config,
+		limiter:   limiter,
+		twoFactor: twoFactor,
+		oauth:     provider,
+		oidc:      sso,
 	}
 }
 
+// OnLogin registers fn to be called with the login address and encrypted
+// credentials after each successful login
+func (h *AuthHandler) OnLogin(fn func(email, credentials string)) {
+	h.logins = append(h.logins, fn)
+}
+
 // ShowLogin renders the login page
 func (h *AuthHandler) ShowLogin(c *fiber.Ctx) error {
 	sess, err := h.store.Get(c)
@@ -38,11 +65,13 @@ func (h *AuthHandler) ShowLogin(c *fiber.Ctx) error {
 			return c.Redirect("/inbox")
 		}
 	}
+	h.offerOAuth(c)
 	return c.Render("login", fiber.Map{})
 }
 
 // HandleLogin processes the login form
 func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
+	h.offerOAuth(c)
 	sess, err := h.store.Get(c)
 	if err != nil {
 		return c.Status(500).SendString("Session error")
@@ -66,13 +95,23 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 		})
 	}
 
-	client, err := api.NewClient(
-		h.config.IMAP.Server,
-		h.config.IMAP.Port,
-		email,
-		password,
-	)
+	// Throttle guessing before the password reaches the mail server
+	attempt, wait := h.limiter.Check(c.IP(), email)
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+		return c.Status(429).Render("login", fiber.Map{
+			"Error": fmt.Sprintf("Too many failed logins. Try again in %s.", waitText(seconds)),
+			"Email": email,
+		})
+	}
+	defer attempt.Release()
+
+	client, err := api.NewClient(h.config.IMAP.Profile, email, password)
 	if err != nil {
+		if errors.Is(err, api.ErrLoginFailed) {
+			attempt.Fail()
+		}
 		return c.Status(401).Render("login", fiber.Map{
 			"Error": "Invalid credentials or server error",
 			"Email": email,
@@ -80,6 +119,363 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 	}
 	defer client.Close()
 
+	encryptedCreds, err := api.EncryptCredentials(email, password, h.config.Encryption.Keyring)
+	if err != nil {
+		return c.Status(500).Render("login", fiber.Map{
+			"Error": "Failed to secure credentials",
+			"Email": email,
+		})
+	}
+
+	return h.finishLogin(c, sess, client, email, encryptedCreds)
+}
+
+// finishLogin continues a login whose mail server credentials were
+// accepted: with the second step when two-factor login is on, or by
+// authenticating the session right away
+func (h *AuthHandler) finishLogin(c *fiber.Ctx, sess *session.Session, client *api.Client, email, encryptedCreds string) error {
+	twoFactor, err := h.twoFactor.Enabled(email)
+	if err != nil {
+		log.Printf("Error reading two-factor settings for %s: %v", email, err)
+		return c.Status(500).Render("login", fiber.Map{
+			"Error": "Server error occurred during setup",
+			"Email": email,
+		})
+	}
+	if !twoFactor {
+		h.limiter.Succeed(c.IP(), email)
+		return h.completeLogin(c, sess, client, email, encryptedCreds)
+	}
+
+	// The credentials were right; the session is only authenticated once the
+	// second step succeeds too
+	if err := sess.Regenerate(); err != nil {
+		return c.Status(500).Render("login", fiber.Map{
+			"Error": "Failed to create session",
+			"Email": email,
+		})
+	}
+	sess.Set("pending_credentials", encryptedCreds)
+	sess.Set("pending_until", time.Now().Add(pendingLoginTimeout).Unix())
+	if err := sess.Save(); err != nil {
+		return c.Status(500).Render("login", fiber.Map{
+			"Error": "Failed to create session",
+			"Email": email,
+		})
+	}
+
+	return c.Redirect("/login/verify")
+}
+
+// HandleOAuthStart sends the browser to the OAuth provider. The state and
+// PKCE verifier stay in the session until the provider redirects back.
+func (h *AuthHandler) HandleOAuthStart(c *fiber.Ctx) error {
+	if h.oauth == nil {
+		return c.Redirect("/login")
+	}
+
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	state, err := oauth.NewVerifier()
+	if err != nil {
+		return c.Status(500).SendString("Failed to start sign-in")
+	}
+	verifier, err := oauth.NewVerifier()
+	if err != nil {
+		return c.Status(500).SendString("Failed to start sign-in")
+	}
+
+	sess.Set("oauth_state", state)
+	sess.Set("oauth_verifier", verifier)
+	if err := sess.Save(); err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	return c.Redirect(h.oauth.AuthCodeURL(state, verifier))
+}
+
+// HandleOAuthCallback completes the authorization code flow and logs in to
+// the mail server with the access token
+func (h *AuthHandler) HandleOAuthCallback(c *fiber.Ctx) error {
+	if h.oauth == nil {
+		return c.Redirect("/login")
+	}
+	h.offerOAuth(c)
+
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	state, _ := sess.Get("oauth_state").(string)
+	verifier, _ := sess.Get("oauth_verifier").(string)
+	sess.Delete("oauth_state")
+	sess.Delete("oauth_verifier")
+	if err := sess.Save(); err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	if reason := c.Query("error"); reason != "" {
+		log.Printf("OAuth sign-in refused by provider: %s %s", reason, c.Query("error_description"))
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Sign-in was cancelled or refused",
+		})
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		return c.Status(400).Render("login", fiber.Map{
+			"Error": "Your sign-in has expired, please try again",
+		})
+	}
+
+	token, err := h.oauth.Exchange(c.Context(), c.Query("code"), verifier)
+	if err != nil {
+		log.Printf("OAuth code exchange failed: %v", err)
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Sign-in failed",
+		})
+	}
+	email, err := h.oauth.Email(c.Context(), token)
+	if err != nil {
+		log.Printf("OAuth sign-in without usable address: %v", err)
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Sign-in failed",
+		})
+	}
+
+	creds := &api.Credentials{
+		Email:        email,
+		Password:     token.AccessToken,
+		Mechanism:    h.oauth.Mechanism(),
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+	client, err := api.NewClient(creds.Profile(h.config.IMAP.Profile), creds.Email, creds.Password)
+	if err != nil {
+		log.Printf("OAuth token for %s refused by the mail server: %v", email, err)
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "The mail server did not accept the sign-in",
+			"Email": email,
+		})
+	}
+	defer client.Close()
+
+	encryptedCreds, err := api.SealCredentials(creds, h.config.Encryption.Keyring)
+	if err != nil {
+		return c.Status(500).Render("login", fiber.Map{
+			"Error": "Failed to secure credentials",
+			"Email": email,
+		})
+	}
+
+	return h.finishLogin(c, sess, client, email, encryptedCreds)
+}
+
+// HandleOIDCStart sends the browser to the OpenID Connect provider
+func (h *AuthHandler) HandleOIDCStart(c *fiber.Ctx) error {
+	if h.oidc == nil {
+		return c.Redirect("/login")
+	}
+	h.offerOAuth(c)
+
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	state, err := oauth.NewVerifier()
+	if err != nil {
+		return c.Status(500).SendString("Failed to start sign-in")
+	}
+	verifier, err := oauth.NewVerifier()
+	if err != nil {
+		return c.Status(500).SendString("Failed to start sign-in")
+	}
+	nonce, err := oauth.NewVerifier()
+	if err != nil {
+		return c.Status(500).SendString("Failed to start sign-in")
+	}
+
+	target, err := h.oidc.AuthCodeURL(c.Context(), state, verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC sign-in unavailable: %v", err)
+		return c.Status(502).Render("login", fiber.Map{
+			"Error": "Single sign-on is unavailable, please try again later",
+		})
+	}
+
+	sess.Set("oidc_state", state)
+	sess.Set("oidc_verifier", verifier)
+	sess.Set("oidc_nonce", nonce)
+	if err := sess.Save(); err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	return c.Redirect(target)
+}
+
+// HandleOIDCCallback verifies the ID token and opens the mailbox it names
+// with the master user
+func (h *AuthHandler) HandleOIDCCallback(c *fiber.Ctx) error {
+	if h.oidc == nil {
+		return c.Redirect("/login")
+	}
+	h.offerOAuth(c)
+
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	state, _ := sess.Get("oidc_state").(string)
+	verifier, _ := sess.Get("oidc_verifier").(string)
+	nonce, _ := sess.Get("oidc_nonce").(string)
+	sess.Delete("oidc_state")
+	sess.Delete("oidc_verifier")
+	sess.Delete("oidc_nonce")
+	if err := sess.Save(); err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	if reason := c.Query("error"); reason != "" {
+		log.Printf("OIDC sign-in refused by provider: %s %s", reason, c.Query("error_description"))
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Sign-in was cancelled or refused",
+		})
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		return c.Status(400).Render("login", fiber.Map{
+			"Error": "Your sign-in has expired, please try again",
+		})
+	}
+
+	mailbox, err := h.oidc.Exchange(c.Context(), c.Query("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC sign-in failed: %v", err)
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Sign-in failed",
+		})
+	}
+
+	creds := &api.Credentials{
+		Email:     mailbox,
+		Mechanism: config.AuthMaster,
+	}
+	client, err := api.NewClient(creds.Profile(h.config.IMAP.Profile), creds.Email, creds.Password)
+	if err != nil {
+		log.Printf("Master user login to %s failed: %v", mailbox, err)
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Your mailbox could not be opened",
+			"Email": mailbox,
+		})
+	}
+	defer client.Close()
+
+	encryptedCreds, err := api.SealCredentials(creds, h.config.Encryption.Keyring)
+	if err != nil {
+		return c.Status(500).Render("login", fiber.Map{
+			"Error": "Failed to secure credentials",
+			"Email": mailbox,
+		})
+	}
+
+	log.Printf("OIDC login to mailbox %s", mailbox)
+	return h.finishLogin(c, sess, client, mailbox, encryptedCreds)
+}
+
+// offerOAuth makes the login page show the provider buttons
+func (h *AuthHandler) offerOAuth(c *fiber.Ctx) {
+	if h.oauth != nil {
+		c.Locals("OAuthName", h.config.OAuth.Name)
+	}
+	if h.oidc != nil {
+		c.Locals("OIDCName", h.config.OIDC.Name)
+	}
+}
+
+// ShowVerify renders the second login step
+func (h *AuthHandler) ShowVerify(c *fiber.Ctx) error {
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+	if _, err := h.pendingLogin(sess); err != nil {
+		return c.Redirect("/login")
+	}
+	return c.Render("login-verify", fiber.Map{})
+}
+
+// HandleVerify checks the authenticator or recovery code of the second
+// login step
+func (h *AuthHandler) HandleVerify(c *fiber.Ctx) error {
+	h.offerOAuth(c)
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return c.Status(500).SendString("Session error")
+	}
+
+	creds, err := h.pendingLogin(sess)
+	if err != nil {
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Your login has expired, please sign in again",
+		})
+	}
+	encryptedCreds, _ := sess.Get("pending_credentials").(string)
+
+	attempt, wait := h.limiter.Check(c.IP(), creds.Email)
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+		return c.Status(429).Render("login-verify", fiber.Map{
+			"Error": fmt.Sprintf("Too many failed attempts. Try again in %s.", waitText(seconds)),
+		})
+	}
+	defer attempt.Release()
+
+	if err := h.twoFactor.Verify(creds.Email, c.FormValue("code")); err != nil {
+		if !errors.Is(err, twofactor.ErrInvalidCode) {
+			log.Printf("Error verifying two-factor code for %s: %v", creds.Email, err)
+			return c.Status(500).Render("login-verify", fiber.Map{
+				"Error": "Server error occurred during verification",
+			})
+		}
+		attempt.Fail()
+		return c.Status(401).Render("login-verify", fiber.Map{
+			"Error": "Invalid verification code",
+		})
+	}
+	attempt.Succeed()
+
+	client, err := api.NewClient(creds.Profile(h.config.IMAP.Profile), creds.Email, creds.Password)
+	if err != nil {
+		return c.Status(401).Render("login", fiber.Map{
+			"Error": "Invalid credentials or server error",
+			"Email": creds.Email,
+		})
+	}
+	defer client.Close()
+
+	return h.completeLogin(c, sess, client, creds.Email, encryptedCreds)
+}
+
+// pendingLogin returns the credentials of a login waiting for its second
+// step
+func (h *AuthHandler) pendingLogin(sess *session.Session) (*api.Credentials, error) {
+	encryptedCreds, _ := sess.Get("pending_credentials").(string)
+	until, _ := sess.Get("pending_until").(int64)
+	if encryptedCreds == "" || time.Now().Unix() > until {
+		return nil, fmt.Errorf("no pending login")
+	}
+	return api.DecryptCredentials(encryptedCreds, h.config.Encryption.Keyring)
+}
+
+// completeLogin authenticates the session of a user whose credentials
+// (and second factor, if enabled) were checked
+func (h *AuthHandler) completeLogin(c *fiber.Ctx, sess *session.Session, client *api.Client, email, encryptedCreds string) error {
+	username := api.GetUsernameFromEmail(email)
+
 	userCacheFolder := filepath.Join(h.config.Cache.Folder, username)
 	if err := h.ensureUserCacheFolder(userCacheFolder); err != nil {
 		return c.Status(500).Render("login", fiber.Map{
@@ -88,7 +484,7 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 		})
 	}
 
-	token, err := api.GenerateToken(username, email, h.config.JWT.Secret)
+	token, claims, err := api.GenerateToken(username, email, h.config.JWT.Secret)
 	if err != nil {
 		return c.Status(500).Render("login", fiber.Map{
 			"Error": "Failed to create authentication token",
@@ -96,18 +492,22 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 		})
 	}
 
-	encryptedCreds, err := api.EncryptCredentials(email, password, h.config.Encryption.Key)
-	if err != nil {
+	// A new session ID, so an ID planted before login is worthless
+	if err := sess.Regenerate(); err != nil {
 		return c.Status(500).Render("login", fiber.Map{
-			"Error": "Failed to secure credentials",
+			"Error": "Failed to create session",
 			"Email": email,
 		})
 	}
 
+	sess.Delete("pending_credentials")
+	sess.Delete("pending_until")
 	sess.Set("authenticated", true)
 	sess.Set("email", email)
 	sess.Set("username", username)
 	sess.Set("token", token)
+	sess.Set("token_id", claims.ID)
+	sess.Set("token_expiry", claims.ExpiresAt.Unix())
 	sess.Set("credentials", encryptedCreds)
 	sess.SetExpiry(24 * 60 * 60 * time.Second)
 
@@ -122,6 +522,10 @@ func (h *AuthHandler) HandleLogin(c *fiber.Ctx) error {
 		fmt.Printf("Error fetching initial data for user %s: %v\n", username, err)
 	}
 
+	for _, fn := range h.logins {
+		fn(email, encryptedCreds)
+	}
+
 	return c.Redirect("/inbox")
 }
 
@@ -187,12 +591,8 @@ func (h *AuthHandler) clearUserCache(path string) error {
 }
 
 func (h *AuthHandler) fetchInitialData(client *api.Client, cacheFolder string) error {
-	folders, err := client.FetchFolders()
-	if err != nil {
-		return fmt.Errorf("failed to fetch folders: %v", err)
-	}
-	if err := utils.SaveCache(filepath.Join(cacheFolder, "folders.json"), folders); err != nil {
-		return fmt.Errorf("failed to cache folders: %v", err)
+	if _, err := h.cacheFolders(client, cacheFolder); err != nil {
+		return err
 	}
 
 	messages, err := client.FetchMessages("INBOX", 10)
@@ -207,26 +607,106 @@ func (h *AuthHandler) fetchInitialData(client *api.Client, cacheFolder string) e
 	return nil
 }
 
-// Add this method to the AuthHandler struct
-func (h *AuthHandler) CreateIMAPClient(c *fiber.Ctx) (*api.Client, error) {
-	// Get credentials from session
+// cacheFolders fetches the folder list and stores it as folders.json
+func (h *AuthHandler) cacheFolders(client *api.Client, cacheFolder string) ([]*api.MailboxInfo, error) {
+	folders, err := client.FetchFolders()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch folders: %v", err)
+	}
+	if err := utils.SaveCache(filepath.Join(cacheFolder, "folders.json"), folders); err != nil {
+		return nil, fmt.Errorf("failed to cache folders: %v", err)
+	}
+	return folders, nil
+}
+
+// RefreshFolders updates the cached folder list of the session user after
+// folders changed on the server
+func (h *AuthHandler) RefreshFolders(c *fiber.Ctx, client *api.Client) ([]*api.MailboxInfo, error) {
+	username := api.GetSessionUser(c)
+	if username == "" {
+		return nil, fmt.Errorf("no user in session")
+	}
+	return h.cacheFolders(client, filepath.Join(h.config.Cache.Folder, username))
+}
+
+// SaveFolders replaces the cached folder list of the session user
+func (h *AuthHandler) SaveFolders(c *fiber.Ctx, folders []*api.MailboxInfo) error {
+	username := api.GetSessionUser(c)
+	if username == "" {
+		return fmt.Errorf("no user in session")
+	}
+	return utils.SaveCache(filepath.Join(h.config.Cache.Folder, username, "folders.json"), folders)
+}
+
+// LoadFolders returns the cached folder list of the session user
+func (h *AuthHandler) LoadFolders(c *fiber.Ctx) ([]*api.MailboxInfo, error) {
+	username := api.GetSessionUser(c)
+	if username == "" {
+		return nil, fmt.Errorf("no user in session")
+	}
+
+	var folders []*api.MailboxInfo
+	if err := utils.LoadCache(filepath.Join(h.config.Cache.Folder, username, "folders.json"), &folders); err != nil {
+		return nil, err
+	}
+	// Caches written before roles were detected carry none
+	api.AssignRoles(folders)
+	return folders, nil
+}
+
+// EncryptedCredentials returns the still-encrypted credentials stored in the
+// session, for handing over to background workers
+func (h *AuthHandler) EncryptedCredentials(c *fiber.Ctx) (string, error) {
 	sess, err := h.store.Get(c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get session: %v", err)
+		return "", fmt.Errorf("failed to get session: %v", err)
 	}
 
 	encryptedCreds := sess.Get("credentials")
 	if encryptedCreds == nil {
-		return nil, fmt.Errorf("no credentials found in session")
+		return "", fmt.Errorf("no credentials found in session")
 	}
 
 	encryptedStr, ok := encryptedCreds.(string)
 	if !ok {
-		return nil, fmt.Errorf("invalid credentials format")
+		return "", fmt.Errorf("invalid credentials format")
+	}
+
+	return encryptedStr, nil
+}
+
+// waitText describes a throttling delay for the login page
+func waitText(seconds int) string {
+	if seconds < 60 {
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	minutes := (seconds + 59) / 60
+	if minutes == 1 {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// Add this method to the AuthHandler struct
+func (h *AuthHandler) CreateIMAPClient(c *fiber.Ctx) (*api.Client, error) {
+	dial, err := h.IMAPDialer(c)
+	if err != nil {
+		return nil, err
+	}
+	return dial()
+}
+
+// IMAPDialer returns a function opening IMAP connections for the session
+// user. It does not touch the request, so it can be used from goroutines.
+func (h *AuthHandler) IMAPDialer(c *fiber.Ctx) (func() (*api.Client, error), error) {
+	// Get credentials from session
+	encryptedStr, err := h.EncryptedCredentials(c)
+	if err != nil {
+		return nil, err
 	}
 
 	// Decrypt credentials
-	creds, err := api.DecryptCredentials(encryptedStr, h.config.Encryption.Key)
+	creds, err := api.DecryptCredentials(encryptedStr, h.config.Encryption.Keyring)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt credentials: %v", err)
 	}
@@ -237,48 +717,43 @@ func (h *AuthHandler) CreateIMAPClient(c *fiber.Ctx) (*api.Client, error) {
 		return nil, fmt.Errorf("invalid email format")
 	}
 
-	// Create new IMAP client
-	return api.NewClient(
-		h.config.IMAP.Server,
-		h.config.IMAP.Port,
-		creds.Email,
-		creds.Password,
-	)
+	return func() (*api.Client, error) {
+		return api.NewClient(creds.Profile(h.config.IMAP.Profile), creds.Email, creds.Password)
+	}, nil
 }
 
 func (h *AuthHandler) CreateSMTPClient(c *fiber.Ctx) (*api.SMTPClient, error) {
-	// Convert IMAP server to SMTP server (e.g., imap.gmail.com -> smtp.gmail.com)
-	smtpServer := strings.Replace(h.config.IMAP.Server, "imap.", "smtp.", 1)
-
-	// Get SMTP port from config, or use default
-	smtpPort := h.config.SMTP.GetPort()
-
 	// Get credentials from session
-	sess, err := h.store.Get(c)
+	encryptedStr, err := h.EncryptedCredentials(c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get session: %v", err)
-	}
-
-	encryptedCreds := sess.Get("credentials")
-	if encryptedCreds == nil {
-		return nil, fmt.Errorf("no credentials found in session")
-	}
-
-	encryptedStr, ok := encryptedCreds.(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid credentials format")
+		return nil, err
 	}
 
 	// Decrypt credentials
-	creds, err := api.DecryptCredentials(encryptedStr, h.config.Encryption.Key)
+	creds, err := api.DecryptCredentials(encryptedStr, h.config.Encryption.Keyring)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt credentials: %v", err)
 	}
 
-	client := api.NewSMTPClient(smtpServer, smtpPort, creds.Email, creds.Password)
+	client := api.NewSMTPClient(creds.Profile(h.config.SMTP.Profile), creds.Email, creds.Password)
 	if client == nil {
 		return nil, fmt.Errorf("failed to create SMTP client")
 	}
 
 	return client, nil
 }
+
+// CreateSieveClient opens a ManageSieve connection for the session user
+func (h *AuthHandler) CreateSieveClient(c *fiber.Ctx) (*api.SieveClient, error) {
+	encryptedStr, err := h.EncryptedCredentials(c)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := api.DecryptCredentials(encryptedStr, h.config.Encryption.Keyring)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials: %v", err)
+	}
+
+	return api.NewSieveClient(creds.Profile(h.config.Sieve.Profile), creds.Email, creds.Password)
+}
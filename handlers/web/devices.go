@@ -0,0 +1,191 @@
+// handlers/web/devices.go
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/storage"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+type DeviceHandler struct {
+	store    *session.Store
+	config   *config.Config
+	sessions *storage.Store
+	denylist *api.Denylist
+}
+
+// Device is a signed-in session as shown to its owner. The session key is
+// a secret, so devices are named by a hash of it.
+type Device struct {
+	ID        string    `json:"id"`
+	Current   bool      `json:"current"`
+	Name      string    `json:"name"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func NewDeviceHandler(store *session.Store, config *config.Config, sessions *storage.Store, denylist *api.Denylist) *DeviceHandler {
+	return &DeviceHandler{
+		store:    store,
+		config:   config,
+		sessions: sessions,
+		denylist: denylist,
+	}
+}
+
+// HandleList renders the user's sessions for htmx requests and returns
+// them as JSON otherwise
+func (h *DeviceHandler) HandleList(c *fiber.Ctx) error {
+	sessions, err := h.sessions.Sessions(api.GetSessionEmail(c))
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error listing sessions",
+		})
+	}
+
+	current := h.currentKey(c)
+	devices := make([]Device, 0, len(sessions))
+	for _, meta := range sessions {
+		devices = append(devices, Device{
+			ID:        deviceID(meta.Key),
+			Current:   meta.Key == current,
+			Name:      describeAgent(meta.UserAgent),
+			IP:        meta.IP,
+			UserAgent: meta.UserAgent,
+			CreatedAt: meta.CreatedAt,
+			LastSeen:  meta.LastSeen,
+		})
+	}
+
+	if c.Get("HX-Request") != "" {
+		return c.Render("partials/devices", fiber.Map{
+			"Devices": devices,
+		}, "")
+	}
+
+	return c.JSON(devices)
+}
+
+// HandleRevoke signs out one of the user's other sessions
+func (h *DeviceHandler) HandleRevoke(c *fiber.Ctx) error {
+	owner := api.GetSessionEmail(c)
+	sessions, err := h.sessions.Sessions(owner)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error listing sessions",
+		})
+	}
+
+	for _, meta := range sessions {
+		if deviceID(meta.Key) != c.Params("id") {
+			continue
+		}
+		if meta.Key == h.currentKey(c) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Use sign out to end this session",
+			})
+		}
+		if err := h.sessions.Delete(meta.Key); err != nil {
+			log.Printf("Error deleting session: %v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Error signing out the device",
+			})
+		}
+		return h.revoked(c, []storage.SessionMeta{meta})
+	}
+
+	return c.Status(404).JSON(fiber.Map{
+		"error": "Session not found",
+	})
+}
+
+// HandleRevokeOthers signs out every session of the user but this one
+func (h *DeviceHandler) HandleRevokeOthers(c *fiber.Ctx) error {
+	deleted, err := h.sessions.DeleteOwner(api.GetSessionEmail(c), h.currentKey(c))
+	if err != nil {
+		log.Printf("Error deleting sessions: %v", err)
+		if len(deleted) == 0 {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Error signing out other devices",
+			})
+		}
+	}
+	return h.revoked(c, deleted)
+}
+
+// revoked denies the tokens of deleted sessions, so a copied token stops
+// working along with its session
+func (h *DeviceHandler) revoked(c *fiber.Ctx, deleted []storage.SessionMeta) error {
+	if err := h.denylist.RevokeSessions(deleted); err != nil {
+		log.Printf("Error revoking tokens: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Signed out, but the access tokens could not be revoked",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"revoked": len(deleted),
+	})
+}
+
+func (h *DeviceHandler) currentKey(c *fiber.Ctx) string {
+	sess, err := h.store.Get(c)
+	if err != nil {
+		return ""
+	}
+	return sess.ID()
+}
+
+func deviceID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// describeAgent names the browser and system of a User-Agent header, such
+// as "Firefox on Linux"
+func describeAgent(ua string) string {
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	systems := []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+
+	browser := "Unknown browser"
+	for _, b := range browsers {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(ua, s.token) {
+			return browser + " on " + s.name
+		}
+	}
+	return browser
+}
@@ -0,0 +1,166 @@
+// handlers/web/drafts.go
+package web
+
+import (
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/identity"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+type DraftHandler struct {
+	store      *session.Store
+	config     *config.Config
+	auth       *AuthHandler
+	identities *identity.Store
+}
+
+func NewDraftHandler(store *session.Store, config *config.Config, auth *AuthHandler, identities *identity.Store) *DraftHandler {
+	return &DraftHandler{
+		store:      store,
+		config:     config,
+		auth:       auth,
+		identities: identities,
+	}
+}
+
+// HandleSaveDraft stores the compose form in the Drafts folder, replacing
+// the version identified by draft_uid
+func (h *DraftHandler) HandleSaveDraft(c *fiber.Ctx) error {
+	to := c.FormValue("to")
+	cc := c.FormValue("cc")
+	subject := c.FormValue("subject")
+	body := c.FormValue("body")
+	previousUID := c.FormValue("draft_uid")
+
+	if strings.TrimSpace(to+cc+subject+body) == "" {
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"draftUid": previousUID,
+		})
+	}
+
+	ident, err := resolveIdentity(c, h.identities)
+	if err != nil {
+		return identityError(c, err)
+	}
+
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	// The signature is only added when sending, so drafts keep the text
+	// as typed
+	msg := &api.OutgoingMessage{
+		From:       ident.From(),
+		To:         lenientAddressList(to),
+		Cc:         lenientAddressList(cc),
+		Subject:    subject,
+		Body:       body,
+		InReplyTo:  c.FormValue("in_reply_to"),
+		References: c.FormValue("references"),
+	}
+
+	uid, err := client.SaveDraft(msg, previousUID)
+	if err != nil {
+		log.Printf("Error saving draft: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error saving draft",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"draftUid": uid,
+	})
+}
+
+// HandleGetDraft returns a draft in the shape expected by the compose form
+func (h *DraftHandler) HandleGetDraft(c *fiber.Ctx) error {
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	folder, err := client.DraftsFolder()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error locating Drafts folder",
+		})
+	}
+
+	email, err := client.FetchSingleMessage(folder, c.Params("uid"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Draft not found",
+		})
+	}
+
+	ident, err := h.identities.Match(api.GetSessionEmail(c), []string{email.From})
+	if err != nil {
+		return identityError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"draft": fiber.Map{
+			"to":         email.To,
+			"cc":         email.Cc,
+			"subject":    email.Subject,
+			"body":       email.Body,
+			"identityId": ident.ID,
+			"inReplyTo":  email.InReplyTo,
+			"references": email.References,
+			"draftUid":   email.ID,
+		},
+	})
+}
+
+// HandleDeleteDraft discards a draft
+func (h *DraftHandler) HandleDeleteDraft(c *fiber.Ctx) error {
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	if err := client.DeleteDraft(c.Params("uid")); err != nil {
+		log.Printf("Error deleting draft: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error deleting draft",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+// lenientAddressList parses what the user typed so far. Drafts may hold
+// incomplete addresses, which are kept verbatim instead of being rejected.
+func lenientAddressList(list string) []*mail.Address {
+	if addrs, err := api.ParseAddressList(list); err == nil {
+		return addrs
+	}
+
+	var addrs []*mail.Address
+	for _, part := range strings.Split(list, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			addrs = append(addrs, &mail.Address{Address: part})
+		}
+	}
+	return addrs
+}
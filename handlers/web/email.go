@@ -5,26 +5,39 @@ import (
 	"fmt"
 	"lilmail/config"
 	"lilmail/handlers/api"
-	"lilmail/utils"
+	"lilmail/identity"
+	"lilmail/labels"
+	"lilmail/models"
+	"lilmail/outbox"
 	"log"
 	"net/url"
-	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
 )
 
 type EmailHandler struct {
-	store  *session.Store
-	config *config.Config
-	auth   *AuthHandler
+	store      *session.Store
+	config     *config.Config
+	auth       *AuthHandler
+	outbox     *outbox.Queue
+	sender     *outbox.Worker
+	identities *identity.Store
+	labels     *labels.Store
 }
 
-func NewEmailHandler(store *session.Store, config *config.Config, auth *AuthHandler) *EmailHandler {
+func NewEmailHandler(store *session.Store, config *config.Config, auth *AuthHandler, queue *outbox.Queue, sender *outbox.Worker, identities *identity.Store, labelStore *labels.Store) *EmailHandler {
 	return &EmailHandler{
-		store:  store,
-		config: config,
-		auth:   auth,
+		store:      store,
+		config:     config,
+		auth:       auth,
+		outbox:     queue,
+		sender:     sender,
+		identities: identities,
+		labels:     labelStore,
 	}
 }
 
@@ -41,9 +54,8 @@ func (h *EmailHandler) HandleInbox(c *fiber.Ctx) error {
 	}
 
 	// Load folders from cache
-	userCacheFolder := filepath.Join(h.config.Cache.Folder, userStr)
-	var folders []*api.MailboxInfo
-	if err := utils.LoadCache(filepath.Join(userCacheFolder, "folders.json"), &folders); err != nil {
+	folders, err := h.auth.LoadFolders(c)
+	if err != nil {
 		return c.Status(500).SendString("Error loading folders")
 	}
 
@@ -55,7 +67,7 @@ func (h *EmailHandler) HandleInbox(c *fiber.Ctx) error {
 	defer client.Close()
 
 	// Fetch inbox messages
-	emails, err := client.FetchMessages("INBOX", 50)
+	emails, filter, err := h.fetchListing(c, client, "INBOX")
 	if err != nil {
 		return c.Status(500).SendString("Error fetching emails")
 	}
@@ -68,13 +80,51 @@ func (h *EmailHandler) HandleInbox(c *fiber.Ctx) error {
 
 	return c.Render("inbox", fiber.Map{
 		"Username":      userStr,
-		"Folders":       folders,
+		"FolderTree":    folderTree(c, h.config, folders, "INBOX"),
 		"Emails":        emails,
 		"CurrentFolder": "INBOX",
+		"DraftsFolder":  api.FolderByRole(folders, api.RoleDrafts),
 		"Token":         token,
+		"Labels":        filter.byKeyword,
+		"AllLabels":     filter.all,
+		"CurrentLabel":  filter.current,
+		"SieveEnabled":  h.config.Sieve.Enabled,
 	})
 }
 
+// labelFilter holds the labels of the session user and the one given by
+// ?label=, if any
+type labelFilter struct {
+	all       []*labels.Label
+	byKeyword map[string]*labels.Label
+	current   *labels.Label
+}
+
+// fetchListing fetches the newest messages of a folder, only those carrying
+// the label given by ?label= when set
+func (h *EmailHandler) fetchListing(c *fiber.Ctx, client *api.Client, folderName string) ([]models.Email, labelFilter, error) {
+	var filter labelFilter
+	owner := api.GetSessionEmail(c)
+
+	var err error
+	if filter.all, err = h.labels.List(owner); err != nil {
+		log.Printf("Error loading labels: %v", err)
+	}
+	filter.byKeyword = labels.ByKeyword(filter.all)
+	for _, label := range filter.all {
+		if label.ID == c.Query("label") {
+			filter.current = label
+		}
+	}
+
+	if filter.current != nil {
+		emails, err := client.FetchMessagesWithKeyword(folderName, filter.current.Keyword, 50)
+		return emails, filter, err
+	}
+	emails, err := client.FetchMessages(folderName, 50)
+	return emails, filter, err
+}
+
 // HandleFolder displays emails from a specific folder
 func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 	username := c.Locals("username")
@@ -93,9 +143,8 @@ func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 	}
 
 	// Load folders for sidebar
-	userCacheFolder := filepath.Join(h.config.Cache.Folder, userStr)
-	var folders []*api.MailboxInfo
-	if err := utils.LoadCache(filepath.Join(userCacheFolder, "folders.json"), &folders); err != nil {
+	folders, err := h.auth.LoadFolders(c)
+	if err != nil {
 		return c.Status(500).SendString("Error loading folders")
 	}
 
@@ -107,7 +156,7 @@ func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 	defer client.Close()
 
 	// Fetch folder emails
-	emails, err := client.FetchMessages(folderName, 50)
+	emails, filter, err := h.fetchListing(c, client, folderName)
 	if err != nil {
 		return c.Status(500).SendString("Error fetching emails")
 	}
@@ -120,21 +169,20 @@ func (h *EmailHandler) HandleFolder(c *fiber.Ctx) error {
 
 	return c.Render("inbox", fiber.Map{
 		"Username":      userStr,
-		"Folders":       folders,
+		"FolderTree":    folderTree(c, h.config, folders, folderName),
 		"Emails":        emails,
 		"CurrentFolder": folderName,
+		"DraftsFolder":  api.FolderByRole(folders, api.RoleDrafts),
 		"Token":         token,
+		"Labels":        filter.byKeyword,
+		"AllLabels":     filter.all,
+		"CurrentLabel":  filter.current,
+		"SieveEnabled":  h.config.Sieve.Enabled,
 	})
 }
 
 // HandleEmailView handles the HTMX request for viewing a single email
 func (h *EmailHandler) HandleEmailView(c *fiber.Ctx) error {
-	// Validate Authorization header
-	token := c.Get("Authorization")
-	if token == "" || len(token) < 8 || token[:7] != "Bearer " {
-		return c.Status(401).SendString("Unauthorized")
-	}
-
 	// Get folder and email ID
 	folderName := c.Get("X-Folder")
 	if folderName == "" {
@@ -166,28 +214,93 @@ func (h *EmailHandler) HandleEmailView(c *fiber.Ctx) error {
 			"error": fmt.Sprintf("Error fetching email: %v", err),
 		})
 	}
+	// Opening a message marks it as read
+	if !hasFlag(email.Flags, imap.SeenFlag) {
+		if err := client.MarkMessageAsRead(folderName, emailID); err != nil {
+			log.Printf("Error marking email %s as read: %v", emailID, err)
+		} else {
+			countsChanged(c, folderName)
+		}
+	}
+
+	allLabels, err := h.labels.List(api.GetSessionEmail(c))
+	if err != nil {
+		log.Printf("Error loading labels: %v", err)
+	}
 	// Important: Set empty layout and only render the partial
 	return c.Render("partials/email-viewer", fiber.Map{
 		"Email":         email,
 		"CurrentFolder": folderName,
+		"AllLabels":     allLabels,
+		"EmailLabels":   labelsOf(email.Flags, labels.ByKeyword(allLabels)),
 		"Layout":        "", // This is crucial to prevent full HTML rendering
 	}, "") // Add empty string as second argument to explicitly disable layout
 }
 
-// HandleDeleteEmail handles the email deletion request
-func (h *EmailHandler) HandleDeleteEmail(c *fiber.Ctx) error {
-	// Validate Authorization header
-	token := c.Get("Authorization")
-	if token == "" || len(token) < 8 || token[:7] != "Bearer " {
-		return c.Status(401).SendString("Unauthorized")
+// HandleReplyEmail returns the compose fields for answering a message,
+// sent from the identity the message was addressed to. Pass all=1 to
+// reply to all recipients.
+func (h *EmailHandler) HandleReplyEmail(c *fiber.Ctx) error {
+	folderName := c.Query("folder", "INBOX")
+	owner := api.GetSessionEmail(c)
+
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	email, err := client.FetchSingleMessage(folderName, c.Params("id"))
+	if err != nil {
+		log.Printf("Error fetching email %s from folder %s: %v", c.Params("id"), folderName, err)
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Email not found",
+		})
+	}
+
+	identities, err := h.identities.List(owner)
+	if err != nil {
+		return identityError(c, err)
+	}
+	isOwn := func(address string) bool {
+		for _, ident := range identities {
+			if strings.EqualFold(strings.TrimSpace(address), ident.Email) {
+				return true
+			}
+		}
+		return false
 	}
 
-	// Validate JWT token
-	_, err := api.ValidateToken(token[7:], h.config.JWT.Secret)
+	// Delivered-To names the alias that received the message even when it
+	// only appears in Bcc
+	recipients := append([]string{}, email.DeliveredTo...)
+	for _, list := range []string{email.To, email.Cc, email.From} {
+		recipients = append(recipients, strings.Split(list, ",")...)
+	}
+	ident, err := h.identities.Match(owner, recipients)
 	if err != nil {
-		return c.Status(401).SendString("Invalid token")
+		return identityError(c, err)
 	}
 
+	reply := api.NewReply(email, isOwn, c.Query("all") != "")
+
+	return c.JSON(fiber.Map{
+		"reply": fiber.Map{
+			"to":         reply.To,
+			"cc":         reply.Cc,
+			"subject":    reply.Subject,
+			"body":       reply.Body,
+			"inReplyTo":  reply.InReplyTo,
+			"references": reply.References,
+			"identityId": ident.ID,
+		},
+	})
+}
+
+// HandleDeleteEmail handles the email deletion request
+func (h *EmailHandler) HandleDeleteEmail(c *fiber.Ctx) error {
 	// Get folder and email ID
 	folderName := c.Get("X-Folder")
 	if folderName == "" {
@@ -219,12 +332,47 @@ func (h *EmailHandler) HandleDeleteEmail(c *fiber.Ctx) error {
 		})
 	}
 
+	countsChanged(c, folderName)
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Email deleted successfully",
 	})
 }
 
+// HandleMarkUnread clears the \Seen flag of a message
+func (h *EmailHandler) HandleMarkUnread(c *fiber.Ctx) error {
+	folderName := c.Query("folder", "INBOX")
+
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	if err := client.MarkMessageAsUnread(folderName, c.Params("id")); err != nil {
+		log.Printf("Error marking email %s as unread: %v", c.Params("id"), err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error marking email as unread",
+		})
+	}
+
+	countsChanged(c, folderName)
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
 // handlers/web/email.go
 // HandleFolderEmails handles template rendering for folder contents
 func (h *EmailHandler) HandleFolderEmails(c *fiber.Ctx) error {
@@ -242,14 +390,6 @@ func (h *EmailHandler) HandleFolderEmails(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get JWT token for API requests
-	token, err := api.GetSessionToken(c, h.store)
-	if err != nil {
-		return c.Status(401).JSON(fiber.Map{
-			"error": "Invalid session",
-		})
-	}
-
 	// Get IMAP client
 	client, err := h.auth.CreateIMAPClient(c)
 	if err != nil {
@@ -260,7 +400,7 @@ func (h *EmailHandler) HandleFolderEmails(c *fiber.Ctx) error {
 	defer client.Close()
 
 	// Fetch emails from the folder
-	emails, err := client.FetchMessages(folderName, 50)
+	emails, filter, err := h.fetchListing(c, client, folderName)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": fmt.Sprintf("Error fetching emails: %v", err),
@@ -270,10 +410,19 @@ func (h *EmailHandler) HandleFolderEmails(c *fiber.Ctx) error {
 	// Add debug logging
 	log.Printf("Folder: %s, Emails count: %d", folderName, len(emails))
 
+	// Cached folders tell us whether this is the Drafts folder
+	folders, err := h.auth.LoadFolders(c)
+	if err != nil {
+		log.Printf("Error loading cached folders: %v", err)
+	}
+
 	return c.Render("partials/email-list", fiber.Map{
 		"Emails":        emails,
 		"CurrentFolder": folderName,
-		"Token":         token,
+		"DraftsFolder":  api.FolderByRole(folders, api.RoleDrafts),
+		"Labels":        filter.byKeyword,
+		"AllLabels":     filter.all,
+		"CurrentLabel":  filter.current,
 	}, "") // Explicitly set no layout
 }
 
@@ -282,6 +431,7 @@ func (h *EmailHandler) HandleComposeEmail(c *fiber.Ctx) error {
 
 	// Get form values
 	to := c.FormValue("to")
+	cc := c.FormValue("cc")
 	subject := c.FormValue("subject")
 	body := c.FormValue("body")
 
@@ -291,44 +441,101 @@ func (h *EmailHandler) HandleComposeEmail(c *fiber.Ctx) error {
 		})
 	}
 
-	// Create SMTP client
-	smtpClient, err := h.auth.CreateSMTPClient(c)
-	if err != nil {
-		log.Printf("SMTP client creation error: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to connect to email server",
+	if err := validateRecipients(to, cc); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
 		})
 	}
 
-	// Send the email
-	err = smtpClient.SendMail(to, subject, body)
+	ident, err := resolveIdentity(c, h.identities)
 	if err != nil {
-		log.Printf("Email sending error: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error": fmt.Sprintf("Failed to send email: %v", err),
+		return identityError(c, err)
+	}
+	inReplyTo := c.FormValue("in_reply_to")
+	references := c.FormValue("references")
+
+	// A message is held back for the undo window unless the user picked a
+	// delivery time
+	sendAt, err := parseSendAt(c.FormValue("send_at"), c.FormValue("tz_offset"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
 		})
 	}
+	scheduled := !sendAt.IsZero()
+	if !scheduled {
+		sendAt = time.Now().Add(time.Duration(h.config.Outbox.UndoSeconds) * time.Second)
+	}
 
-	// Get IMAP client to save to Sent folder
-	imapClient, err := h.auth.CreateIMAPClient(c)
+	// Hand the message over to the outbox; the worker delivers it and
+	// retries temporary failures
+	encryptedCreds, err := h.auth.EncryptedCredentials(c)
 	if err != nil {
-		log.Printf("IMAP client error when saving to Sent: %v", err)
-		// Don't return error here since email was sent successfully
-	} else {
-		defer imapClient.Close()
+		log.Printf("Outbox credentials error: %v", err)
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid session",
+		})
+	}
 
-		// Try to save to Sent folder
-		if err := imapClient.SaveToSent(to, subject, body); err != nil {
-			log.Printf("Error saving to Sent folder: %v", err)
+	var msg *outbox.Message
+	if outboxID := c.FormValue("outbox_id"); outboxID != "" {
+		// Editing a message that is still waiting in the outbox
+		msg, err = h.outbox.Modify(outboxID, api.GetSessionEmail(c), func(m *outbox.Message) error {
+			m.Credentials = encryptedCreds
+			m.To = to
+			m.Cc = cc
+			m.Subject = subject
+			m.Body = body
+			m.Identity = ident
+			m.InReplyTo = inReplyTo
+			m.References = references
+			m.DraftUID = c.FormValue("draft_uid")
+			m.Requeue(sendAt)
+			return nil
+		})
+		if err != nil {
+			return outboxError(c, err)
+		}
+	} else {
+		msg = &outbox.Message{
+			Owner:       api.GetSessionEmail(c),
+			Credentials: encryptedCreds,
+			To:          to,
+			Cc:          cc,
+			Subject:     subject,
+			Body:        body,
+			Identity:    ident,
+			InReplyTo:   inReplyTo,
+			References:  references,
+			DraftUID:    c.FormValue("draft_uid"),
+			SendAt:      sendAt,
 		}
+		if err := h.outbox.Enqueue(msg); err != nil {
+			log.Printf("Outbox enqueue error: %v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to queue email",
+			})
+		}
+	}
+	h.sender.Wake()
+
+	message := "Email queued for delivery"
+	undoSeconds := h.config.Outbox.UndoSeconds
+	if scheduled {
+		message = fmt.Sprintf("Email scheduled for %s", sendAt.Format("Jan 02, 2006 15:04"))
+		undoSeconds = 0
 	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
-		"message": "Email sent successfully",
+		"message": message,
 		"details": fiber.Map{
-			"to":      to,
-			"subject": subject,
+			"id":          msg.ID,
+			"to":          to,
+			"subject":     subject,
+			"sendAt":      sendAt.Format(time.RFC3339),
+			"scheduled":   scheduled,
+			"undoSeconds": undoSeconds,
 		},
 	})
 }
@@ -0,0 +1,261 @@
+// handlers/web/folders.go
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/i18n"
+	"log"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+type FolderHandler struct {
+	store  *session.Store
+	config *config.Config
+	auth   *AuthHandler
+}
+
+func NewFolderHandler(store *session.Store, config *config.Config, auth *AuthHandler) *FolderHandler {
+	return &FolderHandler{
+		store:  store,
+		config: config,
+		auth:   auth,
+	}
+}
+
+// HandleManage renders the folder management view with every folder,
+// subscribed or not
+func (h *FolderHandler) HandleManage(c *fiber.Ctx) error {
+	folders, err := h.auth.LoadFolders(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error loading folders",
+		})
+	}
+
+	return c.Render("partials/folder-manager", fiber.Map{
+		"Folders":   folders,
+		"Protected": protectedFolders(folders),
+	}, "")
+}
+
+// HandleNav renders the sidebar folder list
+func (h *FolderHandler) HandleNav(c *fiber.Ctx) error {
+	folders, err := h.auth.LoadFolders(c)
+	if err != nil {
+		return c.Status(500).SendString("Error loading folders")
+	}
+
+	current := c.Query("current", "INBOX")
+	return c.Render("partials/folder-nav", fiber.Map{
+		"FolderTree":    folderTree(c, h.config, folders, current),
+		"CurrentFolder": current,
+	}, "")
+}
+
+// countWorkers is the number of IMAP connections used to count folders on
+// servers without LIST-STATUS
+const countWorkers = 4
+
+// HandleCounts returns the total and unread message counts of every folder,
+// or of the folder given by ?folder= only, and updates the folder cache
+func (h *FolderHandler) HandleCounts(c *fiber.Ctx) error {
+	folders, err := h.auth.LoadFolders(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error loading folders",
+		})
+	}
+
+	dial, err := h.auth.IMAPDialer(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+
+	var counts map[string]api.FolderCount
+	if name := c.Query("folder"); name != "" {
+		counts, err = folderCount(dial, name)
+	} else {
+		counts, err = api.FetchFolderCounts(folders, dial, countWorkers)
+	}
+	if err != nil {
+		log.Printf("Error counting folders: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error counting messages",
+		})
+	}
+
+	api.ApplyFolderCounts(folders, counts)
+	if err := h.auth.SaveFolders(c, folders); err != nil {
+		log.Printf("Error caching folder counts: %v", err)
+	}
+
+	all := make(map[string]api.FolderCount, len(folders))
+	for _, mb := range folders {
+		all[mb.Name] = api.FolderCount{
+			Total:  uint32(mb.TotalCount),
+			Unread: uint32(mb.UnreadCount),
+			Recent: uint32(mb.RecentCount),
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"counts":      all,
+		"totalUnread": api.TotalUnread(folders),
+	})
+}
+
+func folderCount(dial func() (*api.Client, error), name string) (map[string]api.FolderCount, error) {
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	count, err := client.FolderCount(name)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]api.FolderCount{name: count}, nil
+}
+
+// HandleCreate creates a folder, optionally below a parent folder
+func (h *FolderHandler) HandleCreate(c *fiber.Ctx) error {
+	return h.modify(c, func(client *api.Client) error {
+		_, err := client.CreateFolder(c.FormValue("parent"), c.FormValue("name"))
+		return err
+	})
+}
+
+// HandleRename renames the folder in the URL to the new_name form value
+func (h *FolderHandler) HandleRename(c *fiber.Ctx) error {
+	name, err := url.QueryUnescape(c.Params("name"))
+	if err != nil || name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid folder name",
+		})
+	}
+
+	return h.modify(c, func(client *api.Client) error {
+		return client.RenameFolder(name, c.FormValue("new_name"))
+	})
+}
+
+// HandleDelete deletes a folder and the messages in it
+func (h *FolderHandler) HandleDelete(c *fiber.Ctx) error {
+	name, err := url.QueryUnescape(c.Params("name"))
+	if err != nil || name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid folder name",
+		})
+	}
+
+	return h.modify(c, func(client *api.Client) error {
+		return client.DeleteFolder(name)
+	})
+}
+
+// HandleSubscribe subscribes to a folder (POST) or unsubscribes (DELETE)
+func (h *FolderHandler) HandleSubscribe(c *fiber.Ctx) error {
+	name, err := url.QueryUnescape(c.Params("name"))
+	if err != nil || name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid folder name",
+		})
+	}
+
+	subscribed := c.Method() != fiber.MethodDelete
+	return h.modify(c, func(client *api.Client) error {
+		return client.SetSubscribed(name, subscribed)
+	})
+}
+
+// modify runs a folder operation and refreshes the cached folder list, then
+// tells htmx to reload the sidebar through the folders-changed event
+func (h *FolderHandler) modify(c *fiber.Ctx, op func(client *api.Client) error) error {
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	if err := op(client); err != nil {
+		if errors.Is(err, api.ErrProtectedFolder) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "This folder cannot be renamed or deleted",
+			})
+		}
+		log.Printf("Folder operation error: %v", err)
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	folders, err := h.auth.RefreshFolders(c, client)
+	if err != nil {
+		log.Printf("Error refreshing folder cache: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error refreshing folders",
+		})
+	}
+
+	c.Set("HX-Trigger", "folders-changed")
+	return c.JSON(fiber.Map{
+		"success": true,
+		"folders": folders,
+	})
+}
+
+// countsChanged asks the page to refresh the counters of a folder after a
+// message in it was read, marked unread or deleted
+func countsChanged(c *fiber.Ctx, folder string) {
+	trigger, err := json.Marshal(fiber.Map{
+		"counts-changed": fiber.Map{"folder": folder},
+	})
+	if err == nil {
+		c.Set("HX-Trigger", string(trigger))
+	}
+}
+
+// folderTree builds the sidebar tree, applying the subscribed_only setting,
+// expanding the path to the current folder and translating the names of
+// folders with a role to the browser's language
+func folderTree(c *fiber.Ctx, config *config.Config, folders []*api.MailboxInfo, current string) []*api.FolderNode {
+	if config.IMAP.SubscribedOnly {
+		folders = api.SubscribedFolders(folders)
+	}
+	tree := api.FolderTree(folders)
+	api.SetCurrentFolder(tree, current)
+	localizeFolders(tree, c.AcceptsLanguages(i18n.Languages...))
+	return tree
+}
+
+func localizeFolders(nodes []*api.FolderNode, lang string) {
+	for _, n := range nodes {
+		if n.Role != "" {
+			n.Label = i18n.FolderLabel(lang, n.Role)
+		}
+		localizeFolders(n.Children, lang)
+	}
+}
+
+// protectedFolders maps the names of folders that cannot be renamed or
+// deleted, for the templates
+func protectedFolders(folders []*api.MailboxInfo) map[string]bool {
+	protected := make(map[string]bool)
+	for _, mb := range folders {
+		if api.IsProtectedFolder(folders, mb.Name) {
+			protected[mb.Name] = true
+		}
+	}
+	return protected
+}
@@ -0,0 +1,135 @@
+// handlers/web/identities.go
+package web
+
+import (
+	"errors"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/identity"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+type IdentityHandler struct {
+	store      *session.Store
+	config     *config.Config
+	identities *identity.Store
+}
+
+func NewIdentityHandler(store *session.Store, config *config.Config, identities *identity.Store) *IdentityHandler {
+	return &IdentityHandler{
+		store:      store,
+		config:     config,
+		identities: identities,
+	}
+}
+
+// HandleList renders the identity settings for htmx requests and returns
+// the identities as JSON otherwise (used by the compose form)
+func (h *IdentityHandler) HandleList(c *fiber.Ctx) error {
+	identities, err := h.identities.List(api.GetSessionEmail(c))
+	if err != nil {
+		log.Printf("Error listing identities: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error loading identities",
+		})
+	}
+
+	if c.Get("HX-Request") != "" {
+		return c.Render("partials/identities", fiber.Map{
+			"Identities": identities,
+		}, "")
+	}
+
+	return c.JSON(fiber.Map{
+		"identities": identities,
+	})
+}
+
+// HandleCreate adds an identity
+func (h *IdentityHandler) HandleCreate(c *fiber.Ctx) error {
+	return h.save(c, &identity.Identity{})
+}
+
+// HandleUpdate replaces an existing identity
+func (h *IdentityHandler) HandleUpdate(c *fiber.Ctx) error {
+	existing, err := h.identities.Get(api.GetSessionEmail(c), c.Params("id"))
+	if err != nil {
+		return identityError(c, err)
+	}
+	return h.save(c, &identity.Identity{ID: existing.ID})
+}
+
+// HandleDelete removes an identity
+func (h *IdentityHandler) HandleDelete(c *fiber.Ctx) error {
+	if err := h.identities.Delete(api.GetSessionEmail(c), c.Params("id")); err != nil {
+		return identityError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+func (h *IdentityHandler) save(c *fiber.Ctx, ident *identity.Identity) error {
+	ident.Name = c.FormValue("name")
+	ident.Email = c.FormValue("email")
+	ident.ReplyTo = c.FormValue("reply_to")
+	ident.Signature = c.FormValue("signature")
+	ident.SignatureHTML = c.FormValue("signature_html")
+	ident.Default = c.FormValue("default") != ""
+
+	if err := ident.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := h.identities.Save(api.GetSessionEmail(c), ident); err != nil {
+		return identityError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"identity": ident,
+	})
+}
+
+func identityError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, identity.ErrNotFound):
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Identity not found",
+		})
+	case errors.Is(err, identity.ErrLastIdentity):
+		return c.Status(400).JSON(fiber.Map{
+			"error": "At least one identity is required",
+		})
+	case errors.Is(err, identity.ErrNotAllowed):
+		return c.Status(403).JSON(fiber.Map{
+			"error": "You are not allowed to send as this address",
+		})
+	}
+
+	log.Printf("Identity error: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Error saving identity",
+	})
+}
+
+// resolveIdentity returns the identity picked in a compose form. Its
+// address is checked again, as the configured aliases may have changed
+// since it was saved.
+func resolveIdentity(c *fiber.Ctx, identities *identity.Store) (*identity.Identity, error) {
+	owner := api.GetSessionEmail(c)
+	ident, err := identities.Get(owner, c.FormValue("identity_id"))
+	if err != nil {
+		return nil, err
+	}
+	if !identities.Allowed(owner, ident.Email) {
+		return nil, identity.ErrNotAllowed
+	}
+	return ident, nil
+}
@@ -0,0 +1,203 @@
+// handlers/web/labels.go
+package web
+
+import (
+	"errors"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/labels"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+type LabelHandler struct {
+	store  *session.Store
+	config *config.Config
+	auth   *AuthHandler
+	labels *labels.Store
+}
+
+func NewLabelHandler(store *session.Store, config *config.Config, auth *AuthHandler, labelStore *labels.Store) *LabelHandler {
+	return &LabelHandler{
+		store:  store,
+		config: config,
+		auth:   auth,
+		labels: labelStore,
+	}
+}
+
+// HandleList renders the label management view for htmx requests and
+// returns the labels as JSON otherwise
+func (h *LabelHandler) HandleList(c *fiber.Ctx) error {
+	list, err := h.labels.List(api.GetSessionEmail(c))
+	if err != nil {
+		return labelError(c, err)
+	}
+
+	if c.Get("HX-Request") != "" {
+		return c.Render("partials/labels", fiber.Map{
+			"Labels": list,
+			"Colors": labels.Colors,
+		}, "")
+	}
+
+	return c.JSON(fiber.Map{
+		"labels": list,
+		"colors": labels.Colors,
+	})
+}
+
+// HandleNav renders the sidebar label list, linking each label to the
+// filtered listing of the current folder
+func (h *LabelHandler) HandleNav(c *fiber.Ctx) error {
+	list, err := h.labels.List(api.GetSessionEmail(c))
+	if err != nil {
+		return c.Status(500).SendString("Error loading labels")
+	}
+
+	var current *labels.Label
+	for _, label := range list {
+		if label.ID == c.Query("label") {
+			current = label
+		}
+	}
+
+	return c.Render("partials/label-nav", fiber.Map{
+		"AllLabels":     list,
+		"CurrentFolder": c.Query("current", "INBOX"),
+		"CurrentLabel":  current,
+	}, "")
+}
+
+// HandleCreate adds a label
+func (h *LabelHandler) HandleCreate(c *fiber.Ctx) error {
+	return h.save(c, &labels.Label{})
+}
+
+// HandleUpdate renames or recolours a label
+func (h *LabelHandler) HandleUpdate(c *fiber.Ctx) error {
+	existing, err := h.labels.Get(api.GetSessionEmail(c), c.Params("id"))
+	if err != nil {
+		return labelError(c, err)
+	}
+	return h.save(c, &labels.Label{ID: existing.ID})
+}
+
+// HandleDelete removes a label
+func (h *LabelHandler) HandleDelete(c *fiber.Ctx) error {
+	if err := h.labels.Delete(api.GetSessionEmail(c), c.Params("id")); err != nil {
+		return labelError(c, err)
+	}
+
+	c.Set("HX-Trigger", "labels-changed")
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+// HandleApply adds the label to the messages listed in the comma-separated
+// ids form value (POST), or removes it (DELETE)
+func (h *LabelHandler) HandleApply(c *fiber.Ctx) error {
+	label, err := h.labels.Get(api.GetSessionEmail(c), c.Params("id"))
+	if err != nil {
+		return labelError(c, err)
+	}
+
+	folderName := c.FormValue("folder", "INBOX")
+	ids := splitIDs(c.FormValue("ids"))
+	if len(ids) == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "No messages selected",
+		})
+	}
+
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	add := c.Method() != fiber.MethodDelete
+	if err := client.SetKeyword(folderName, ids, label.Keyword, add); err != nil {
+		if errors.Is(err, api.ErrKeywordsUnsupported) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "The mail server does not allow labels in this folder",
+			})
+		}
+		log.Printf("Error applying label %s: %v", label.Keyword, err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error updating labels",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"label":   label,
+		"ids":     ids,
+	})
+}
+
+func (h *LabelHandler) save(c *fiber.Ctx, label *labels.Label) error {
+	label.Name = c.FormValue("name")
+	label.Color = c.FormValue("color")
+
+	if err := label.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := h.labels.Save(api.GetSessionEmail(c), label); err != nil {
+		return labelError(c, err)
+	}
+
+	c.Set("HX-Trigger", "labels-changed")
+	return c.JSON(fiber.Map{
+		"success": true,
+		"label":   label,
+	})
+}
+
+func labelError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, labels.ErrNotFound):
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Label not found",
+		})
+	case errors.Is(err, labels.ErrDuplicate):
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	log.Printf("Label error: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Error saving label",
+	})
+}
+
+// labelsOf returns the labels matching the keywords of a message
+func labelsOf(flags []string, byKeyword map[string]*labels.Label) []*labels.Label {
+	var found []*labels.Label
+	for _, flag := range flags {
+		if label, ok := byKeyword[strings.ToLower(flag)]; ok {
+			found = append(found, label)
+		}
+	}
+	return found
+}
+
+func splitIDs(list string) []string {
+	var ids []string
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
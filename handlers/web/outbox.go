@@ -0,0 +1,272 @@
+// handlers/web/outbox.go
+package web
+
+import (
+	"errors"
+	"fmt"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/identity"
+	"lilmail/outbox"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+type OutboxHandler struct {
+	store      *session.Store
+	config     *config.Config
+	auth       *AuthHandler
+	outbox     *outbox.Queue
+	sender     *outbox.Worker
+	identities *identity.Store
+}
+
+func NewOutboxHandler(store *session.Store, config *config.Config, auth *AuthHandler, queue *outbox.Queue, sender *outbox.Worker, identities *identity.Store) *OutboxHandler {
+	return &OutboxHandler{
+		store:      store,
+		config:     config,
+		auth:       auth,
+		outbox:     queue,
+		sender:     sender,
+		identities: identities,
+	}
+}
+
+// HandleList renders the pending, scheduled and failed messages of the user
+func (h *OutboxHandler) HandleList(c *fiber.Ctx) error {
+	messages, err := h.outbox.List(api.GetSessionEmail(c))
+	if err != nil {
+		log.Printf("Error listing outbox: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error loading outbox",
+		})
+	}
+
+	return c.Render("partials/outbox-list", fiber.Map{
+		"Messages": messages,
+	}, "")
+}
+
+// HandleGet returns a single outgoing message
+func (h *OutboxHandler) HandleGet(c *fiber.Ctx) error {
+	msg, err := h.outbox.Get(c.Params("id"))
+	if err != nil || msg.Owner != api.GetSessionEmail(c) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Message not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": outboxMessageView(msg),
+	})
+}
+
+// HandleUpdate edits the recipients, subject, body and optionally the
+// sender identity and delivery time of a message that has not been sent yet
+func (h *OutboxHandler) HandleUpdate(c *fiber.Ctx) error {
+	to := c.FormValue("to")
+	cc := c.FormValue("cc")
+	subject := c.FormValue("subject")
+	body := c.FormValue("body")
+
+	if to == "" || subject == "" || body == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "All fields are required",
+		})
+	}
+
+	if err := validateRecipients(to, cc); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	sendAt, err := parseSendAt(c.FormValue("send_at"), c.FormValue("tz_offset"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var ident *identity.Identity
+	if c.FormValue("identity_id") != "" {
+		if ident, err = resolveIdentity(c, h.identities); err != nil {
+			return identityError(c, err)
+		}
+	}
+
+	// A new delivery time retries a failed message, which lost its
+	// credentials
+	var encryptedCreds string
+	if !sendAt.IsZero() {
+		if encryptedCreds, err = h.auth.EncryptedCredentials(c); err != nil {
+			log.Printf("Outbox credentials error: %v", err)
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Invalid session",
+			})
+		}
+	}
+
+	msg, err := h.outbox.Modify(c.Params("id"), api.GetSessionEmail(c), func(msg *outbox.Message) error {
+		msg.To = to
+		msg.Cc = cc
+		msg.Subject = subject
+		msg.Body = body
+		if ident != nil {
+			msg.Identity = ident
+		}
+		if !sendAt.IsZero() {
+			msg.Credentials = encryptedCreds
+			msg.Requeue(sendAt)
+		}
+		return nil
+	})
+	if err != nil {
+		return outboxError(c, err)
+	}
+	h.sender.Wake()
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": outboxMessageView(msg),
+	})
+}
+
+// HandleReschedule moves a message to a new delivery time. Failed messages
+// are retried from scratch.
+func (h *OutboxHandler) HandleReschedule(c *fiber.Ctx) error {
+	sendAt, err := parseSendAt(c.FormValue("send_at"), c.FormValue("tz_offset"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if sendAt.IsZero() {
+		sendAt = time.Now()
+	}
+
+	encryptedCreds, err := h.auth.EncryptedCredentials(c)
+	if err != nil {
+		log.Printf("Outbox credentials error: %v", err)
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid session",
+		})
+	}
+
+	msg, err := h.outbox.Reschedule(c.Params("id"), api.GetSessionEmail(c), encryptedCreds, sendAt)
+	if err != nil {
+		return outboxError(c, err)
+	}
+	h.sender.Wake()
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": outboxMessageView(msg),
+	})
+}
+
+// HandleCancel removes a message before it is sent. The cancelled message is
+// returned so the client can reopen it in the compose form.
+func (h *OutboxHandler) HandleCancel(c *fiber.Ctx) error {
+	msg, err := h.outbox.Cancel(c.Params("id"), api.GetSessionEmail(c))
+	if err != nil {
+		return outboxError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": outboxMessageView(msg),
+	})
+}
+
+// outboxMessageView is the client-facing representation of a message; it
+// leaves out the stored credentials
+func outboxMessageView(msg *outbox.Message) fiber.Map {
+	identityID := ""
+	if msg.Identity != nil {
+		identityID = msg.Identity.ID
+	}
+
+	return fiber.Map{
+		"id":         msg.ID,
+		"to":         msg.To,
+		"cc":         msg.Cc,
+		"subject":    msg.Subject,
+		"body":       msg.Body,
+		"identityId": identityID,
+		"inReplyTo":  msg.InReplyTo,
+		"references": msg.References,
+		"draftUid":   msg.DraftUID,
+		"status":     msg.Status,
+		"attempts":   msg.Attempts,
+		"lastError":  msg.LastError,
+		"sendAt":     msg.SendAt.Format(time.RFC3339),
+	}
+}
+
+func outboxError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, outbox.ErrNotFound):
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Message not found",
+		})
+	case errors.Is(err, outbox.ErrNotPending):
+		return c.Status(409).JSON(fiber.Map{
+			"error": "Message is already being sent",
+		})
+	}
+
+	log.Printf("Outbox error: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Error updating outbox",
+	})
+}
+
+// validateRecipients rejects address lists the outbox could not deliver to
+func validateRecipients(to, cc string) error {
+	if _, err := api.ParseAddressList(to); err != nil {
+		return fmt.Errorf("invalid To address")
+	}
+	if _, err := api.ParseAddressList(cc); err != nil {
+		return fmt.Errorf("invalid Cc address")
+	}
+	return nil
+}
+
+// parseSendAt reads a delivery time from a form. RFC 3339 values are taken
+// as-is; values from a datetime-local input are interpreted using the
+// browser's timezone offset (minutes, as returned by getTimezoneOffset).
+// An empty value yields the zero time.
+func parseSendAt(value, tzOffset string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return validateSendAt(t)
+	}
+
+	offset, _ := strconv.Atoi(tzOffset)
+	loc := time.FixedZone("client", -offset*60)
+
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return validateSendAt(t)
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid delivery time")
+}
+
+func validateSendAt(t time.Time) (time.Time, error) {
+	if t.Before(time.Now().Add(-time.Minute)) {
+		return time.Time{}, fmt.Errorf("delivery time is in the past")
+	}
+	return t, nil
+}
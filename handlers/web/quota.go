@@ -0,0 +1,139 @@
+// handlers/web/quota.go
+package web
+
+import (
+	"errors"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"log"
+
+	"github.com/emersion/go-imap"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// Largest messages view limits
+const (
+	defaultLargestLimit = 50
+	maxLargestLimit     = 200
+)
+
+type QuotaHandler struct {
+	store  *session.Store
+	config *config.Config
+	auth   *AuthHandler
+}
+
+func NewQuotaHandler(store *session.Store, config *config.Config, auth *AuthHandler) *QuotaHandler {
+	return &QuotaHandler{
+		store:  store,
+		config: config,
+		auth:   auth,
+	}
+}
+
+// HandleQuota returns storage usage against the server quota. The level is
+// "ok", "warning" or "critical" depending on the configured thresholds.
+// Servers without quotas get an empty sidebar widget and a null quota.
+func (h *QuotaHandler) HandleQuota(c *fiber.Ctx) error {
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	quota, err := client.Quota()
+	if err != nil && !errors.Is(err, api.ErrQuotaUnsupported) {
+		log.Printf("Error getting quota: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error getting quota",
+		})
+	}
+
+	data := fiber.Map{}
+	if quota != nil {
+		data = fiber.Map{
+			"root":    quota.Root,
+			"used":    quota.Used,
+			"limit":   quota.Limit,
+			"percent": quota.Percent(),
+			"level":   h.quotaLevel(quota),
+		}
+	}
+
+	if c.Get("HX-Request") != "" {
+		return c.Render("partials/quota", fiber.Map{
+			"Quota": data,
+		}, "")
+	}
+
+	if quota == nil {
+		return c.JSON(fiber.Map{"quota": nil})
+	}
+	return c.JSON(fiber.Map{"quota": data})
+}
+
+func (h *QuotaHandler) quotaLevel(quota *api.Quota) string {
+	switch p := quota.Percent(); {
+	case p >= h.config.Quota.CriticalPercent:
+		return "critical"
+	case p >= h.config.Quota.WarnPercent:
+		return "warning"
+	default:
+		return "ok"
+	}
+}
+
+// HandleLargest lists the largest messages of every selectable folder, or
+// of ?folder= only, so users can free space
+func (h *QuotaHandler) HandleLargest(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", defaultLargestLimit)
+	if limit < 1 || limit > maxLargestLimit {
+		limit = defaultLargestLimit
+	}
+
+	var names []string
+	if name := c.Query("folder"); name != "" {
+		names = []string{name}
+	} else {
+		folders, err := h.auth.LoadFolders(c)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Error loading folders",
+			})
+		}
+		for _, mb := range folders {
+			if !hasFlag(mb.Attributes, imap.NoSelectAttr) {
+				names = append(names, mb.Name)
+			}
+		}
+	}
+
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	messages, err := client.LargestMessages(names, limit)
+	if err != nil {
+		log.Printf("Error listing largest messages: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error listing messages",
+		})
+	}
+
+	if c.Get("HX-Request") != "" {
+		return c.Render("partials/largest-messages", fiber.Map{
+			"Messages": messages,
+		}, "")
+	}
+
+	return c.JSON(fiber.Map{
+		"messages": messages,
+	})
+}
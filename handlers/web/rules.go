@@ -0,0 +1,234 @@
+// handlers/web/rules.go
+package web
+
+import (
+	"errors"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/labels"
+	"lilmail/rules"
+	"log"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// Apply-to-existing-mail limits
+const (
+	defaultApplyLimit = 200
+	maxApplyLimit     = 1000
+)
+
+type RuleHandler struct {
+	store  *session.Store
+	config *config.Config
+	auth   *AuthHandler
+	rules  *rules.Store
+	engine *rules.Engine
+	labels *labels.Store
+}
+
+func NewRuleHandler(store *session.Store, config *config.Config, auth *AuthHandler, ruleStore *rules.Store, engine *rules.Engine, labelStore *labels.Store) *RuleHandler {
+	return &RuleHandler{
+		store:  store,
+		config: config,
+		auth:   auth,
+		rules:  ruleStore,
+		engine: engine,
+		labels: labelStore,
+	}
+}
+
+// HandleList renders the rules editor for htmx requests and returns the
+// rules as JSON otherwise
+func (h *RuleHandler) HandleList(c *fiber.Ctx) error {
+	owner := api.GetSessionEmail(c)
+	list, err := h.rules.List(owner)
+	if err != nil {
+		return ruleError(c, err)
+	}
+
+	if c.Get("HX-Request") != "" {
+		folders, err := h.auth.LoadFolders(c)
+		if err != nil {
+			log.Printf("Error loading folders: %v", err)
+		}
+		labelList, err := h.labels.List(owner)
+		if err != nil {
+			log.Printf("Error loading labels: %v", err)
+		}
+		return c.Render("partials/rules", fiber.Map{
+			"Folders": folders,
+			"Labels":  labelList,
+		}, "")
+	}
+
+	return c.JSON(fiber.Map{
+		"rules": list,
+	})
+}
+
+// HandleCreate adds a rule from a JSON body
+func (h *RuleHandler) HandleCreate(c *fiber.Ctx) error {
+	return h.save(c, "")
+}
+
+// HandleUpdate replaces a rule from a JSON body
+func (h *RuleHandler) HandleUpdate(c *fiber.Ctx) error {
+	existing, err := h.rules.Get(api.GetSessionEmail(c), c.Params("id"))
+	if err != nil {
+		return ruleError(c, err)
+	}
+	return h.save(c, existing.ID)
+}
+
+// HandleDelete removes a rule
+func (h *RuleHandler) HandleDelete(c *fiber.Ctx) error {
+	if err := h.rules.Delete(api.GetSessionEmail(c), c.Params("id")); err != nil {
+		return ruleError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+// HandleApply runs one rule against the newest messages of a folder. With
+// dry_run set nothing is changed and the would-be hits are returned.
+func (h *RuleHandler) HandleApply(c *fiber.Ctx) error {
+	owner := api.GetSessionEmail(c)
+	rule, err := h.rules.Get(owner, c.Params("id"))
+	if err != nil {
+		return ruleError(c, err)
+	}
+
+	folderName, err := url.QueryUnescape(c.Query("folder", "INBOX"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid folder name",
+		})
+	}
+
+	limit := c.QueryInt("limit", defaultApplyLimit)
+	if limit <= 0 || limit > maxApplyLimit {
+		limit = maxApplyLimit
+	}
+	dryRun := c.QueryBool("dry_run")
+
+	credentials, err := h.auth.EncryptedCredentials(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Session expired",
+		})
+	}
+
+	client, err := h.auth.CreateIMAPClient(c)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error connecting to email server",
+		})
+	}
+	defer client.Close()
+
+	messages, err := client.LatestSummaries(folderName, uint32(limit))
+	if err != nil {
+		log.Printf("Error fetching messages for rule %s: %v", rule.ID, err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error fetching messages",
+		})
+	}
+
+	hits := h.engine.Run(client, owner, credentials, folderName, []*rules.Rule{rule}, messages, dryRun)
+	if !dryRun {
+		if err := h.rules.AddHits(owner, hits); err != nil {
+			log.Printf("Error saving rule hits: %v", err)
+		}
+		countsChanged(c, folderName)
+	}
+
+	if hits == nil {
+		hits = []rules.Hit{}
+	}
+	return c.JSON(fiber.Map{
+		"dryRun":  dryRun,
+		"checked": len(messages),
+		"hits":    hits,
+	})
+}
+
+// HandleHits returns the hit log of a rule, newest first
+func (h *RuleHandler) HandleHits(c *fiber.Ctx) error {
+	owner := api.GetSessionEmail(c)
+	if _, err := h.rules.Get(owner, c.Params("id")); err != nil {
+		return ruleError(c, err)
+	}
+
+	hits, err := h.rules.Hits(owner, c.Params("id"))
+	if err != nil {
+		return ruleError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"hits": hits,
+	})
+}
+
+// HandleStatus reports scan errors of the background worker, such as
+// credentials rejected after a password change
+func (h *RuleHandler) HandleStatus(c *fiber.Ctx) error {
+	mb, err := h.rules.Mailbox(api.GetSessionEmail(c))
+	if err != nil {
+		return ruleError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"lastError":  mb.LastError,
+		"authFailed": mb.AuthFailed,
+	})
+}
+
+func (h *RuleHandler) save(c *fiber.Ctx, id string) error {
+	var rule rules.Rule
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid rule",
+		})
+	}
+	rule.ID = id
+
+	if err := rule.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	credentials, err := h.auth.EncryptedCredentials(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Session expired",
+		})
+	}
+
+	if err := h.rules.Save(api.GetSessionEmail(c), credentials, &rule); err != nil {
+		return ruleError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"rule":    &rule,
+	})
+}
+
+func ruleError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, rules.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Rule not found",
+		})
+	}
+
+	log.Printf("Rule error: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Error saving rule",
+	})
+}
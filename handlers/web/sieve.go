@@ -0,0 +1,324 @@
+// handlers/web/sieve.go
+package web
+
+import (
+	"errors"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/labels"
+	"lilmail/sieve"
+	"log"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+var errSieveDisabled = errors.New("ManageSieve is not configured")
+
+type SieveHandler struct {
+	store  *session.Store
+	config *config.Config
+	auth   *AuthHandler
+	labels *labels.Store
+}
+
+func NewSieveHandler(store *session.Store, config *config.Config, auth *AuthHandler, labelStore *labels.Store) *SieveHandler {
+	return &SieveHandler{
+		store:  store,
+		config: config,
+		auth:   auth,
+		labels: labelStore,
+	}
+}
+
+// sieveRequest is the body of save and check requests: either raw script
+// content or the settings of the guided editor
+type sieveRequest struct {
+	Content  string        `json:"content"`
+	Guided   *sieve.Script `json:"guided"`
+	Activate bool          `json:"activate"`
+}
+
+// HandleList renders the script manager for htmx requests and returns the
+// scripts and server extensions as JSON otherwise
+func (h *SieveHandler) HandleList(c *fiber.Ctx) error {
+	client, err := h.connect(c)
+	if err != nil {
+		return sieveError(c, err)
+	}
+	defer client.Close()
+
+	scripts, err := client.ListScripts()
+	if err != nil {
+		return sieveError(c, err)
+	}
+
+	if c.Get("HX-Request") != "" {
+		folders, err := h.auth.LoadFolders(c)
+		if err != nil {
+			log.Printf("Error loading folders: %v", err)
+		}
+		labelList, err := h.labels.List(api.GetSessionEmail(c))
+		if err != nil {
+			log.Printf("Error loading labels: %v", err)
+		}
+		return c.Render("partials/sieve", fiber.Map{
+			"Implementation": client.Implementation(),
+			"HasVacation":    client.HasExtension("vacation"),
+			"Folders":        folders,
+			"Labels":         labelList,
+		}, "")
+	}
+
+	return c.JSON(fiber.Map{
+		"scripts":        scripts,
+		"extensions":     client.Extensions(),
+		"implementation": client.Implementation(),
+	})
+}
+
+// HandleGet returns a script along with its guided settings, which are
+// null for scripts written by hand
+func (h *SieveHandler) HandleGet(c *fiber.Ctx) error {
+	name, err := scriptName(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return sieveError(c, err)
+	}
+	defer client.Close()
+
+	content, err := client.GetScript(name)
+	if err != nil {
+		return sieveError(c, err)
+	}
+
+	guided, _ := sieve.Parse(content)
+	return c.JSON(fiber.Map{
+		"name":    name,
+		"content": content,
+		"guided":  guided,
+	})
+}
+
+// HandleSave uploads a script, generating it first when guided settings
+// are given. The server rejects scripts with errors.
+func (h *SieveHandler) HandleSave(c *fiber.Ctx) error {
+	name, err := scriptName(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req sieveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid script"})
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return sieveError(c, err)
+	}
+	defer client.Close()
+
+	content, err := h.content(c, client, &req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	warnings, err := client.PutScript(name, content)
+	if err != nil {
+		return sieveError(c, err)
+	}
+	if req.Activate {
+		if err := client.SetActive(name); err != nil {
+			return sieveError(c, err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"name":     name,
+		"content":  content,
+		"warnings": warnings,
+	})
+}
+
+// HandleCheck validates a script on the server without storing it
+func (h *SieveHandler) HandleCheck(c *fiber.Ctx) error {
+	var req sieveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid script"})
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return sieveError(c, err)
+	}
+	defer client.Close()
+
+	content, err := h.content(c, client, &req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	warnings, err := client.CheckScript(content)
+	if err != nil {
+		return sieveError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"valid":    true,
+		"content":  content,
+		"warnings": warnings,
+	})
+}
+
+// HandleActivate makes a script the active one
+func (h *SieveHandler) HandleActivate(c *fiber.Ctx) error {
+	name, err := scriptName(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return h.setActive(c, name)
+}
+
+// HandleDeactivate turns off server-side filtering
+func (h *SieveHandler) HandleDeactivate(c *fiber.Ctx) error {
+	return h.setActive(c, "")
+}
+
+// HandleDelete removes a script that is not active
+func (h *SieveHandler) HandleDelete(c *fiber.Ctx) error {
+	name, err := scriptName(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	client, err := h.connect(c)
+	if err != nil {
+		return sieveError(c, err)
+	}
+	defer client.Close()
+
+	if err := client.DeleteScript(name); err != nil {
+		return sieveError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+func (h *SieveHandler) setActive(c *fiber.Ctx, name string) error {
+	client, err := h.connect(c)
+	if err != nil {
+		return sieveError(c, err)
+	}
+	defer client.Close()
+
+	if err := client.SetActive(name); err != nil {
+		return sieveError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"active":  name,
+	})
+}
+
+func (h *SieveHandler) connect(c *fiber.Ctx) (*api.SieveClient, error) {
+	if !h.config.Sieve.Enabled {
+		return nil, errSieveDisabled
+	}
+	return h.auth.CreateSieveClient(c)
+}
+
+// content returns the raw script of a request, generated from the guided
+// settings when present
+func (h *SieveHandler) content(c *fiber.Ctx, client *api.SieveClient, req *sieveRequest) (string, error) {
+	if req.Guided == nil {
+		if strings.TrimSpace(req.Content) == "" {
+			return "", errors.New("script is empty")
+		}
+		return req.Content, nil
+	}
+
+	opts, err := sieveOptions(c, h.auth, h.labels, client)
+	if err != nil {
+		return "", err
+	}
+	return sieve.Generate(req.Guided, opts)
+}
+
+// sieveOptions collects what the script generator needs to know about the
+// user's labels, folders and the server's extensions
+func sieveOptions(c *fiber.Ctx, auth *AuthHandler, labelStore *labels.Store, client *api.SieveClient) (sieve.Options, error) {
+	opts := sieve.Options{
+		Keywords:   make(map[string]string),
+		Extensions: client.Extensions(),
+	}
+	labelList, err := labelStore.List(api.GetSessionEmail(c))
+	if err != nil {
+		return opts, err
+	}
+	for _, label := range labelList {
+		opts.Keywords[label.ID] = label.Keyword
+	}
+	if folders, err := auth.LoadFolders(c); err == nil {
+		opts.TrashFolder = api.FolderByRole(folders, api.RoleTrash)
+	}
+	return opts, nil
+}
+
+// scriptName reads the :name route parameter
+func scriptName(c *fiber.Ctx) (string, error) {
+	name, err := url.QueryUnescape(c.Params("name"))
+	if err != nil {
+		return "", errors.New("invalid script name")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 128 {
+		return "", errors.New("script name must be 1 to 128 characters")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", errors.New("invalid script name")
+		}
+	}
+	return name, nil
+}
+
+func sieveError(c *fiber.Ctx, err error) error {
+	var sieveErr *api.SieveError
+	switch {
+	case errors.Is(err, errSieveDisabled):
+		if c.Get("HX-Request") != "" {
+			return c.Render("partials/sieve", fiber.Map{
+				"Disabled": true,
+			}, "")
+		}
+		return c.Status(404).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.As(err, &sieveErr):
+		status := 400
+		if sieveErr.Code == "NONEXISTENT" {
+			status = 404
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": sieveErr.Error(),
+			"code":  sieveErr.Code,
+		})
+	}
+
+	log.Printf("Sieve error: %v", err)
+	return c.Status(502).JSON(fiber.Map{
+		"error": "Error talking to the Sieve server",
+	})
+}
@@ -0,0 +1,159 @@
+// handlers/web/twofactor.go
+package web
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/throttle"
+	"lilmail/twofactor"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/skip2/go-qrcode"
+)
+
+type TwoFactorHandler struct {
+	store     *session.Store
+	config    *config.Config
+	limiter   *throttle.Limiter
+	twoFactor *twofactor.Store
+}
+
+func NewTwoFactorHandler(store *session.Store, config *config.Config, limiter *throttle.Limiter, twoFactor *twofactor.Store) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		store:     store,
+		config:    config,
+		limiter:   limiter,
+		twoFactor: twoFactor,
+	}
+}
+
+// HandleStatus renders the two-factor settings for htmx requests and
+// returns the status as JSON otherwise
+func (h *TwoFactorHandler) HandleStatus(c *fiber.Ctx) error {
+	status, err := h.twoFactor.Status(api.GetSessionEmail(c))
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	if c.Get("HX-Request") != "" {
+		return c.Render("partials/twofactor", fiber.Map{
+			"Status": status,
+		}, "")
+	}
+
+	return c.JSON(status)
+}
+
+// HandleSetup starts enrolment and returns the new secret with its QR code,
+// drawn here so the page loads no third-party script
+func (h *TwoFactorHandler) HandleSetup(c *fiber.Ctx) error {
+	secret, uri, err := h.twoFactor.Begin(api.GetSessionEmail(c))
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 192)
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"secret": secret,
+		"uri":    uri,
+		"qr":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// HandleEnable confirms enrolment with a code from the authenticator and
+// returns the recovery codes, which are not shown again
+func (h *TwoFactorHandler) HandleEnable(c *fiber.Ctx) error {
+	codes, err := h.twoFactor.Confirm(api.GetSessionEmail(c), c.FormValue("code"))
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":       true,
+		"recoveryCodes": codes,
+	})
+}
+
+// HandleRecovery replaces the recovery codes. A current code is required,
+// so an unattended session cannot read new ones.
+func (h *TwoFactorHandler) HandleRecovery(c *fiber.Ctx) error {
+	owner := api.GetSessionEmail(c)
+	if ok, err := h.verify(c, owner); !ok {
+		return err
+	}
+
+	codes, err := h.twoFactor.RegenerateRecovery(owner)
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":       true,
+		"recoveryCodes": codes,
+	})
+}
+
+// HandleDisable turns two-factor login off after checking a current code
+func (h *TwoFactorHandler) HandleDisable(c *fiber.Ctx) error {
+	owner := api.GetSessionEmail(c)
+	if ok, err := h.verify(c, owner); !ok {
+		return err
+	}
+
+	if err := h.twoFactor.Disable(owner); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+// verify checks the code in the form against the login throttle, as the
+// second login step does, so a session cannot guess codes without limit.
+// When it returns false, the response has been written.
+func (h *TwoFactorHandler) verify(c *fiber.Ctx, owner string) (bool, error) {
+	attempt, wait := h.limiter.Check(c.IP(), owner)
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+		return false, c.Status(429).JSON(fiber.Map{
+			"error": fmt.Sprintf("Too many failed attempts. Try again in %s.", waitText(seconds)),
+		})
+	}
+	defer attempt.Release()
+
+	if err := h.twoFactor.Verify(owner, c.FormValue("code")); err != nil {
+		if errors.Is(err, twofactor.ErrInvalidCode) {
+			attempt.Fail()
+		}
+		return false, twoFactorError(c, err)
+	}
+	attempt.Succeed()
+	return true, nil
+}
+
+func twoFactorError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, twofactor.ErrInvalidCode), errors.Is(err, twofactor.ErrNotPending), errors.Is(err, twofactor.ErrEnabled):
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	log.Printf("Two-factor error: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Error updating two-factor settings",
+	})
+}
@@ -0,0 +1,300 @@
+// handlers/web/vacation.go
+package web
+
+import (
+	"errors"
+	"fmt"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/identity"
+	"lilmail/labels"
+	"lilmail/sieve"
+	"lilmail/vacation"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// vacationScript is the Sieve script created for the reply when the user
+// has no active script
+const vacationScript = "lilmail"
+
+// knownContactLimit is the number of sent messages searched for the
+// senders a Sieve reply is limited to
+const knownContactLimit = 500
+
+type VacationHandler struct {
+	store      *session.Store
+	config     *config.Config
+	auth       *AuthHandler
+	vacations  *vacation.Store
+	identities *identity.Store
+	labels     *labels.Store
+}
+
+func NewVacationHandler(store *session.Store, config *config.Config, auth *AuthHandler, vacations *vacation.Store, identities *identity.Store, labelStore *labels.Store) *VacationHandler {
+	return &VacationHandler{
+		store:      store,
+		config:     config,
+		auth:       auth,
+		vacations:  vacations,
+		identities: identities,
+		labels:     labelStore,
+	}
+}
+
+// HandleGet renders the vacation settings for htmx requests and returns
+// them as JSON otherwise
+func (h *VacationHandler) HandleGet(c *fiber.Ctx) error {
+	mb, err := h.vacations.Get(api.GetSessionEmail(c))
+	if err != nil {
+		log.Printf("Error loading vacation reply: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error loading vacation reply",
+		})
+	}
+
+	if c.Get("HX-Request") != "" {
+		return c.Render("partials/vacation", fiber.Map{
+			"Mailbox": mb,
+			"Active":  mb.Settings.Active(time.Now()),
+		}, "")
+	}
+
+	return c.JSON(fiber.Map{
+		"settings":  mb.Settings,
+		"active":    mb.Settings.Active(time.Now()),
+		"mode":      mb.Mode,
+		"fallback":  mb.Fallback,
+		"lastError": mb.LastError,
+	})
+}
+
+// HandleSave stores the vacation reply. It is installed as a Sieve script
+// when possible and sent by the vacation worker otherwise.
+func (h *VacationHandler) HandleSave(c *fiber.Ctx) error {
+	days, err := strconv.Atoi(c.FormValue("days", "7"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid number of days",
+		})
+	}
+
+	settings := vacation.Settings{
+		Enabled:   c.FormValue("enabled") != "",
+		Start:     c.FormValue("start"),
+		End:       c.FormValue("end"),
+		Subject:   c.FormValue("subject"),
+		Body:      c.FormValue("body"),
+		Days:      days,
+		KnownOnly: c.FormValue("known_only") != "",
+	}
+	if err := settings.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	owner := api.GetSessionEmail(c)
+	mb, err := h.vacations.Get(owner)
+	if err != nil {
+		return vacationError(c, err)
+	}
+	wasEnabled := mb.Settings.Enabled
+	previous := mb.Mode
+	mb.Settings = settings
+
+	if !settings.Enabled {
+		if previous == vacation.ModeSieve {
+			if _, err := h.sieveVacation(c, mb.Script, nil); err != nil {
+				log.Printf("Error removing Sieve vacation reply for %s: %v", owner, err)
+			}
+		}
+		mb.Mode = ""
+		mb.Script = ""
+		mb.Fallback = ""
+		mb.Credentials = ""
+		mb.Restart()
+		if err := h.vacations.Save(mb); err != nil {
+			return vacationError(c, err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	}
+
+	mb.Fallback = ""
+	if h.config.Sieve.Enabled {
+		script, err := h.sieveVacation(c, "", h.sieveSettings(c, owner, settings))
+		if err == nil {
+			if previous == vacation.ModeSieve && mb.Script != script {
+				if _, err := h.sieveVacation(c, mb.Script, nil); err != nil {
+					log.Printf("Error removing Sieve vacation reply for %s: %v", owner, err)
+				}
+			}
+			mb.Mode = vacation.ModeSieve
+			mb.Script = script
+			mb.Credentials = ""
+			mb.Restart()
+			mb.LastError = ""
+			if err := h.vacations.Save(mb); err != nil {
+				return vacationError(c, err)
+			}
+			return c.JSON(fiber.Map{
+				"success": true,
+				"mode":    mb.Mode,
+			})
+		}
+		log.Printf("Sieve vacation reply unavailable for %s: %v", owner, err)
+		mb.Fallback = err.Error()
+	}
+
+	if previous == vacation.ModeSieve {
+		if _, err := h.sieveVacation(c, mb.Script, nil); err != nil {
+			log.Printf("Error removing Sieve vacation reply for %s: %v", owner, err)
+		}
+	}
+
+	credentials, err := h.auth.EncryptedCredentials(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Session expired",
+		})
+	}
+
+	// A reply that starts now begins with mail arriving from here on
+	if !wasEnabled || previous != vacation.ModeWorker {
+		mb.Restart()
+	}
+	mb.Mode = vacation.ModeWorker
+	mb.Script = ""
+	mb.Credentials = credentials
+	mb.LastError = ""
+	mb.AuthFailed = false
+	if err := h.vacations.Save(mb); err != nil {
+		return vacationError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"mode":     mb.Mode,
+		"fallback": mb.Fallback,
+	})
+}
+
+// sieveSettings turns the settings into a Sieve vacation action. Known
+// contacts are looked up once, so the script answers the people written to
+// before it was saved.
+func (h *VacationHandler) sieveSettings(c *fiber.Ctx, owner string, settings vacation.Settings) *sieve.Vacation {
+	v := &sieve.Vacation{
+		Enabled:   true,
+		Subject:   settings.Subject,
+		Body:      settings.Body,
+		Days:      settings.Days,
+		Addresses: []string{owner},
+		Start:     settings.Start,
+		End:       settings.End,
+	}
+
+	identities, err := h.identities.List(owner)
+	if err != nil {
+		log.Printf("Error loading identities: %v", err)
+	}
+	for _, ident := range identities {
+		v.Addresses = append(v.Addresses, ident.Email)
+	}
+
+	if settings.KnownOnly {
+		client, err := h.auth.CreateIMAPClient(c)
+		if err != nil {
+			log.Printf("Error connecting for known contacts: %v", err)
+			return v
+		}
+		defer client.Close()
+		if v.Senders, err = client.SentRecipients(knownContactLimit); err != nil {
+			log.Printf("Error loading known contacts: %v", err)
+		}
+	}
+	return v
+}
+
+// sieveVacation stores the reply in the guided script called name, or in
+// the active script when name is empty, and returns the script name. A nil
+// reply removes it again. Scripts written by hand are left alone.
+func (h *VacationHandler) sieveVacation(c *fiber.Ctx, name string, reply *sieve.Vacation) (string, error) {
+	client, err := h.auth.CreateSieveClient(c)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	if reply != nil && !client.HasExtension("vacation") {
+		return "", errors.New("the mail server does not support Sieve vacation replies")
+	}
+
+	scripts, err := client.ListScripts()
+	if err != nil {
+		return "", err
+	}
+	active, exists := "", false
+	for _, script := range scripts {
+		if script.Active {
+			active = script.Name
+		}
+	}
+	if name == "" {
+		name = active
+	}
+	if name == "" {
+		name = vacationScript
+	}
+	for _, script := range scripts {
+		if script.Name == name {
+			exists = true
+		}
+	}
+
+	guided := &sieve.Script{}
+	if exists {
+		content, err := client.GetScript(name)
+		if err != nil {
+			return "", err
+		}
+		parsed, ok := sieve.Parse(content)
+		if !ok {
+			return "", fmt.Errorf("the Sieve script %q was written by hand", name)
+		}
+		guided = parsed
+	} else if reply == nil {
+		return name, nil
+	}
+	guided.Vacation = reply
+
+	opts, err := sieveOptions(c, h.auth, h.labels, client)
+	if err != nil {
+		return "", err
+	}
+	content, err := sieve.Generate(guided, opts)
+	if err != nil {
+		return "", err
+	}
+	if _, err := client.PutScript(name, content); err != nil {
+		return "", err
+	}
+	if reply != nil && active != name {
+		if err := client.SetActive(name); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+func vacationError(c *fiber.Ctx, err error) error {
+	log.Printf("Vacation error: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Error saving vacation reply",
+	})
+}
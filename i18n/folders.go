@@ -0,0 +1,25 @@
+// Package i18n holds the few translated strings of the interface
+package i18n
+
+// Languages are the supported languages, the first one being the default
+var Languages = []string{"en", "de", "fr", "es", "nl", "pt", "it"}
+
+// folderLabels are the display names of folders with a role
+var folderLabels = map[string]map[string]string{
+	"en": {"inbox": "Inbox", "drafts": "Drafts", "sent": "Sent", "archive": "Archive", "all": "All Mail", "junk": "Junk", "trash": "Trash"},
+	"de": {"inbox": "Posteingang", "drafts": "Entwürfe", "sent": "Gesendet", "archive": "Archiv", "all": "Alle Nachrichten", "junk": "Spam", "trash": "Papierkorb"},
+	"fr": {"inbox": "Boîte de réception", "drafts": "Brouillons", "sent": "Envoyés", "archive": "Archives", "all": "Tous les messages", "junk": "Indésirables", "trash": "Corbeille"},
+	"es": {"inbox": "Bandeja de entrada", "drafts": "Borradores", "sent": "Enviados", "archive": "Archivo", "all": "Todos", "junk": "Correo no deseado", "trash": "Papelera"},
+	"nl": {"inbox": "Postvak IN", "drafts": "Concepten", "sent": "Verzonden", "archive": "Archief", "all": "Alle e-mail", "junk": "Ongewenst", "trash": "Prullenbak"},
+	"pt": {"inbox": "Caixa de entrada", "drafts": "Rascunhos", "sent": "Enviados", "archive": "Arquivo", "all": "Todos os e-mails", "junk": "Lixo eletrónico", "trash": "Lixo"},
+	"it": {"inbox": "Posta in arrivo", "drafts": "Bozze", "sent": "Inviata", "archive": "Archivio", "all": "Tutti i messaggi", "junk": "Posta indesiderata", "trash": "Cestino"},
+}
+
+// FolderLabel returns the translated name of a folder role, falling back
+// to English. Unknown roles yield an empty string.
+func FolderLabel(lang, role string) string {
+	if label, ok := folderLabels[lang][role]; ok {
+		return label
+	}
+	return folderLabels[Languages[0]][role]
+}
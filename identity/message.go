@@ -0,0 +1,31 @@
+package identity
+
+import (
+	"html"
+	"lilmail/handlers/api"
+	"strings"
+)
+
+// Apply sets the sender headers of msg and appends the signature. An HTML
+// signature turns the message into text and HTML alternatives.
+func (i *Identity) Apply(msg *api.OutgoingMessage) error {
+	msg.From = i.From()
+
+	if i.ReplyTo != "" {
+		replyTo, err := api.ParseAddressList(i.ReplyTo)
+		if err != nil {
+			return err
+		}
+		msg.ReplyTo = replyTo
+	}
+
+	body := msg.Body
+	if i.Signature != "" {
+		msg.Body = strings.TrimRight(body, "\r\n") + "\n\n-- \n" + i.Signature
+	}
+	if i.SignatureHTML != "" {
+		text := strings.ReplaceAll(html.EscapeString(strings.TrimRight(body, "\r\n")), "\n", "<br>\n")
+		msg.HTMLBody = "<div>" + text + "</div>\n<br>\n<div class=\"signature\">-- <br>\n" + i.SignatureHTML + "</div>"
+	}
+	return nil
+}
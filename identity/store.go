@@ -0,0 +1,276 @@
+// Package identity stores the sender identities of each user: the
+// addresses, display names and signatures they can send mail as.
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/config"
+	"lilmail/utils"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultID identifies the implicit identity built from the login address
+const DefaultID = "default"
+
+// ErrNotFound is returned for unknown identity IDs
+var ErrNotFound = errors.New("identity not found")
+
+// ErrLastIdentity is returned when deleting the only identity of a user
+var ErrLastIdentity = errors.New("at least one identity is required")
+
+// ErrNotAllowed is returned for addresses the user may not send as
+var ErrNotAllowed = errors.New("sending as this address is not allowed")
+
+// Identity is an address a user sends mail as
+type Identity struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`  // Display name used in the From header
+	Email         string `json:"email"` // Login address or one of its aliases
+	ReplyTo       string `json:"replyTo,omitempty"`
+	Signature     string `json:"signature,omitempty"`     // Plain text signature
+	SignatureHTML string `json:"signatureHtml,omitempty"` // Optional HTML variant
+	Default       bool   `json:"default,omitempty"`
+}
+
+// From returns the address used in the From header
+func (i *Identity) From() *mail.Address {
+	return &mail.Address{Name: i.Name, Address: i.Email}
+}
+
+// Validate checks the addresses of the identity
+func (i *Identity) Validate() error {
+	i.Name = strings.TrimSpace(i.Name)
+	i.Email = strings.TrimSpace(i.Email)
+	i.ReplyTo = strings.TrimSpace(i.ReplyTo)
+
+	addr, err := mail.ParseAddress(i.Email)
+	if err != nil || addr.Name != "" {
+		return fmt.Errorf("invalid email address %q", i.Email)
+	}
+	if i.ReplyTo != "" {
+		if _, err := mail.ParseAddressList(i.ReplyTo); err != nil {
+			return fmt.Errorf("invalid reply-to address %q", i.ReplyTo)
+		}
+	}
+	return nil
+}
+
+// Store keeps the identities of each user in a JSON file named after a
+// hash of the login address
+type Store struct {
+	dir     string
+	senders config.IdentitiesConfig
+	mu      sync.Mutex
+}
+
+// NewStore opens (or creates) the identities directory. Besides the login
+// address, users may only send as the aliases and domains in senders.
+func NewStore(directory string, senders config.IdentitiesConfig) (*Store, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create identities directory: %v", err)
+	}
+	return &Store{dir: directory, senders: senders}, nil
+}
+
+// Allowed reports whether owner may send as address: their login address,
+// an alias configured for it, or any address in a configured domain
+func (s *Store) Allowed(owner, address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if address == strings.ToLower(owner) {
+		return true
+	}
+	for _, alias := range s.senders.Aliases[strings.ToLower(owner)] {
+		if alias == address {
+			return true
+		}
+	}
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		for _, domain := range s.senders.Domains {
+			if address[i+1:] == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// List returns the identities of owner, default first. A user who never
+// saved an identity gets one for the login address.
+func (s *Store) List(owner string) ([]*Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(owner)
+}
+
+// Get returns one identity of owner. An empty ID selects the default.
+func (s *Store) Get(owner, id string) (*Identity, error) {
+	identities, err := s.List(owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, ident := range identities {
+		if ident.ID == id || (id == "" && ident.Default) {
+			return ident, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Save creates or replaces an identity. Marking it as default clears the
+// flag on the others.
+func (s *Store) Save(owner string, ident *Identity) error {
+	if err := ident.Validate(); err != nil {
+		return err
+	}
+	if !s.Allowed(owner, ident.Email) {
+		return ErrNotAllowed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identities, err := s.read(owner)
+	if err != nil {
+		return err
+	}
+
+	if ident.ID == "" {
+		if ident.ID, err = newID(); err != nil {
+			return err
+		}
+	}
+
+	replaced := false
+	for i, existing := range identities {
+		if existing.ID == ident.ID {
+			identities[i] = ident
+			replaced = true
+		}
+	}
+	if !replaced {
+		identities = append(identities, ident)
+	}
+
+	if ident.Default {
+		for _, other := range identities {
+			if other != ident {
+				other.Default = false
+			}
+		}
+	}
+	return s.write(owner, identities)
+}
+
+// Delete removes an identity. The last identity cannot be removed.
+func (s *Store) Delete(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identities, err := s.read(owner)
+	if err != nil {
+		return err
+	}
+
+	kept := identities[:0]
+	for _, ident := range identities {
+		if ident.ID != id {
+			kept = append(kept, ident)
+		}
+	}
+	if len(kept) == len(identities) {
+		return ErrNotFound
+	}
+	if len(kept) == 0 {
+		return ErrLastIdentity
+	}
+	return s.write(owner, kept)
+}
+
+// Match returns the identity whose address appears first in addresses,
+// such as the recipients of a message being replied to. The default
+// identity is returned when none matches. Identities the user may no
+// longer send as are skipped, down to one for the login address.
+func (s *Store) Match(owner string, addresses []string) (*Identity, error) {
+	all, err := s.List(owner)
+	if err != nil {
+		return nil, err
+	}
+	var identities []*Identity
+	for _, ident := range all {
+		if s.Allowed(owner, ident.Email) {
+			identities = append(identities, ident)
+		}
+	}
+	if len(identities) == 0 {
+		return &Identity{ID: DefaultID, Email: owner, Default: true}, nil
+	}
+
+	for _, address := range addresses {
+		for _, ident := range identities {
+			if strings.EqualFold(strings.TrimSpace(address), ident.Email) {
+				return ident, nil
+			}
+		}
+	}
+	return identities[0], nil
+}
+
+// Helper methods
+
+func (s *Store) path(owner string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(owner)))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *Store) read(owner string) ([]*Identity, error) {
+	data, err := os.ReadFile(s.path(owner))
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Identity{{ID: DefaultID, Email: owner, Default: true}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []*Identity
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return nil, fmt.Errorf("corrupt identities file for %s: %v", owner, err)
+	}
+	if len(identities) == 0 {
+		return []*Identity{{ID: DefaultID, Email: owner, Default: true}}, nil
+	}
+
+	// Keep the default identity first
+	for i, ident := range identities {
+		if ident.Default {
+			identities[0], identities[i] = identities[i], identities[0]
+			break
+		}
+	}
+	identities[0].Default = true
+	return identities, nil
+}
+
+func (s *Store) write(owner string, identities []*Identity) error {
+	data, err := json.MarshalIndent(identities, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path(owner), data, 0600)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate identity ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,158 @@
+package identity
+
+import (
+	"errors"
+	"lilmail/config"
+	"path/filepath"
+	"testing"
+)
+
+const owner = "user@example.com"
+
+func newTestStore(t *testing.T, senders config.IdentitiesConfig) *Store {
+	t.Helper()
+	if err := senders.ResolveIdentities(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(filepath.Join(t.TempDir(), "identities"), senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	ident := &Identity{Name: " Support ", Email: " support@example.com ", ReplyTo: "a@example.com, B <b@example.com>"}
+	if err := ident.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if ident.Name != "Support" || ident.Email != "support@example.com" {
+		t.Errorf("Validate did not trim: %q, %q", ident.Name, ident.Email)
+	}
+
+	for _, ident := range []*Identity{
+		{Email: ""},
+		{Email: "support"},
+		{Email: "Support <support@example.com>"},
+		{Email: "support@example.com", ReplyTo: "not an address"},
+	} {
+		if err := ident.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", ident)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	s := newTestStore(t, config.IdentitiesConfig{
+		Domains: []string{"@Example.org"},
+		Aliases: map[string][]string{"User@Example.com": {"Sales@Example.com"}},
+	})
+	for _, tt := range []struct {
+		owner, address string
+		want           bool
+	}{
+		{owner, "USER@example.com", true},
+		{owner, "sales@example.com", true},
+		{owner, "anyone@example.org", true},
+		{owner, "anyone@sub.example.org", false},
+		{owner, "boss@example.com", false},
+		{"other@example.com", "sales@example.com", false},
+		{"other@example.com", "other@example.com", true},
+	} {
+		if got := s.Allowed(tt.owner, tt.address); got != tt.want {
+			t.Errorf("Allowed(%s, %s) = %v, want %v", tt.owner, tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := newTestStore(t, config.IdentitiesConfig{Aliases: map[string][]string{owner: {"sales@example.com"}}})
+
+	// A user who never saved an identity sends as the login address
+	identities, err := s.List(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].ID != DefaultID || identities[0].Email != owner || !identities[0].Default {
+		t.Fatalf("List = %+v, want the login address", identities)
+	}
+
+	if err := s.Save(owner, &Identity{Email: "boss@example.com"}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Save of a foreign address = %v, want ErrNotAllowed", err)
+	}
+	if err := s.Save(owner, &Identity{Email: "sales"}); err == nil {
+		t.Error("Save of an invalid address succeeded")
+	}
+
+	sales := &Identity{Name: "Sales", Email: "sales@example.com", Default: true}
+	if err := s.Save(owner, sales); err != nil {
+		t.Fatal(err)
+	}
+	if sales.ID == "" {
+		t.Fatal("Save did not assign an ID")
+	}
+	if got, err := s.Get(owner, ""); err != nil || got.ID != sales.ID {
+		t.Errorf("default identity = %+v, %v; want the new one", got, err)
+	}
+	if identities, _ := s.List(owner); len(identities) != 2 || identities[0].ID != sales.ID || identities[1].Default {
+		t.Errorf("List = %+v, want the new default first and the only default", identities)
+	}
+
+	// Other users do not see it
+	if identities, _ := s.List("other@example.com"); len(identities) != 1 || identities[0].Email != "other@example.com" {
+		t.Errorf("List of another user = %+v", identities)
+	}
+
+	if _, err := s.Get(owner, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an unknown ID = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(owner, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of an unknown ID = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(owner, DefaultID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(owner, sales.ID); !errors.Is(err, ErrLastIdentity) {
+		t.Errorf("Delete of the last identity = %v, want ErrLastIdentity", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	senders := config.IdentitiesConfig{Aliases: map[string][]string{owner: {"sales@example.com", "support@example.com"}}}
+	s := newTestStore(t, senders)
+	for _, ident := range []*Identity{
+		{Email: owner, Default: true},
+		{Email: "sales@example.com"},
+		{Email: "support@example.com"},
+	} {
+		if err := s.Save(owner, ident); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		addresses []string
+		want      string
+	}{
+		// Delivered-To comes first: a message to a list containing both
+		// aliases arrived through support@
+		{"Delivered-To first", []string{"support@example.com", "list@example.com", " Sales@Example.com"}, "support@example.com"},
+		{"recipient", []string{"friend@example.com", "SALES@example.com"}, "sales@example.com"},
+		{"no match", []string{"friend@example.com"}, owner},
+	} {
+		ident, err := s.Match(owner, tt.addresses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ident.Email != tt.want {
+			t.Errorf("%s: Match = %s, want %s", tt.name, ident.Email, tt.want)
+		}
+	}
+
+	// Aliases removed from the configuration are no longer picked
+	restricted := &Store{dir: s.dir}
+	if ident, err := restricted.Match(owner, []string{"support@example.com"}); err != nil || ident.Email != owner {
+		t.Errorf("Match without the alias = %+v, %v; want the login address", ident, err)
+	}
+}
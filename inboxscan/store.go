@@ -0,0 +1,230 @@
+// Package inboxscan runs the background workers that handle new INBOX
+// messages of users who are logged out, and keeps the state they need in a
+// JSON file per user.
+package inboxscan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// State is what a worker keeps about the INBOX of one user. Documents embed
+// it next to their own settings.
+type State struct {
+	Owner       string `json:"owner"`
+	Credentials string `json:"credentials,omitempty"` // Encrypted, as in the outbox
+	UIDValidity uint32 `json:"uidValidity,omitempty"` // 0 until the first scan
+	LastUID     uint32 `json:"lastUid,omitempty"`     // Highest INBOX UID already handled
+	LastError   string `json:"lastError,omitempty"`
+	AuthFailed  bool   `json:"authFailed,omitempty"` // Paused until the credentials are refreshed
+}
+
+// ScanState returns the state, which makes documents embedding it satisfy
+// Document
+func (s *State) ScanState() *State {
+	return s
+}
+
+// Restart makes the next scan only record where the INBOX stands, so mail
+// that arrived before it is left alone
+func (s *State) Restart() {
+	s.UIDValidity = 0
+	s.LastUID = 0
+}
+
+// Document is the file of one user in a Store
+type Document interface {
+	ScanState() *State
+}
+
+// Store keeps a document per user in a JSON file named after a hash of the
+// login address
+type Store struct {
+	dir    string
+	name   string // What the documents hold, for messages
+	create func(owner string) Document
+	mu     sync.Mutex
+}
+
+// NewStore opens (or creates) directory. create returns the document of a
+// user who has none yet.
+func NewStore(directory, name string, create func(owner string) Document) (*Store, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s directory: %v", name, err)
+	}
+	return &Store{
+		dir:    directory,
+		name:   name,
+		create: create,
+	}, nil
+}
+
+// Get returns the document of owner
+func (s *Store) Get(owner string) (Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(owner)
+}
+
+// Save stores a document
+func (s *Store) Save(doc Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(doc)
+}
+
+// Update changes the document of owner. Nothing is written when fn fails.
+func (s *Store) Update(owner string, fn func(doc Document) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.read(owner)
+	if err != nil {
+		return err
+	}
+	if err := fn(doc); err != nil {
+		return err
+	}
+	return s.write(doc)
+}
+
+// All returns the document of every user, skipping unreadable files
+func (s *Store) All() ([]Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := s.paths()
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []Document
+	for _, path := range paths {
+		doc := s.create("")
+		if err := readJSON(path, doc); err != nil {
+			log.Printf("Inbox scan: skipping unreadable %s file %s: %v", s.name, path, err)
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// RefreshCredentials replaces the stored credentials of owner when scanned
+// reports that a worker uses them, so a changed password reaches the worker
+// at the next login
+func (s *Store) RefreshCredentials(owner, credentials string, scanned func(doc Document) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.read(owner)
+	if err != nil || !scanned(doc) {
+		return err
+	}
+	state := doc.ScanState()
+	state.Credentials = credentials
+	state.LastError = ""
+	state.AuthFailed = false
+	return s.write(doc)
+}
+
+// RekeyCredentials re-encrypts the stored credentials with rekey and
+// returns how many documents changed
+func (s *Store) RekeyCredentials(rekey func(string) (string, error)) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := s.paths()
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, path := range paths {
+		doc := s.create("")
+		if err := readJSON(path, doc); err != nil {
+			return changed, fmt.Errorf("unreadable %s file %s: %v", s.name, path, err)
+		}
+		state := doc.ScanState()
+		if state.Credentials == "" {
+			continue
+		}
+		credentials, err := rekey(state.Credentials)
+		if err != nil {
+			return changed, fmt.Errorf("credentials of %s: %v", state.Owner, err)
+		}
+		if credentials == state.Credentials {
+			continue
+		}
+		state.Credentials = credentials
+		if err := s.write(doc); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Path returns the file of owner ending in suffix, for files kept next to
+// the documents. Documents end in ".json".
+func (s *Store) Path(owner, suffix string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(owner)))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+suffix)
+}
+
+// Helper methods
+
+// paths lists the document files, leaving out files such as "x.hits.json"
+// kept next to them
+func (s *Store) paths() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	kept := paths[:0]
+	for _, path := range paths {
+		if strings.Count(filepath.Base(path), ".") == 1 {
+			kept = append(kept, path)
+		}
+	}
+	return kept, nil
+}
+
+func (s *Store) read(owner string) (Document, error) {
+	doc := s.create(owner)
+	err := readJSON(s.Path(owner, ".json"), doc)
+	if errors.Is(err, os.ErrNotExist) {
+		return doc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("corrupt %s file for %s: %v", s.name, owner, err)
+	}
+	return doc, nil
+}
+
+func (s *Store) write(doc Document) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.Path(doc.ScanState().Owner, ".json"), data, 0600)
+}
+
+// readJSON decodes the JSON file at path into v
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,182 @@
+package inboxscan
+
+import (
+	"errors"
+	"fmt"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Handler handles the INBOX messages of a user that arrived since the last
+// scan, oldest first. It returns the highest UID it is done with, which
+// stays below a message it wants offered again, and a change to save with
+// it, which may be nil.
+type Handler func(doc Document, client *api.Client, creds *api.Credentials, messages []api.MessageSummary) (uint32, func(doc Document), error)
+
+// Worker periodically hands the new INBOX messages of users to a Handler
+type Worker struct {
+	name     string // Prefix of log messages, such as "Rules"
+	store    *Store
+	config   *config.Config
+	interval time.Duration
+	list     func() ([]Document, error)
+	handle   Handler
+	stop     chan struct{}
+}
+
+// NewWorker creates a worker scanning the users list returns every
+// pollInterval seconds
+func NewWorker(name string, store *Store, config *config.Config, pollInterval int, list func() ([]Document, error), handle Handler) *Worker {
+	interval := time.Duration(pollInterval) * time.Second
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+	return &Worker{
+		name:     name,
+		store:    store,
+		config:   config,
+		interval: interval,
+		list:     list,
+		handle:   handle,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Run scans mailboxes until Stop is called
+func (w *Worker) Run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		docs, err := w.list()
+		if err != nil {
+			log.Printf("%s: error listing mailboxes: %v", w.name, err)
+		}
+		for _, doc := range docs {
+			if !doc.ScanState().AuthFailed {
+				w.scan(doc)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run
+func (w *Worker) Stop() {
+	close(w.stop)
+}
+
+// UID returns the UID of a message, or 0 when it has none
+func UID(msg *api.MessageSummary) uint32 {
+	uid, err := strconv.ParseUint(msg.UID, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(uid)
+}
+
+// scan hands the INBOX messages that arrived since the last scan to the
+// handler. The first scan, and a scan after UIDVALIDITY changed, only
+// records where the mailbox stands, so existing mail is left alone.
+func (w *Worker) scan(doc Document) {
+	state := doc.ScanState()
+	creds, err := api.DecryptCredentials(state.Credentials, w.config.Encryption.Keyring)
+	if err != nil {
+		w.fail(state.Owner, fmt.Errorf("failed to decrypt credentials: %v", err), true)
+		return
+	}
+
+	client, err := api.NewClient(creds.Profile(w.config.IMAP.Profile), creds.Email, creds.Password)
+	if err != nil {
+		w.fail(state.Owner, err, errors.Is(err, api.ErrLoginFailed))
+		return
+	}
+	defer client.Close()
+
+	uidValidity, uidNext, err := client.FolderState("INBOX")
+	if err != nil {
+		w.fail(state.Owner, err, false)
+		return
+	}
+
+	// UIDVALIDITY is never 0, so a stored 0 marks a mailbox never scanned,
+	// while LastUID is legitimately 0 after a scan of an empty INBOX
+	if uidValidity == 0 {
+		w.fail(state.Owner, errors.New("server reported no UIDVALIDITY for INBOX"), false)
+		return
+	}
+	if state.UIDValidity != uidValidity {
+		w.checkpoint(state.Owner, uidValidity, lastBefore(uidNext), nil)
+		return
+	}
+
+	messages, err := client.SummariesSince("INBOX", state.LastUID)
+	if err != nil {
+		w.fail(state.Owner, err, false)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return UID(&messages[i]) < UID(&messages[j])
+	})
+
+	lastUID, change, err := w.handle(doc, client, creds, messages)
+	if lastUID < state.LastUID {
+		lastUID = state.LastUID
+	}
+	w.checkpoint(state.Owner, uidValidity, lastUID, change)
+	if err != nil {
+		w.fail(state.Owner, err, false)
+	}
+}
+
+func (w *Worker) checkpoint(owner string, uidValidity, lastUID uint32, change func(doc Document)) {
+	err := w.store.Update(owner, func(doc Document) error {
+		state := doc.ScanState()
+		state.UIDValidity = uidValidity
+		state.LastUID = lastUID
+		state.LastError = ""
+		if change != nil {
+			change(doc)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("%s: error saving state for %s: %v", w.name, owner, err)
+	}
+}
+
+// fail records a scan error. Rejected credentials pause the mailbox so the
+// worker does not keep failing logins until the user signs in again.
+func (w *Worker) fail(owner string, err error, pause bool) {
+	log.Printf("%s: error scanning mailbox of %s: %v", w.name, owner, err)
+	updateErr := w.store.Update(owner, func(doc Document) error {
+		state := doc.ScanState()
+		state.LastError = err.Error()
+		state.AuthFailed = pause
+		return nil
+	})
+	if updateErr != nil {
+		log.Printf("%s: error saving state for %s: %v", w.name, owner, updateErr)
+	}
+}
+
+// lastBefore returns the UID below uidNext, which is 0 for a mailbox that
+// never held a message
+func lastBefore(uidNext uint32) uint32 {
+	if uidNext == 0 {
+		return 0
+	}
+	return uidNext - 1
+}
@@ -0,0 +1,227 @@
+// Package keyring holds the keys that encrypt stored credentials and
+// secrets. Keys are derived from passphrases, and every ciphertext names
+// the key it was made with, so a new key can encrypt while older ones still
+// decrypt until everything has been re-encrypted.
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key derivation functions
+const (
+	KDFHKDF   = "hkdf"     // For long random secrets
+	KDFArgon2 = "argon2id" // For passphrases people can remember
+)
+
+// Argon2id cost, the OWASP minimum, kept low for small servers since keys
+// are only derived at startup
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024 // KiB
+	argonThreads = 1
+)
+
+// hkdfInfo binds derived keys to their use
+const hkdfInfo = "lilmail stored credentials"
+
+// ErrUnknownKey is returned for ciphertexts made with a key that is no
+// longer configured
+var ErrUnknownKey = errors.New("encrypted with an unknown key")
+
+// Spec describes one configured key
+type Spec struct {
+	ID         string
+	Passphrase string
+	KDF        string // KDFHKDF when empty
+	Salt       string // Derived from the ID when empty
+}
+
+// Keyring encrypts with its primary key and decrypts with any of its keys
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+	legacy  cipher.AEAD // Raw AES key for ciphertexts without a key ID
+}
+
+// New derives the keys of specs; the first one encrypts. legacy is the
+// former raw AES key, kept to read what was stored before key IDs existed.
+// It is ignored unless it is 16, 24 or 32 bytes long.
+func New(specs []Spec, legacy string) (*Keyring, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no encryption key configured")
+	}
+
+	k := &Keyring{
+		primary: specs[0].ID,
+		keys:    make(map[string]cipher.AEAD),
+	}
+	for _, spec := range specs {
+		if err := validID(spec.ID); err != nil {
+			return nil, err
+		}
+		if _, ok := k.keys[spec.ID]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", spec.ID)
+		}
+		raw, err := derive(spec)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", spec.ID, err)
+		}
+		if k.keys[spec.ID], err = newAEAD(raw); err != nil {
+			return nil, fmt.Errorf("key %q: %v", spec.ID, err)
+		}
+	}
+
+	switch len(legacy) {
+	case 16, 24, 32:
+		aead, err := newAEAD([]byte(legacy))
+		if err != nil {
+			return nil, err
+		}
+		k.legacy = aead
+	}
+	return k, nil
+}
+
+// Primary returns the ID of the key new ciphertexts are made with
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Encrypt seals plaintext with AES-GCM under the primary key and returns
+// it as "<key ID>:<base64>"
+func (k *Keyring) Encrypt(plaintext []byte) (string, error) {
+	aead := k.keys[k.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	// The key ID is authenticated too, so it cannot be swapped
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(k.primary))
+	return k.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a ciphertext made with any key of the ring
+func (k *Keyring) Decrypt(encrypted string) ([]byte, error) {
+	id, data, aead, err := k.split(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode: %v", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	var additional []byte
+	if id != "" {
+		additional = []byte(id)
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, additional)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
+// Current reports whether a ciphertext was made with the primary key
+func (k *Keyring) Current(encrypted string) bool {
+	id, _, ok := strings.Cut(encrypted, ":")
+	return ok && id == k.primary
+}
+
+// Rekey re-encrypts a ciphertext with the primary key. It returns the input
+// unchanged when it already uses the primary key.
+func (k *Keyring) Rekey(encrypted string) (string, error) {
+	if k.Current(encrypted) {
+		return encrypted, nil
+	}
+	plaintext, err := k.Decrypt(encrypted)
+	if err != nil {
+		return "", err
+	}
+	return k.Encrypt(plaintext)
+}
+
+// Helper methods
+
+func (k *Keyring) split(encrypted string) (string, string, cipher.AEAD, error) {
+	id, data, ok := strings.Cut(encrypted, ":")
+	if !ok {
+		if k.legacy == nil {
+			return "", "", nil, ErrUnknownKey
+		}
+		return "", encrypted, k.legacy, nil
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return "", "", nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	return id, data, aead, nil
+}
+
+// derive turns a passphrase into a 256-bit AES key
+func derive(spec Spec) ([]byte, error) {
+	if spec.Passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	salt := []byte(spec.Salt)
+	if len(salt) == 0 {
+		sum := sha256.Sum256([]byte("lilmail:" + spec.ID))
+		salt = sum[:]
+	}
+
+	switch strings.ToLower(spec.KDF) {
+	case "", KDFHKDF:
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(spec.Passphrase), salt, []byte(hkdfInfo)), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	case KDFArgon2:
+		return argon2.IDKey([]byte(spec.Passphrase), salt, argonTime, argonMemory, argonThreads, 32), nil
+	}
+	return nil, fmt.Errorf("kdf %q must be one of hkdf, argon2id", spec.KDF)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return aead, nil
+}
+
+// validID keeps key IDs apart from the base64 data that follows them
+func validID(id string) error {
+	if id == "" {
+		return errors.New("key ID is empty")
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("key ID %q may only contain letters, digits, - and _", id)
+		}
+	}
+	return nil
+}
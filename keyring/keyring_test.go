@@ -0,0 +1,239 @@
+package keyring
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+func mustNew(t *testing.T, specs []Spec, legacy string) *Keyring {
+	t.Helper()
+	k, err := New(specs, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := mustNew(t, []Spec{{ID: "2025", Passphrase: "correct horse"}}, "")
+
+	for _, plaintext := range [][]byte{[]byte("user@example.com:secret"), {}, bytes.Repeat([]byte{0xff}, 4096)} {
+		encrypted, err := k.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(encrypted, "2025:") {
+			t.Errorf("Encrypt = %q, want the key ID as prefix", encrypted)
+		}
+		got, err := k.Decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Decrypt = %q, want %q", got, plaintext)
+		}
+	}
+
+	// A fresh nonce every time
+	a, _ := k.Encrypt([]byte("same"))
+	b, _ := k.Encrypt([]byte("same"))
+	if a == b {
+		t.Error("two encryptions of the same plaintext are identical")
+	}
+}
+
+func TestTamperedCiphertext(t *testing.T) {
+	// Both keys share a passphrase and salt, so only the key ID, which is
+	// authenticated, tells their ciphertexts apart
+	k := mustNew(t, []Spec{
+		{ID: "a", Passphrase: "shared", Salt: "salt"},
+		{ID: "b", Passphrase: "shared", Salt: "salt"},
+	}, "")
+	encrypted, err := k.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, _ := strings.Cut(encrypted, ":")
+
+	if _, err := k.Decrypt("b:" + data); err == nil {
+		t.Error("Decrypt accepted a ciphertext whose key ID was swapped")
+	}
+	if _, err := k.Decrypt("unknown:" + data); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt with an unknown key ID = %v, want ErrUnknownKey", err)
+	}
+	if _, err := k.Decrypt(data); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt without a key ID or legacy key = %v, want ErrUnknownKey", err)
+	}
+
+	sealed, _ := base64.StdEncoding.DecodeString(data)
+	sealed[len(sealed)-1] ^= 1
+	if _, err := k.Decrypt("a:" + base64.StdEncoding.EncodeToString(sealed)); err == nil {
+		t.Error("Decrypt accepted a modified ciphertext")
+	}
+	for _, broken := range []string{"a:not base64!", "a:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := k.Decrypt(broken); err == nil {
+			t.Errorf("Decrypt(%q) succeeded", broken)
+		}
+	}
+}
+
+func TestLegacyRawKey(t *testing.T) {
+	const legacy = "0123456789abcdef0123456789abcdef"
+
+	// Encrypted as before key IDs: AES-GCM under the raw key, nonce first,
+	// no additional data
+	block, err := aes.NewCipher([]byte(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		t.Fatal(err)
+	}
+	blob := base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte("old secret"), nil))
+
+	k := mustNew(t, []Spec{{ID: "default", Passphrase: legacy}}, legacy)
+	got, err := k.Decrypt(blob)
+	if err != nil {
+		t.Fatalf("Decrypt of a legacy blob: %v", err)
+	}
+	if string(got) != "old secret" {
+		t.Errorf("Decrypt = %q", got)
+	}
+	if k.Current(blob) {
+		t.Error("a legacy blob counts as current")
+	}
+	rekeyed, err := k.Rekey(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rekeyed, "default:") {
+		t.Errorf("Rekey of a legacy blob = %q", rekeyed)
+	}
+
+	// A passphrase that is not a valid AES key length leaves no legacy key
+	k = mustNew(t, []Spec{{ID: "default", Passphrase: "a long passphrase"}}, "a long passphrase")
+	if _, err := k.Decrypt(blob); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt of a legacy blob without a legacy key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old := mustNew(t, []Spec{{ID: "2024", Passphrase: "old passphrase"}}, "")
+	encrypted, err := old.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new primary key, with the old one kept to decrypt
+	k := mustNew(t, []Spec{
+		{ID: "2025", Passphrase: "new passphrase", KDF: KDFArgon2},
+		{ID: "2024", Passphrase: "old passphrase"},
+	}, "")
+	if k.Primary() != "2025" {
+		t.Errorf("Primary = %q, want the first key", k.Primary())
+	}
+	if got, err := k.Decrypt(encrypted); err != nil || string(got) != "secret" {
+		t.Errorf("Decrypt with the old key still in the ring = %q, %v", got, err)
+	}
+	if k.Current(encrypted) {
+		t.Error("a ciphertext of the old key counts as current")
+	}
+
+	rekeyed, err := k.Rekey(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.Current(rekeyed) {
+		t.Errorf("Rekey = %q, not under the primary key", rekeyed)
+	}
+	if again, _ := k.Rekey(rekeyed); again != rekeyed {
+		t.Error("Rekey changed a ciphertext already under the primary key")
+	}
+
+	// Once the old key is removed, only the rekeyed value decrypts
+	k = mustNew(t, []Spec{{ID: "2025", Passphrase: "new passphrase", KDF: KDFArgon2}}, "")
+	if got, err := k.Decrypt(rekeyed); err != nil || string(got) != "secret" {
+		t.Errorf("Decrypt of the rekeyed value = %q, %v", got, err)
+	}
+	if _, err := k.Decrypt(encrypted); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt after removing the old key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestDerive(t *testing.T) {
+	idSalt := sha256.Sum256([]byte("lilmail:main"))
+
+	hkdfKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte("secret"), idSalt[:], []byte(hkdfInfo)), hkdfKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		spec Spec
+		want []byte
+	}{
+		{"hkdf by default", Spec{ID: "main", Passphrase: "secret"}, hkdfKey},
+		{"hkdf", Spec{ID: "main", Passphrase: "secret", KDF: "HKDF"}, hkdfKey},
+		{"argon2id", Spec{ID: "main", Passphrase: "secret", KDF: KDFArgon2},
+			argon2.IDKey([]byte("secret"), idSalt[:], argonTime, argonMemory, argonThreads, 32)},
+		{"argon2id with salt", Spec{ID: "main", Passphrase: "secret", KDF: KDFArgon2, Salt: "pepper"},
+			argon2.IDKey([]byte("secret"), []byte("pepper"), argonTime, argonMemory, argonThreads, 32)},
+	} {
+		got, err := derive(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: derived %s, want %s", tt.name, hex.EncodeToString(got), hex.EncodeToString(tt.want))
+		}
+	}
+
+	// The ID salts the key, so equal passphrases give different keys
+	a, _ := derive(Spec{ID: "a", Passphrase: "secret"})
+	b, _ := derive(Spec{ID: "b", Passphrase: "secret"})
+	if bytes.Equal(a, b) {
+		t.Error("keys with different IDs derived the same key")
+	}
+
+	for _, spec := range []Spec{
+		{ID: "main", Passphrase: ""},
+		{ID: "main", Passphrase: "secret", KDF: "scrypt"},
+	} {
+		if _, err := derive(spec); err == nil {
+			t.Errorf("derive(%+v) succeeded", spec)
+		}
+	}
+}
+
+func TestNewRejectsSpecs(t *testing.T) {
+	for name, specs := range map[string][]Spec{
+		"no keys":      nil,
+		"empty ID":     {{ID: "", Passphrase: "x"}},
+		"colon in ID":  {{ID: "a:b", Passphrase: "x"}},
+		"duplicate ID": {{ID: "a", Passphrase: "x"}, {ID: "a", Passphrase: "y"}},
+		"unknown KDF":  {{ID: "a", Passphrase: "x", KDF: "md5"}},
+	} {
+		if _, err := New(specs, ""); err == nil {
+			t.Errorf("%s: New succeeded", name)
+		}
+	}
+}
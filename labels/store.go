@@ -0,0 +1,237 @@
+// Package labels stores the message labels of each user. A label is shown
+// with a name and a colour and is kept on the server as an IMAP keyword.
+package labels
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned for unknown label IDs
+var ErrNotFound = errors.New("label not found")
+
+// ErrDuplicate is returned when a user already has a label with the name
+var ErrDuplicate = errors.New("a label with this name already exists")
+
+// Colors are the label colours offered in the UI, named after the Tailwind
+// palette used by the templates
+var Colors = []string{"gray", "red", "orange", "yellow", "green", "teal", "blue", "indigo", "purple", "pink"}
+
+// Label is a user-defined tag applied to messages
+type Label struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Color   string `json:"color"`
+	Keyword string `json:"keyword"` // IMAP keyword; kept when the label is renamed
+}
+
+// Validate checks the name and colour of the label
+func (l *Label) Validate() error {
+	l.Name = strings.TrimSpace(l.Name)
+	if l.Name == "" {
+		return fmt.Errorf("label name is required")
+	}
+	if len(l.Name) > 64 {
+		return fmt.Errorf("label name is too long")
+	}
+	if l.Color == "" {
+		l.Color = Colors[0]
+	}
+	for _, color := range Colors {
+		if l.Color == color {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid label color %q", l.Color)
+}
+
+// Store keeps the labels of each user in a JSON file named after a hash of
+// the login address
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewStore opens (or creates) the labels directory
+func NewStore(directory string) (*Store, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create labels directory: %v", err)
+	}
+	return &Store{dir: directory}, nil
+}
+
+// List returns the labels of owner, sorted as they were created
+func (s *Store) List(owner string) ([]*Label, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(owner)
+}
+
+// Get returns one label of owner
+func (s *Store) Get(owner, id string) (*Label, error) {
+	labels, err := s.List(owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, label := range labels {
+		if label.ID == id {
+			return label, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ByKeyword maps lowercased keywords to labels, for showing the labels of
+// fetched messages
+func ByKeyword(labels []*Label) map[string]*Label {
+	byKeyword := make(map[string]*Label, len(labels))
+	for _, label := range labels {
+		byKeyword[strings.ToLower(label.Keyword)] = label
+	}
+	return byKeyword
+}
+
+// Save creates or updates a label. New labels get a keyword derived from
+// their name; renaming keeps the keyword so tagged messages keep the label.
+func (s *Store) Save(owner string, label *Label) error {
+	if err := label.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	labels, err := s.read(owner)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range labels {
+		if existing.ID != label.ID && strings.EqualFold(existing.Name, label.Name) {
+			return ErrDuplicate
+		}
+	}
+
+	if label.ID == "" {
+		if label.ID, err = newID(); err != nil {
+			return err
+		}
+		label.Keyword = newKeyword(label, labels)
+		labels = append(labels, label)
+		return s.write(owner, labels)
+	}
+
+	for i, existing := range labels {
+		if existing.ID == label.ID {
+			label.Keyword = existing.Keyword
+			labels[i] = label
+			return s.write(owner, labels)
+		}
+	}
+	return ErrNotFound
+}
+
+// Delete removes a label. Messages keep the keyword, which is no longer
+// shown.
+func (s *Store) Delete(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	labels, err := s.read(owner)
+	if err != nil {
+		return err
+	}
+
+	kept := labels[:0]
+	for _, label := range labels {
+		if label.ID != id {
+			kept = append(kept, label)
+		}
+	}
+	if len(kept) == len(labels) {
+		return ErrNotFound
+	}
+	return s.write(owner, kept)
+}
+
+// Helper methods
+
+func (s *Store) path(owner string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(owner)))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *Store) read(owner string) ([]*Label, error) {
+	data, err := os.ReadFile(s.path(owner))
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Label{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []*Label
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("corrupt labels file for %s: %v", owner, err)
+	}
+	return labels, nil
+}
+
+func (s *Store) write(owner string, labels []*Label) error {
+	data, err := json.MarshalIndent(labels, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path(owner), data, 0600)
+}
+
+// newKeyword turns the label name into an IMAP atom, so other clients show
+// a readable keyword. Names without usable characters, and names clashing
+// with another label's keyword, fall back to the label ID.
+func newKeyword(label *Label, labels []*Label) string {
+	var b strings.Builder
+	for _, r := range label.Name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('_')
+		}
+	}
+
+	keyword := b.String()
+	if keyword == "" {
+		return "label-" + label.ID
+	}
+	for _, reserved := range reservedKeywords {
+		if strings.EqualFold(reserved, keyword) {
+			return keyword + "-" + label.ID
+		}
+	}
+	for _, other := range labels {
+		if strings.EqualFold(other.Keyword, keyword) {
+			return keyword + "-" + label.ID
+		}
+	}
+	return keyword
+}
+
+// reservedKeywords are set by other clients with a meaning of their own
+var reservedKeywords = []string{"Junk", "NonJunk", "Forwarded", "MDNSent"}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate label ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
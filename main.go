@@ -1,12 +1,24 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"lilmail/config"
 	"lilmail/handlers/api"
 	"lilmail/handlers/web"
+	"lilmail/identity"
+	"lilmail/labels"
+	"lilmail/oauth"
+	"lilmail/oidc"
+	"lilmail/outbox"
+	"lilmail/rules"
 	"lilmail/storage"
+	"lilmail/throttle"
+	"lilmail/twofactor"
+	"lilmail/vacation"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -17,23 +29,45 @@ import (
 	"github.com/gofiber/template/html/v2"
 )
 
-var store *session.Store
+var (
+	store    *session.Store
+	sessions *storage.Store // Also lists and revokes sessions
+)
 
-func init() {
-	// Create file storage
-	storage, err := storage.NewFileStorage("./sessions")
+// openSessions opens the configured session storage
+func openSessions(cfg config.SessionConfig) {
+	var err error
+	sessions, err = storage.Open(cfg)
 	if err != nil {
 		log.Fatal("Failed to initialize session storage:", err)
 	}
 
 	store = session.New(session.Config{
-		Storage:        storage,
+		Storage:        sessions,
 		Expiration:     24 * time.Hour,
 		CookieSecure:   false, // Set to true in production with HTTPS
 		CookieHTTPOnly: true,
+		CookieSameSite: "Lax", // Not sent with cross-site form posts or subrequests
 	})
 }
 
+// openCommandSessions opens the session storage for a command, which must
+// reach the sessions the server keeps
+func openCommandSessions(cfg config.SessionConfig, command string) {
+	if cfg.Backend == config.SessionMemory {
+		log.Fatalf("lilmail %s: sessions are kept in the memory of the server process, out of reach of this command; they all end when the server restarts", command)
+	}
+
+	var err error
+	sessions, err = storage.Open(cfg)
+	if errors.Is(err, storage.ErrDatabaseInUse) {
+		log.Fatalf("lilmail %s: %v; stop the server first", command, err)
+	}
+	if err != nil {
+		log.Fatal("Failed to initialize session storage:", err)
+	}
+}
+
 // Helper function to determine if request is an API request
 func isAPIRequest(c *fiber.Ctx) bool {
 	if c == nil {
@@ -57,6 +91,32 @@ func main() {
 		log.Fatal("Failed to load config:", err)
 	}
 
+	// "lilmail rekey" re-encrypts stored data with the current key and exits
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		openCommandSessions(config.Session, "rekey")
+		if err := rekey(config); err != nil {
+			log.Fatal("Rekey failed: ", err)
+		}
+		return
+	}
+
+	// "lilmail sign-out <email>" ends every session of an account and exits
+	if len(os.Args) > 1 && os.Args[1] == "sign-out" {
+		if len(os.Args) != 3 {
+			log.Fatal("Usage: lilmail sign-out <email>")
+		}
+		openCommandSessions(config.Session, "sign-out")
+		if err := signOut(config, os.Args[2]); err != nil {
+			log.Fatal("Sign-out failed: ", err)
+		}
+		return
+	}
+
+	openSessions(config.Session)
+
+	log.Printf("IMAP server: %s", config.IMAP.Profile)
+	log.Printf("SMTP server: %s", config.SMTP.Profile)
+
 	// Initialize template engine with custom functions
 	engine := html.New("./templates", ".html")
 
@@ -92,8 +152,11 @@ func main() {
 
 	// Initialize Fiber with template engine
 	app := fiber.New(fiber.Config{
-		Views:       engine,
-		ViewsLayout: "layouts/main", // Default layout
+		Views:              engine,
+		ViewsLayout:        "layouts/main", // Default layout
+		PassLocalsToViews:  true,           // Templates read the CSRF token from Locals
+		ProxyHeader:        config.Server.ProxyHeader,
+		EnableIPValidation: true, // Take only a valid address from the proxy header
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -125,49 +188,236 @@ func main() {
 		CacheDuration: 24 * time.Hour,
 	})
 
+	// OAuth logins keep their access tokens fresh for the handlers and
+	// workers alike
+	var oauthProvider *oauth.Provider
+	if config.OAuth.Enabled {
+		oauthProvider = oauth.NewProvider(config.OAuth)
+		api.TokenRefresher = oauthProvider.Renew
+	}
+	var oidcProvider *oidc.Provider
+	if config.OIDC.Enabled {
+		oidcProvider = oidc.NewProvider(config.OIDC)
+	}
+
+	// Create the outbox worker
+	outboxQueue, err := outbox.NewQueue(filepath.Join(config.Data.Folder, "outbox"))
+	if err != nil {
+		log.Fatal("Failed to initialize outbox:", err)
+	}
+	outboxWorker := outbox.NewWorker(outboxQueue, config)
+
+	identities, err := identity.NewStore(filepath.Join(config.Data.Folder, "identities"), config.Identities)
+	if err != nil {
+		log.Fatal("Failed to initialize identities:", err)
+	}
+
+	labelStore, err := labels.NewStore(filepath.Join(config.Data.Folder, "labels"))
+	if err != nil {
+		log.Fatal("Failed to initialize labels:", err)
+	}
+
+	// Create the mail rules worker
+	ruleStore, err := rules.NewStore(filepath.Join(config.Data.Folder, "rules"))
+	if err != nil {
+		log.Fatal("Failed to initialize rules:", err)
+	}
+	ruleEngine := rules.NewEngine(labelStore, outboxQueue, outboxWorker)
+	rulesWorker := rules.NewWorker(ruleStore, ruleEngine, config)
+
+	// Create the vacation reply worker (used when Sieve cannot send replies)
+	vacationStore, err := vacation.NewStore(filepath.Join(config.Data.Folder, "vacation"))
+	if err != nil {
+		log.Fatal("Failed to initialize vacation replies:", err)
+	}
+	vacationWorker := vacation.NewWorker(vacationStore, identities, config)
+
+	// Failed login counters survive restarts
+	loginLimiter, err := throttle.NewLimiter(filepath.Join(config.Data.Folder, "login-attempts.json"), config.Login)
+	if err != nil {
+		log.Fatal("Failed to initialize login throttling:", err)
+	}
+
+	twoFactorStore, err := twofactor.NewStore(filepath.Join(config.Data.Folder, "twofactor"), config.Encryption.Keyring, config.TwoFactor.Issuer)
+	if err != nil {
+		log.Fatal("Failed to initialize two-factor login:", err)
+	}
+
+	// Revoked tokens are refused until they expire
+	denylist, err := api.NewDenylist(filepath.Join(config.Data.Folder, revokedTokensFile))
+	if err != nil {
+		log.Fatal("Failed to initialize token revocation:", err)
+	}
+
 	// Initialize web handlers
-	webAuthHandler := web.NewAuthHandler(store, config)
-	webEmailHandler := web.NewEmailHandler(store, config, webAuthHandler)
+	webAuthHandler := web.NewAuthHandler(store, config, loginLimiter, twoFactorStore, oauthProvider, oidcProvider)
+	webEmailHandler := web.NewEmailHandler(store, config, webAuthHandler, outboxQueue, outboxWorker, identities, labelStore)
+	webOutboxHandler := web.NewOutboxHandler(store, config, webAuthHandler, outboxQueue, outboxWorker, identities)
+	webDraftHandler := web.NewDraftHandler(store, config, webAuthHandler, identities)
+	webIdentityHandler := web.NewIdentityHandler(store, config, identities)
+	webLabelHandler := web.NewLabelHandler(store, config, webAuthHandler, labelStore)
+	webFolderHandler := web.NewFolderHandler(store, config, webAuthHandler)
+	webQuotaHandler := web.NewQuotaHandler(store, config, webAuthHandler)
+	webSieveHandler := web.NewSieveHandler(store, config, webAuthHandler, labelStore)
+	webRuleHandler := web.NewRuleHandler(store, config, webAuthHandler, ruleStore, ruleEngine, labelStore)
+	webTwoFactorHandler := web.NewTwoFactorHandler(store, config, loginLimiter, twoFactorStore)
+	webVacationHandler := web.NewVacationHandler(store, config, webAuthHandler, vacationStore, identities, labelStore)
+	webDeviceHandler := web.NewDeviceHandler(store, config, sessions, denylist)
+
+	// Keep the credentials used by the workers current
+	keepCredentials := func(email, credentials string) {
+		if err := ruleStore.RefreshCredentials(email, credentials); err != nil {
+			log.Printf("Error refreshing rule credentials for %s: %v", email, err)
+		}
+		if err := vacationStore.RefreshCredentials(email, credentials); err != nil {
+			log.Printf("Error refreshing vacation credentials for %s: %v", email, err)
+		}
+		if err := outboxQueue.RefreshCredentials(email, credentials); err != nil {
+			log.Printf("Error refreshing outbox credentials for %s: %v", email, err)
+		}
+	}
+	webAuthHandler.OnLogin(keepCredentials)
+
+	// Renewed OAuth tokens replace every stored copy, including those in
+	// the user's sessions, since the old refresh token may no longer work
+	api.CredentialsRenewed = func(email, refreshToken, credentials string) {
+		keepCredentials(email, credentials)
+		if _, err := renewSessions(config.Encryption.Keyring, email, refreshToken, credentials); err != nil {
+			log.Printf("Error refreshing session credentials for %s: %v", email, err)
+		}
+	}
+
+	// Start the workers once renewed credentials are written back
+	go outboxWorker.Run()
+	go rulesWorker.Run()
+	go vacationWorker.Run()
+
+	// Health check endpoint
+	app.Get("/health", func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	// Every route below needs the CSRF token for state-changing requests
+	app.Use(api.CSRFMiddleware(store, config.Server.TrustedOrigins))
 
 	// Public routes
 	app.Get("/login", webAuthHandler.ShowLogin)
 	app.Post("/login", webAuthHandler.HandleLogin)
-	app.Get("/logout", webAuthHandler.HandleLogout)
+	app.Get("/login/verify", webAuthHandler.ShowVerify)
+	app.Post("/login/verify", webAuthHandler.HandleVerify)
+	app.Get("/login/oauth", webAuthHandler.HandleOAuthStart)
+	app.Get("/login/oauth/callback", webAuthHandler.HandleOAuthCallback)
+	app.Get("/login/oidc", webAuthHandler.HandleOIDCStart)
+	app.Get("/login/oidc/callback", webAuthHandler.HandleOIDCCallback)
+	app.Post("/logout", webAuthHandler.HandleLogout)
 
 	// Protected routes group
-	protected := app.Group("", api.SessionMiddleware(store))
+	protected := app.Group("", api.SessionMiddleware(store, sessions))
 
 	// Main web routes
 	protected.Get("/", webEmailHandler.HandleInbox)      // Default to inbox
 	protected.Get("/inbox", webEmailHandler.HandleInbox) // Explicit inbox route
 	protected.Get("/folder/:name", webEmailHandler.HandleFolder)
 
-	// API routes - Keep these paths exactly as they were before
-	apiRoutes := protected.Group("/api")
+	// API routes - Keep these paths exactly as they were before. Every API
+	// and HTMX request carries the bearer token of the page it came from.
+	apiRoutes := protected.Group("/api", api.TokenMiddleware(config.JWT.Secret, denylist))
 	{
 		// Email routes
 		apiRoutes.Get("/email/:id", webEmailHandler.HandleEmailView)
 		apiRoutes.Delete("/email/:id", webEmailHandler.HandleDeleteEmail)
+		apiRoutes.Get("/email/:id/reply", webEmailHandler.HandleReplyEmail)
+		apiRoutes.Post("/email/:id/mark-unread", webEmailHandler.HandleMarkUnread)
 
 		// Folder routes - This is the important fix
 		apiRoutes.Get("/folder/:name/emails", webEmailHandler.HandleFolderEmails) // Match the path in HTML
 
+		// Folder management (refreshes the cached folder list)
+		apiRoutes.Get("/folders", webFolderHandler.HandleManage)
+		apiRoutes.Get("/folders/nav", webFolderHandler.HandleNav)
+		apiRoutes.Get("/folders/counts", webFolderHandler.HandleCounts)
+
+		// Quota routes
+		apiRoutes.Get("/quota", webQuotaHandler.HandleQuota)
+		apiRoutes.Get("/quota/largest", webQuotaHandler.HandleLargest)
+		apiRoutes.Post("/folders", webFolderHandler.HandleCreate)
+		apiRoutes.Put("/folder/:name", webFolderHandler.HandleRename)
+		apiRoutes.Delete("/folder/:name", webFolderHandler.HandleDelete)
+		apiRoutes.Post("/folder/:name/subscribe", webFolderHandler.HandleSubscribe)
+		apiRoutes.Delete("/folder/:name/subscribe", webFolderHandler.HandleSubscribe)
+
 		// Composition routes
 		apiRoutes.Post("/compose", webEmailHandler.HandleComposeEmail)
+
+		// Draft routes (autosave to the IMAP Drafts folder)
+		apiRoutes.Post("/drafts", webDraftHandler.HandleSaveDraft)
+		apiRoutes.Get("/drafts/:uid", webDraftHandler.HandleGetDraft)
+		apiRoutes.Delete("/drafts/:uid", webDraftHandler.HandleDeleteDraft)
+
+		// Sender identity routes
+		apiRoutes.Get("/identities", webIdentityHandler.HandleList)
+		apiRoutes.Post("/identities", webIdentityHandler.HandleCreate)
+		apiRoutes.Put("/identities/:id", webIdentityHandler.HandleUpdate)
+		apiRoutes.Delete("/identities/:id", webIdentityHandler.HandleDelete)
+
+		// Label routes (labels are stored on messages as IMAP keywords)
+		apiRoutes.Get("/labels", webLabelHandler.HandleList)
+		apiRoutes.Get("/labels/nav", webLabelHandler.HandleNav)
+		apiRoutes.Post("/labels", webLabelHandler.HandleCreate)
+		apiRoutes.Put("/labels/:id", webLabelHandler.HandleUpdate)
+		apiRoutes.Delete("/labels/:id", webLabelHandler.HandleDelete)
+		apiRoutes.Post("/labels/:id/messages", webLabelHandler.HandleApply)
+		apiRoutes.Delete("/labels/:id/messages", webLabelHandler.HandleApply)
+
+		// Mail rule routes (applied to new INBOX messages by the rules worker)
+		apiRoutes.Get("/rules", webRuleHandler.HandleList)
+		apiRoutes.Get("/rules/status", webRuleHandler.HandleStatus)
+		apiRoutes.Post("/rules", webRuleHandler.HandleCreate)
+		apiRoutes.Put("/rules/:id", webRuleHandler.HandleUpdate)
+		apiRoutes.Delete("/rules/:id", webRuleHandler.HandleDelete)
+		apiRoutes.Post("/rules/:id/apply", webRuleHandler.HandleApply)
+		apiRoutes.Get("/rules/:id/hits", webRuleHandler.HandleHits)
+
+		// Sieve script routes (ManageSieve, when configured)
+		apiRoutes.Get("/sieve", webSieveHandler.HandleList)
+		apiRoutes.Post("/sieve/check", webSieveHandler.HandleCheck)
+		apiRoutes.Delete("/sieve/active", webSieveHandler.HandleDeactivate)
+		apiRoutes.Get("/sieve/scripts/:name", webSieveHandler.HandleGet)
+		apiRoutes.Put("/sieve/scripts/:name", webSieveHandler.HandleSave)
+		apiRoutes.Delete("/sieve/scripts/:name", webSieveHandler.HandleDelete)
+		apiRoutes.Post("/sieve/scripts/:name/activate", webSieveHandler.HandleActivate)
+
+		// Two-factor login settings
+		apiRoutes.Get("/2fa", webTwoFactorHandler.HandleStatus)
+		apiRoutes.Post("/2fa/setup", webTwoFactorHandler.HandleSetup)
+		apiRoutes.Post("/2fa/enable", webTwoFactorHandler.HandleEnable)
+		apiRoutes.Post("/2fa/recovery", webTwoFactorHandler.HandleRecovery)
+		apiRoutes.Post("/2fa/disable", webTwoFactorHandler.HandleDisable)
+
+		// Signed-in devices
+		apiRoutes.Get("/sessions", webDeviceHandler.HandleList)
+		apiRoutes.Delete("/sessions", webDeviceHandler.HandleRevokeOthers)
+		apiRoutes.Delete("/sessions/:id", webDeviceHandler.HandleRevoke)
+
+		// Vacation reply routes
+		apiRoutes.Get("/vacation", webVacationHandler.HandleGet)
+		apiRoutes.Put("/vacation", webVacationHandler.HandleSave)
+
+		// Outbox routes (undo window, scheduled and failed messages)
+		apiRoutes.Get("/outbox", webOutboxHandler.HandleList)
+		apiRoutes.Get("/outbox/:id", webOutboxHandler.HandleGet)
+		apiRoutes.Put("/outbox/:id", webOutboxHandler.HandleUpdate)
+		apiRoutes.Post("/outbox/:id/reschedule", webOutboxHandler.HandleReschedule)
+		apiRoutes.Delete("/outbox/:id", webOutboxHandler.HandleCancel)
 	}
 
 	// HTMX routes (partial template renders)
-	htmx := protected.Group("/htmx")
+	htmx := protected.Group("/htmx", api.TokenMiddleware(config.JWT.Secret, denylist))
 	{
 		htmx.Get("/email/:id", webEmailHandler.HandleEmailView)
 		htmx.Get("/folder/:name/emails", webEmailHandler.HandleFolderEmails)
 	}
 
-	// Health check endpoint
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.SendString("OK")
-	})
-
 	// 404 Handler for undefined routes
 	app.Use(func(c *fiber.Ctx) error {
 		if isAPIRequest(c) {
@@ -12,6 +12,11 @@ type Email struct {
 	To             string        `json:"to"`
 	ToNames        []string      `json:"toNames,omitempty"`
 	Cc             string        `json:"cc,omitempty"`
+	ReplyTo        string        `json:"replyTo,omitempty"`
+	DeliveredTo    []string      `json:"deliveredTo,omitempty"` // Delivered-To and X-Original-To headers
+	MessageID      string        `json:"messageId,omitempty"`
+	InReplyTo      string        `json:"inReplyTo,omitempty"`
+	References     string        `json:"references,omitempty"`
 	Subject        string        `json:"subject"`
 	Preview        string        `json:"preview"`
 	Body           string        `json:"body"` // Plain text
@@ -0,0 +1,311 @@
+// Package oauth signs users in with an OAuth 2.0 provider using the
+// authorization code flow with PKCE (RFC 7636). The access token stands in
+// for the password towards the mail servers, which accept it through
+// XOAUTH2 or OAUTHBEARER, and is refreshed before it expires.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// requestTimeout bounds each call to the provider
+const requestTimeout = 15 * time.Second
+
+// refreshGrace is how long a refresh is shared with other users of the
+// same credentials, which may have read their copy before it was replaced
+const refreshGrace = time.Minute
+
+// Token is the result of a code exchange or refresh
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	IDToken      string
+	Expiry       time.Time
+}
+
+// Provider talks to the configured authorization server
+type Provider struct {
+	config config.OAuthConfig
+	client *http.Client
+
+	// Recent refreshes, by a hash of the refresh token they used. Requests
+	// running at once renew the same credentials, and a provider rotating
+	// refresh tokens refuses one that was used before.
+	recent map[string]*refresh
+	mu     sync.Mutex
+}
+
+type refresh struct {
+	token *Token
+	at    time.Time
+}
+
+// emailClaims are read from the userinfo endpoint or the ID token
+type emailClaims struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	jwt.RegisteredClaims
+}
+
+// NewProvider creates a provider from its settings
+func NewProvider(cfg config.OAuthConfig) *Provider {
+	return &Provider{
+		config: cfg,
+		client: &http.Client{Timeout: requestTimeout},
+		recent: make(map[string]*refresh),
+	}
+}
+
+// Mechanism is the SASL mechanism the mail servers expect the token in
+func (p *Provider) Mechanism() string {
+	return p.config.Mechanism
+}
+
+// NewVerifier returns a random PKCE code verifier, also used for the state
+// parameter
+func NewVerifier() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to create verifier: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Challenge derives the S256 code challenge from a verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the provider URL the browser is sent to
+func (p *Provider) AuthCodeURL(state, verifier string) string {
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.config.ClientID)
+	values.Set("redirect_uri", p.config.RedirectURL)
+	values.Set("scope", strings.Join(p.config.Scopes, " "))
+	values.Set("state", state)
+	values.Set("code_challenge", Challenge(verifier))
+	values.Set("code_challenge_method", "S256")
+	// Ask for a refresh token; providers that do not need this ignore it
+	values.Set("access_type", "offline")
+
+	sep := "?"
+	if strings.Contains(p.config.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.config.AuthURL + sep + values.Encode()
+}
+
+// Exchange trades the authorization code for tokens
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (*Token, error) {
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", p.config.RedirectURL)
+	values.Set("code_verifier", verifier)
+	return p.token(ctx, values)
+}
+
+// Refresh gets a new access token. Providers that do not rotate refresh
+// tokens leave the old one in place.
+func (p *Provider) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	values := url.Values{}
+	values.Set("grant_type", "refresh_token")
+	values.Set("refresh_token", refreshToken)
+
+	token, err := p.token(ctx, values)
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+// Email returns the address the token belongs to, from the userinfo
+// endpoint when configured and the ID token otherwise
+func (p *Provider) Email(ctx context.Context, token *Token) (string, error) {
+	var claims emailClaims
+
+	if p.config.UserInfoURL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.UserInfoURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		if err := p.do(req, &claims); err != nil {
+			return "", fmt.Errorf("userinfo request failed: %v", err)
+		}
+	} else if err := p.idTokenClaims(token.IDToken, &claims); err != nil {
+		return "", err
+	}
+
+	if claims.Email == "" {
+		return "", errors.New("provider did not return an email address")
+	}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return "", fmt.Errorf("email address %s is not verified", claims.Email)
+	}
+	return claims.Email, nil
+}
+
+// Renew puts a fresh access token into OAuth credentials, along with the
+// refresh token when the provider rotated it. It is used as
+// api.TokenRefresher, whose caller stores the renewed credentials.
+func (p *Provider) Renew(creds *api.Credentials) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, r := range p.recent {
+		if time.Since(r.at) > refreshGrace {
+			delete(p.recent, key)
+		}
+	}
+
+	key := tokenKey(creds.RefreshToken)
+	r := p.recent[key]
+	if r == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+
+		token, err := p.Refresh(ctx, creds.RefreshToken)
+		if err != nil {
+			return err
+		}
+		r = &refresh{token: token, at: time.Now()}
+		p.recent[key] = r
+	}
+
+	creds.Password = r.token.AccessToken
+	creds.RefreshToken = r.token.RefreshToken
+	creds.Expiry = r.token.Expiry
+	return nil
+}
+
+// Helper methods
+
+// idTokenClaims reads the claims of an ID token. It came straight from the
+// token endpoint over TLS, which OpenID Connect accepts in place of its
+// signature, but it must be issued by the configured issuer to this client
+// and not have expired.
+func (p *Provider) idTokenClaims(idToken string, claims *emailClaims) error {
+	if idToken == "" {
+		return errors.New("provider returned no ID token; set userinfo_url")
+	}
+	if _, _, err := jwt.NewParser().ParseUnverified(idToken, claims); err != nil {
+		return fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	validator := jwt.NewValidator(
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err := validator.Validate(claims); err != nil {
+		return fmt.Errorf("invalid ID token: %v", err)
+	}
+	return nil
+}
+
+// token calls the token endpoint. Confidential clients authenticate with
+// their secret in the form body (client_secret_post).
+func (p *Provider) token(ctx context.Context, values url.Values) (*Token, error) {
+	values.Set("client_id", p.config.ClientID)
+	if p.config.ClientSecret != "" {
+		values.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.TokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := p.do(req, &resp); err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, errors.New("token request failed: no access token in response")
+	}
+	if resp.TokenType != "" && !strings.EqualFold(resp.TokenType, "bearer") {
+		return nil, fmt.Errorf("token request failed: unsupported token type %q", resp.TokenType)
+	}
+
+	token := &Token{
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		IDToken:      resp.IDToken,
+	}
+	if resp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	} else {
+		// Without a lifetime, assume the usual hour
+		token.Expiry = time.Now().Add(time.Hour)
+	}
+	return token, nil
+}
+
+// do sends a request and decodes its JSON response, turning OAuth error
+// responses into errors
+func (p *Provider) do(req *http.Request, out interface{}) error {
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error != "" {
+			if oauthErr.Description != "" {
+				return fmt.Errorf("%s: %s", oauthErr.Error, oauthErr.Description)
+			}
+			return errors.New(oauthErr.Error)
+		}
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+func tokenKey(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
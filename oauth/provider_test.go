@@ -0,0 +1,333 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/keyring"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://accounts.example.com"
+	testClientID = "lilmail"
+	testEmail    = "user@example.com"
+)
+
+// providerStub is an authorization server rotating refresh tokens on every
+// refresh, and an IMAP server accepting its current access token through
+// XOAUTH2
+type providerStub struct {
+	idClaims jwt.MapClaims // Claims of the ID token of the code exchange
+
+	mu        sync.Mutex
+	serial    int
+	access    string // The only access token the IMAP server accepts
+	refresh   string // The only refresh token the token endpoint accepts
+	refreshes int
+}
+
+func newProviderStub(t *testing.T) (*providerStub, *Provider, config.ConnectionProfile) {
+	t.Helper()
+	stub := &providerStub{idClaims: jwt.MapClaims{
+		"iss":            testIssuer,
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          testEmail,
+		"email_verified": true,
+	}}
+
+	web := httptest.NewServer(http.HandlerFunc(stub.token))
+	t.Cleanup(web.Close)
+	provider := NewProvider(config.OAuthConfig{
+		TokenURL:    web.URL,
+		Issuer:      testIssuer,
+		ClientID:    testClientID,
+		RedirectURL: "http://mail.example.com/login/oauth/callback",
+		Mechanism:   config.AuthXOAuth2,
+	})
+
+	be := memory.New()
+	imapServer := server.New(be)
+	imapServer.AllowInsecureAuth = true
+	imapServer.EnableAuth("XOAUTH2", func(conn server.Conn) sasl.Server {
+		return &xoauth2Server{stub: stub, be: be, conn: conn}
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go imapServer.Serve(ln)
+	t.Cleanup(func() { imapServer.Close() })
+
+	profile := config.ConnectionProfile{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		Security: config.SecurityNone,
+	}
+	return stub, provider, profile
+}
+
+// token is the token endpoint
+func (s *providerStub) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := map[string]interface{}{"token_type": "Bearer", "expires_in": 3600}
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		if r.PostFormValue("code") != "code" || r.PostFormValue("code_verifier") == "" {
+			s.refuse(w)
+			return
+		}
+		idToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, s.idClaims).SignedString([]byte("provider key"))
+		resp["id_token"] = idToken
+	case "refresh_token":
+		if r.PostFormValue("refresh_token") != s.refresh {
+			s.refuse(w)
+			return
+		}
+		s.refreshes++
+	default:
+		s.refuse(w)
+		return
+	}
+
+	s.serial++
+	s.access = fmt.Sprintf("access-%d", s.serial)
+	s.refresh = fmt.Sprintf("refresh-%d", s.serial)
+	resp["access_token"] = s.access
+	resp["refresh_token"] = s.refresh
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *providerStub) refuse(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(`{"error":"invalid_grant"}`))
+}
+
+func (s *providerStub) accepts(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return token != "" && token == s.access
+}
+
+// xoauth2Server logs the memory backend's only user in for the current
+// access token
+type xoauth2Server struct {
+	stub *providerStub
+	be   *memory.Backend
+	conn server.Conn
+}
+
+func (a *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	fields := strings.Split(string(response), "\x01")
+	if len(fields) < 2 || fields[0] != "user="+testEmail || !a.stub.accepts(strings.TrimPrefix(fields[1], "auth=Bearer ")) {
+		return nil, true, errors.New("invalid token")
+	}
+	user, err := a.be.Login(nil, "username", "password")
+	if err != nil {
+		return nil, true, err
+	}
+	ctx := a.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil, true, nil
+}
+
+func testKeyring(t *testing.T) *keyring.Keyring {
+	t.Helper()
+	keys, err := keyring.New([]keyring.Spec{{ID: "test", Passphrase: "secret"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// login runs the code exchange as the callback handler does
+func login(t *testing.T, provider *Provider) *api.Credentials {
+	t.Helper()
+	ctx := context.Background()
+	token, err := provider.Exchange(ctx, "code", "verifier")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	email, err := provider.Email(ctx, token)
+	if err != nil {
+		t.Fatalf("Email: %v", err)
+	}
+	return &api.Credentials{
+		Email:        email,
+		Password:     token.AccessToken,
+		Mechanism:    provider.Mechanism(),
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+}
+
+func dial(creds *api.Credentials, profile config.ConnectionProfile) error {
+	client, err := api.NewClient(creds.Profile(profile), creds.Email, creds.Password)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+// renewals installs the provider as the token refresher and records the
+// credentials it renews
+func renewals(t *testing.T, provider *Provider) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var renewed []string
+	api.TokenRefresher = provider.Renew
+	api.CredentialsRenewed = func(email, refreshToken, credentials string) {
+		mu.Lock()
+		defer mu.Unlock()
+		renewed = append(renewed, credentials)
+	}
+	t.Cleanup(func() {
+		api.TokenRefresher = nil
+		api.CredentialsRenewed = nil
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return renewed
+	}
+}
+
+func TestXOAuth2Login(t *testing.T) {
+	_, provider, profile := newProviderStub(t)
+	creds := login(t, provider)
+
+	if creds.Email != testEmail || creds.Mechanism != config.AuthXOAuth2 {
+		t.Errorf("credentials = %+v", creds)
+	}
+	if err := dial(creds, profile); err != nil {
+		t.Fatalf("login with the access token: %v", err)
+	}
+
+	creds.Password = "stolen"
+	if err := dial(creds, profile); !errors.Is(err, api.ErrLoginFailed) {
+		t.Errorf("login with another token = %v, want ErrLoginFailed", err)
+	}
+}
+
+func TestRenewWritesBackRotatedToken(t *testing.T) {
+	stub, provider, profile := newProviderStub(t)
+	keys := testKeyring(t)
+	renewed := renewals(t, provider)
+
+	creds := login(t, provider)
+	creds.Expiry = time.Now().Add(-time.Minute)
+	sealed, err := api.SealCredentials(creds, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests running at once share a single refresh
+	var wg sync.WaitGroup
+	results := make([]*api.Credentials, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fresh, err := api.DecryptCredentials(sealed, keys)
+			if err != nil {
+				t.Errorf("DecryptCredentials: %v", err)
+				return
+			}
+			results[i] = fresh
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	if stub.refreshes != 1 {
+		t.Errorf("%d refreshes for concurrent requests, want 1", stub.refreshes)
+	}
+	for _, fresh := range results {
+		if fresh.RefreshToken != stub.refresh || !stub.accepts(fresh.Password) {
+			t.Errorf("renewed credentials = %+v, want the rotated tokens", fresh)
+		}
+	}
+	if err := dial(results[0], profile); err != nil {
+		t.Fatalf("login with the renewed token: %v", err)
+	}
+
+	// Every renewal hands back the credentials to store
+	copies := renewed()
+	if len(copies) != len(results) {
+		t.Fatalf("%d renewals written back, want %d", len(copies), len(results))
+	}
+	stored, err := api.DecryptCredentials(copies[0], keys)
+	if err != nil {
+		t.Fatalf("decrypting the written back credentials: %v", err)
+	}
+	if stored.RefreshToken != stub.refresh || stub.refreshes != 1 {
+		t.Errorf("written back credentials hold %q after %d refreshes", stored.RefreshToken, stub.refreshes)
+	}
+
+	// Past the grace period the old copy is refused, and the stored one
+	// renews again
+	for _, r := range provider.recent {
+		r.at = time.Now().Add(-2 * refreshGrace)
+	}
+	if _, err := api.DecryptCredentials(sealed, keys); !errors.Is(err, api.ErrLoginFailed) {
+		t.Errorf("old copy after rotation = %v, want ErrLoginFailed", err)
+	}
+	stored.Expiry = time.Now().Add(-time.Minute)
+	resealed, _ := api.SealCredentials(stored, keys)
+	again, err := api.DecryptCredentials(resealed, keys)
+	if err != nil {
+		t.Fatalf("renewing the written back credentials: %v", err)
+	}
+	if err := dial(again, profile); err != nil {
+		t.Errorf("login after the second renewal: %v", err)
+	}
+}
+
+func TestIDTokenChecked(t *testing.T) {
+	for name, change := range map[string]jwt.MapClaims{
+		"other issuer":   {"iss": "https://evil.example"},
+		"other audience": {"aud": "another-client"},
+		"expired":        {"exp": time.Now().Add(-time.Hour).Unix()},
+		"no expiry":      {"exp": nil},
+		"unverified":     {"email_verified": false},
+	} {
+		stub, provider, _ := newProviderStub(t)
+		for claim, value := range change {
+			if value == nil {
+				delete(stub.idClaims, claim)
+			} else {
+				stub.idClaims[claim] = value
+			}
+		}
+
+		token, err := provider.Exchange(context.Background(), "code", "verifier")
+		if err != nil {
+			t.Fatalf("%s: Exchange: %v", name, err)
+		}
+		if email, err := provider.Email(context.Background(), token); err == nil {
+			t.Errorf("%s: Email = %q, want an error", name, email)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package oidc signs users in through an OpenID Connect identity provider.
+// The verified ID token names the user's mailbox, which LilMail then opens
+// with a master user, so nobody types a mail password.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/config"
+	"lilmail/oauth"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// requestTimeout bounds each call to the provider
+const requestTimeout = 15 * time.Second
+
+// discovery is the part of the provider metadata LilMail uses
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to the configured identity provider. Its endpoints are
+// discovered at the first login, so the app starts while the provider is
+// down.
+type Provider struct {
+	config config.OIDCConfig
+	client *http.Client
+
+	meta  *discovery
+	oauth *oauth.Provider
+	keys  *keySet
+	mu    sync.Mutex
+}
+
+// NewProvider creates a provider from its settings
+func NewProvider(cfg config.OIDCConfig) *Provider {
+	return &Provider{
+		config: cfg,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// AuthCodeURL returns the provider URL the browser is sent to. nonce is
+// echoed in the ID token, tying it to this login.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, verifier, nonce string) (string, error) {
+	flow, err := p.flow(ctx)
+	if err != nil {
+		return "", err
+	}
+	return flow.AuthCodeURL(state, verifier) + "&" + url.Values{"nonce": {nonce}}.Encode(), nil
+}
+
+// Exchange trades the authorization code for an ID token, verifies it and
+// returns the mailbox it maps to
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (string, error) {
+	flow, err := p.flow(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := flow.Exchange(ctx, code, verifier)
+	if err != nil {
+		return "", err
+	}
+	if token.IDToken == "" {
+		return "", errors.New("provider returned no ID token")
+	}
+
+	claims, err := p.verify(ctx, token.IDToken, nonce)
+	if err != nil {
+		return "", fmt.Errorf("invalid ID token: %v", err)
+	}
+	return p.mailbox(claims)
+}
+
+// Helper methods
+
+// flow returns the authorization code flow, discovering the endpoints on
+// first use
+func (p *Provider) flow(ctx context.Context) (*oauth.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth != nil {
+		return p.oauth, nil
+	}
+
+	issuer := strings.TrimRight(p.config.Issuer, "/")
+	var meta discovery
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+	if strings.TrimRight(meta.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery failed: provider calls itself %q", meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery failed: endpoints missing")
+	}
+
+	p.meta = &meta
+	p.keys = newKeySet(meta.JWKSURI, p.getJSON)
+	p.oauth = oauth.NewProvider(config.OAuthConfig{
+		AuthURL:      meta.AuthorizationEndpoint,
+		TokenURL:     meta.TokenEndpoint,
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		Scopes:       p.config.Scopes,
+		RedirectURL:  p.config.RedirectURL,
+	})
+	return p.oauth, nil
+}
+
+// verify checks the signature, issuer, audience, lifetime and nonce of an
+// ID token
+func (p *Provider) verify(ctx context.Context, raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.meta.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if got, _ := claims["nonce"].(string); nonce == "" || got != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	// With several audiences the token must have been issued to us
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, fmt.Errorf("issued to %q", azp)
+	}
+	return claims, nil
+}
+
+// mailbox maps the configured claim to a mailbox address: through the
+// mailboxes table, or within the mailbox domain. The master user opens any
+// mailbox, so an address elsewhere is refused unless it is mapped.
+func (p *Provider) mailbox(claims jwt.MapClaims) (string, error) {
+	value, _ := claims[p.config.MailboxClaim].(string)
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("ID token has no %s claim", p.config.MailboxClaim)
+	}
+	if p.config.MailboxClaim == "email" && !emailVerified(claims) {
+		return "", fmt.Errorf("email address %s is not verified", value)
+	}
+
+	if mapped, ok := p.config.Mailboxes[value]; ok {
+		return mapped, nil
+	}
+	local, domain, found := strings.Cut(value, "@")
+	if !found {
+		return value + "@" + p.config.MailboxDomain, nil
+	}
+	if local == "" || !strings.EqualFold(domain, p.config.MailboxDomain) {
+		return "", fmt.Errorf("%s %q is outside %s and not in oidc.mailboxes", p.config.MailboxClaim, value, p.config.MailboxDomain)
+	}
+	return value, nil
+}
+
+// emailVerified reports whether the provider vouches for the email claim.
+// Some providers send the flag as a string.
+func emailVerified(claims jwt.MapClaims) bool {
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+// getJSON fetches and decodes a JSON document
+func (p *Provider) getJSON(ctx context.Context, target string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", target, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
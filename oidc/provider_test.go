@@ -0,0 +1,227 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lilmail/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testNonce = "nonce-1"
+
+// idpStub is an identity provider answering every code exchange with the
+// ID token set by the test
+type idpStub struct {
+	url string
+	key *ecdsa.PrivateKey // Published in the key set
+
+	mu      sync.Mutex
+	idToken string
+}
+
+func newIDPStub(t *testing.T) (*idpStub, *Provider) {
+	t.Helper()
+	stub := &idpStub{key: newKey(t)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.url,
+			"authorization_endpoint": stub.url + "/authorize",
+			"token_endpoint":         stub.url + "/token",
+			"jwks_uri":               stub.url + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		pub := stub.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "EC",
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     stub.idToken,
+		})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	stub.url = server.URL
+
+	provider := NewProvider(config.OIDCConfig{
+		Issuer:        server.URL,
+		ClientID:      "lilmail",
+		RedirectURL:   "http://mail.example.com/login/oidc/callback",
+		MailboxClaim:  "email",
+		MailboxDomain: "mail.example",
+		Mailboxes:     map[string]string{"jdoe@corp.example": "john@mail.example"},
+	})
+	return stub, provider
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// claims returns valid ID token claims for user@mail.example
+func (s *idpStub) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            s.url,
+		"aud":            "lilmail",
+		"sub":            "user-1",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          testNonce,
+		"email":          "user@mail.example",
+		"email_verified": true,
+	}
+}
+
+// issue makes the next code exchange return the claims signed with key
+func (s *idpStub) issue(t *testing.T, claims jwt.MapClaims, key *ecdsa.PrivateKey) {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.idToken = signed
+	s.mu.Unlock()
+}
+
+func TestExchange(t *testing.T) {
+	stub, provider := newIDPStub(t)
+	stub.issue(t, stub.claims(), stub.key)
+
+	mailbox, err := provider.Exchange(context.Background(), "code", "verifier", testNonce)
+	if err != nil || mailbox != "user@mail.example" {
+		t.Errorf("Exchange = %q, %v; want user@mail.example", mailbox, err)
+	}
+}
+
+func TestExchangeRejectsInvalidIDToken(t *testing.T) {
+	stub, provider := newIDPStub(t)
+
+	for name, tc := range map[string]struct {
+		change map[string]interface{}
+		key    *ecdsa.PrivateKey
+		nonce  string
+	}{
+		"bad signature":   {key: newKey(t)},
+		"other issuer":    {change: map[string]interface{}{"iss": "https://evil.example"}},
+		"other audience":  {change: map[string]interface{}{"aud": "another-client"}},
+		"other party":     {change: map[string]interface{}{"aud": []string{"lilmail", "another-client"}, "azp": "another-client"}},
+		"expired":         {change: map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}},
+		"no expiry":       {change: map[string]interface{}{"exp": nil}},
+		"other nonce":     {nonce: "nonce-2"},
+		"no nonce claim":  {change: map[string]interface{}{"nonce": nil}},
+		"no login nonce":  {nonce: "-"}, // The session lost its nonce
+		"issued later on": {change: map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()}},
+	} {
+		claims := stub.claims()
+		for claim, value := range tc.change {
+			if value == nil {
+				delete(claims, claim)
+			} else {
+				claims[claim] = value
+			}
+		}
+		key := tc.key
+		if key == nil {
+			key = stub.key
+		}
+		nonce := testNonce
+		if tc.nonce == "-" {
+			nonce = ""
+		} else if tc.nonce != "" {
+			nonce = tc.nonce
+		}
+
+		stub.issue(t, claims, key)
+		mailbox, err := provider.Exchange(context.Background(), "code", "verifier", nonce)
+		if err == nil || !strings.Contains(err.Error(), "invalid ID token") {
+			t.Errorf("%s: Exchange = %q, %v; want an invalid ID token", name, mailbox, err)
+		}
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	_, provider := newIDPStub(t)
+
+	for _, tc := range []struct {
+		claims jwt.MapClaims
+		want   string // Empty when the login is refused
+	}{
+		{jwt.MapClaims{"email": "user@mail.example", "email_verified": true}, "user@mail.example"},
+		{jwt.MapClaims{"email": "user@MAIL.example", "email_verified": "true"}, "user@MAIL.example"},
+		{jwt.MapClaims{"email": "jdoe@corp.example", "email_verified": true}, "john@mail.example"},
+		{jwt.MapClaims{"email": "user", "email_verified": true}, "user@mail.example"},
+
+		{jwt.MapClaims{"email": "user@mail.example", "email_verified": false}, ""},
+		{jwt.MapClaims{"email": "user@mail.example", "email_verified": "false"}, ""},
+		{jwt.MapClaims{"email": "user@mail.example"}, ""},
+		{jwt.MapClaims{"email": "jdoe@corp.example"}, ""},
+		{jwt.MapClaims{"email": "user@evil.example", "email_verified": true}, ""},
+		{jwt.MapClaims{"email": "user@sub.mail.example", "email_verified": true}, ""},
+		{jwt.MapClaims{"email": "user@mail.example@evil.example", "email_verified": true}, ""},
+		{jwt.MapClaims{"email": "@mail.example", "email_verified": true}, ""},
+		{jwt.MapClaims{"email_verified": true}, ""},
+	} {
+		got, err := provider.mailbox(tc.claims)
+		if tc.want == "" && err == nil {
+			t.Errorf("mailbox(%v) = %q, want an error", tc.claims, got)
+		} else if tc.want != "" && (err != nil || got != tc.want) {
+			t.Errorf("mailbox(%v) = %q, %v; want %q", tc.claims, got, err, tc.want)
+		}
+	}
+}
+
+func TestMailboxFromUsername(t *testing.T) {
+	_, provider := newIDPStub(t)
+	provider.config.MailboxClaim = "preferred_username"
+
+	// Usernames need no verified email, but stay within the domain
+	for value, want := range map[string]string{
+		"user":                   "user@mail.example",
+		"jdoe@corp.example":      "john@mail.example",
+		"user@mail.example":      "user@mail.example",
+		"admin@other.example":    "",
+		"admin@mail.example.org": "",
+	} {
+		got, err := provider.mailbox(jwt.MapClaims{"preferred_username": value})
+		if want == "" && err == nil {
+			t.Errorf("mailbox(%q) = %q, want an error", value, got)
+		} else if want != "" && (err != nil || got != want) {
+			t.Errorf("mailbox(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+// Package outbox implements a durable queue of outgoing messages that are
+// delivered over SMTP by a background worker.
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/handlers/api"
+	"lilmail/identity"
+	"lilmail/utils"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message states
+const (
+	StatusQueued  = "queued"  // Waiting for its next delivery attempt
+	StatusSending = "sending" // Picked up by the worker
+	StatusFailed  = "failed"  // Permanently failed, a bounce was produced; the credentials are dropped
+)
+
+// ErrNotFound is returned for unknown message IDs
+var ErrNotFound = errors.New("outbox message not found")
+
+// ErrNotPending is returned when changing a message the worker already picked up
+var ErrNotPending = errors.New("outbox message is already being sent")
+
+// Message is a queued outgoing email
+type Message struct {
+	ID          string             `json:"id"`
+	Owner       string             `json:"owner"`       // Login email of the sender
+	Credentials string             `json:"credentials"` // Encrypted credentials used for delivery
+	MessageID   string             `json:"messageId"`   // Kept across retries so recipients can deduplicate
+	To          string             `json:"to"`
+	Cc          string             `json:"cc,omitempty"`
+	Subject     string             `json:"subject"`
+	Body        string             `json:"body"`
+	Identity    *identity.Identity `json:"identity,omitempty"` // Sender identity at the time of queuing
+	InReplyTo   string             `json:"inReplyTo,omitempty"`
+	References  string             `json:"references,omitempty"`
+	Headers     map[string]string  `json:"headers,omitempty"`  // Additional headers, such as those marking a forward
+	DraftUID    string             `json:"draftUid,omitempty"` // Draft to remove once delivered
+	Status      string             `json:"status"`
+	Attempts    int                `json:"attempts"`
+	LastError   string             `json:"lastError,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	SendAt      time.Time          `json:"sendAt"` // Requested delivery time (scheduled send or undo window)
+	NextAttempt time.Time          `json:"nextAttempt"`
+	Bounced     bool               `json:"bounced,omitempty"`
+}
+
+// Requeue schedules the message for sendAt. A failed message starts over
+// with a fresh attempt counter.
+func (m *Message) Requeue(sendAt time.Time) {
+	m.SendAt = sendAt
+	m.NextAttempt = sendAt
+	if m.Status == StatusFailed {
+		m.Status = StatusQueued
+		m.Attempts = 0
+		m.LastError = ""
+		m.Bounced = false
+	}
+}
+
+// Outgoing turns the queued message into a message ready to render
+func (m *Message) Outgoing() (*api.OutgoingMessage, error) {
+	to, err := api.ParseAddressList(m.To)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := api.ParseAddressList(m.Cc)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &api.OutgoingMessage{
+		From:       &mail.Address{Address: m.Owner},
+		To:         to,
+		Cc:         cc,
+		Subject:    m.Subject,
+		Body:       m.Body,
+		MessageID:  m.MessageID,
+		InReplyTo:  m.InReplyTo,
+		References: m.References,
+		Headers: map[string]string{
+			"X-Mailer": "LilMail",
+		},
+	}
+	for name, value := range m.Headers {
+		out.Headers[name] = value
+	}
+	if m.Identity != nil {
+		if err := m.Identity.Apply(out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Queue stores messages as individual JSON files in a directory
+type Queue struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewQueue opens (or creates) a queue directory. Messages left in the
+// sending state by a previous run are put back in the queue, and failed
+// messages saved with their credentials lose them.
+func NewQueue(directory string) (*Queue, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+
+	q := &Queue{dir: directory}
+
+	messages, err := q.all()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		switch {
+		case msg.Status == StatusSending:
+			msg.Status = StatusQueued
+		case msg.Status == StatusFailed && msg.Credentials != "":
+			msg.Credentials = ""
+		default:
+			continue
+		}
+		if err := q.write(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// Enqueue assigns an ID to the message and stores it for delivery at
+// msg.SendAt, or immediately when no delivery time is set
+func (q *Queue) Enqueue(msg *Message) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	msg.ID = id
+	if msg.MessageID == "" {
+		msg.MessageID = api.NewMessageID(msg.Owner)
+	}
+	msg.Status = StatusQueued
+	msg.CreatedAt = now
+	if msg.SendAt.IsZero() {
+		msg.SendAt = now
+	}
+	msg.NextAttempt = msg.SendAt
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.write(msg)
+}
+
+// Get loads a single message
+func (q *Queue) Get(id string) (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.read(id)
+}
+
+// Update persists changes to an existing message. The stored credentials
+// are kept, as RefreshCredentials may have replaced them meanwhile, unless
+// the message failed: nothing is sent with them any more.
+func (q *Queue) Update(msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stored, err := q.read(msg.ID)
+	if err != nil {
+		return err
+	}
+	msg.Credentials = stored.Credentials
+	if msg.Status == StatusFailed {
+		msg.Credentials = ""
+	}
+	return q.write(msg)
+}
+
+// Modify applies fn to a message of owner that has not been claimed by the
+// worker yet, and persists the result. Failed messages can be modified too,
+// which is how they are retried.
+func (q *Queue) Modify(id, owner string, fn func(msg *Message) error) (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Owner != owner {
+		return nil, ErrNotFound
+	}
+	if msg.Status == StatusSending {
+		return nil, ErrNotPending
+	}
+
+	if err := fn(msg); err != nil {
+		return nil, err
+	}
+	return msg, q.write(msg)
+}
+
+// Reschedule moves a message to a new delivery time. A failed message is
+// put back in the queue with a fresh attempt counter; credentials replace
+// the ones it lost.
+func (q *Queue) Reschedule(id, owner, credentials string, sendAt time.Time) (*Message, error) {
+	return q.Modify(id, owner, func(msg *Message) error {
+		msg.Credentials = credentials
+		msg.Requeue(sendAt)
+		return nil
+	})
+}
+
+// Cancel removes a message of owner that has not been claimed by the worker
+func (q *Queue) Cancel(id, owner string) (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Owner != owner {
+		return nil, ErrNotFound
+	}
+	if msg.Status == StatusSending {
+		return nil, ErrNotPending
+	}
+
+	path, err := q.path(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Remove deletes a message from the queue
+func (q *Queue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	path, err := q.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// List returns the messages of one owner, earliest delivery first
+func (q *Queue) List(owner string) ([]*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages, err := q.all()
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*Message
+	for _, msg := range messages {
+		if msg.Owner == owner {
+			owned = append(owned, msg)
+		}
+	}
+	return owned, nil
+}
+
+// Claim marks every queued message whose next attempt is due as sending and
+// returns them, so a message is never handed out twice.
+func (q *Queue) Claim(now time.Time) ([]*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages, err := q.all()
+	if err != nil {
+		return nil, err
+	}
+
+	var due []*Message
+	for _, msg := range messages {
+		if msg.Status != StatusQueued || msg.NextAttempt.After(now) {
+			continue
+		}
+		msg.Status = StatusSending
+		if err := q.write(msg); err != nil {
+			return due, err
+		}
+		due = append(due, msg)
+	}
+	return due, nil
+}
+
+// NextDue returns the earliest pending delivery time, if any
+func (q *Queue) NextDue() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages, err := q.all()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var next time.Time
+	for _, msg := range messages {
+		if msg.Status != StatusQueued {
+			continue
+		}
+		if next.IsZero() || msg.NextAttempt.Before(next) {
+			next = msg.NextAttempt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// RefreshCredentials replaces the credentials of the messages of owner
+func (q *Queue) RefreshCredentials(owner, credentials string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages, err := q.all()
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if msg.Owner != owner || msg.Credentials == "" || msg.Credentials == credentials {
+			continue
+		}
+		msg.Credentials = credentials
+		if err := q.write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RekeyCredentials re-encrypts the credentials of every message with
+// rekey and returns how many messages changed
+func (q *Queue) RekeyCredentials(rekey func(string) (string, error)) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages, err := q.all()
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, msg := range messages {
+		if msg.Credentials == "" {
+			continue
+		}
+		credentials, err := rekey(msg.Credentials)
+		if err != nil {
+			return changed, fmt.Errorf("credentials of message %s: %v", msg.ID, err)
+		}
+		if credentials == msg.Credentials {
+			continue
+		}
+		msg.Credentials = credentials
+		if err := q.write(msg); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Helper methods
+
+func (q *Queue) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(q.dir, id+".json"), nil
+}
+
+func (q *Queue) read(id string) (*Message, error) {
+	path, err := q.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("corrupt outbox message %s: %v", id, err)
+	}
+	return &msg, nil
+}
+
+func (q *Queue) write(msg *Message) error {
+	path, err := q.path(msg.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, data, 0600)
+}
+
+func (q *Queue) all() ([]*Message, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*Message
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		msg, err := q.read(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			fmt.Printf("Skipping outbox entry %s: %v\n", name, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].SendAt.Before(messages[j].SendAt)
+	})
+	return messages, nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate message ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
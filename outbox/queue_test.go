@@ -0,0 +1,175 @@
+package outbox
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T) (*Queue, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "outbox")
+	q, err := NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, dir
+}
+
+func enqueue(t *testing.T, q *Queue, sendAt time.Time) *Message {
+	t.Helper()
+	msg := &Message{
+		Owner:       "user@example.com",
+		Credentials: "test:credentials",
+		To:          "friend@example.com",
+		Subject:     "Hello",
+		Body:        "Hi",
+		SendAt:      sendAt,
+	}
+	if err := q.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestNewQueueRequeuesInterruptedSends(t *testing.T) {
+	q, dir := newTestQueue(t)
+	sending := enqueue(t, q, time.Time{})
+	queued := enqueue(t, q, time.Now().Add(time.Hour))
+	failed := enqueue(t, q, time.Time{})
+
+	// The worker had claimed a message when the process stopped
+	if claimed, err := q.Claim(time.Now()); err != nil || len(claimed) != 2 {
+		t.Fatalf("Claim = %d messages, %v; want 2", len(claimed), err)
+	}
+	failed.Status = StatusFailed
+	if err := q.Update(failed); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		msg    *Message
+		status string
+	}{
+		{sending, StatusQueued},
+		{queued, StatusQueued},
+		{failed, StatusFailed},
+	} {
+		got, err := restarted.Get(tt.msg.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.status {
+			t.Errorf("%s after restart = %s, want %s", tt.msg.Subject, got.Status, tt.status)
+		}
+	}
+
+	// The interrupted message is handed out again
+	claimed, err := restarted.Claim(time.Now())
+	if err != nil || len(claimed) != 1 || claimed[0].ID != sending.ID {
+		t.Errorf("Claim after restart = %v, %v; want the interrupted message", claimed, err)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	q, _ := newTestQueue(t)
+	now := time.Now()
+	due := enqueue(t, q, now.Add(-time.Minute))
+	later := enqueue(t, q, now.Add(time.Hour))
+
+	claimed, err := q.Claim(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != due.ID || claimed[0].Status != StatusSending {
+		t.Fatalf("Claim = %+v, want only the due message, marked sending", claimed)
+	}
+
+	// A claimed message is not handed out twice, nor changed by its owner
+	if again, _ := q.Claim(now); len(again) != 0 {
+		t.Errorf("second Claim = %d messages, want none", len(again))
+	}
+	if _, err := q.Cancel(due.ID, due.Owner); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Cancel of a claimed message = %v, want ErrNotPending", err)
+	}
+
+	if next, ok := q.NextDue(); !ok || !next.Equal(later.NextAttempt) {
+		t.Errorf("NextDue = %v, %v; want %v", next, ok, later.NextAttempt)
+	}
+	if claimed, _ := q.Claim(now.Add(2 * time.Hour)); len(claimed) != 1 || claimed[0].ID != later.ID {
+		t.Errorf("Claim once the later message is due = %v", claimed)
+	}
+}
+
+func TestFailedMessagesDropCredentials(t *testing.T) {
+	q, dir := newTestQueue(t)
+	msg := enqueue(t, q, time.Time{})
+
+	msg.Status = StatusFailed
+	if err := q.Update(msg); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := q.Get(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Credentials != "" {
+		t.Errorf("failed message kept its credentials: %q", stored.Credentials)
+	}
+
+	// Refreshing credentials does not bring them back
+	if err := q.RefreshCredentials(msg.Owner, "test:renewed"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := q.Get(msg.ID); stored.Credentials != "" {
+		t.Errorf("RefreshCredentials gave a failed message credentials: %q", stored.Credentials)
+	}
+
+	// Retrying hands it fresh ones
+	retried, err := q.Reschedule(msg.ID, msg.Owner, "test:retry", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Status != StatusQueued || retried.Attempts != 0 || retried.Credentials != "test:retry" {
+		t.Errorf("Reschedule = %+v, want queued from scratch with new credentials", retried)
+	}
+
+	// Failed messages written before credentials were dropped lose them at
+	// startup
+	retried.Status = StatusFailed
+	if err := q.write(retried); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewQueue(dir); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := q.Get(msg.ID); stored.Credentials != "" {
+		t.Errorf("failed message kept its credentials across a restart: %q", stored.Credentials)
+	}
+}
+
+func TestUpdateKeepsRefreshedCredentials(t *testing.T) {
+	q, _ := newTestQueue(t)
+	msg := enqueue(t, q, time.Time{})
+	claimed, err := q.Claim(time.Now())
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("Claim = %v, %v", claimed, err)
+	}
+
+	// The user logs in again while the worker is delivering
+	if err := q.RefreshCredentials(msg.Owner, "test:renewed"); err != nil {
+		t.Fatal(err)
+	}
+	claimed[0].Status = StatusQueued
+	if err := q.Update(claimed[0]); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := q.Get(msg.ID); stored.Credentials != "test:renewed" {
+		t.Errorf("Update replaced refreshed credentials with %q", stored.Credentials)
+	}
+}
@@ -0,0 +1,248 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Worker delivers queued messages and retries temporary failures with
+// exponential backoff
+type Worker struct {
+	queue  *Queue
+	config *config.Config
+	wake   chan struct{}
+	stop   chan struct{}
+}
+
+// NewWorker creates a worker for the queue
+func NewWorker(queue *Queue, config *config.Config) *Worker {
+	return &Worker{
+		queue:  queue,
+		config: config,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Run processes the queue until Stop is called
+func (w *Worker) Run() {
+	interval := time.Duration(w.config.Outbox.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+
+	for {
+		w.processDue()
+
+		// Sleep until the next message is due, so undo windows and scheduled
+		// sends are honoured to the second, but rescan at least every interval
+		wait := interval
+		if next, ok := w.queue.NextDue(); ok {
+			if until := time.Until(next); until < wait {
+				wait = until
+			}
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-w.wake:
+			timer.Stop()
+		case <-w.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Wake asks the worker to scan the queue now instead of waiting for the next tick
+func (w *Worker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends Run
+func (w *Worker) Stop() {
+	close(w.stop)
+}
+
+func (w *Worker) processDue() {
+	messages, err := w.queue.Claim(time.Now())
+	if err != nil {
+		log.Printf("Outbox: error scanning queue: %v", err)
+	}
+
+	for _, msg := range messages {
+		w.deliver(msg)
+	}
+}
+
+// deliver makes one delivery attempt and records the outcome
+func (w *Worker) deliver(msg *Message) {
+	msg.Attempts++
+
+	raw, err := w.send(msg)
+	if err == nil {
+		log.Printf("Outbox: delivered %s for %s after %d attempt(s)", msg.ID, msg.Owner, msg.Attempts)
+		w.afterDelivery(msg, raw)
+		if err := w.queue.Remove(msg.ID); err != nil {
+			log.Printf("Outbox: error removing delivered message %s: %v", msg.ID, err)
+		}
+		return
+	}
+
+	msg.LastError = err.Error()
+
+	if isTemporary(err) && msg.Attempts < w.config.Outbox.MaxAttempts {
+		delay := w.backoff(msg.Attempts)
+		msg.Status = StatusQueued
+		msg.NextAttempt = time.Now().Add(delay)
+		log.Printf("Outbox: attempt %d for %s failed, retrying in %s: %v", msg.Attempts, msg.ID, delay, err)
+	} else {
+		msg.Status = StatusFailed
+		log.Printf("Outbox: giving up on %s after %d attempt(s): %v", msg.ID, msg.Attempts, err)
+		if err := w.bounce(msg); err != nil {
+			log.Printf("Outbox: error delivering bounce for %s: %v", msg.ID, err)
+		} else {
+			msg.Bounced = true
+		}
+	}
+
+	if err := w.queue.Update(msg); err != nil {
+		log.Printf("Outbox: error saving message %s: %v", msg.ID, err)
+	}
+}
+
+// send renders and delivers the message, returning the exact bytes sent
+func (w *Worker) send(msg *Message) ([]byte, error) {
+	creds, err := api.DecryptCredentials(msg.Credentials, w.config.Encryption.Keyring)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials: %w", err)
+	}
+
+	out, err := msg.Outgoing()
+	if err != nil {
+		return nil, err
+	}
+	raw := out.Bytes()
+
+	client := api.NewSMTPClient(creds.Profile(w.config.SMTP.Profile), creds.Email, creds.Password)
+	if err := client.Send(out.Recipients(), raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// afterDelivery keeps a copy of the sent bytes in the sender's Sent folder
+// (unless the server does that itself) and removes the draft the message
+// was written from
+func (w *Worker) afterDelivery(msg *Message, raw []byte) {
+	if w.config.SMTP.ServerSavesSent && msg.DraftUID == "" {
+		return
+	}
+
+	creds, err := api.DecryptCredentials(msg.Credentials, w.config.Encryption.Keyring)
+	if err != nil {
+		log.Printf("Outbox: failed to decrypt credentials for %s: %v", msg.ID, err)
+		return
+	}
+
+	client, err := api.NewClient(creds.Profile(w.config.IMAP.Profile), creds.Email, creds.Password)
+	if err != nil {
+		log.Printf("Outbox: IMAP error after delivering %s: %v", msg.ID, err)
+		return
+	}
+	defer client.Close()
+
+	if !w.config.SMTP.ServerSavesSent {
+		if err := client.SaveToSent(raw); err != nil {
+			log.Printf("Outbox: error saving %s to Sent folder: %v", msg.ID, err)
+		}
+	}
+
+	if msg.DraftUID != "" {
+		if err := client.DeleteDraft(msg.DraftUID); err != nil {
+			log.Printf("Outbox: error removing draft %s of %s: %v", msg.DraftUID, msg.ID, err)
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt
+func (w *Worker) backoff(attempts int) time.Duration {
+	base := time.Duration(w.config.Outbox.RetryBase) * time.Second
+	max := time.Duration(w.config.Outbox.RetryMax) * time.Second
+
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// bounce puts a delivery failure report in the sender's INBOX
+func (w *Worker) bounce(msg *Message) error {
+	creds, err := api.DecryptCredentials(msg.Credentials, w.config.Encryption.Keyring)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt credentials: %v", err)
+	}
+
+	client, err := api.NewClient(creds.Profile(w.config.IMAP.Profile), creds.Email, creds.Password)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.AppendMessage("INBOX", nil, bounceMessage(msg))
+}
+
+func bounceMessage(msg *Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "From: Mail Delivery System <mailer-daemon@%s>\r\n", api.GetDomainFromEmail(msg.Owner))
+	fmt.Fprintf(&b, "To: %s\r\n", msg.Owner)
+	fmt.Fprintf(&b, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "Your message could not be delivered after %d attempt(s).\r\n\r\n", msg.Attempts)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Error: %s\r\n\r\n", msg.LastError)
+	fmt.Fprintf(&b, "----- Original message -----\r\n\r\n")
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// isTemporary reports whether a delivery error is worth retrying: SMTP 4xx
+// replies and network problems are, 5xx replies and local errors are not.
+func isTemporary(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,262 @@
+package outbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/keyring"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// errTimeout is a network timeout
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
+
+func TestIsTemporary(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: errTimeout{}}
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&textproto.Error{Code: 421, Msg: "try again later"}, true},
+		{&textproto.Error{Code: 451, Msg: "greylisted"}, true},
+		{fmt.Errorf("rcpt to x failed: %w", &textproto.Error{Code: 452, Msg: "mailbox full"}), true},
+		{&textproto.Error{Code: 550, Msg: "no such user"}, false},
+		{fmt.Errorf("mail from failed: %w", &textproto.Error{Code: 554, Msg: "rejected"}), false},
+		{io.EOF, true},
+		{fmt.Errorf("hello failed: %w", io.ErrUnexpectedEOF), true},
+		{fmt.Errorf("dial failed: %w", timeout), true},
+		{errors.New("failed to decrypt credentials"), false},
+	} {
+		if got := isTemporary(tt.err); got != tt.want {
+			t.Errorf("isTemporary(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	w := NewWorker(nil, &config.Config{Outbox: config.OutboxConfig{RetryBase: 60, RetryMax: 300}})
+	for attempts, want := range map[int]time.Duration{
+		1: time.Minute,
+		2: 2 * time.Minute,
+		3: 4 * time.Minute,
+		4: 5 * time.Minute,
+		9: 5 * time.Minute,
+	} {
+		if got := w.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+// smtpStub answers MAIL FROM with reply, after accepting any login
+func smtpStub(t *testing.T, reply string) config.ConnectionProfile {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "220 stub ESMTP\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.Fields(line + " x")[0]); verb {
+					case "EHLO":
+						fmt.Fprintf(conn, "250-stub\r\n250 AUTH PLAIN\r\n")
+					case "AUTH":
+						fmt.Fprintf(conn, "235 ok\r\n")
+					case "MAIL":
+						fmt.Fprintf(conn, "%s\r\n", reply)
+					case "QUIT":
+						fmt.Fprintf(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprintf(conn, "250 ok\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return config.ConnectionProfile{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		Security: config.SecurityNone,
+	}
+}
+
+// imapStub serves the memory backend's only user, who receives bounces
+func imapStub(t *testing.T) config.ConnectionProfile {
+	t.Helper()
+	imapServer := server.New(memory.New())
+	imapServer.AllowInsecureAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go imapServer.Serve(ln)
+	t.Cleanup(func() { imapServer.Close() })
+
+	return config.ConnectionProfile{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		Security: config.SecurityNone,
+	}
+}
+
+// newTestWorker returns a worker delivering through an SMTP server that
+// answers MAIL FROM with reply, and a queued message for it
+func newTestWorker(t *testing.T, reply string) (*Worker, *Queue, *Message) {
+	t.Helper()
+	keys, err := keyring.New([]keyring.Spec{{ID: "test", Passphrase: "test passphrase"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.Encryption.Keyring = keys
+	cfg.SMTP.Profile = smtpStub(t, reply)
+	cfg.IMAP.Profile = imapStub(t)
+	cfg.Outbox = config.OutboxConfig{RetryBase: 60, RetryMax: 3600, MaxAttempts: 3}
+
+	credentials, err := api.EncryptCredentials("username", "password", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := newTestQueue(t)
+	msg := &Message{
+		Owner:       "username",
+		Credentials: credentials,
+		To:          "friend@example.com",
+		Subject:     "Hello",
+		Body:        "Hi",
+	}
+	if err := q.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	return NewWorker(q, cfg), q, msg
+}
+
+// inboxSubjects lists the subjects in the stub user's INBOX
+func inboxSubjects(t *testing.T, w *Worker) []string {
+	t.Helper()
+	client, err := api.NewClient(w.config.IMAP.Profile, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	emails, err := client.FetchMessages("INBOX", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for _, email := range emails {
+		subjects = append(subjects, email.Subject)
+	}
+	return subjects
+}
+
+func countBounces(subjects []string) int {
+	n := 0
+	for _, subject := range subjects {
+		if subject == "Undelivered Mail Returned to Sender" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDeliverRetriesTemporaryFailure(t *testing.T) {
+	w, q, msg := newTestWorker(t, "451 greylisted, try again later")
+
+	before := time.Now()
+	w.processDue()
+
+	stored, err := q.Get(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusQueued || stored.Attempts != 1 {
+		t.Fatalf("after a temporary failure: status %s, %d attempts; want queued after 1", stored.Status, stored.Attempts)
+	}
+	if wait := stored.NextAttempt.Sub(before); wait < time.Minute || wait > time.Minute+5*time.Second {
+		t.Errorf("next attempt in %v, want the retry base of 1m", wait)
+	}
+	if !strings.Contains(stored.LastError, "451") {
+		t.Errorf("LastError = %q", stored.LastError)
+	}
+	if stored.Credentials == "" {
+		t.Error("a message to be retried lost its credentials")
+	}
+	if claimed, _ := q.Claim(time.Now()); len(claimed) != 0 {
+		t.Error("a message waiting for its retry was claimed")
+	}
+
+	// Later attempts fail the same way until they run out
+	for attempt := 2; attempt <= 3; attempt++ {
+		claimed, err := q.Claim(stored.NextAttempt)
+		if err != nil || len(claimed) != 1 {
+			t.Fatalf("Claim at the next attempt = %v, %v", claimed, err)
+		}
+		w.deliver(claimed[0])
+		if stored, err = q.Get(msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stored.Status != StatusFailed || stored.Attempts != 3 {
+		t.Errorf("after max attempts: status %s, %d attempts; want failed after 3", stored.Status, stored.Attempts)
+	}
+	if !stored.Bounced || countBounces(inboxSubjects(t, w)) != 1 {
+		t.Error("giving up did not bounce")
+	}
+	if stored.Credentials != "" {
+		t.Error("failed message kept its credentials")
+	}
+}
+
+func TestDeliverBouncesPermanentFailure(t *testing.T) {
+	w, q, msg := newTestWorker(t, "550 no such user")
+	w.processDue()
+
+	stored, err := q.Get(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusFailed || stored.Attempts != 1 {
+		t.Errorf("after a permanent failure: status %s, %d attempts; want failed after 1", stored.Status, stored.Attempts)
+	}
+	if !stored.Bounced {
+		t.Error("message not marked as bounced")
+	}
+	if n := countBounces(inboxSubjects(t, w)); n != 1 {
+		t.Errorf("%d bounces in INBOX, want 1", n)
+	}
+	if stored.Credentials != "" {
+		t.Error("failed message kept its credentials")
+	}
+}
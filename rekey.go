@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"lilmail/config"
+	"lilmail/keyring"
+	"lilmail/outbox"
+	"lilmail/rules"
+	"lilmail/twofactor"
+	"lilmail/vacation"
+	"log"
+	"path/filepath"
+)
+
+// sessionSecrets are the encrypted values kept in sessions
+var sessionSecrets = []string{"credentials", "pending_credentials"}
+
+// rekey re-encrypts everything stored under older keys with the first
+// configured key, so the older keys can then be removed from the config.
+// LilMail must not be running meanwhile.
+func rekey(cfg *config.Config) error {
+	keys := cfg.Encryption.Keyring
+	log.Printf("Re-encrypting stored data with key %q", keys.Primary())
+
+	n, err := sessions.Rewrite(func(_ string, val []byte) ([]byte, error) {
+		return rekeySession(keys, val)
+	})
+	log.Printf("Sessions: %d re-encrypted", n)
+	if err != nil {
+		return err
+	}
+
+	queue, err := outbox.NewQueue(filepath.Join(cfg.Data.Folder, "outbox"))
+	if err != nil {
+		return err
+	}
+	n, err = queue.RekeyCredentials(keys.Rekey)
+	log.Printf("Outbox: %d re-encrypted", n)
+	if err != nil {
+		return err
+	}
+
+	ruleStore, err := rules.NewStore(filepath.Join(cfg.Data.Folder, "rules"))
+	if err != nil {
+		return err
+	}
+	n, err = ruleStore.RekeyCredentials(keys.Rekey)
+	log.Printf("Mail rules: %d re-encrypted", n)
+	if err != nil {
+		return err
+	}
+
+	vacationStore, err := vacation.NewStore(filepath.Join(cfg.Data.Folder, "vacation"))
+	if err != nil {
+		return err
+	}
+	n, err = vacationStore.RekeyCredentials(keys.Rekey)
+	log.Printf("Vacation replies: %d re-encrypted", n)
+	if err != nil {
+		return err
+	}
+
+	twoFactorStore, err := twofactor.NewStore(filepath.Join(cfg.Data.Folder, "twofactor"), keys, cfg.TwoFactor.Issuer)
+	if err != nil {
+		return err
+	}
+	n, err = twoFactorStore.Rekey()
+	log.Printf("Two-factor secrets: %d re-encrypted", n)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Done; keys other than %q can be removed", keys.Primary())
+	return nil
+}
+
+// rekeySession re-encrypts the secrets in the gob-encoded data of a fiber
+// session. It returns nil when nothing changed.
+func rekeySession(keys *keyring.Keyring, val []byte) ([]byte, error) {
+	var data map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	for _, name := range sessionSecrets {
+		value, ok := data[name].(string)
+		if !ok || value == "" {
+			continue
+		}
+		rekeyed, err := keys.Rekey(value)
+		if err != nil {
+			return nil, err
+		}
+		if rekeyed != value {
+			data[name] = rekeyed
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
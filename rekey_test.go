@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"lilmail/config"
+	"lilmail/keyring"
+	"lilmail/outbox"
+	"lilmail/rules"
+	"lilmail/storage"
+	"lilmail/twofactor"
+	"lilmail/vacation"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeyring(t *testing.T, specs ...keyring.Spec) *keyring.Keyring {
+	t.Helper()
+	k, err := keyring.New(specs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func encodeSession(t *testing.T, data map[string]interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRekey(t *testing.T) {
+	oldKey := keyring.Spec{ID: "old", Passphrase: "old passphrase"}
+	newKey := keyring.Spec{ID: "new", Passphrase: "new passphrase"}
+	old := newTestKeyring(t, oldKey)
+	const owner = "user@example.com"
+
+	credentials, err := old.Encrypt([]byte(`{"email":"user@example.com","password":"secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Data.Folder = t.TempDir()
+	cfg.TwoFactor.Issuer = "LilMail"
+
+	// Data stored while only the old key was configured
+	sessions = storage.NewMemoryStore()
+	defer sessions.Close()
+	if err := sessions.Set("signed-in", encodeSession(t, map[string]interface{}{"email": owner, "credentials": credentials}), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Set("anonymous", encodeSession(t, map[string]interface{}{"csrf": "token"}), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := outbox.NewQueue(filepath.Join(cfg.Data.Folder, "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &outbox.Message{Owner: owner, Credentials: credentials, To: "friend@example.com"}
+	if err := queue.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleStore, err := rules.NewStore(filepath.Join(cfg.Data.Folder, "rules"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := &rules.Rule{
+		Name:       "Newsletters",
+		Conditions: []rules.Condition{{Field: rules.FieldSubject, Op: rules.OpContains, Value: "news"}},
+		Actions:    []rules.Action{{Type: rules.ActionMarkRead}},
+	}
+	if err := ruleStore.Save(owner, credentials, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	vacationStore, err := vacation.NewStore(filepath.Join(cfg.Data.Folder, "vacation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vacationStore.Update(owner, func(mb *vacation.Mailbox) { mb.Credentials = credentials }); err != nil {
+		t.Fatal(err)
+	}
+
+	twoFactorStore, err := twofactor.NewStore(filepath.Join(cfg.Data.Folder, "twofactor"), old, "LilMail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := twoFactorStore.Begin(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := twofactor.Code(secret, time.Now())
+	if _, err := twoFactorStore.Confirm(owner, code); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate: the new key encrypts, the old one only decrypts
+	cfg.Encryption.Keyring = newTestKeyring(t, newKey, oldKey)
+	if err := rekey(cfg); err != nil {
+		t.Fatalf("rekey: %v", err)
+	}
+
+	// Everything now opens without the old key
+	current := newTestKeyring(t, newKey)
+	check := func(what, encrypted string) {
+		t.Helper()
+		if !strings.HasPrefix(encrypted, "new:") {
+			t.Errorf("%s = %q, not under the new key", what, encrypted)
+			return
+		}
+		if _, err := current.Decrypt(encrypted); err != nil {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+
+	val, err := sessions.Get("signed-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	check("session credentials", data["credentials"].(string))
+	if data["email"] != owner {
+		t.Errorf("rekey changed other session values: %v", data)
+	}
+	if val, _ := sessions.Get("anonymous"); val == nil {
+		t.Error("rekey dropped a session without secrets")
+	}
+
+	queued, err := queue.Get(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("outbox credentials", queued.Credentials)
+
+	rulesMailbox, err := ruleStore.Mailbox(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("rule credentials", rulesMailbox.Credentials)
+
+	vacationMailbox, err := vacationStore.Get(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("vacation credentials", vacationMailbox.Credentials)
+
+	twoFactorStore, err = twofactor.NewStore(filepath.Join(cfg.Data.Folder, "twofactor"), current, "LilMail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := twoFactorStore.Verify(owner, code); err == nil {
+		t.Error("the code that confirmed enrolment was accepted again")
+	}
+	next, _ := twofactor.Code(secret, time.Now().Add(30*time.Second))
+	if err := twoFactorStore.Verify(owner, next); err != nil {
+		t.Errorf("two-factor secret after rekey: %v", err)
+	}
+
+	// A second run finds nothing left to do
+	if err := rekey(cfg); err != nil {
+		t.Errorf("second rekey: %v", err)
+	}
+	if again, _ := queue.Get(msg.ID); again.Credentials != queued.Credentials {
+		t.Error("second rekey re-encrypted outbox credentials again")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"lilmail/handlers/api"
+	"lilmail/keyring"
+)
+
+// renewSessions puts renewed credentials into the sessions of owner whose
+// credentials hold refreshToken, which the provider may have rotated. It
+// returns how many sessions changed.
+func renewSessions(keys *keyring.Keyring, owner, refreshToken, credentials string) (int, error) {
+	devices, err := sessions.Sessions(owner)
+	if err != nil {
+		return 0, err
+	}
+	owned := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		owned[device.Key] = true
+	}
+
+	return sessions.Rewrite(func(key string, val []byte) ([]byte, error) {
+		if !owned[key] {
+			return nil, nil
+		}
+		return renewSession(keys, val, refreshToken, credentials)
+	})
+}
+
+// renewSession replaces the credentials in the gob-encoded data of a fiber
+// session when they hold refreshToken. It returns nil when nothing changed.
+func renewSession(keys *keyring.Keyring, val []byte, refreshToken, credentials string) ([]byte, error) {
+	var data map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	value, _ := data["credentials"].(string)
+	if value == "" || value == credentials {
+		return nil, nil
+	}
+	creds, err := api.UnsealCredentials(value, keys)
+	if err != nil || creds.RefreshToken != refreshToken {
+		return nil, err
+	}
+	data["credentials"] = credentials
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,166 @@
+package rules
+
+import (
+	"fmt"
+	"lilmail/handlers/api"
+	"lilmail/labels"
+	"lilmail/outbox"
+	"log"
+	"strings"
+	"time"
+)
+
+// Engine applies rules to messages over an open IMAP connection
+type Engine struct {
+	labels *labels.Store
+	outbox *outbox.Queue
+	sender *outbox.Worker
+}
+
+// NewEngine creates an engine resolving labels from labelStore and
+// forwarding through the outbox
+func NewEngine(labelStore *labels.Store, queue *outbox.Queue, sender *outbox.Worker) *Engine {
+	return &Engine{
+		labels: labelStore,
+		outbox: queue,
+		sender: sender,
+	}
+}
+
+// Run evaluates rules in order against messages of folder and applies the
+// actions of those that match. With dryRun set nothing is changed and the
+// hits describe what would have happened.
+func (e *Engine) Run(client *api.Client, owner, credentials, folder string, rules []*Rule, messages []api.MessageSummary, dryRun bool) []Hit {
+	var hits []Hit
+	for i := range messages {
+		msg := &messages[i]
+		for _, rule := range rules {
+			if !rule.Matches(msg) {
+				continue
+			}
+
+			hit := Hit{
+				RuleID:   rule.ID,
+				RuleName: rule.Name,
+				Time:     time.Now(),
+				Folder:   folder,
+				UID:      msg.UID,
+				From:     msg.From,
+				Subject:  msg.Subject,
+			}
+			removed := false
+			for _, action := range ordered(rule.Actions) {
+				hit.Actions = append(hit.Actions, e.describe(owner, action))
+				removed = removed || action.Type == ActionMove || action.Type == ActionDelete
+				if dryRun {
+					continue
+				}
+				if err := e.apply(client, owner, credentials, folder, msg, action); err != nil {
+					hit.Error = err.Error()
+					break
+				}
+			}
+			hits = append(hits, hit)
+
+			if rule.Stop || removed {
+				break
+			}
+		}
+	}
+	return hits
+}
+
+// ordered puts moves and deletions last, once the other actions are done
+func ordered(actions []Action) []Action {
+	var first, last []Action
+	for _, action := range actions {
+		if action.Type == ActionMove || action.Type == ActionDelete {
+			last = append(last, action)
+		} else {
+			first = append(first, action)
+		}
+	}
+	return append(first, last...)
+}
+
+func (e *Engine) apply(client *api.Client, owner, credentials, folder string, msg *api.MessageSummary, action Action) error {
+	switch action.Type {
+	case ActionMove:
+		return client.MoveMessage(folder, msg.UID, action.Value)
+	case ActionDelete:
+		return client.TrashMessage(folder, msg.UID)
+	case ActionMarkRead:
+		return client.MarkMessageAsRead(folder, msg.UID)
+	case ActionFlag:
+		return client.SetFlagged(folder, msg.UID, true)
+	case ActionLabel:
+		label, err := e.labels.Get(owner, action.Value)
+		if err != nil {
+			return fmt.Errorf("label %s: %v", action.Value, err)
+		}
+		return client.SetKeyword(folder, []string{msg.UID}, label.Keyword, true)
+	case ActionForward:
+		return e.forward(client, owner, credentials, folder, msg, action.Value)
+	}
+	return fmt.Errorf("unknown action %q", action.Type)
+}
+
+// forward queues an inline copy of the message in the outbox. Forwarding to
+// the mailbox itself is refused, and messages that were already forwarded
+// automatically are skipped, so that mailboxes forwarding to each other do
+// not loop.
+func (e *Engine) forward(client *api.Client, owner, credentials, folder string, msg *api.MessageSummary, to string) error {
+	if strings.EqualFold(to, owner) {
+		return fmt.Errorf("cannot forward to the same mailbox")
+	}
+	if forwarded(msg, owner) {
+		log.Printf("Rules: not forwarding %s of %s to %s, it was forwarded automatically", msg.UID, owner, to)
+		return nil
+	}
+
+	email, err := client.FetchSingleMessage(folder, msg.UID)
+	if err != nil {
+		return err
+	}
+	fwd := api.NewForward(email)
+
+	if err := e.outbox.Enqueue(&outbox.Message{
+		Owner:       owner,
+		Credentials: credentials,
+		To:          to,
+		Subject:     fwd.Subject,
+		Body:        fwd.Body,
+		References:  fwd.References,
+		Headers: map[string]string{
+			"Auto-Submitted": "auto-forwarded",
+			"X-Loop":         owner,
+		},
+	}); err != nil {
+		return fmt.Errorf("error queuing forward: %v", err)
+	}
+	e.sender.Wake()
+	return nil
+}
+
+// forwarded reports whether msg was forwarded automatically, by this
+// mailbox or another one (RFC 3834, section 5)
+func forwarded(msg *api.MessageSummary, owner string) bool {
+	if strings.EqualFold(strings.TrimSpace(msg.HeaderValue("Auto-Submitted")), "auto-forwarded") {
+		return true
+	}
+	for _, loop := range msg.Header.Values("X-Loop") {
+		if strings.EqualFold(strings.TrimSpace(loop), owner) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Engine) describe(owner string, action Action) string {
+	if action.Type == ActionLabel {
+		if label, err := e.labels.Get(owner, action.Value); err == nil {
+			return "label " + label.Name
+		}
+	}
+	return action.Describe()
+}
@@ -0,0 +1,101 @@
+package rules
+
+import (
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/outbox"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// newTestClient connects to an IMAP server holding the memory backend's
+// only user, whose INBOX has one message with UID 6
+func newTestClient(t *testing.T) *api.Client {
+	t.Helper()
+	imapServer := server.New(memory.New())
+	imapServer.AllowInsecureAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go imapServer.Serve(ln)
+	t.Cleanup(func() { imapServer.Close() })
+
+	client, err := api.NewClient(config.ConnectionProfile{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		Security: config.SecurityNone,
+	}, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestForwardLoopGuard(t *testing.T) {
+	const owner = "user@example.com"
+	client := newTestClient(t)
+	queue, err := outbox.NewQueue(filepath.Join(t.TempDir(), "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewEngine(nil, queue, outbox.NewWorker(queue, &config.Config{}))
+	rule := &Rule{
+		Name:       "Forward everything",
+		Conditions: []Condition{{Field: FieldSubject, Op: OpNotContains, Value: "nothing matches this"}},
+		Actions:    []Action{{Type: ActionForward, Value: "other@example.com"}},
+	}
+
+	run := func(header textproto.MIMEHeader) []*outbox.Message {
+		t.Helper()
+		msg := api.MessageSummary{UID: "6", From: "friend@example.com", Subject: "Hello", Header: header}
+		hits := engine.Run(client, owner, "test:credentials", "INBOX", []*Rule{rule}, []api.MessageSummary{msg}, false)
+		if len(hits) != 1 || hits[0].Error != "" {
+			t.Fatalf("hits = %+v", hits)
+		}
+		queued, err := queue.List(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return queued
+	}
+
+	// A message from a person is forwarded, marked as an automatic forward
+	queued := run(textproto.MIMEHeader{})
+	if len(queued) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(queued))
+	}
+	out, err := queued[0].Outgoing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := string(out.Bytes())
+	for _, header := range []string{"Auto-Submitted: auto-forwarded\r\n", "X-Loop: " + owner + "\r\n"} {
+		if !strings.Contains(raw, header) {
+			t.Errorf("forward lacks %q", header)
+		}
+	}
+
+	// The other mailbox forwarding it back, or anything forwarded by a
+	// machine, is not forwarded again
+	for _, header := range []textproto.MIMEHeader{
+		{"Auto-Submitted": {"auto-forwarded"}},
+		{"X-Loop": {"other@example.com", "USER@example.com"}},
+	} {
+		if queued := run(header); len(queued) != 1 {
+			t.Errorf("message with %v forwarded again", header)
+		}
+	}
+
+	// A loop header of another mailbox alone does not stop it
+	if queued := run(textproto.MIMEHeader{"X-Loop": {"list@example.com"}}); len(queued) != 2 {
+		t.Errorf("%d messages queued, want 2", len(queued))
+	}
+}
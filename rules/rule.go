@@ -0,0 +1,248 @@
+// Package rules filters incoming mail on the server side. Each user keeps a
+// list of rules; a background worker evaluates them against new messages
+// in INBOX and applies their actions over IMAP.
+package rules
+
+import (
+	"fmt"
+	"lilmail/handlers/api"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Condition fields
+const (
+	FieldFrom       = "from"
+	FieldTo         = "to" // To and Cc recipients
+	FieldSubject    = "subject"
+	FieldHeader     = "header"
+	FieldSize       = "size" // In kilobytes
+	FieldAttachment = "attachment"
+)
+
+// Condition operators. Text comparisons ignore case.
+const (
+	OpContains    = "contains"
+	OpNotContains = "not_contains"
+	OpEquals      = "equals"
+	OpStartsWith  = "starts_with"
+	OpEndsWith    = "ends_with"
+	OpGreaterThan = "greater_than"
+	OpLessThan    = "less_than"
+	OpExists      = "exists"
+	OpNotExists   = "not_exists"
+)
+
+// Action types
+const (
+	ActionMove     = "move"  // Value: target folder
+	ActionLabel    = "label" // Value: label ID
+	ActionMarkRead = "mark_read"
+	ActionFlag     = "flag"
+	ActionForward  = "forward" // Value: recipient address
+	ActionDelete   = "delete"
+)
+
+var textOps = []string{OpContains, OpNotContains, OpEquals, OpStartsWith, OpEndsWith}
+
+// fieldOps lists the operators allowed for each field
+var fieldOps = map[string][]string{
+	FieldFrom:       textOps,
+	FieldTo:         textOps,
+	FieldSubject:    textOps,
+	FieldHeader:     append([]string{OpExists, OpNotExists}, textOps...),
+	FieldSize:       {OpGreaterThan, OpLessThan},
+	FieldAttachment: {OpExists, OpNotExists},
+}
+
+// Condition tests one property of a message
+type Condition struct {
+	Field  string `json:"field"`
+	Header string `json:"header,omitempty"` // Header name for FieldHeader
+	Op     string `json:"op"`
+	Value  string `json:"value,omitempty"`
+}
+
+// Action is applied to a matching message
+type Action struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+// Rule is a named set of conditions and the actions taken when they match
+type Rule struct {
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	Enabled    bool        `json:"enabled"`
+	MatchAll   bool        `json:"matchAll"` // All conditions must match, otherwise any
+	Conditions []Condition `json:"conditions"`
+	Actions    []Action    `json:"actions"`
+	Stop       bool        `json:"stop"` // Skip the rules after this one when it matches
+}
+
+// Validate checks the conditions and actions of the rule
+func (r *Rule) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return fmt.Errorf("rule name is required")
+	}
+	if len(r.Conditions) == 0 {
+		return fmt.Errorf("at least one condition is required")
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("at least one action is required")
+	}
+
+	for i := range r.Conditions {
+		cond := &r.Conditions[i]
+		ops, ok := fieldOps[cond.Field]
+		if !ok {
+			return fmt.Errorf("unknown condition field %q", cond.Field)
+		}
+		if !contains(ops, cond.Op) {
+			return fmt.Errorf("operator %q cannot be used with %s", cond.Op, cond.Field)
+		}
+		cond.Header = strings.TrimSpace(cond.Header)
+		if cond.Field == FieldHeader && cond.Header == "" {
+			return fmt.Errorf("header name is required")
+		}
+		if cond.Field == FieldSize {
+			if _, err := strconv.ParseInt(strings.TrimSpace(cond.Value), 10, 64); err != nil {
+				return fmt.Errorf("size must be a number of kilobytes")
+			}
+		}
+	}
+
+	terminal := 0
+	for i := range r.Actions {
+		action := &r.Actions[i]
+		action.Value = strings.TrimSpace(action.Value)
+		switch action.Type {
+		case ActionMove:
+			if action.Value == "" {
+				return fmt.Errorf("target folder is required")
+			}
+			terminal++
+		case ActionDelete:
+			terminal++
+		case ActionLabel:
+			if action.Value == "" {
+				return fmt.Errorf("label is required")
+			}
+		case ActionForward:
+			addr, err := mail.ParseAddress(action.Value)
+			if err != nil {
+				return fmt.Errorf("invalid forward address %q", action.Value)
+			}
+			action.Value = addr.Address
+		case ActionMarkRead, ActionFlag:
+		default:
+			return fmt.Errorf("unknown action %q", action.Type)
+		}
+	}
+	if terminal > 1 {
+		return fmt.Errorf("a rule can either move or delete a message, not both")
+	}
+	return nil
+}
+
+// Matches reports whether the message satisfies the conditions of the rule
+func (r *Rule) Matches(msg *api.MessageSummary) bool {
+	for _, cond := range r.Conditions {
+		matched := cond.Matches(msg)
+		if r.MatchAll && !matched {
+			return false
+		}
+		if !r.MatchAll && matched {
+			return true
+		}
+	}
+	return r.MatchAll
+}
+
+// Matches evaluates the condition against a message
+func (c *Condition) Matches(msg *api.MessageSummary) bool {
+	switch c.Field {
+	case FieldFrom:
+		return c.matchText(msg.From)
+	case FieldTo:
+		// Negative operators must hold for every recipient
+		recipients := append(append([]string{}, msg.To...), msg.Cc...)
+		if c.Op == OpNotContains {
+			for _, addr := range recipients {
+				if !c.matchText(addr) {
+					return false
+				}
+			}
+			return true
+		}
+		for _, addr := range recipients {
+			if c.matchText(addr) {
+				return true
+			}
+		}
+		return false
+	case FieldSubject:
+		return c.matchText(msg.Subject)
+	case FieldHeader:
+		_, present := msg.Header[textproto.CanonicalMIMEHeaderKey(c.Header)]
+		switch c.Op {
+		case OpExists:
+			return present
+		case OpNotExists:
+			return !present
+		}
+		return c.matchText(msg.HeaderValue(c.Header))
+	case FieldSize:
+		kb, _ := strconv.ParseInt(strings.TrimSpace(c.Value), 10, 64)
+		if c.Op == OpGreaterThan {
+			return msg.Size > kb*1024
+		}
+		return msg.Size < kb*1024
+	case FieldAttachment:
+		return msg.HasAttachments == (c.Op == OpExists)
+	}
+	return false
+}
+
+func (c *Condition) matchText(text string) bool {
+	text = strings.ToLower(text)
+	value := strings.ToLower(c.Value)
+	switch c.Op {
+	case OpContains:
+		return strings.Contains(text, value)
+	case OpNotContains:
+		return !strings.Contains(text, value)
+	case OpEquals:
+		return text == value
+	case OpStartsWith:
+		return strings.HasPrefix(text, value)
+	case OpEndsWith:
+		return strings.HasSuffix(text, value)
+	}
+	return false
+}
+
+// Describe returns a short text for the hit log, such as "move to Archive"
+func (a Action) Describe() string {
+	switch a.Type {
+	case ActionMove:
+		return "move to " + a.Value
+	case ActionForward:
+		return "forward to " + a.Value
+	case ActionMarkRead:
+		return "mark as read"
+	}
+	return a.Type
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
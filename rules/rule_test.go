@@ -0,0 +1,128 @@
+package rules
+
+import (
+	"lilmail/handlers/api"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := func() *Rule {
+		return &Rule{
+			Name:       " Newsletters ",
+			Conditions: []Condition{{Field: FieldSubject, Op: OpContains, Value: "news"}},
+			Actions:    []Action{{Type: ActionMove, Value: " Archive "}},
+		}
+	}
+
+	rule := valid()
+	if err := rule.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if rule.Name != "Newsletters" || rule.Actions[0].Value != "Archive" {
+		t.Errorf("Validate did not trim: %q, %q", rule.Name, rule.Actions[0].Value)
+	}
+
+	forward := valid()
+	forward.Actions = []Action{{Type: ActionForward, Value: "Friend <friend@example.com>"}}
+	if err := forward.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if forward.Actions[0].Value != "friend@example.com" {
+		t.Errorf("forward address = %q, want the bare address", forward.Actions[0].Value)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		modify func(*Rule)
+		want   string
+	}{
+		{"no name", func(r *Rule) { r.Name = "  " }, "name is required"},
+		{"no conditions", func(r *Rule) { r.Conditions = nil }, "at least one condition"},
+		{"no actions", func(r *Rule) { r.Actions = nil }, "at least one action"},
+		{"unknown field", func(r *Rule) { r.Conditions[0].Field = "body" }, "unknown condition field"},
+		{"operator of another field", func(r *Rule) { r.Conditions[0].Op = OpGreaterThan }, "cannot be used"},
+		{"header without name", func(r *Rule) {
+			r.Conditions[0] = Condition{Field: FieldHeader, Op: OpExists, Header: " "}
+		}, "header name is required"},
+		{"size not a number", func(r *Rule) {
+			r.Conditions[0] = Condition{Field: FieldSize, Op: OpGreaterThan, Value: "big"}
+		}, "number of kilobytes"},
+		{"move without folder", func(r *Rule) { r.Actions[0].Value = "" }, "target folder"},
+		{"label without label", func(r *Rule) { r.Actions[0] = Action{Type: ActionLabel} }, "label is required"},
+		{"invalid forward address", func(r *Rule) { r.Actions[0] = Action{Type: ActionForward, Value: "friend"} }, "invalid forward address"},
+		{"unknown action", func(r *Rule) { r.Actions[0].Type = "archive" }, "unknown action"},
+		{"move and delete", func(r *Rule) { r.Actions = append(r.Actions, Action{Type: ActionDelete}) }, "not both"},
+	} {
+		rule := valid()
+		tt.modify(rule)
+		err := rule.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Validate = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	msg := &api.MessageSummary{
+		From:    "News@Example.com",
+		To:      []string{"user@example.com"},
+		Cc:      []string{"team@example.com"},
+		Subject: "Weekly Newsletter",
+		Header: textproto.MIMEHeader{
+			"List-Id":   {"<weekly.example.com>"},
+			"X-Subject": {"=?utf-8?q?Gr=C3=BC=C3=9Fe?="},
+		},
+		Size:           20 * 1024,
+		HasAttachments: true,
+	}
+
+	for _, tt := range []struct {
+		cond Condition
+		want bool
+	}{
+		{Condition{Field: FieldFrom, Op: OpEquals, Value: "news@example.com"}, true},
+		{Condition{Field: FieldFrom, Op: OpStartsWith, Value: "news@"}, true},
+		{Condition{Field: FieldFrom, Op: OpEndsWith, Value: "@example.org"}, false},
+		{Condition{Field: FieldSubject, Op: OpContains, Value: "NEWSLETTER"}, true},
+		{Condition{Field: FieldSubject, Op: OpNotContains, Value: "newsletter"}, false},
+		{Condition{Field: FieldTo, Op: OpEquals, Value: "team@example.com"}, true},
+		{Condition{Field: FieldTo, Op: OpNotContains, Value: "team"}, false},
+		{Condition{Field: FieldTo, Op: OpNotContains, Value: "boss"}, true},
+		{Condition{Field: FieldHeader, Header: "list-id", Op: OpExists}, true},
+		{Condition{Field: FieldHeader, Header: "List-Unsubscribe", Op: OpExists}, false},
+		{Condition{Field: FieldHeader, Header: "List-Unsubscribe", Op: OpNotExists}, true},
+		{Condition{Field: FieldHeader, Header: "X-Subject", Op: OpEquals, Value: "grüße"}, true},
+		{Condition{Field: FieldSize, Op: OpGreaterThan, Value: "10"}, true},
+		{Condition{Field: FieldSize, Op: OpLessThan, Value: "10"}, false},
+		{Condition{Field: FieldAttachment, Op: OpExists}, true},
+		{Condition{Field: FieldAttachment, Op: OpNotExists}, false},
+	} {
+		if got := tt.cond.Matches(msg); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.cond, got, tt.want)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	msg := &api.MessageSummary{From: "boss@example.com", Subject: "Invoice"}
+	from := Condition{Field: FieldFrom, Op: OpContains, Value: "boss"}
+	subject := Condition{Field: FieldSubject, Op: OpContains, Value: "holiday"}
+
+	for _, tt := range []struct {
+		matchAll   bool
+		conditions []Condition
+		want       bool
+	}{
+		{false, []Condition{from, subject}, true},
+		{true, []Condition{from, subject}, false},
+		{true, []Condition{from}, true},
+		{false, []Condition{subject}, false},
+	} {
+		rule := &Rule{MatchAll: tt.matchAll, Conditions: tt.conditions}
+		if got := rule.Matches(msg); got != tt.want {
+			t.Errorf("matchAll %v with %d conditions = %v, want %v", tt.matchAll, len(tt.conditions), got, tt.want)
+		}
+	}
+}
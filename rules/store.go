@@ -0,0 +1,238 @@
+package rules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/inboxscan"
+	"lilmail/utils"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for unknown rule IDs
+var ErrNotFound = errors.New("rule not found")
+
+// maxHits is the number of hit log entries kept per user
+const maxHits = 500
+
+// Mailbox is the rule set of one user along with the state the worker
+// needs to scan their INBOX
+type Mailbox struct {
+	inboxscan.State
+	Rules []*Rule `json:"rules"`
+}
+
+// Hit records a rule matching a message and the actions taken
+type Hit struct {
+	RuleID   string    `json:"ruleId"`
+	RuleName string    `json:"ruleName"`
+	Time     time.Time `json:"time"`
+	Folder   string    `json:"folder"`
+	UID      string    `json:"uid"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+	Actions  []string  `json:"actions"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Store keeps the rules and hit log of each user in JSON files named after
+// a hash of the login address
+type Store struct {
+	docs *inboxscan.Store
+	mu   sync.Mutex // Guards the hit logs
+}
+
+// NewStore opens (or creates) the rules directory
+func NewStore(directory string) (*Store, error) {
+	docs, err := inboxscan.NewStore(directory, "rules", func(owner string) inboxscan.Document {
+		return &Mailbox{State: inboxscan.State{Owner: owner}, Rules: []*Rule{}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{docs: docs}, nil
+}
+
+// List returns the rules of owner in evaluation order
+func (s *Store) List(owner string) ([]*Rule, error) {
+	mb, err := s.Mailbox(owner)
+	if err != nil {
+		return nil, err
+	}
+	return mb.Rules, nil
+}
+
+// Mailbox returns the rules and scan state of owner
+func (s *Store) Mailbox(owner string) (*Mailbox, error) {
+	doc, err := s.docs.Get(owner)
+	if err != nil {
+		return nil, err
+	}
+	return doc.(*Mailbox), nil
+}
+
+// Get returns one rule of owner
+func (s *Store) Get(owner, id string) (*Rule, error) {
+	rules, err := s.List(owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.ID == id {
+			return rule, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Save creates or replaces a rule. The credentials are stored so the worker
+// can reach the mailbox while the user is logged out.
+func (s *Store) Save(owner, credentials string, rule *Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	return s.docs.Update(owner, func(doc inboxscan.Document) error {
+		mb := doc.(*Mailbox)
+		mb.Credentials = credentials
+		mb.LastError = ""
+		mb.AuthFailed = false
+
+		if rule.ID == "" {
+			id, err := newID()
+			if err != nil {
+				return err
+			}
+			rule.ID = id
+			mb.Rules = append(mb.Rules, rule)
+			return nil
+		}
+
+		for i, existing := range mb.Rules {
+			if existing.ID == rule.ID {
+				mb.Rules[i] = rule
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// Delete removes a rule
+func (s *Store) Delete(owner, id string) error {
+	return s.docs.Update(owner, func(doc inboxscan.Document) error {
+		mb := doc.(*Mailbox)
+		kept := mb.Rules[:0]
+		for _, rule := range mb.Rules {
+			if rule.ID != id {
+				kept = append(kept, rule)
+			}
+		}
+		if len(kept) == len(mb.Rules) {
+			return ErrNotFound
+		}
+		mb.Rules = kept
+		return nil
+	})
+}
+
+// RefreshCredentials replaces the stored credentials of a user who has
+// rules, so a changed password reaches the worker at the next login
+func (s *Store) RefreshCredentials(owner, credentials string) error {
+	return s.docs.RefreshCredentials(owner, credentials, func(doc inboxscan.Document) bool {
+		return len(doc.(*Mailbox).Rules) > 0
+	})
+}
+
+// Mailboxes returns every user with at least one enabled rule
+func (s *Store) Mailboxes() ([]*Mailbox, error) {
+	docs, err := s.docs.All()
+	if err != nil {
+		return nil, err
+	}
+
+	var mailboxes []*Mailbox
+	for _, doc := range docs {
+		mb := doc.(*Mailbox)
+		for _, rule := range mb.Rules {
+			if rule.Enabled {
+				mailboxes = append(mailboxes, mb)
+				break
+			}
+		}
+	}
+	return mailboxes, nil
+}
+
+// RekeyCredentials re-encrypts the stored credentials with rekey and
+// returns how many mailboxes changed
+func (s *Store) RekeyCredentials(rekey func(string) (string, error)) (int, error) {
+	return s.docs.RekeyCredentials(rekey)
+}
+
+// AddHits appends to the hit log of owner, dropping the oldest entries
+// beyond maxHits
+func (s *Store) AddHits(owner string, hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []Hit
+	if err := readJSON(s.docs.Path(owner, ".hits.json"), &entries); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	entries = append(entries, hits...)
+	if len(entries) > maxHits {
+		entries = entries[len(entries)-maxHits:]
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.docs.Path(owner, ".hits.json"), data, 0600)
+}
+
+// Hits returns the hit log entries of one rule, newest first
+func (s *Store) Hits(owner, ruleID string) ([]Hit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []Hit
+	if err := readJSON(s.docs.Path(owner, ".hits.json"), &entries); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	hits := []Hit{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].RuleID == ruleID {
+			hits = append(hits, entries[i])
+		}
+	}
+	return hits, nil
+}
+
+// Helper methods
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate rule ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
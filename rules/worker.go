@@ -0,0 +1,54 @@
+package rules
+
+import (
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/inboxscan"
+	"log"
+)
+
+// Worker periodically filters new INBOX messages of every user with rules
+type Worker struct {
+	*inboxscan.Worker
+	store  *Store
+	engine *Engine
+}
+
+// NewWorker creates a worker for the rules in store
+func NewWorker(store *Store, engine *Engine, config *config.Config) *Worker {
+	w := &Worker{
+		store:  store,
+		engine: engine,
+	}
+	w.Worker = inboxscan.NewWorker("Rules", store.docs, config, config.Rules.PollInterval, w.mailboxes, w.filter)
+	return w
+}
+
+func (w *Worker) mailboxes() ([]inboxscan.Document, error) {
+	mailboxes, err := w.store.Mailboxes()
+	docs := make([]inboxscan.Document, len(mailboxes))
+	for i, mb := range mailboxes {
+		docs[i] = mb
+	}
+	return docs, err
+}
+
+// filter runs the enabled rules over the new messages
+func (w *Worker) filter(doc inboxscan.Document, client *api.Client, _ *api.Credentials, messages []api.MessageSummary) (uint32, func(inboxscan.Document), error) {
+	mb := doc.(*Mailbox)
+
+	var enabled []*Rule
+	for _, rule := range mb.Rules {
+		if rule.Enabled {
+			enabled = append(enabled, rule)
+		}
+	}
+
+	hits := w.engine.Run(client, mb.Owner, mb.Credentials, "INBOX", enabled, messages, false)
+	if err := w.store.AddHits(mb.Owner, hits); err != nil {
+		log.Printf("Rules: error saving hits for %s: %v", mb.Owner, err)
+	}
+
+	// Failed actions are recorded as hits rather than retried
+	return inboxscan.UID(&messages[len(messages)-1]), nil, nil
+}
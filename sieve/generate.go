@@ -0,0 +1,285 @@
+package sieve
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/rules"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options supply what the generator cannot know from the script itself
+type Options struct {
+	Keywords    map[string]string // IMAP keyword of each label ID
+	TrashFolder string            // Target of the delete action; messages are discarded when empty
+	Extensions  []string          // Extensions offered by the server; nil skips the check
+}
+
+// generator collects the script text and the extensions it needs
+type generator struct {
+	opts     Options
+	b        strings.Builder
+	requires map[string]bool
+}
+
+// Generate renders the guided settings as a Sieve script. The vacation
+// reply comes first, so it is sent even for mail that a filter files away.
+func Generate(script *Script, opts Options) (string, error) {
+	if err := script.Validate(); err != nil {
+		return "", err
+	}
+
+	g := &generator{opts: opts, requires: make(map[string]bool)}
+
+	if v := script.Vacation; v != nil && v.Enabled {
+		g.vacation(v)
+	}
+	for _, filter := range script.Filters {
+		if !filter.Enabled {
+			continue
+		}
+		if err := g.filter(filter); err != nil {
+			return "", fmt.Errorf("filter %q: %v", filter.Name, err)
+		}
+	}
+
+	if err := g.checkExtensions(); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(script)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	out.WriteString("# Generated by lilmail. Changes made outside the guided editor are lost when it saves.\n")
+	out.WriteString(dataPrefix + string(data) + "\n")
+	if len(g.requires) > 0 {
+		out.WriteString("require " + stringList(g.requiredList()) + ";\n")
+	}
+	out.WriteString(g.b.String())
+	return out.String(), nil
+}
+
+func (g *generator) vacation(v *Vacation) {
+	g.requires["vacation"] = true
+
+	var tests []string
+	if v.Start != "" {
+		tests = append(tests, `currentdate :value "ge" "date" `+quote(v.Start))
+	}
+	if v.End != "" {
+		tests = append(tests, `currentdate :value "le" "date" `+quote(v.End))
+	}
+	if len(tests) > 0 {
+		g.requires["date"] = true
+		g.requires["relational"] = true
+	}
+	if len(v.Senders) > 0 {
+		tests = append(tests, `address :all :is "from" `+stringList(v.Senders))
+	}
+
+	command := "vacation :days " + strconv.Itoa(v.Days)
+	if v.Subject != "" {
+		command += " :subject " + quote(v.Subject)
+	}
+	if len(v.Addresses) > 0 {
+		command += " :addresses " + stringList(v.Addresses)
+	}
+	command += " " + quote(v.Body) + ";"
+
+	g.b.WriteString("\n# Vacation reply\n")
+	switch len(tests) {
+	case 0:
+		g.b.WriteString(command + "\n")
+	case 1:
+		g.b.WriteString("if " + tests[0] + " {\n    " + command + "\n}\n")
+	default:
+		g.b.WriteString("if allof (" + strings.Join(tests, ",\n        ") + ") {\n    " + command + "\n}\n")
+	}
+}
+
+func (g *generator) filter(filter *rules.Rule) error {
+	var tests []string
+	for _, cond := range filter.Conditions {
+		tests = append(tests, g.test(cond))
+	}
+
+	test := tests[0]
+	if len(tests) > 1 {
+		joiner := "anyof"
+		if filter.MatchAll {
+			joiner = "allof"
+		}
+		test = joiner + " (" + strings.Join(tests, ",\n        ") + ")"
+	}
+
+	g.b.WriteString("\n# rule: " + strings.ReplaceAll(filter.Name, "\n", " ") + "\n")
+	g.b.WriteString("if " + test + " {\n")
+
+	stop := filter.Stop
+	for _, action := range filter.Actions {
+		// Flags must be set before fileinto for the filed copy to carry them
+		if action.Type == rules.ActionMove || action.Type == rules.ActionDelete {
+			continue
+		}
+		line, err := g.action(action)
+		if err != nil {
+			return err
+		}
+		g.b.WriteString("    " + line + "\n")
+	}
+	for _, action := range filter.Actions {
+		if action.Type != rules.ActionMove && action.Type != rules.ActionDelete {
+			continue
+		}
+		line, err := g.action(action)
+		if err != nil {
+			return err
+		}
+		g.b.WriteString("    " + line + "\n")
+		stop = true
+	}
+
+	if stop {
+		g.b.WriteString("    stop;\n")
+	}
+	g.b.WriteString("}\n")
+	return nil
+}
+
+// test renders one condition with the same meaning the rules engine gives
+// it; Sieve comparisons ignore case by default, as the engine does
+func (g *generator) test(cond rules.Condition) string {
+	switch cond.Field {
+	case rules.FieldFrom:
+		return g.textTest("address :all", `"from"`, cond)
+	case rules.FieldTo:
+		return g.textTest("address :all", `["to", "cc"]`, cond)
+	case rules.FieldSubject:
+		return g.textTest("header", `"subject"`, cond)
+	case rules.FieldHeader:
+		switch cond.Op {
+		case rules.OpExists:
+			return "exists " + quote(cond.Header)
+		case rules.OpNotExists:
+			return "not exists " + quote(cond.Header)
+		}
+		return g.textTest("header", quote(cond.Header), cond)
+	case rules.FieldSize:
+		kb, _ := strconv.ParseInt(strings.TrimSpace(cond.Value), 10, 64)
+		if cond.Op == rules.OpGreaterThan {
+			return fmt.Sprintf("size :over %dK", kb)
+		}
+		return fmt.Sprintf("size :under %dK", kb)
+	case rules.FieldAttachment:
+		g.requires["mime"] = true
+		test := `header :mime :anychild :contains "Content-Disposition" "attachment"`
+		if cond.Op == rules.OpNotExists {
+			return "not " + test
+		}
+		return test
+	}
+	return "false"
+}
+
+func (g *generator) textTest(command, headers string, cond rules.Condition) string {
+	var match, value string
+	switch cond.Op {
+	case rules.OpEquals:
+		match, value = ":is", quote(cond.Value)
+	case rules.OpStartsWith:
+		match, value = ":matches", quote(escapeWildcards(cond.Value)+"*")
+	case rules.OpEndsWith:
+		match, value = ":matches", quote("*"+escapeWildcards(cond.Value))
+	default:
+		match, value = ":contains", quote(cond.Value)
+	}
+
+	test := command + " " + match + " " + headers + " " + value
+	if cond.Op == rules.OpNotContains {
+		return "not " + test
+	}
+	return test
+}
+
+func (g *generator) action(action rules.Action) (string, error) {
+	switch action.Type {
+	case rules.ActionMove:
+		g.requires["fileinto"] = true
+		return "fileinto " + quote(action.Value) + ";", nil
+	case rules.ActionDelete:
+		if g.opts.TrashFolder == "" {
+			return "discard;", nil
+		}
+		g.requires["fileinto"] = true
+		return "fileinto " + quote(g.opts.TrashFolder) + ";", nil
+	case rules.ActionMarkRead:
+		g.requires["imap4flags"] = true
+		return `addflag "\\Seen";`, nil
+	case rules.ActionFlag:
+		g.requires["imap4flags"] = true
+		return `addflag "\\Flagged";`, nil
+	case rules.ActionLabel:
+		keyword, ok := g.opts.Keywords[action.Value]
+		if !ok {
+			return "", fmt.Errorf("unknown label")
+		}
+		g.requires["imap4flags"] = true
+		return "addflag " + quote(keyword) + ";", nil
+	case rules.ActionForward:
+		g.requires["copy"] = true
+		return "redirect :copy " + quote(action.Value) + ";", nil
+	}
+	return "", fmt.Errorf("unknown action %q", action.Type)
+}
+
+func (g *generator) checkExtensions() error {
+	if g.opts.Extensions == nil {
+		return nil
+	}
+	offered := make(map[string]bool, len(g.opts.Extensions))
+	for _, ext := range g.opts.Extensions {
+		offered[strings.ToLower(ext)] = true
+	}
+
+	var missing []string
+	for _, ext := range g.requiredList() {
+		if !offered[ext] {
+			missing = append(missing, ext)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the mail server does not support the Sieve extensions %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (g *generator) requiredList() []string {
+	list := make([]string, 0, len(g.requires))
+	for ext := range g.requires {
+		list = append(list, ext)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// quote returns a Sieve quoted string; line breaks are allowed inside
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func stringList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quote(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// escapeWildcards makes text match literally in a :matches pattern
+func escapeWildcards(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(s)
+}
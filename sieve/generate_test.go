@@ -0,0 +1,99 @@
+package sieve
+
+import (
+	"lilmail/rules"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		`Archive`:          `"Archive"`,
+		`say "hi"`:         `"say \"hi\""`,
+		`C:\mail`:          `"C:\\mail"`,
+		`\"`:               `"\\\""`,
+		"line one\nline 2": "\"line one\nline 2\"",
+	} {
+		if got := quote(in); got != want {
+			t.Errorf("quote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestEscapeWildcards(t *testing.T) {
+	for in, want := range map[string]string{
+		`plain`:    `plain`,
+		`50% off*`: `50% off\*`,
+		`why?`:     `why\?`,
+		`a\b`:      `a\\b`,
+		`\*`:       `\\\*`,
+	} {
+		if got := escapeWildcards(in); got != want {
+			t.Errorf("escapeWildcards(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestGenerateTextTests(t *testing.T) {
+	for _, tt := range []struct {
+		op   string
+		want string
+	}{
+		// Only :matches treats * and ? as wildcards, so only its patterns
+		// escape them; quoting then doubles every backslash
+		{rules.OpStartsWith, `header :matches "subject" "[\\*] \"Sale\\\\\\* now\\?\\\\\\?*"`},
+		{rules.OpEndsWith, `header :matches "subject" "*[\\*] \"Sale\\\\\\* now\\?\\\\\\?"`},
+		{rules.OpContains, `header :contains "subject" "[*] \"Sale\\* now?\\?"`},
+		{rules.OpNotContains, `not header :contains "subject" "[*] \"Sale\\* now?\\?"`},
+		{rules.OpEquals, `header :is "subject" "[*] \"Sale\\* now?\\?"`},
+	} {
+		script := &Script{Filters: []*rules.Rule{{
+			Name:       "Sales",
+			Enabled:    true,
+			Conditions: []rules.Condition{{Field: rules.FieldSubject, Op: tt.op, Value: `[*] "Sale\* now?\?`}},
+			Actions:    []rules.Action{{Type: rules.ActionMarkRead}},
+		}}}
+		out, err := Generate(script, Options{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.op, err)
+		}
+		if !strings.Contains(out, "if "+tt.want+" {\n") {
+			t.Errorf("%s: script lacks test %s:\n%s", tt.op, tt.want, out)
+		}
+	}
+}
+
+func TestGenerateParse(t *testing.T) {
+	script := &Script{
+		Filters: []*rules.Rule{{
+			Name:       "Line\nbreak",
+			Enabled:    true,
+			Conditions: []rules.Condition{{Field: rules.FieldFrom, Op: rules.OpContains, Value: "boss"}},
+			Actions:    []rules.Action{{Type: rules.ActionMove, Value: `Work "urgent"`}},
+		}},
+		Vacation: &Vacation{Enabled: true, Body: "Away\nuntil Monday", Days: 3},
+	}
+	out, err := Generate(script, Options{Extensions: []string{"fileinto", "vacation"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`require ["fileinto", "vacation"];`,
+		"vacation :days 3 \"Away\nuntil Monday\";",
+		"# rule: Line break\n",
+		`fileinto "Work \"urgent\"";`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("script lacks %q:\n%s", want, out)
+		}
+	}
+
+	parsed, ok := Parse(out)
+	if !ok || len(parsed.Filters) != 1 || parsed.Filters[0].Name != "Line\nbreak" || parsed.Vacation.Body != "Away\nuntil Monday" {
+		t.Errorf("Parse = %+v, %v", parsed, ok)
+	}
+
+	if _, err := Generate(script, Options{Extensions: []string{"vacation"}}); err == nil || !strings.Contains(err.Error(), "fileinto") {
+		t.Errorf("Generate without fileinto = %v, want an error naming it", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Package sieve builds Sieve scripts (RFC 5228) for the guided filter
+// editor. The guided settings are stored as a comment inside the generated
+// script, so the editor can reopen scripts it wrote; other scripts are
+// edited as raw text.
+package sieve
+
+import (
+	"encoding/json"
+	"fmt"
+	"lilmail/rules"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// dateLayout is the format of vacation dates, as compared by the Sieve
+// date extension
+const dateLayout = "2006-01-02"
+
+// dataPrefix starts the comment line holding the guided settings
+const dataPrefix = "# lilmail: "
+
+// Script holds the guided settings of a generated script
+type Script struct {
+	Filters  []*rules.Rule `json:"filters"`
+	Vacation *Vacation     `json:"vacation,omitempty"`
+}
+
+// Vacation is an automatic reply sent with the Sieve vacation extension
+type Vacation struct {
+	Enabled   bool     `json:"enabled"`
+	Subject   string   `json:"subject"`
+	Body      string   `json:"body"`
+	Days      int      `json:"days"`              // Minimum days between two replies to one sender
+	Addresses []string `json:"addresses"`         // Aliases of the user, so mail sent to them is answered too
+	Start     string   `json:"start,omitempty"`   // First day (YYYY-MM-DD) replies are sent, optional
+	End       string   `json:"end,omitempty"`     // Last day replies are sent, optional
+	Senders   []string `json:"senders,omitempty"` // When set, only these senders get a reply
+}
+
+// Validate checks the filters and the vacation reply
+func (s *Script) Validate() error {
+	for _, filter := range s.Filters {
+		if err := filter.Validate(); err != nil {
+			return fmt.Errorf("filter %q: %v", filter.Name, err)
+		}
+	}
+
+	if v := s.Vacation; v != nil && v.Enabled {
+		if strings.TrimSpace(v.Body) == "" {
+			return fmt.Errorf("vacation message is required")
+		}
+		if v.Days < 1 {
+			v.Days = 1
+		}
+		var addresses []string
+		for _, addr := range v.Addresses {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			parsed, err := mail.ParseAddress(addr)
+			if err != nil {
+				return fmt.Errorf("invalid vacation address %q", addr)
+			}
+			addresses = append(addresses, parsed.Address)
+		}
+		v.Addresses = addresses
+
+		for _, day := range []string{v.Start, v.End} {
+			if day == "" {
+				continue
+			}
+			if _, err := time.Parse(dateLayout, day); err != nil {
+				return fmt.Errorf("invalid vacation date %q", day)
+			}
+		}
+		if v.Start != "" && v.End != "" && v.End < v.Start {
+			return fmt.Errorf("vacation ends before it starts")
+		}
+	}
+	return nil
+}
+
+// Parse returns the guided settings stored in a script, and false for
+// scripts that were not generated by the guided editor
+func Parse(content string) (*Script, bool) {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, dataPrefix) {
+			continue
+		}
+		var script Script
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, dataPrefix)), &script); err != nil {
+			return nil, false
+		}
+		return &script, true
+	}
+	return nil, false
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"log"
+	"path/filepath"
+)
+
+// revokedTokensFile keeps the IDs of revoked tokens in the data folder
+const revokedTokensFile = "revoked-tokens.json"
+
+// signOut deletes every session of an account and revokes their tokens.
+// LilMail may keep running; it reads the revoked tokens on the next request.
+func signOut(cfg *config.Config, owner string) error {
+	denylist, err := api.NewDenylist(filepath.Join(cfg.Data.Folder, revokedTokensFile))
+	if err != nil {
+		return err
+	}
+
+	// Revoke what was deleted even when a later session could not be
+	deleted, deleteErr := sessions.DeleteOwner(owner)
+	log.Printf("Sessions of %s: %d deleted", owner, len(deleted))
+	if err := denylist.RevokeSessions(deleted); err != nil {
+		return err
+	}
+	return deleteErr
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout bounds the wait for the database lock, which another
+// LilMail process may hold
+const boltOpenTimeout = 5 * time.Second
+
+var sessionsBucket = []byte("sessions")
+
+// ErrDatabaseInUse is returned when another process, such as the running
+// server, holds the session database
+var ErrDatabaseInUse = errors.New("session database is in use by another process")
+
+// boltRecords keeps sessions in an embedded bbolt database, a single file
+// that one process at a time may open
+type boltRecords struct {
+	db *bolt.DB
+}
+
+// NewBoltStore creates a store keeping sessions in the database at path
+func NewBoltStore(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, filePerm, &bolt.Options{Timeout: boltOpenTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseInUse, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session database: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open session database: %v", err)
+	}
+
+	return newStore(&boltRecords{db: db}), nil
+}
+
+func (r *boltRecords) load(key string) (*sessionData, error) {
+	var data *sessionData
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		data, err = decodeBolt(tx.Bucket(sessionsBucket).Get([]byte(key)))
+		return err
+	})
+	return data, err
+}
+
+func (r *boltRecords) update(key string, fn func(old *sessionData) (*sessionData, error)) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		old, err := decodeBolt(bucket.Get([]byte(key)))
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return err
+		}
+		data, err := fn(old)
+		if err != nil || data == nil {
+			return err
+		}
+
+		value, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (r *boltRecords) remove(key string, fn func(old *sessionData) bool) (bool, error) {
+	removed := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		value := bucket.Get([]byte(key))
+		old, err := decodeBolt(value)
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return err
+		}
+		if !fn(old) || value == nil {
+			return nil
+		}
+		removed = true
+		return bucket.Delete([]byte(key))
+	})
+	return removed, err
+}
+
+func (r *boltRecords) keys() ([]string, error) {
+	var keys []string
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (r *boltRecords) reset() error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(sessionsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(sessionsBucket)
+		return err
+	})
+}
+
+func (r *boltRecords) tidy() {}
+
+func (r *boltRecords) close() error {
+	return r.db.Close()
+}
+
+// decodeBolt decodes a stored session. Values are only valid during their
+// transaction, which the decoded copy outlives.
+func decodeBolt(value []byte) (*sessionData, error) {
+	if value == nil {
+		return nil, nil
+	}
+	var data sessionData
+	if err := json.Unmarshal(value, &data); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return &data, nil
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Session files hold encrypted credentials, so only the server user may
+// read them
+const (
+	dirPerm  = 0700
+	filePerm = 0600
+)
+
+// tempMaxAge is how old a temporary file left by an interrupted write must
+// be before the sweeper removes it
+const tempMaxAge = time.Hour
+
+// lockName is the file locked while sessions are changed, so instances
+// sharing the directory do not overwrite each other's changes
+const lockName = ".lock"
+
+// fileRecords keeps each session in its own file. Files are replaced
+// atomically, so they can be read without locking.
+type fileRecords struct {
+	dir  string
+	lock *FileLock
+}
+
+// NewFileStore creates a store keeping sessions as files in directory
+func NewFileStore(directory string) (*Store, error) {
+	// Create directory if it doesn't exist, and tighten one that does
+	if err := os.MkdirAll(directory, dirPerm); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(directory, dirPerm); err != nil {
+		return nil, err
+	}
+
+	lock, err := OpenFileLock(filepath.Join(directory, lockName))
+	if err != nil {
+		return nil, err
+	}
+
+	return newStore(&fileRecords{
+		dir:  directory,
+		lock: lock,
+	}), nil
+}
+
+func (r *fileRecords) load(key string) (*sessionData, error) {
+	data, err := os.ReadFile(r.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session sessionData
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return &session, nil
+}
+
+func (r *fileRecords) update(key string, fn func(old *sessionData) (*sessionData, error)) error {
+	return r.locked(func() error {
+		old, err := r.load(key)
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return err
+		}
+		data, err := fn(old)
+		if err != nil || data == nil {
+			return err
+		}
+
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		// A crash mid-write leaves the old session or the new one, never half
+		return utils.WriteFileAtomic(r.path(key), jsonData, filePerm)
+	})
+}
+
+func (r *fileRecords) remove(key string, fn func(old *sessionData) bool) (bool, error) {
+	removed := false
+	err := r.locked(func() error {
+		old, err := r.load(key)
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return err
+		}
+		if !fn(old) {
+			return nil
+		}
+		err = os.Remove(r.path(key))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		removed = err == nil
+		return err
+	})
+	return removed, err
+}
+
+func (r *fileRecords) keys() ([]string, error) {
+	dir, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, d := range dir {
+		key := strings.TrimSuffix(d.Name(), ".session")
+		if filepath.Ext(d.Name()) == ".session" && validKey(key) == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (r *fileRecords) reset() error {
+	return r.locked(func() error {
+		dir, err := os.ReadDir(r.dir)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range dir {
+			if filepath.Ext(d.Name()) == ".session" || isTemp(d.Name()) {
+				os.Remove(filepath.Join(r.dir, d.Name()))
+			}
+		}
+		return nil
+	})
+}
+
+// tidy removes temporary files of writes that were interrupted. Recent
+// ones may belong to a write in progress.
+func (r *fileRecords) tidy() {
+	dir, err := os.ReadDir(r.dir)
+	if err != nil {
+		return
+	}
+
+	for _, d := range dir {
+		if !isTemp(d.Name()) {
+			continue
+		}
+		if info, err := d.Info(); err == nil && time.Since(info.ModTime()) > tempMaxAge {
+			os.Remove(filepath.Join(r.dir, d.Name()))
+		}
+	}
+}
+
+func (r *fileRecords) close() error {
+	return r.lock.Close()
+}
+
+// Helper methods
+
+func (r *fileRecords) path(key string) string {
+	return filepath.Join(r.dir, key+".session")
+}
+
+// locked runs fn holding the directory lock
+func (r *fileRecords) locked(fn func() error) error {
+	return r.lock.Locked(fn)
+}
+
+// isTemp reports whether name is a temporary file of WriteFileAtomic
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".session.tmp-")
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "sessions")
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, dir
+}
+
+// sessionFiles returns the names in dir besides the lock file
+func sessionFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != lockName {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// writeTemp leaves a temporary file as an interrupted write would
+func writeTemp(t *testing.T, dir, name string, age time.Duration) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(`{"value":`), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileStoreRejectsKeys(t *testing.T) {
+	s, dir := newTestFileStore(t)
+	outside := filepath.Join(filepath.Dir(dir), "outside.session")
+	if err := os.WriteFile(outside, []byte(`{"value":"c2VjcmV0","expires_at":"2999-01-01T00:00:00Z"}`), filePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"../outside",
+		"..",
+		".",
+		"a/b",
+		`a\b`,
+		"/etc/passwd",
+		"a.b",
+		"a\x00b",
+		"",
+		string(make([]byte, maxKeyLength+1)),
+	} {
+		if err := s.Set(key, []byte("x"), time.Hour); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Set(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if val, err := s.Get(key); val != nil || err != nil {
+			t.Errorf("Get(%q) = %q, %v; want nothing", key, val, err)
+		}
+		if err := s.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if err := s.Touch(key, SessionMeta{Owner: "user@example.com"}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Touch(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the directory: %v", err)
+	}
+	if files := sessionFiles(t, dir); len(files) != 0 {
+		t.Errorf("files written for rejected keys: %v", files)
+	}
+}
+
+func TestFileStorePermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	// A directory created before the store is tightened too
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Set("abc", []byte("x"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Touch("abc", SessionMeta{Owner: "user@example.com", LastSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != dirPerm {
+		t.Errorf("directory mode = %o, want %o", perm, dirPerm)
+	}
+	for _, name := range []string{"abc.session", lockName} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != filePerm {
+			t.Errorf("%s mode = %o, want %o", name, perm, filePerm)
+		}
+	}
+}
+
+func TestFileStoreTempFiles(t *testing.T) {
+	s, dir := newTestFileStore(t)
+	if err := s.Set("abc", []byte("saved"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Touch("abc", SessionMeta{Owner: "user@example.com", LastSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An interrupted write leaves the old session and a temporary file
+	stale := writeTemp(t, dir, ".abc.session.tmp-1", 2*tempMaxAge)
+	recent := writeTemp(t, dir, ".abc.session.tmp-2", 0)
+
+	if val, err := s.Get("abc"); string(val) != "saved" || err != nil {
+		t.Errorf("Get after an interrupted write = %q, %v; want the old session", val, err)
+	}
+	sessions, err := s.Sessions("user@example.com")
+	if err != nil || len(sessions) != 1 || sessions[0].Key != "abc" {
+		t.Errorf("Sessions = %v, %v; want only abc", sessions, err)
+	}
+
+	if n, err := s.Sweep(); n != 0 || err != nil {
+		t.Errorf("Sweep = %d, %v; want no sessions removed", n, err)
+	}
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale temporary file kept: %v", err)
+	}
+	// A recent one may belong to a write in progress
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("recent temporary file removed: %v", err)
+	}
+
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if files := sessionFiles(t, dir); len(files) != 0 {
+		t.Errorf("files left by Reset: %v", files)
+	}
+}
+
+func TestFileStoreConcurrentKey(t *testing.T) {
+	s, dir := newTestFileStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				val := fmt.Sprintf("%d-%d", i, j)
+				if err := s.Set("abc", []byte(val), time.Hour); err != nil {
+					t.Errorf("Set: %v", err)
+				}
+				// Readers see a whole session or none, never a torn write
+				got, err := s.Get("abc")
+				if err != nil {
+					t.Errorf("Get: %v", err)
+				}
+				if got != nil {
+					var a, b int
+					if _, err := fmt.Sscanf(string(got), "%d-%d", &a, &b); err != nil {
+						t.Errorf("Get = %q, not a value that was set", got)
+					}
+				}
+				if j%5 == 0 {
+					if err := s.Delete("abc"); err != nil {
+						t.Errorf("Delete: %v", err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, name := range sessionFiles(t, dir) {
+		if isTemp(name) {
+			t.Errorf("temporary file %s left behind", name)
+		}
+	}
+}
+
+func TestSweepRemovesOnlyExpired(t *testing.T) {
+	s, dir := newTestFileStore(t)
+	for key, exp := range map[string]time.Duration{
+		"live":    time.Hour,
+		"expired": -time.Second,
+		"old":     -time.Hour,
+	} {
+		if err := s.Set(key, []byte(key), exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "corrupt.session"), []byte("{"), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("kept"), filePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired sessions are not returned before the sweep either
+	if val, _ := s.Get("expired"); val != nil {
+		t.Errorf("Get of an expired session = %q", val)
+	}
+
+	n, err := s.Sweep()
+	if err != nil || n != 3 {
+		t.Errorf("Sweep = %d, %v; want 3 removed", n, err)
+	}
+	files := sessionFiles(t, dir)
+	if len(files) != 2 || !contains(files, "live.session") || !contains(files, "notes.txt") {
+		t.Errorf("files after sweeping = %v, want live.session and notes.txt", files)
+	}
+	if val, err := s.Get("live"); string(val) != "live" || err != nil {
+		t.Errorf("Get(live) after sweeping = %q, %v", val, err)
+	}
+}
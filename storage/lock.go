@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileLock is an exclusive lock held on a file, so that processes sharing
+// data, such as the server and the sign-out command, take turns changing it
+type FileLock struct {
+	file *os.File
+	mu   sync.Mutex // The file lock does not exclude goroutines of one process
+}
+
+// OpenFileLock opens (or creates) the lock file at path
+func OpenFileLock(path string) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	return &FileLock{file: file}, nil
+}
+
+// Locked runs fn holding the lock
+func (l *FileLock) Locked(fn func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := lockFile(l.file); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", l.file.Name(), err)
+	}
+	defer unlockFile(l.file)
+
+	return fn()
+}
+
+// Close releases the lock file
+func (l *FileLock) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,85 @@
+package storage
+
+import "sync"
+
+// memoryRecords keeps sessions in memory. They are lost on restart and not
+// shared between instances, which suits tests and trying LilMail out.
+type memoryRecords struct {
+	sessions map[string]sessionData
+	mu       sync.Mutex
+}
+
+// NewMemoryStore creates a store keeping sessions in memory
+func NewMemoryStore() *Store {
+	return newStore(&memoryRecords{
+		sessions: make(map[string]sessionData),
+	})
+}
+
+func (r *memoryRecords) load(key string) (*sessionData, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.sessions[key]
+	if !ok {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+func (r *memoryRecords) update(key string, fn func(old *sessionData) (*sessionData, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var old *sessionData
+	if data, ok := r.sessions[key]; ok {
+		old = &data
+	}
+	data, err := fn(old)
+	if err != nil || data == nil {
+		return err
+	}
+	r.sessions[key] = *data
+	return nil
+}
+
+func (r *memoryRecords) remove(key string, fn func(old *sessionData) bool) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.sessions[key]
+	if !ok {
+		fn(nil)
+		return false, nil
+	}
+	if !fn(&data) {
+		return false, nil
+	}
+	delete(r.sessions, key)
+	return true, nil
+}
+
+func (r *memoryRecords) keys() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.sessions))
+	for key := range r.sessions {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (r *memoryRecords) reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions = make(map[string]sessionData)
+	return nil
+}
+
+func (r *memoryRecords) tidy() {}
+
+func (r *memoryRecords) close() error {
+	return nil
+}
@@ -1,136 +1,355 @@
+// Package storage keeps fiber sessions. A Store implements fiber's Storage
+// interface on top of one of several backends: files in a directory, which
+// several LilMail instances may share, an embedded database, or memory.
 package storage
 
 import (
-	"encoding/json"
 	"errors"
-	"os"
-	"path/filepath"
+	"fmt"
+	"lilmail/config"
+	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-// FileStorage implements fiber's Storage interface for file-based session storage
-type FileStorage struct {
-	dir string
-	mu  sync.RWMutex
-}
+// gcInterval is how often expired sessions are removed
+const gcInterval = 10 * time.Minute
+
+// maxKeyLength bounds session keys; fiber's are 36-character UUIDs
+const maxKeyLength = 128
+
+// touchInterval limits how often an unchanged session's last-seen time is
+// written
+const touchInterval = time.Minute
+
+// ErrInvalidKey is returned for keys that cannot safely name a file
+var ErrInvalidKey = errors.New("invalid session key")
+
+// errCorrupt marks stored sessions that cannot be decoded
+var errCorrupt = errors.New("corrupt session")
 
 type sessionData struct {
-	Value     []byte    `json:"value"`
-	ExpiresAt time.Time `json:"expires_at"`
+	Value     []byte       `json:"value"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	Meta      *SessionMeta `json:"meta,omitempty"`
 }
 
-// NewFileStorage creates a new file storage instance
-func NewFileStorage(directory string) (*FileStorage, error) {
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(directory, 0755); err != nil {
-		return nil, err
+// SessionMeta describes the device a session is used from, for listing
+// and revoking sessions
+type SessionMeta struct {
+	Key         string    `json:"-"` // Storage key, filled in by Sessions
+	Owner       string    `json:"owner"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent"`
+	TokenID     string    `json:"token_id,omitempty"`
+	TokenExpiry time.Time `json:"token_expiry,omitempty"`
+}
+
+// records is what a backend provides: whole sessions by key. update and
+// remove must be atomic, also against other processes sharing the backend.
+type records interface {
+	// load returns nil for a missing session and errCorrupt for one that
+	// cannot be decoded
+	load(key string) (*sessionData, error)
+	// update stores what fn returns, or nothing when it returns nil. fn
+	// gets nil for a missing or corrupt session.
+	update(key string, fn func(old *sessionData) (*sessionData, error)) error
+	// remove deletes the session when fn, which gets nil for a missing or
+	// corrupt session, returns true
+	remove(key string, fn func(old *sessionData) bool) (bool, error)
+	keys() ([]string, error)
+	reset() error
+	// tidy removes what the backend leaves behind besides sessions
+	tidy()
+	close() error
+}
+
+// Store implements fiber's Storage interface, and lists and revokes the
+// sessions of a user. Expired sessions are removed in the background until
+// it is closed.
+type Store struct {
+	records records
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newStore(r records) *Store {
+	s := &Store{
+		records: r,
+		done:    make(chan struct{}),
 	}
+	go s.gc()
+	return s
+}
 
-	return &FileStorage{
-		dir: directory,
-	}, nil
+// Open creates the store of the configured backend
+func Open(cfg config.SessionConfig) (*Store, error) {
+	switch cfg.Backend {
+	case config.SessionBolt:
+		return NewBoltStore(cfg.Path)
+	case config.SessionMemory:
+		return NewMemoryStore(), nil
+	}
+	return NewFileStore(cfg.Path)
 }
 
-// Get retrieves session data from file
-func (s *FileStorage) Get(key string) ([]byte, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// Get retrieves session data. Missing, expired and unreadable sessions are
+// all reported as absent.
+func (s *Store) Get(key string) ([]byte, error) {
+	if validKey(key) != nil {
+		return nil, nil
+	}
 
-	data, err := s.readFile(key)
+	data, err := s.records.load(key)
+	if errors.Is(err, errCorrupt) {
+		log.Printf("Session storage: discarding unreadable session: %v", err)
+		s.Delete(key)
+		return nil, nil
+	}
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil, nil // Return nil for non-existent keys
-		}
 		return nil, err
 	}
 
-	// Check if session has expired
-	if time.Now().After(data.ExpiresAt) {
-		s.Delete(key) // Clean up expired session
+	// Expired sessions are left to the sweeper
+	if data == nil || time.Now().After(data.ExpiresAt) {
 		return nil, nil
 	}
-
 	return data.Value, nil
 }
 
-// Set stores session data to file
-func (s *FileStorage) Set(key string, val []byte, exp time.Duration) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	data := sessionData{
-		Value:     val,
-		ExpiresAt: time.Now().Add(exp),
+// Set stores session data
+func (s *Store) Set(key string, val []byte, exp time.Duration) error {
+	if err := validKey(key); err != nil {
+		return err
 	}
 
-	return s.writeFile(key, data)
+	return s.records.update(key, func(old *sessionData) (*sessionData, error) {
+		data := &sessionData{
+			Value:     append([]byte(nil), val...),
+			ExpiresAt: time.Now().Add(exp),
+		}
+		// Saving the session must not drop what Touch recorded
+		if old != nil {
+			data.Meta = old.Meta
+		}
+		return data, nil
+	})
 }
 
-// Delete removes session file
-func (s *FileStorage) Delete(key string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	path := s.getPath(key)
-	err := os.Remove(path)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+// Delete removes a session
+func (s *Store) Delete(key string) error {
+	if err := validKey(key); err != nil {
 		return err
 	}
-	return nil
+
+	_, err := s.records.remove(key, func(*sessionData) bool {
+		return true
+	})
+	return err
 }
 
-// Reset removes all session files
-func (s *FileStorage) Reset() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Reset removes all sessions
+func (s *Store) Reset() error {
+	return s.records.reset()
+}
 
-	dir, err := os.ReadDir(s.dir)
+// Close implements Storage.Close and stops the sweeper
+func (s *Store) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.records.close()
+	})
+	return err
+}
+
+// Rewrite passes the data of every live session through fn and stores what
+// it returns, keeping the expiry. fn returns nil to leave a session as it
+// is. It returns how many sessions changed.
+func (s *Store) Rewrite(fn func(key string, val []byte) ([]byte, error)) (int, error) {
+	keys, err := s.records.keys()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	for _, d := range dir {
-		if filepath.Ext(d.Name()) == ".session" {
-			os.Remove(filepath.Join(s.dir, d.Name()))
+	changed := 0
+	for _, key := range keys {
+		rewritten := false
+		err := s.records.update(key, func(old *sessionData) (*sessionData, error) {
+			if old == nil || time.Now().After(old.ExpiresAt) {
+				return nil, nil
+			}
+			val, err := fn(key, old.Value)
+			if err != nil || val == nil {
+				return nil, err
+			}
+			data := *old
+			data.Value = val
+			rewritten = true
+			return &data, nil
+		})
+		if err != nil {
+			return changed, fmt.Errorf("session %s: %v", key, err)
+		}
+		if rewritten {
+			changed++
 		}
 	}
+	return changed, nil
+}
 
-	return nil
+// Touch records that a session was used. The creation time is kept, and
+// an unchanged session is only written once per touchInterval.
+func (s *Store) Touch(key string, seen SessionMeta) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	return s.records.update(key, func(old *sessionData) (*sessionData, error) {
+		if old == nil {
+			return nil, nil
+		}
+		if meta := old.Meta; meta != nil {
+			seen.CreatedAt = meta.CreatedAt
+			if meta.Owner == seen.Owner && meta.IP == seen.IP && meta.UserAgent == seen.UserAgent &&
+				meta.TokenID == seen.TokenID && seen.LastSeen.Sub(meta.LastSeen) < touchInterval {
+				return nil, nil
+			}
+		} else {
+			seen.CreatedAt = seen.LastSeen
+		}
+		data := *old
+		data.Meta = &seen
+		return &data, nil
+	})
 }
 
-// Close implements Storage.Close
-func (s *FileStorage) Close() error {
-	return nil
+// Sessions returns the live sessions of owner, most recently used first
+func (s *Store) Sessions(owner string) ([]SessionMeta, error) {
+	keys, err := s.records.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []SessionMeta
+	for _, key := range keys {
+		data, err := s.records.load(key)
+		if err != nil || !ownedBy(data, owner) || time.Now().After(data.ExpiresAt) {
+			continue
+		}
+		meta := *data.Meta
+		meta.Key = key
+		sessions = append(sessions, meta)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
 }
 
-// Helper methods
+// DeleteOwner removes the sessions of owner whose key is not in keep and
+// returns what they recorded
+func (s *Store) DeleteOwner(owner string, keep ...string) ([]SessionMeta, error) {
+	sessions, err := s.Sessions(owner)
+	if err != nil {
+		return nil, err
+	}
 
-func (s *FileStorage) getPath(key string) string {
-	return filepath.Join(s.dir, key+".session")
+	var deleted []SessionMeta
+	for _, meta := range sessions {
+		if contains(keep, meta.Key) {
+			continue
+		}
+		ok, err := s.records.remove(meta.Key, func(old *sessionData) bool {
+			return ownedBy(old, owner)
+		})
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted = append(deleted, meta)
+		}
+	}
+	return deleted, nil
 }
 
-func (s *FileStorage) readFile(key string) (*sessionData, error) {
-	path := s.getPath(key)
+// Sweep removes expired and unreadable sessions, and whatever else the
+// backend left behind. It returns how many sessions it removed.
+func (s *Store) Sweep() (int, error) {
+	s.records.tidy()
 
-	data, err := os.ReadFile(path)
+	keys, err := s.records.keys()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	var session sessionData
-	if err := json.Unmarshal(data, &session); err != nil {
-		return nil, err
+	now := time.Now()
+	removed := 0
+	for _, key := range keys {
+		// Checked again when removing, since it may have been saved meanwhile
+		ok, err := s.records.remove(key, func(old *sessionData) bool {
+			return old == nil || now.After(old.ExpiresAt)
+		})
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
 	}
+	return removed, nil
+}
+
+// Helper methods
 
-	return &session, nil
+// gc sweeps every gcInterval until the store is closed
+func (s *Store) gc() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			n, err := s.Sweep()
+			if err != nil {
+				log.Printf("Session storage: sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Session storage: removed %d expired sessions", n)
+			}
+		}
+	}
 }
 
-func (s *FileStorage) writeFile(key string, data sessionData) error {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return err
+func ownedBy(data *sessionData, owner string) bool {
+	return data != nil && data.Meta != nil && strings.EqualFold(data.Meta.Owner, owner)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
 	}
+	return false
+}
 
-	return os.WriteFile(s.getPath(key), jsonData, 0644)
+// validKey accepts the characters of session IDs, so a key from a cookie
+// cannot reach outside the session directory
+func validKey(key string) error {
+	if key == "" || len(key) > maxKeyLength {
+		return ErrInvalidKey
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return ErrInvalidKey
+		}
+	}
+	return nil
 }
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var _ fiber.Storage = (*Store)(nil)
+
+// backends opens a fresh store of every backend
+var backends = map[string]func(t *testing.T) *Store{
+	"file": func(t *testing.T) *Store {
+		s, err := NewFileStore(filepath.Join(t.TempDir(), "sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"bolt": func(t *testing.T) *Store {
+		s, err := NewBoltStore(filepath.Join(t.TempDir(), "sessions.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"memory": func(t *testing.T) *Store {
+		return NewMemoryStore()
+	},
+}
+
+// forEachBackend runs test against a fresh store of every backend
+func forEachBackend(t *testing.T, test func(t *testing.T, s *Store)) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			t.Cleanup(func() { s.Close() })
+			test(t, s)
+		})
+	}
+}
+
+func mustSet(t *testing.T, s *Store, key, val string, exp time.Duration) {
+	t.Helper()
+	if err := s.Set(key, []byte(val), exp); err != nil {
+		t.Fatalf("Set(%q): %v", key, err)
+	}
+}
+
+func TestGetSetDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		if val, err := s.Get("missing"); val != nil || err != nil {
+			t.Errorf("Get of a missing session = %q, %v", val, err)
+		}
+
+		mustSet(t, s, "a", "first", time.Hour)
+		mustSet(t, s, "b", "other", time.Hour)
+		mustSet(t, s, "a", "second", time.Hour)
+		if val, err := s.Get("a"); string(val) != "second" || err != nil {
+			t.Errorf("Get(a) = %q, %v; want second", val, err)
+		}
+
+		// The stored value is a copy
+		val := []byte("copied")
+		if err := s.Set("c", val, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		val[0] = 'X'
+		if got, _ := s.Get("c"); string(got) != "copied" {
+			t.Errorf("Get(c) = %q after changing the set slice", got)
+		}
+
+		if err := s.Delete("a"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := s.Delete("a"); err != nil {
+			t.Errorf("Delete of a missing session: %v", err)
+		}
+		if val, _ := s.Get("a"); val != nil {
+			t.Errorf("Get after Delete = %q", val)
+		}
+		if val, _ := s.Get("b"); string(val) != "other" {
+			t.Errorf("Delete removed another session: Get(b) = %q", val)
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		mustSet(t, s, "live", "x", time.Hour)
+		mustSet(t, s, "expired", "x", -time.Second)
+		mustSet(t, s, "short", "x", 50*time.Millisecond)
+
+		if val, _ := s.Get("expired"); val != nil {
+			t.Errorf("Get of an expired session = %q", val)
+		}
+		if val, _ := s.Get("short"); val == nil {
+			t.Error("Get of a session before it expires = nil")
+		}
+		time.Sleep(100 * time.Millisecond)
+		if val, _ := s.Get("short"); val != nil {
+			t.Errorf("Get of a session after it expired = %q", val)
+		}
+
+		// Saving an expired session brings it back
+		mustSet(t, s, "expired", "again", time.Hour)
+		if val, _ := s.Get("expired"); string(val) != "again" {
+			t.Errorf("Get of a session saved again = %q", val)
+		}
+
+		if n, err := s.Sweep(); n != 1 || err != nil {
+			t.Errorf("Sweep = %d, %v; want 1 removed", n, err)
+		}
+		if val, _ := s.Get("live"); val == nil {
+			t.Error("Sweep removed a live session")
+		}
+	})
+}
+
+func TestReset(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		for i := 0; i < 5; i++ {
+			mustSet(t, s, fmt.Sprintf("key%d", i), "x", time.Hour)
+		}
+		if err := s.Reset(); err != nil {
+			t.Fatalf("Reset: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if val, _ := s.Get(fmt.Sprintf("key%d", i)); val != nil {
+				t.Errorf("key%d kept by Reset", i)
+			}
+		}
+
+		mustSet(t, s, "after", "x", time.Hour)
+		if val, _ := s.Get("after"); val == nil {
+			t.Error("Set after Reset did not store")
+		}
+	})
+}
+
+func TestKeyValidation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		for _, key := range []string{"", "../x", "a/b", `a\b`, "a.b", "a b", "a\x00", string(make([]byte, maxKeyLength+1))} {
+			if err := s.Set(key, []byte("x"), time.Hour); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Set(%q) = %v, want ErrInvalidKey", key, err)
+			}
+			if val, err := s.Get(key); val != nil || err != nil {
+				t.Errorf("Get(%q) = %q, %v; want nothing", key, val, err)
+			}
+			if err := s.Delete(key); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Delete(%q) = %v, want ErrInvalidKey", key, err)
+			}
+		}
+
+		// Fiber's session IDs are UUIDs
+		for _, key := range []string{"0b6f3c1e-7a52-4d7e-9a43-2f8d61c0e5b4", "A_z-9", strings.Repeat("k", maxKeyLength)} {
+			if err := s.Set(key, []byte("x"), time.Hour); err != nil {
+				t.Errorf("Set(%q): %v", key, err)
+			}
+		}
+	})
+}
+
+func TestSessionsOfOwner(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		now := time.Now()
+		mustSet(t, s, "laptop", "x", time.Hour)
+		mustSet(t, s, "phone", "x", time.Hour)
+		mustSet(t, s, "other", "x", time.Hour)
+		s.Touch("laptop", SessionMeta{Owner: "User@example.com", LastSeen: now, TokenID: "t1"})
+		s.Touch("phone", SessionMeta{Owner: "user@example.com", LastSeen: now.Add(time.Second)})
+		s.Touch("other", SessionMeta{Owner: "other@example.com", LastSeen: now})
+
+		// Touch does not create sessions, and Set keeps what it recorded
+		if err := s.Touch("missing", SessionMeta{Owner: "user@example.com"}); err != nil {
+			t.Errorf("Touch of a missing session: %v", err)
+		}
+		mustSet(t, s, "laptop", "saved", time.Hour)
+
+		sessions, err := s.Sessions("user@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 2 || sessions[0].Key != "phone" || sessions[1].Key != "laptop" || sessions[1].TokenID != "t1" {
+			t.Errorf("Sessions = %+v, want phone, then laptop with its token", sessions)
+		}
+
+		deleted, err := s.DeleteOwner("user@example.com", "phone")
+		if err != nil || len(deleted) != 1 || deleted[0].Key != "laptop" {
+			t.Errorf("DeleteOwner = %+v, %v; want laptop", deleted, err)
+		}
+		for key, want := range map[string]bool{"laptop": false, "phone": true, "other": true} {
+			if val, _ := s.Get(key); (val != nil) != want {
+				t.Errorf("after DeleteOwner, %s present = %v", key, val != nil)
+			}
+		}
+	})
+}
+
+func TestRewrite(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		mustSet(t, s, "a", "old", time.Hour)
+		mustSet(t, s, "b", "kept", time.Hour)
+		mustSet(t, s, "expired", "old", -time.Second)
+
+		n, err := s.Rewrite(func(key string, val []byte) ([]byte, error) {
+			if string(val) != "old" {
+				return nil, nil
+			}
+			return []byte("new"), nil
+		})
+		if n != 1 || err != nil {
+			t.Errorf("Rewrite = %d, %v; want 1 changed", n, err)
+		}
+		if val, _ := s.Get("a"); string(val) != "new" {
+			t.Errorf("Get(a) = %q after Rewrite", val)
+		}
+		if val, _ := s.Get("b"); string(val) != "kept" {
+			t.Errorf("Get(b) = %q after Rewrite", val)
+		}
+	})
+}
+
+func TestConcurrentUse(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					key := fmt.Sprintf("k%d", j%4)
+					if err := s.Set(key, []byte("x"), time.Hour); err != nil {
+						t.Errorf("Set: %v", err)
+					}
+					if _, err := s.Get(key); err != nil {
+						t.Errorf("Get: %v", err)
+					}
+					s.Touch(key, SessionMeta{Owner: "user@example.com", LastSeen: time.Now(), IP: strconv.Itoa(i)})
+					if j%7 == 0 {
+						s.Delete(key)
+					}
+					if j%20 == 0 {
+						s.Sweep()
+						s.Sessions("user@example.com")
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+func TestCloseTwice(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Store) {
+		if err := s.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("second Close: %v", err)
+		}
+	})
+}
+
+func TestFileStoresShareDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	var replicas []*Store
+	for i := 0; i < 2; i++ {
+		s, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		replicas = append(replicas, s)
+	}
+	a, b := replicas[0], replicas[1]
+
+	// Sessions saved by one replica are seen by the other
+	mustSet(t, a, "shared", "from a", time.Hour)
+	if val, _ := b.Get("shared"); string(val) != "from a" {
+		t.Errorf("Get on the other replica = %q", val)
+	}
+	if err := b.Delete("shared"); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := a.Get("shared"); val != nil {
+		t.Errorf("session deleted by the other replica = %q", val)
+	}
+
+	// Changes through both replicas at once are all kept
+	mustSet(t, a, "counter", "0", time.Hour)
+	var wg sync.WaitGroup
+	for _, s := range []*Store{a, b, a, b} {
+		wg.Add(1)
+		go func(s *Store) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				err := s.records.update("counter", func(old *sessionData) (*sessionData, error) {
+					n, _ := strconv.Atoi(string(old.Value))
+					data := *old
+					data.Value = []byte(strconv.Itoa(n + 1))
+					return &data, nil
+				})
+				if err != nil {
+					t.Errorf("update: %v", err)
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+	if val, _ := b.Get("counter"); string(val) != "200" {
+		t.Errorf("counter = %s after 200 increments through two replicas", val)
+	}
+}
+
+func TestBoltDatabaseInUse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the database lock to time out")
+	}
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := NewBoltStore(path); !errors.Is(err, ErrDatabaseInUse) {
+		t.Errorf("opening the database twice = %v, want ErrDatabaseInUse", err)
+	}
+}
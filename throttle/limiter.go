@@ -0,0 +1,349 @@
+// Package throttle slows down password guessing at the login form. Failed
+// logins are counted per client address and per account; each failure
+// doubles the wait before the next attempt, and too many failures lock the
+// address or account out for a while. Attempts still waiting for the mail
+// server count too, so parallel guesses cannot slip past the limits. The
+// counters are kept in a file so a restart does not reset them.
+package throttle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/config"
+	"lilmail/utils"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// attemptTimeout is how long an attempt counts as in flight when it is never
+// settled, such as when its handler panicked
+const attemptTimeout = 2 * time.Minute
+
+// entry counts the recent failures of one address or account
+type entry struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+}
+
+// Limiter decides whether a login attempt may reach the mail server
+type Limiter struct {
+	path     string
+	config   config.LoginConfig
+	allowed  []*net.IPNet
+	entries  map[string]*entry
+	inflight map[string]map[*Attempt]bool // Attempts Check let through, by key
+	mu       sync.Mutex
+}
+
+// Attempt is a login attempt that Check let through. Until Fail, Succeed or
+// Release settles it, it counts against its address and account, so
+// concurrent attempts cannot all pass a check that each alone would pass.
+type Attempt struct {
+	limiter     *Limiter
+	ip, account string
+	started     time.Time
+	settled     bool
+}
+
+// limit is the counting of one address or account
+type limit struct {
+	key, name string
+	max       int
+	serial    bool // One attempt at a time once it has failed before
+}
+
+// NewLimiter loads the counters stored at path
+func NewLimiter(path string, cfg config.LoginConfig) (*Limiter, error) {
+	l := &Limiter{
+		path:     path,
+		config:   cfg,
+		entries:  make(map[string]*entry),
+		inflight: make(map[string]map[*Attempt]bool),
+	}
+
+	for _, item := range cfg.AllowList {
+		network, err := parseNetwork(item)
+		if err != nil {
+			return nil, err
+		}
+		l.allowed = append(l.allowed, network)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read login attempts: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &l.entries); err != nil {
+			log.Printf("Login throttle: discarding unreadable %s: %v", path, err)
+			l.entries = make(map[string]*entry)
+		}
+	}
+	return l, nil
+}
+
+// Check returns how long the client at ip has to wait before trying to log
+// in to account. When it may go ahead, the returned attempt holds its place
+// among the attempts in flight until it is settled.
+func (l *Limiter) Check(ip, account string) (*Attempt, time.Duration) {
+	attempt := &Attempt{limiter: l, ip: ip, account: account, started: time.Now()}
+	if l.isAllowed(ip) {
+		attempt.settled = true
+		return attempt, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	for _, lim := range l.limits(ip, account) {
+		if d := l.wait(l.entries[lim.key], attempt.started); d > wait {
+			wait = d
+		}
+		if d := l.busy(lim, attempt.started); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return nil, wait
+	}
+
+	for _, lim := range l.limits(ip, account) {
+		if l.inflight[lim.key] == nil {
+			l.inflight[lim.key] = make(map[*Attempt]bool)
+		}
+		l.inflight[lim.key][attempt] = true
+	}
+	return attempt, 0
+}
+
+// Fail records a rejected password or code. It locks the address or
+// account when it reaches its limit.
+func (a *Attempt) Fail() {
+	if a.limiter.isAllowed(a.ip) {
+		log.Printf("Login throttle: failed login for %s from allow-listed %s", a.account, a.ip)
+		return
+	}
+
+	l := a.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a.release()
+	now := time.Now()
+	l.prune(now)
+
+	for _, lim := range l.limits(a.ip, a.account) {
+		e := l.entries[lim.key]
+		if e == nil {
+			e = &entry{}
+			l.entries[lim.key] = e
+		}
+		e.Failures++
+		e.LastFailure = now
+		if lim.max > 0 && e.Failures >= lim.max && !now.Before(e.LockedUntil) {
+			e.LockedUntil = now.Add(l.lockout())
+			log.Printf("Login throttle: locked %s for %v after %d failed logins", lim.name, l.lockout(), e.Failures)
+		}
+	}
+	log.Printf("Login throttle: failed login for %s from %s", a.account, a.ip)
+
+	l.save()
+}
+
+// Succeed clears the failures of the account, as Limiter.Succeed does
+func (a *Attempt) Succeed() {
+	a.limiter.mu.Lock()
+	a.release()
+	a.limiter.mu.Unlock()
+
+	a.limiter.Succeed(a.ip, a.account)
+}
+
+// Release settles an attempt that neither failed nor succeeded, such as one
+// the mail server could not answer. It does nothing once the attempt is
+// settled, so it may be deferred.
+func (a *Attempt) Release() {
+	a.limiter.mu.Lock()
+	defer a.limiter.mu.Unlock()
+	a.release()
+}
+
+// Succeed clears the failures of an account after a correct password. The
+// address keeps its count, so logging in to one's own account does not
+// reset guessing at others.
+func (l *Limiter) Succeed(ip, account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.entries[accountKey(account)]; !ok {
+		return
+	}
+	delete(l.entries, accountKey(account))
+	l.save()
+}
+
+// Helper methods
+
+// release stops counting the attempt as in flight; the caller holds the
+// limiter's lock
+func (a *Attempt) release() {
+	if a.settled {
+		return
+	}
+	a.settled = true
+	for _, lim := range a.limiter.limits(a.ip, a.account) {
+		delete(a.limiter.inflight[lim.key], a)
+		if len(a.limiter.inflight[lim.key]) == 0 {
+			delete(a.limiter.inflight, lim.key)
+		}
+	}
+}
+
+func (l *Limiter) limits(ip, account string) []limit {
+	return []limit{
+		{ipKey(ip), "address " + ip, l.config.MaxAttemptsPerIP, false},
+		{accountKey(account), "account " + account, l.config.MaxAttemptsPerAccount, true},
+	}
+}
+
+// busy returns how long to wait for the attempts in flight at a key: until
+// they are settled when they could use up what is left of its limit, or
+// for a key that serialises attempts once it has failed before, so each
+// guess waits out the backoff of the one before
+func (l *Limiter) busy(lim limit, now time.Time) time.Duration {
+	pending := 0
+	for attempt := range l.inflight[lim.key] {
+		if now.Sub(attempt.started) > attemptTimeout {
+			delete(l.inflight[lim.key], attempt)
+			continue
+		}
+		pending++
+	}
+	if pending == 0 {
+		return 0
+	}
+
+	failures := 0
+	if e := l.entries[lim.key]; e != nil {
+		failures = e.Failures
+	}
+	if (lim.serial && failures > 0) || (lim.max > 0 && failures+pending >= lim.max) {
+		return l.retryDelay()
+	}
+	return 0
+}
+
+// wait returns the remaining lockout, or the exponential backoff since the
+// last failure: one base delay after the first, doubling with each further
+// failure up to the lockout length
+func (l *Limiter) wait(e *entry, now time.Time) time.Duration {
+	if e == nil {
+		return 0
+	}
+	if now.Before(e.LockedUntil) {
+		return e.LockedUntil.Sub(now)
+	}
+
+	delay := time.Duration(l.config.BaseDelay) * time.Second
+	for i := 1; i < e.Failures && delay < l.lockout(); i++ {
+		delay *= 2
+	}
+	if delay > l.lockout() {
+		delay = l.lockout()
+	}
+	if next := e.LastFailure.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// prune forgets failures older than the counting window
+func (l *Limiter) prune(now time.Time) {
+	window := time.Duration(l.config.Window) * time.Second
+	for key, e := range l.entries {
+		if now.Sub(e.LastFailure) > window && !now.Before(e.LockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// retryDelay is the wait for attempts in flight, at least a second
+func (l *Limiter) retryDelay() time.Duration {
+	if l.config.BaseDelay <= 0 {
+		return time.Second
+	}
+	return time.Duration(l.config.BaseDelay) * time.Second
+}
+
+func (l *Limiter) lockout() time.Duration {
+	return time.Duration(l.config.LockoutSeconds) * time.Second
+}
+
+func (l *Limiter) isAllowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range l.allowed {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Limiter) save() {
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err == nil {
+		err = utils.WriteFileAtomic(l.path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Login throttle: error saving %s: %v", l.path, err)
+	}
+}
+
+// parseNetwork accepts a single address or a CIDR range
+func parseNetwork(item string) (*net.IPNet, error) {
+	item = strings.TrimSpace(item)
+	if !strings.Contains(item, "/") {
+		addr := net.ParseIP(item)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid allow-list entry %q", item)
+		}
+		bits := 32
+		if addr.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(item)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow-list entry %q", item)
+	}
+	return network, nil
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// accountKey hashes the address, so the file does not list the accounts
+// that were tried
+func accountKey(account string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(account))))
+	return "account:" + hex.EncodeToString(sum[:])
+}
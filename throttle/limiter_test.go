@@ -0,0 +1,147 @@
+package throttle
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"lilmail/config"
+)
+
+func newTestLimiter(t *testing.T) *Limiter {
+	t.Helper()
+	l, err := NewLimiter(filepath.Join(t.TempDir(), "login-attempts.json"), config.LoginConfig{
+		MaxAttemptsPerIP:      20,
+		MaxAttemptsPerAccount: 5,
+		BaseDelay:             1,
+		LockoutSeconds:        900,
+		Window:                3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// checkConcurrently runs n checks at once and returns the attempts let through
+func checkConcurrently(l *Limiter, n int, ip func(i int) string, account string) []*Attempt {
+	var mu sync.Mutex
+	var passed []*Attempt
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if attempt, wait := l.Check(ip(i), account); wait == 0 {
+				mu.Lock()
+				passed = append(passed, attempt)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return passed
+}
+
+func TestConcurrentAttemptsStayWithinLimit(t *testing.T) {
+	l := newTestLimiter(t)
+	ip := func(i int) string { return fmt.Sprintf("192.0.2.%d", i%10) }
+
+	// Before any failure, attempts may run in parallel, but no more than
+	// the failures that lock the account
+	passed := checkConcurrently(l, 50, ip, "user@example.com")
+	if len(passed) != 5 {
+		t.Fatalf("%d concurrent attempts passed, want 5", len(passed))
+	}
+	for _, attempt := range passed {
+		attempt.Fail()
+	}
+
+	if _, wait := l.Check("192.0.2.99", "user@example.com"); wait < 10*time.Minute {
+		t.Errorf("wait after 5 failures = %v, want the lockout", wait)
+	}
+}
+
+func TestFailedAccountAttemptsOneAtATime(t *testing.T) {
+	l := newTestLimiter(t)
+	first, _ := l.Check("192.0.2.1", "user@example.com")
+	first.Fail()
+
+	// Once the account failed, a second guess waits for the one in flight
+	l.entries[accountKey("user@example.com")].LastFailure = time.Now().Add(-time.Hour)
+	l.entries[ipKey("192.0.2.1")].LastFailure = time.Now().Add(-time.Hour)
+	attempt, wait := l.Check("192.0.2.1", "user@example.com")
+	if wait != 0 {
+		t.Fatalf("wait after the backoff = %v, want 0", wait)
+	}
+	if _, wait := l.Check("192.0.2.2", "user@example.com"); wait == 0 {
+		t.Error("second attempt at a failed account passed while one is in flight")
+	}
+
+	attempt.Release()
+	next, wait := l.Check("192.0.2.2", "user@example.com")
+	if wait != 0 {
+		t.Errorf("wait after the attempt was released = %v, want 0", wait)
+	}
+	next.Succeed()
+	if _, ok := l.entries[accountKey("user@example.com")]; ok {
+		t.Error("Succeed kept the account's failures")
+	}
+}
+
+func TestAttemptSettledOnce(t *testing.T) {
+	l := newTestLimiter(t)
+	attempt, _ := l.Check("192.0.2.1", "user@example.com")
+	attempt.Fail()
+	attempt.Release()
+
+	if n := len(l.inflight); n != 0 {
+		t.Errorf("%d keys still in flight after settling", n)
+	}
+	if got := l.entries[ipKey("192.0.2.1")].Failures; got != 1 {
+		t.Errorf("address failures = %d, want 1", got)
+	}
+}
+
+func TestAbandonedAttemptsExpire(t *testing.T) {
+	l := newTestLimiter(t)
+	for i := 0; i < 4; i++ {
+		attempt, wait := l.Check("192.0.2.1", "user@example.com")
+		if wait != 0 {
+			t.Fatalf("attempt %d waits %v", i, wait)
+		}
+		attempt.started = time.Now().Add(-2 * attemptTimeout)
+	}
+
+	if _, wait := l.Check("192.0.2.1", "user@example.com"); wait != 0 {
+		t.Errorf("wait with only abandoned attempts in flight = %v, want 0", wait)
+	}
+}
+
+func TestAllowListedAttemptsUncounted(t *testing.T) {
+	l := newTestLimiter(t)
+	l.allowed = append(l.allowed, mustNetwork(t, "192.0.2.0/24"))
+
+	for i := 0; i < 10; i++ {
+		attempt, wait := l.Check("192.0.2.1", "user@example.com")
+		if wait != 0 {
+			t.Fatalf("allow-listed attempt %d waits %v", i, wait)
+		}
+		attempt.Fail()
+	}
+	if len(l.entries) != 0 || len(l.inflight) != 0 {
+		t.Errorf("allow-listed attempts were counted: %v, %v", l.entries, l.inflight)
+	}
+}
+
+func mustNetwork(t *testing.T, item string) *net.IPNet {
+	t.Helper()
+	network, err := parseNetwork(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
@@ -0,0 +1,332 @@
+package twofactor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lilmail/keyring"
+	"lilmail/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recoveryCount is the number of recovery codes handed out at a time
+const recoveryCount = 10
+
+// ErrNotPending is returned when enrolment is confirmed without being
+// started
+var ErrNotPending = errors.New("two-factor setup was not started")
+
+// ErrEnabled is returned when enrolment is started for an account that
+// already has two-factor login; it has to be turned off first
+var ErrEnabled = errors.New("two-factor login is already on")
+
+// ErrInvalidCode is returned for wrong, expired or reused codes
+var ErrInvalidCode = errors.New("invalid verification code")
+
+// Account is the two-factor state of one user. Secrets are encrypted with
+// the configured encryption key; recovery codes are only kept as hashes.
+type Account struct {
+	Owner         string    `json:"owner"`
+	Enabled       bool      `json:"enabled"`
+	Secret        string    `json:"secret,omitempty"`
+	Pending       string    `json:"pending,omitempty"` // Secret being enrolled, not yet confirmed
+	RecoveryCodes []string  `json:"recoveryCodes,omitempty"`
+	LastStep      int64     `json:"lastStep,omitempty"` // Time step of the last accepted code
+	EnabledAt     time.Time `json:"enabledAt,omitempty"`
+}
+
+// Status is what the settings page shows about an account
+type Status struct {
+	Enabled       bool      `json:"enabled"`
+	EnabledAt     time.Time `json:"enabledAt,omitempty"`
+	RecoveryCodes int       `json:"recoveryCodes"` // Unused codes left
+}
+
+// Store keeps the two-factor state of each user in a JSON file named after
+// a hash of the login address
+type Store struct {
+	dir    string
+	keys   *keyring.Keyring
+	issuer string
+	mu     sync.Mutex
+}
+
+// NewStore opens (or creates) the two-factor directory. Secrets are
+// encrypted with keys; issuer names the app in authenticators.
+func NewStore(directory string, keys *keyring.Keyring, issuer string) (*Store, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create two-factor directory: %v", err)
+	}
+	return &Store{dir: directory, keys: keys, issuer: issuer}, nil
+}
+
+// Enabled reports whether owner has to enter a code at login
+func (s *Store) Enabled(owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.read(owner)
+	if err != nil {
+		return false, err
+	}
+	return account.Enabled, nil
+}
+
+// Status describes the two-factor setup of owner
+func (s *Store) Status(owner string) (*Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.read(owner)
+	if err != nil {
+		return nil, err
+	}
+	return &Status{
+		Enabled:       account.Enabled,
+		EnabledAt:     account.EnabledAt,
+		RecoveryCodes: len(account.RecoveryCodes),
+	}, nil
+}
+
+// Begin starts enrolment with a new secret and returns it along with its
+// provisioning URI. Two-factor login only starts with Confirm.
+func (s *Store) Begin(owner string) (secret, uri string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.read(owner)
+	if err != nil {
+		return "", "", err
+	}
+	if account.Enabled {
+		return "", "", ErrEnabled
+	}
+
+	secret, err = GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if account.Pending, err = s.keys.Encrypt([]byte(secret)); err != nil {
+		return "", "", err
+	}
+	if err := s.write(account); err != nil {
+		return "", "", err
+	}
+	return secret, ProvisioningURI(secret, s.issuer, owner), nil
+}
+
+// Confirm finishes enrolment once the user typed a code from the new
+// secret, and returns the recovery codes to show them once
+func (s *Store) Confirm(owner, input string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.read(owner)
+	if err != nil {
+		return nil, err
+	}
+	if account.Pending == "" {
+		return nil, ErrNotPending
+	}
+
+	secret, err := s.keys.Decrypt(account.Pending)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := verify(string(secret), input, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	account.Enabled = true
+	account.Secret = account.Pending
+	account.Pending = ""
+	account.RecoveryCodes = hashes
+	account.LastStep = step
+	account.EnabledAt = time.Now()
+	if err := s.write(account); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks a login code: the current authenticator code, or an
+// unused recovery code, which is then used up
+func (s *Store) Verify(owner, input string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.read(owner)
+	if err != nil {
+		return err
+	}
+	if !account.Enabled {
+		return ErrInvalidCode
+	}
+
+	secret, err := s.keys.Decrypt(account.Secret)
+	if err != nil {
+		return err
+	}
+	if step, ok := verify(string(secret), input, time.Now()); ok {
+		// Each code works once, so a code seen over a shoulder is useless
+		if step <= account.LastStep {
+			return ErrInvalidCode
+		}
+		account.LastStep = step
+		return s.write(account)
+	}
+
+	hash := hashRecoveryCode(input)
+	for i, stored := range account.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			account.RecoveryCodes = append(account.RecoveryCodes[:i], account.RecoveryCodes[i+1:]...)
+			return s.write(account)
+		}
+	}
+	return ErrInvalidCode
+}
+
+// RegenerateRecovery replaces the recovery codes of an enabled account
+func (s *Store) RegenerateRecovery(owner string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.read(owner)
+	if err != nil {
+		return nil, err
+	}
+	if !account.Enabled {
+		return nil, ErrNotPending
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	account.RecoveryCodes = hashes
+	if err := s.write(account); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable turns two-factor login off and forgets the secret
+func (s *Store) Disable(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.path(owner))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Rekey re-encrypts the stored secrets with the primary key and returns
+// how many accounts changed
+func (s *Store) Rekey() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return changed, err
+		}
+		var account Account
+		if err := json.Unmarshal(data, &account); err != nil {
+			return changed, fmt.Errorf("corrupt two-factor file %s: %v", entry.Name(), err)
+		}
+
+		secret, pending := account.Secret, account.Pending
+		for _, field := range []*string{&account.Secret, &account.Pending} {
+			if *field == "" {
+				continue
+			}
+			if *field, err = s.keys.Rekey(*field); err != nil {
+				return changed, fmt.Errorf("two-factor secret of %s: %v", account.Owner, err)
+			}
+		}
+		if account.Secret == secret && account.Pending == pending {
+			continue
+		}
+		if err := s.write(&account); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Helper methods
+
+func (s *Store) path(owner string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(owner)))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *Store) read(owner string) (*Account, error) {
+	account := &Account{Owner: owner}
+	data, err := os.ReadFile(s.path(owner))
+	if errors.Is(err, os.ErrNotExist) {
+		return account, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, fmt.Errorf("corrupt two-factor file for %s: %v", owner, err)
+	}
+	return account, nil
+}
+
+func (s *Store) write(account *Account) error {
+	data, err := json.MarshalIndent(account, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path(account.Owner), data, 0600)
+}
+
+// newRecoveryCodes returns codes in the form xxxxx-xxxxx and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCount)
+	hashes := make([]string, recoveryCount)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, fmt.Errorf("failed to create recovery code: %v", err)
+		}
+		raw := strings.ToLower(hex.EncodeToString(buf))
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(input string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(normalize(input))))
+	return hex.EncodeToString(sum[:])
+}
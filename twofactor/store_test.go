@@ -0,0 +1,167 @@
+package twofactor
+
+import (
+	"errors"
+	"lilmail/keyring"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	keys, err := keyring.New([]keyring.Spec{{ID: "test", Passphrase: "test passphrase"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(filepath.Join(t.TempDir(), "twofactor"), keys, "LilMail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// enable enrols owner and returns the secret and recovery codes
+func enable(t *testing.T, s *Store, owner string) (string, []string) {
+	t.Helper()
+	secret, _, err := s.Begin(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, _ := Code(secret, time.Now())
+	codes, err := s.Confirm(owner, input)
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	return secret, codes
+}
+
+func TestEnrolment(t *testing.T) {
+	s := newTestStore(t)
+	const owner = "user@example.com"
+
+	if _, err := s.Confirm(owner, "123456"); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Confirm without Begin = %v, want ErrNotPending", err)
+	}
+	if _, _, err := s.Begin(owner); err != nil {
+		t.Fatal(err)
+	}
+	if on, _ := s.Enabled(owner); on {
+		t.Error("enabled before Confirm")
+	}
+	if _, err := s.Confirm(owner, "000000x"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Confirm with a wrong code = %v, want ErrInvalidCode", err)
+	}
+
+	secret, codes := enable(t, s, owner)
+	if on, _ := s.Enabled(owner); !on {
+		t.Error("not enabled after Confirm")
+	}
+	if len(codes) != recoveryCount {
+		t.Errorf("%d recovery codes, want %d", len(codes), recoveryCount)
+	}
+	if _, _, err := s.Begin(owner); !errors.Is(err, ErrEnabled) {
+		t.Errorf("Begin when enabled = %v, want ErrEnabled", err)
+	}
+
+	// Neither the secret nor the recovery codes are stored in the clear
+	data, err := os.ReadFile(s.path(owner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range append([]string{secret}, codes...) {
+		if strings.Contains(string(data), plain) {
+			t.Errorf("stored file contains %s", plain)
+		}
+	}
+
+	if err := s.Disable(owner); err != nil {
+		t.Fatal(err)
+	}
+	if on, _ := s.Enabled(owner); on {
+		t.Error("enabled after Disable")
+	}
+}
+
+func TestVerifyRefusesReplay(t *testing.T) {
+	s := newTestStore(t)
+	const owner = "user@example.com"
+	secret, _ := enable(t, s, owner)
+
+	// The code used to confirm enrolment cannot log in
+	now := time.Now()
+	current, _ := Code(secret, now)
+	if err := s.Verify(owner, current); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Verify with the code that confirmed enrolment = %v, want ErrInvalidCode", err)
+	}
+
+	// The next code works once, and then neither it nor older ones do
+	next, _ := Code(secret, now.Add(period*time.Second))
+	if err := s.Verify(owner, next); err != nil {
+		t.Fatalf("Verify with the next code: %v", err)
+	}
+	if err := s.Verify(owner, next); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("replayed code = %v, want ErrInvalidCode", err)
+	}
+	if err := s.Verify(owner, current); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("code older than the last one used = %v, want ErrInvalidCode", err)
+	}
+
+	account, err := s.read(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.LastStep != counter(now)+1 {
+		t.Errorf("LastStep = %d, want %d", account.LastStep, counter(now)+1)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	s := newTestStore(t)
+	const owner = "user@example.com"
+	_, codes := enable(t, s, owner)
+
+	if err := s.Verify(owner, codes[0]); err != nil {
+		t.Fatalf("Verify with a recovery code: %v", err)
+	}
+	if err := s.Verify(owner, codes[0]); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("recovery code used twice = %v, want ErrInvalidCode", err)
+	}
+
+	// Typed in upper case or without the dash
+	if err := s.Verify(owner, strings.ToUpper(codes[1])); err != nil {
+		t.Errorf("Verify with an upper-case recovery code: %v", err)
+	}
+	if err := s.Verify(owner, strings.ReplaceAll(codes[2], "-", "")); err != nil {
+		t.Errorf("Verify with a recovery code without its dash: %v", err)
+	}
+
+	status, err := s.Status(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RecoveryCodes != recoveryCount-3 {
+		t.Errorf("%d recovery codes left, want %d", status.RecoveryCodes, recoveryCount-3)
+	}
+
+	// New codes replace all the old ones
+	fresh, err := s.RegenerateRecovery(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(owner, codes[3]); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("replaced recovery code = %v, want ErrInvalidCode", err)
+	}
+	if err := s.Verify(owner, fresh[0]); err != nil {
+		t.Errorf("Verify with a new recovery code: %v", err)
+	}
+}
+
+func TestVerifyWhenDisabled(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.Verify("user@example.com", "123456"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Verify without two-factor login = %v, want ErrInvalidCode", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Package twofactor adds an optional second login step with time-based
+// one-time passwords (RFC 6238), as shown by authenticator apps, and
+// single-use recovery codes for when the phone is lost.
+package twofactor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters understood by all common authenticator apps
+const (
+	period    = 30 // Seconds per code
+	digits    = 6
+	secretLen = 20 // Bytes, the size of an HMAC-SHA1 key
+	skew      = 1  // Codes accepted before and after the current one
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret in base32
+func GenerateSecret() (string, error) {
+	buf := make([]byte, secretLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to create secret: %v", err)
+	}
+	return encoding.EncodeToString(buf), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI shown as a QR code during
+// enrolment
+func ProvisioningURI(secret, issuer, account string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(digits))
+	values.Set("period", fmt.Sprint(period))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// Code returns the code of secret at time t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, counter(t)), nil
+}
+
+// verify checks a code against the current time step and its neighbours.
+// It returns the matching time step so it can be refused when replayed.
+func verify(secret, input string, now time.Time) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	input = normalize(input)
+	if len(input) != digits {
+		return 0, false
+	}
+
+	current := counter(now)
+	for step := current - skew; step <= current+skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, step)), []byte(input)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// code computes the HOTP value (RFC 4226) for a counter
+func code(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
+
+func counter(t time.Time) int64 {
+	return t.Unix() / period
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret: %v", err)
+	}
+	return key, nil
+}
+
+// normalize drops the spaces and dashes people type into codes
+func normalize(input string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(input))
+}
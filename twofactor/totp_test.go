@@ -0,0 +1,78 @@
+package twofactor
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of the RFC 6238 test vectors
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	// The last six digits of the eight-digit codes in RFC 6238, appendix B
+	for _, tt := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	// Lower case and padding, as people copy secrets
+	if got, _ := Code(strings.ToLower(rfcSecret)+"====", time.Unix(59, 0)); got != "287082" {
+		t.Errorf("Code of a lower-case padded secret = %s", got)
+	}
+	if _, err := Code("not base32!", time.Now()); err == nil {
+		t.Error("Code of an invalid secret succeeded")
+	}
+}
+
+func TestVerifySkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := counter(now)
+
+	for offset, ok := range map[int64]bool{-2: false, -1: true, 0: true, 1: true, 2: false} {
+		input, _ := Code(rfcSecret, now.Add(time.Duration(offset*period)*time.Second))
+		step, got := verify(rfcSecret, input, now)
+		if got != ok {
+			t.Errorf("code %d steps away accepted = %v, want %v", offset, got, ok)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code %d steps away matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	for _, input := range []string{"050 471", "050-471", " 050471 "} {
+		if _, ok := verify(rfcSecret, input, now); !ok {
+			t.Errorf("verify(%q) refused a code with separators", input)
+		}
+	}
+	for _, input := range []string{"", "05047", "0504711", "abcdef"} {
+		if _, ok := verify(rfcSecret, input, now); ok {
+			t.Errorf("verify(%q) accepted", input)
+		}
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("JBSWY3DPEHPK3PXP", "LilMail", "user@example.com")
+	for _, part := range []string{"otpauth://totp/LilMail:user@example.com?", "secret=JBSWY3DPEHPK3PXP", "issuer=LilMail", "digits=6", "period=30"} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("ProvisioningURI = %s, missing %s", uri, part)
+		}
+	}
+}
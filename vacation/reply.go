@@ -0,0 +1,97 @@
+package vacation
+
+import (
+	"lilmail/handlers/api"
+	"net/mail"
+	"strings"
+)
+
+// automatedSenders are local parts of addresses that never get a reply
+var automatedSenders = []string{
+	"mailer-daemon", "postmaster", "noreply", "no-reply", "donotreply",
+	"do-not-reply", "listserv", "majordomo", "bounce", "bounces",
+}
+
+// replyTarget returns the address to answer, or false when the message
+// must not get an automatic reply: it was sent by a machine or a mailing
+// list, is itself automatic, or was not addressed to the user directly
+// (RFC 3834, section 2)
+func replyTarget(msg *api.MessageSummary, own []string) (string, bool) {
+	sender := strings.ToLower(strings.TrimSpace(msg.From))
+	if sender == "" || !strings.Contains(sender, "@") {
+		return "", false
+	}
+
+	if strings.TrimSpace(msg.HeaderValue("Return-Path")) == "<>" {
+		return "", false
+	}
+	if auto := strings.ToLower(strings.TrimSpace(msg.HeaderValue("Auto-Submitted"))); auto != "" && auto != "no" {
+		return "", false
+	}
+	switch strings.ToLower(strings.TrimSpace(msg.HeaderValue("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "", false
+	}
+	for _, name := range []string{"List-Id", "List-Unsubscribe", "List-Post", "X-Loop"} {
+		if len(msg.Header.Values(name)) > 0 {
+			return "", false
+		}
+	}
+	if suppress := strings.ToLower(msg.HeaderValue("X-Auto-Response-Suppress")); strings.Contains(suppress, "oof") || strings.Contains(suppress, "all") {
+		return "", false
+	}
+
+	local := sender[:strings.LastIndex(sender, "@")]
+	for _, name := range automatedSenders {
+		if local == name {
+			return "", false
+		}
+	}
+	if strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return "", false
+	}
+
+	// Only answer mail sent to the user, not to a list or as a blind copy
+	addressed := false
+	for _, addr := range own {
+		if strings.EqualFold(addr, sender) {
+			return "", false
+		}
+		for _, rcpt := range append(append([]string{}, msg.To...), msg.Cc...) {
+			if strings.EqualFold(addr, rcpt) {
+				addressed = true
+			}
+		}
+	}
+	if !addressed {
+		return "", false
+	}
+
+	return sender, true
+}
+
+// newReply builds the automatic reply to msg. The Auto-Submitted header
+// keeps other responders from answering it in turn.
+func newReply(msg *api.MessageSummary, settings Settings, to string) *api.OutgoingMessage {
+	subject := settings.Subject
+	if subject == "" {
+		subject = "Auto: " + msg.Subject
+	}
+
+	out := &api.OutgoingMessage{
+		To:      []*mail.Address{{Address: to}},
+		Subject: subject,
+		Body:    settings.Body,
+		Headers: map[string]string{
+			"Auto-Submitted":           "auto-replied",
+			"X-Auto-Response-Suppress": "All",
+			"X-Mailer":                 "LilMail",
+		},
+	}
+
+	if id := strings.TrimSpace(msg.HeaderValue("Message-Id")); id != "" {
+		out.InReplyTo = id
+		out.References = strings.TrimSpace(strings.Join(strings.Fields(msg.HeaderValue("References")), " ") + " " + id)
+	}
+	return out
+}
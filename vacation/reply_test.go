@@ -0,0 +1,98 @@
+package vacation
+
+import (
+	"lilmail/handlers/api"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestReplyTarget(t *testing.T) {
+	own := []string{"user@example.com", "alias@example.com"}
+	message := func(from string, header textproto.MIMEHeader) *api.MessageSummary {
+		if header == nil {
+			header = textproto.MIMEHeader{}
+		}
+		return &api.MessageSummary{
+			From:    from,
+			To:      []string{"User@Example.com"},
+			Subject: "Lunch?",
+			Header:  header,
+		}
+	}
+
+	if to, ok := replyTarget(message(" Friend@Example.com ", nil), own); !ok || to != "friend@example.com" {
+		t.Errorf("replyTarget of a personal message = %q, %v", to, ok)
+	}
+	cc := message("friend@example.com", nil)
+	cc.To, cc.Cc = []string{"team@example.com"}, []string{"alias@example.com"}
+	if _, ok := replyTarget(cc, own); !ok {
+		t.Error("no reply to a message sent to an alias in Cc")
+	}
+
+	for _, tt := range []struct {
+		name string
+		msg  *api.MessageSummary
+	}{
+		{"no sender", message("", nil)},
+		{"null return path", message("friend@example.com", textproto.MIMEHeader{"Return-Path": {"<>"}})},
+		{"auto-replied", message("friend@example.com", textproto.MIMEHeader{"Auto-Submitted": {"auto-replied"}})},
+		{"auto-generated", message("friend@example.com", textproto.MIMEHeader{"Auto-Submitted": {"Auto-Generated"}})},
+		{"precedence bulk", message("friend@example.com", textproto.MIMEHeader{"Precedence": {"bulk"}})},
+		{"precedence list", message("friend@example.com", textproto.MIMEHeader{"Precedence": {" List "}})},
+		{"precedence junk", message("friend@example.com", textproto.MIMEHeader{"Precedence": {"junk"}})},
+		{"List-Id", message("friend@example.com", textproto.MIMEHeader{"List-Id": {"<team.example.com>"}})},
+		{"List-Unsubscribe", message("friend@example.com", textproto.MIMEHeader{"List-Unsubscribe": {"<mailto:leave@example.com>"}})},
+		{"List-Post", message("friend@example.com", textproto.MIMEHeader{"List-Post": {"<mailto:team@example.com>"}})},
+		{"X-Loop", message("friend@example.com", textproto.MIMEHeader{"X-Loop": {"user@example.com"}})},
+		{"responses suppressed", message("friend@example.com", textproto.MIMEHeader{"X-Auto-Response-Suppress": {"OOF, AutoReply"}})},
+		{"mailer daemon", message("MAILER-DAEMON@example.com", nil)},
+		{"no-reply", message("no-reply@example.com", nil)},
+		{"list owner", message("owner-team@example.com", nil)},
+		{"list request", message("team-request@example.com", nil)},
+		{"own address", message("alias@example.com", nil)},
+		{"blind copy", &api.MessageSummary{From: "friend@example.com", To: []string{"team@example.com"}, Header: textproto.MIMEHeader{}}},
+	} {
+		if to, ok := replyTarget(tt.msg, own); ok {
+			t.Errorf("%s: replyTarget = %q, want no reply", tt.name, to)
+		}
+	}
+
+	if _, ok := replyTarget(message("friend@example.com", textproto.MIMEHeader{"Auto-Submitted": {"no"}}), own); !ok {
+		t.Error("no reply to a message marked Auto-Submitted: no")
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	msg := &api.MessageSummary{
+		Subject: "Lunch?",
+		Header: textproto.MIMEHeader{
+			"Message-Id": {"<b@example.com>"},
+			"References": {"<a@example.com>\r\n <x@example.com>"},
+		},
+	}
+
+	out := newReply(msg, Settings{Body: "Away until Monday"}, "friend@example.com")
+	if out.Subject != "Auto: Lunch?" {
+		t.Errorf("Subject = %q", out.Subject)
+	}
+	if len(out.To) != 1 || out.To[0].Address != "friend@example.com" || out.Body != "Away until Monday" {
+		t.Errorf("reply = %+v", out)
+	}
+	if out.InReplyTo != "<b@example.com>" || out.References != "<a@example.com> <x@example.com> <b@example.com>" {
+		t.Errorf("In-Reply-To = %q, References = %q", out.InReplyTo, out.References)
+	}
+	raw := string(out.Bytes())
+	for _, header := range []string{"Auto-Submitted: auto-replied\r\n", "X-Auto-Response-Suppress: All\r\n"} {
+		if !strings.Contains(raw, header) {
+			t.Errorf("reply lacks %q", header)
+		}
+	}
+
+	// A subject of its own replaces the default; without a Message-ID the
+	// reply starts a thread
+	out = newReply(&api.MessageSummary{Subject: "Lunch?", Header: textproto.MIMEHeader{}}, Settings{Subject: "Out of office"}, "friend@example.com")
+	if out.Subject != "Out of office" || out.InReplyTo != "" || out.References != "" {
+		t.Errorf("reply = %+v", out)
+	}
+}
@@ -0,0 +1,72 @@
+// Package vacation sends out-of-office replies. The reply is left to a
+// Sieve vacation script when the mail server allows installing one, and is
+// otherwise sent by a background worker that watches INBOX.
+package vacation
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dateLayout is the format of the first and last day of the vacation
+const dateLayout = "2006-01-02"
+
+// Ways the reply is sent
+const (
+	ModeSieve  = "sieve"  // By the mail server, from a Sieve script
+	ModeWorker = "worker" // By the vacation worker over SMTP
+)
+
+// Settings describe the automatic reply
+type Settings struct {
+	Enabled   bool   `json:"enabled"`
+	Start     string `json:"start,omitempty"` // First day (YYYY-MM-DD), optional
+	End       string `json:"end,omitempty"`   // Last day, optional
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	Days      int    `json:"days"`      // Reply to each sender at most once in this many days
+	KnownOnly bool   `json:"knownOnly"` // Only reply to people the user has written to
+}
+
+// Validate checks the reply and its date range
+func (s *Settings) Validate() error {
+	s.Subject = strings.TrimSpace(s.Subject)
+	s.Start = strings.TrimSpace(s.Start)
+	s.End = strings.TrimSpace(s.End)
+
+	if s.Enabled && strings.TrimSpace(s.Body) == "" {
+		return fmt.Errorf("reply message is required")
+	}
+	if s.Days < 1 {
+		s.Days = 1
+	}
+	for _, day := range []string{s.Start, s.End} {
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse(dateLayout, day); err != nil {
+			return fmt.Errorf("invalid date %q", day)
+		}
+	}
+	if s.Start != "" && s.End != "" && s.End < s.Start {
+		return fmt.Errorf("the vacation ends before it starts")
+	}
+	return nil
+}
+
+// Active reports whether replies are due at the given time. The dates are
+// whole days in the server's time zone.
+func (s *Settings) Active(now time.Time) bool {
+	if !s.Enabled {
+		return false
+	}
+	today := now.Format(dateLayout)
+	if s.Start != "" && today < s.Start {
+		return false
+	}
+	if s.End != "" && today > s.End {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package vacation
+
+import (
+	"lilmail/inboxscan"
+	"time"
+)
+
+// defaultDays is the reply interval offered to users who never saved
+// their settings
+const defaultDays = 7
+
+// Mailbox is the vacation reply of one user along with the state the
+// worker needs to answer their INBOX
+type Mailbox struct {
+	inboxscan.State
+	Settings Settings             `json:"settings"`
+	Mode     string               `json:"mode,omitempty"`
+	Script   string               `json:"script,omitempty"`   // Sieve script holding the reply in sieve mode
+	Fallback string               `json:"fallback,omitempty"` // Why Sieve could not be used
+	Replied  map[string]time.Time `json:"replied,omitempty"`  // Last reply to each sender
+}
+
+// Store keeps the vacation settings of each user in a JSON file named
+// after a hash of the login address
+type Store struct {
+	docs *inboxscan.Store
+}
+
+// NewStore opens (or creates) the vacation directory
+func NewStore(directory string) (*Store, error) {
+	docs, err := inboxscan.NewStore(directory, "vacation", func(owner string) inboxscan.Document {
+		return &Mailbox{State: inboxscan.State{Owner: owner}, Settings: Settings{Days: defaultDays}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{docs: docs}, nil
+}
+
+// Get returns the vacation reply of owner
+func (s *Store) Get(owner string) (*Mailbox, error) {
+	doc, err := s.docs.Get(owner)
+	if err != nil {
+		return nil, err
+	}
+	return doc.(*Mailbox), nil
+}
+
+// Save stores the vacation reply of a user
+func (s *Store) Save(mb *Mailbox) error {
+	return s.docs.Save(mb)
+}
+
+// Update changes the stored state of owner's mailbox
+func (s *Store) Update(owner string, fn func(mb *Mailbox)) error {
+	return s.docs.Update(owner, func(doc inboxscan.Document) error {
+		fn(doc.(*Mailbox))
+		return nil
+	})
+}
+
+// RefreshCredentials replaces the stored credentials of a user whose
+// replies are sent by the worker, so a changed password reaches it at the
+// next login
+func (s *Store) RefreshCredentials(owner, credentials string) error {
+	return s.docs.RefreshCredentials(owner, credentials, func(doc inboxscan.Document) bool {
+		mb := doc.(*Mailbox)
+		return mb.Mode == ModeWorker && mb.Settings.Enabled
+	})
+}
+
+// Mailboxes returns every user whose enabled reply is sent by the worker
+func (s *Store) Mailboxes() ([]*Mailbox, error) {
+	docs, err := s.docs.All()
+	if err != nil {
+		return nil, err
+	}
+
+	var mailboxes []*Mailbox
+	for _, doc := range docs {
+		mb := doc.(*Mailbox)
+		if mb.Mode == ModeWorker && mb.Settings.Enabled {
+			mailboxes = append(mailboxes, mb)
+		}
+	}
+	return mailboxes, nil
+}
+
+// RekeyCredentials re-encrypts the stored credentials with rekey and
+// returns how many mailboxes changed
+func (s *Store) RekeyCredentials(rekey func(string) (string, error)) (int, error) {
+	return s.docs.RekeyCredentials(rekey)
+}
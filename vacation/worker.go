@@ -0,0 +1,148 @@
+package vacation
+
+import (
+	"fmt"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/identity"
+	"lilmail/inboxscan"
+	"log"
+	"strings"
+	"time"
+)
+
+// knownLimit is the number of sent messages searched for known contacts
+const knownLimit = 500
+
+// Worker answers new INBOX messages of users whose reply is not handled
+// by a Sieve script
+type Worker struct {
+	*inboxscan.Worker
+	store      *Store
+	identities *identity.Store
+	config     *config.Config
+}
+
+// NewWorker creates a worker for the replies in store
+func NewWorker(store *Store, identities *identity.Store, config *config.Config) *Worker {
+	w := &Worker{
+		store:      store,
+		identities: identities,
+		config:     config,
+	}
+	w.Worker = inboxscan.NewWorker("Vacation", store.docs, config, config.Vacation.PollInterval, w.mailboxes, w.answer)
+	return w
+}
+
+// mailboxes returns the users on vacation. Outside the vacation dates the
+// position is forgotten, so the first scan of a vacation only records where
+// the mailbox stands and earlier mail is not answered.
+func (w *Worker) mailboxes() ([]inboxscan.Document, error) {
+	mailboxes, err := w.store.Mailboxes()
+	now := time.Now()
+
+	var docs []inboxscan.Document
+	for _, mb := range mailboxes {
+		if mb.Settings.Active(now) {
+			docs = append(docs, mb)
+			continue
+		}
+		if mb.UIDValidity != 0 {
+			if err := w.store.Update(mb.Owner, func(m *Mailbox) { m.Restart() }); err != nil {
+				log.Printf("Vacation: error saving state for %s: %v", mb.Owner, err)
+			}
+		}
+	}
+	return docs, err
+}
+
+// answer replies to the senders of the new messages. A message whose reply
+// failed is offered again at the next scan, along with the ones after it;
+// the senders answered meanwhile are remembered and not answered twice.
+func (w *Worker) answer(doc inboxscan.Document, client *api.Client, creds *api.Credentials, messages []api.MessageSummary) (uint32, func(inboxscan.Document), error) {
+	mb := doc.(*Mailbox)
+	now := time.Now()
+
+	identities, err := w.identities.List(mb.Owner)
+	if err != nil {
+		return 0, nil, err
+	}
+	own := []string{mb.Owner}
+	for _, ident := range identities {
+		own = append(own, ident.Email)
+	}
+
+	replied := make(map[string]time.Time)
+	interval := time.Duration(mb.Settings.Days) * 24 * time.Hour
+	for sender, at := range mb.Replied {
+		if now.Sub(at) < interval {
+			replied[sender] = at
+		}
+	}
+	remember := func(doc inboxscan.Document) {
+		doc.(*Mailbox).Replied = replied
+	}
+
+	var known map[string]bool
+	var sendErr error
+	var lastUID uint32
+	for i := range messages {
+		msg := &messages[i]
+		sender, ok := replyTarget(msg, own)
+		if _, done := replied[sender]; done {
+			ok = false
+		}
+
+		if ok && mb.Settings.KnownOnly {
+			if known == nil {
+				if known, err = w.knownContacts(client); err != nil {
+					return lastUID, remember, err
+				}
+			}
+			ok = known[sender]
+		}
+
+		if ok {
+			err := w.reply(mb, creds, msg, sender, append(append([]string{}, msg.To...), msg.Cc...))
+			if err != nil {
+				log.Printf("Vacation: error replying to %s for %s: %v", sender, mb.Owner, err)
+				sendErr = err
+			} else {
+				replied[sender] = now
+			}
+		}
+		if sendErr == nil {
+			lastUID = inboxscan.UID(msg)
+		}
+	}
+	return lastUID, remember, sendErr
+}
+
+// reply sends the automatic reply from the identity the message was
+// addressed to, with an empty envelope sender
+func (w *Worker) reply(mb *Mailbox, creds *api.Credentials, msg *api.MessageSummary, sender string, recipients []string) error {
+	out := newReply(msg, mb.Settings, sender)
+
+	ident, err := w.identities.Match(mb.Owner, recipients)
+	if err != nil {
+		return err
+	}
+	if err := ident.Apply(out); err != nil {
+		return err
+	}
+
+	client := api.NewSMTPClient(creds.Profile(w.config.SMTP.Profile), creds.Email, creds.Password)
+	return client.SendAutomatic(out.Recipients(), out.Bytes())
+}
+
+func (w *Worker) knownContacts(client *api.Client) (map[string]bool, error) {
+	recipients, err := client.SentRecipients(knownLimit)
+	if err != nil {
+		return nil, fmt.Errorf("error reading known contacts: %v", err)
+	}
+	known := make(map[string]bool, len(recipients))
+	for _, addr := range recipients {
+		known[strings.ToLower(addr)] = true
+	}
+	return known, nil
+}
@@ -0,0 +1,104 @@
+package vacation
+
+import (
+	"bufio"
+	"fmt"
+	"lilmail/config"
+	"lilmail/handlers/api"
+	"lilmail/identity"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smtpStub accepts any message and sends the MAIL FROM line of each on
+// the returned channel
+func smtpStub(t *testing.T) (config.ConnectionProfile, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	mailFrom := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "220 stub ESMTP\r\n")
+				data := false
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if data {
+						if line == ".\r\n" {
+							data = false
+							fmt.Fprintf(conn, "250 queued\r\n")
+						}
+						continue
+					}
+					switch verb := strings.ToUpper(strings.Fields(line + " x")[0]); verb {
+					case "EHLO":
+						fmt.Fprintf(conn, "250-stub\r\n250 AUTH PLAIN\r\n")
+					case "AUTH":
+						fmt.Fprintf(conn, "235 ok\r\n")
+					case "MAIL":
+						mailFrom <- strings.TrimSpace(line)
+						fmt.Fprintf(conn, "250 ok\r\n")
+					case "DATA":
+						data = true
+						fmt.Fprintf(conn, "354 go ahead\r\n")
+					case "QUIT":
+						fmt.Fprintf(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprintf(conn, "250 ok\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return config.ConnectionProfile{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		Security: config.SecurityNone,
+	}, mailFrom
+}
+
+func TestReplyHasNullSender(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(filepath.Join(dir, "vacation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := identity.NewStore(filepath.Join(dir, "identities"), config.IdentitiesConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	profile, mailFrom := smtpStub(t)
+	cfg.SMTP.Profile = profile
+	w := NewWorker(store, identities, cfg)
+
+	mb := &Mailbox{Settings: Settings{Enabled: true, Body: "Away"}}
+	mb.Owner = "user@example.com"
+	creds := &api.Credentials{Email: "user@example.com", Password: "secret"}
+	msg := &api.MessageSummary{From: "friend@example.com", To: []string{"user@example.com"}, Subject: "Lunch?", Header: textproto.MIMEHeader{}}
+	if err := w.reply(mb, creds, msg, "friend@example.com", msg.To); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-mailFrom; !strings.HasPrefix(got, "MAIL FROM:<>") {
+		t.Errorf("envelope sender = %q, want MAIL FROM:<>", got)
+	}
+}